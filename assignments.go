@@ -0,0 +1,79 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"sync"
+
+	"github.com/rcrowley/go-metrics"
+)
+
+// assignments keeps the partitions claimed in the current consumer group
+// session and exposes their number per topic as
+// consumer.assigned_partitions.<topic> gauges. All methods are safe for
+// concurrent use, assign may also be called on a nil assignments.
+type assignments struct {
+	mu           sync.Mutex
+	memberID     string
+	generationID int32
+	claims       map[string][]int32
+	registry     metrics.Registry
+}
+
+// assignmentsResponse is the body of GET /assignments
+type assignmentsResponse struct {
+	MemberID     string             `json:"member_id"`
+	GenerationID int32              `json:"generation_id"`
+	Claims       map[string][]int32 `json:"claims"`
+}
+
+func newAssignments(registry metrics.Registry) *assignments {
+	return &assignments{claims: map[string][]int32{}, registry: registry}
+}
+
+// assign replaces the claims, it is called whenever a consumer group session
+// starts or ends. Topics which are not claimed anymore keep their gauge at 0.
+func (a *assignments) assign(memberID string, generationID int32, claims map[string][]int32) {
+	if a == nil {
+		return
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	for topic := range a.claims {
+		if _, ok := claims[topic]; !ok {
+			metrics.GetOrRegisterGauge(assignedGaugeName(topic), a.registry).Update(0)
+		}
+	}
+	a.memberID = memberID
+	a.generationID = generationID
+	a.claims = map[string][]int32{}
+	for topic, partitions := range claims {
+		sorted := append([]int32(nil), partitions...)
+		sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+		a.claims[topic] = sorted
+		metrics.GetOrRegisterGauge(assignedGaugeName(topic), a.registry).Update(int64(len(sorted)))
+	}
+}
+
+func (a *assignments) current() assignmentsResponse {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	claims := make(map[string][]int32, len(a.claims))
+	for topic, partitions := range a.claims {
+		claims[topic] = partitions
+	}
+	return assignmentsResponse{MemberID: a.memberID, GenerationID: a.generationID, Claims: claims}
+}
+
+func assignedGaugeName(topic string) string {
+	return `consumer.assigned_partitions.` + topic
+}
+
+// register adds the GET /assignments endpoint to the mux
+func (a *assignments) register(mux *http.ServeMux) {
+	mux.HandleFunc("/assignments", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(a.current())
+	})
+}
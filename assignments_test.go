@@ -0,0 +1,58 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/rcrowley/go-metrics"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAssignments(t *testing.T) {
+	registry := metrics.NewRegistry()
+	a := newAssignments(registry)
+	mux := http.NewServeMux()
+	a.register(mux)
+	get := func() assignmentsResponse {
+		rec := httptest.NewRecorder()
+		mux.ServeHTTP(rec, httptest.NewRequest("GET", "/assignments", nil))
+		assert.Equal(t, http.StatusOK, rec.Code)
+		assert.Equal(t, "application/json", rec.Header().Get("Content-Type"))
+		var got assignmentsResponse
+		assert.NoError(t, json.Unmarshal(rec.Body.Bytes(), &got))
+		return got
+	}
+	gauge := func(topic string) int64 {
+		return metrics.GetOrRegisterGauge(assignedGaugeName(topic), registry).Value()
+	}
+
+	a.assign("member-1", 3, map[string][]int32{"logs": {2, 0, 1}, "events": {4}})
+	assert.Equal(t, assignmentsResponse{MemberID: "member-1", GenerationID: 3, Claims: map[string][]int32{"logs": {0, 1, 2}, "events": {4}}}, get())
+	assert.Equal(t, int64(3), gauge("logs"))
+	assert.Equal(t, int64(1), gauge("events"))
+
+	a.assign("member-1", 4, map[string][]int32{"logs": {0}})
+	assert.Equal(t, assignmentsResponse{MemberID: "member-1", GenerationID: 4, Claims: map[string][]int32{"logs": {0}}}, get())
+	assert.Equal(t, int64(1), gauge("logs"))
+	assert.Equal(t, int64(0), gauge("events"), "the gauge of an unclaimed topic was not reset")
+
+	a.assign("member-1", 4, nil)
+	assert.Empty(t, get().Claims)
+	assert.Equal(t, int64(0), gauge("logs"))
+
+	var disabled *assignments
+	disabled.assign("member-1", 1, map[string][]int32{"logs": {0}})
+}
+
+func TestSetupAssignments(t *testing.T) {
+	consumer := newTestConsumer("hash", newTestProducer())
+	consumer.assignments = newAssignments(consumer.metrics)
+	session := &testSession{claims: map[string][]int32{"source": {0, 1}}}
+	assert.NoError(t, consumer.Setup(session))
+	assert.Equal(t, map[string][]int32{"source": {0, 1}}, consumer.assignments.current().Claims)
+	assert.Equal(t, int64(2), metrics.GetOrRegisterGauge(assignedGaugeName("source"), consumer.metrics).Value())
+	assert.NoError(t, consumer.Cleanup(session))
+	assert.Empty(t, consumer.assignments.current().Claims)
+}
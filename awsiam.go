@@ -0,0 +1,549 @@
+package main
+
+import (
+	"bufio"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// mskTokenLifetime is how long a signed MSK IAM token is valid
+const mskTokenLifetime = 15 * time.Minute
+
+// The AWS SDK for Go v2 and aws-msk-iam-sasl-signer-go need a much newer Go
+// than this module and would pull in a large dependency tree, so the few parts
+// of MSK IAM authentication are implemented here: presigning a single request
+// with Signature Version 4 and resolving the credentials like the SDK.
+
+// newMSKIAMTokenProvider returns the tokens of AWS MSK IAM authentication: a
+// kafka-cluster:Connect request presigned with AWS Signature Version 4, base64
+// url encoded and sent via SASL OAUTHBEARER
+func newMSKIAMTokenProvider(region string, credentials *awsCredentialChain) *tokenProvider {
+	p := newTokenProvider(nil)
+	p.fetch = func() (string, time.Time, error) {
+		creds, err := credentials.get()
+		if err != nil {
+			return "", time.Time{}, fmt.Errorf("could not resolve the AWS credentials for MSK IAM: %s", err)
+		}
+		now := p.now().UTC()
+		expires := now.Add(mskTokenLifetime)
+		if !creds.expires.IsZero() && creds.expires.Before(expires) {
+			expires = creds.expires
+		}
+		return base64.RawURLEncoding.EncodeToString([]byte(presignMSKConnect(region, creds, now))), expires, nil
+	}
+	return p
+}
+
+// presignMSKConnect returns the presigned url of the kafka-cluster:Connect
+// action, see
+// https://docs.aws.amazon.com/general/latest/gr/sigv4-query-string-auth.html
+func presignMSKConnect(region string, creds awsCredentials, now time.Time) string {
+	const service = "kafka-cluster"
+	host := "kafka." + region + ".amazonaws.com"
+	date := now.Format("20060102")
+	amzDate := now.Format("20060102T150405Z")
+	scope := date + "/" + region + "/" + service + "/aws4_request"
+	query := url.Values{}
+	query.Set("Action", "kafka-cluster:Connect")
+	query.Set("X-Amz-Algorithm", "AWS4-HMAC-SHA256")
+	query.Set("X-Amz-Credential", creds.accessKeyID+"/"+scope)
+	query.Set("X-Amz-Date", amzDate)
+	query.Set("X-Amz-Expires", fmt.Sprint(int(mskTokenLifetime.Seconds())))
+	query.Set("X-Amz-SignedHeaders", "host")
+	if creds.sessionToken != "" {
+		query.Set("X-Amz-Security-Token", creds.sessionToken)
+	}
+	// sigv4 escapes spaces as %20, url.Values as +
+	canonicalQuery := strings.Replace(query.Encode(), "+", "%20", -1)
+	canonicalRequest := strings.Join([]string{"GET", "/", canonicalQuery, "host:" + host + "\n", "host", sha256Hex("")}, "\n")
+	stringToSign := strings.Join([]string{"AWS4-HMAC-SHA256", amzDate, scope, sha256Hex(canonicalRequest)}, "\n")
+	signature := hex.EncodeToString(hmacSHA256(sigv4SigningKey(creds.secretAccessKey, date, region, service), stringToSign))
+	return "https://" + host + "/?" + canonicalQuery + "&X-Amz-Signature=" + signature + "&User-Agent=mirrormaker"
+}
+
+// sigv4SigningKey derives the key signing the requests of a day, region and
+// service from the secret access key
+func sigv4SigningKey(secret, date, region, service string) []byte {
+	key := []byte("AWS4" + secret)
+	for _, part := range []string{date, region, service, "aws4_request"} {
+		key = hmacSHA256(key, part)
+	}
+	return key
+}
+
+// signRequest adds the Signature Version 4 authorization header for payload
+// to req, see
+// https://docs.aws.amazon.com/general/latest/gr/sigv4_signing.html
+func signRequest(req *http.Request, payload, region, service string, creds awsCredentials, now time.Time) {
+	date := now.Format("20060102")
+	amzDate := now.Format("20060102T150405Z")
+	req.Header.Set("X-Amz-Date", amzDate)
+	if creds.sessionToken != "" {
+		req.Header.Set("X-Amz-Security-Token", creds.sessionToken)
+	}
+	var headers []string
+	var canonicalHeaders strings.Builder
+	for _, name := range []string{"content-type", "host", "x-amz-date", "x-amz-security-token"} {
+		value := req.Header.Get(name)
+		if name == "host" {
+			value = req.URL.Host
+		}
+		if value == "" {
+			continue
+		}
+		headers = append(headers, name)
+		canonicalHeaders.WriteString(name + ":" + strings.TrimSpace(value) + "\n")
+	}
+	path := req.URL.EscapedPath()
+	if path == "" {
+		path = "/"
+	}
+	signedHeaders := strings.Join(headers, ";")
+	scope := date + "/" + region + "/" + service + "/aws4_request"
+	canonicalRequest := strings.Join([]string{req.Method, path, req.URL.RawQuery, canonicalHeaders.String(), signedHeaders, sha256Hex(payload)}, "\n")
+	stringToSign := strings.Join([]string{"AWS4-HMAC-SHA256", amzDate, scope, sha256Hex(canonicalRequest)}, "\n")
+	signature := hex.EncodeToString(hmacSHA256(sigv4SigningKey(creds.secretAccessKey, date, region, service), stringToSign))
+	req.Header.Set("Authorization", "AWS4-HMAC-SHA256 Credential="+creds.accessKeyID+"/"+scope+", SignedHeaders="+signedHeaders+", Signature="+signature)
+}
+
+func sha256Hex(s string) string {
+	sum := sha256.Sum256([]byte(s))
+	return hex.EncodeToString(sum[:])
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+type awsCredentials struct {
+	accessKeyID     string
+	secretAccessKey string
+	sessionToken    string
+	// expires is zero for static credentials
+	expires time.Time
+}
+
+// awsCredentialChain resolves AWS credentials in the order of the AWS SDKs:
+// the environment, the profile of the shared config and credentials files,
+// web identity (EKS IAM roles for service accounts), the ECS container
+// endpoint and the EC2 instance metadata service. Profiles may assume a role
+// with static keys, a credential_source or web identity, SSO and
+// credential_process are not supported. A configured source which fails ends
+// the chain like in the SDKs, so nothing signs as another identity.
+// Temporary credentials are cached until shortly before they expire.
+type awsCredentialChain struct {
+	getenv func(string) string
+	client *http.Client
+	now    func() time.Time
+	// containerHost and metadataHost are the endpoints of ECS and EC2
+	containerHost string
+	metadataHost  string
+	// stsEndpoint and stsRegion are used to assume roles
+	stsEndpoint string
+	stsRegion   string
+
+	mu     sync.Mutex
+	cached awsCredentials
+}
+
+// newAWSCredentialChain uses the regional STS endpoint of region, the global
+// one without region
+func newAWSCredentialChain(region string) *awsCredentialChain {
+	c := &awsCredentialChain{
+		getenv:        os.Getenv,
+		client:        &http.Client{Timeout: 2 * time.Second},
+		now:           time.Now,
+		containerHost: "http://169.254.170.2",
+		metadataHost:  "http://169.254.169.254",
+		stsEndpoint:   "https://sts.amazonaws.com",
+		stsRegion:     "us-east-1",
+	}
+	if region != "" {
+		c.stsEndpoint = "https://sts." + region + ".amazonaws.com"
+		c.stsRegion = region
+	}
+	return c
+}
+
+func (c *awsCredentialChain) get() (awsCredentials, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.cached.accessKeyID != "" && (c.cached.expires.IsZero() || c.now().Before(c.cached.expires.Add(-5*time.Minute))) {
+		return c.cached, nil
+	}
+	for _, source := range []struct {
+		name string
+		get  func() (awsCredentials, bool, error)
+	}{
+		{"environment", c.fromEnv},
+		{"shared config", c.fromProfile},
+		{"web identity", c.fromWebIdentity},
+		{"container endpoint", c.fromContainer},
+		{"instance metadata", c.fromInstanceMetadata},
+	} {
+		creds, found, err := source.get()
+		if err != nil {
+			return awsCredentials{}, fmt.Errorf("could not get the AWS credentials of the %s: %s", source.name, err)
+		}
+		if found {
+			c.cached = creds
+			return creds, nil
+		}
+	}
+	return awsCredentials{}, fmt.Errorf("no AWS credentials found")
+}
+
+func (c *awsCredentialChain) fromEnv() (awsCredentials, bool, error) {
+	id, secret := c.getenv("AWS_ACCESS_KEY_ID"), c.getenv("AWS_SECRET_ACCESS_KEY")
+	if id == "" || secret == "" {
+		return awsCredentials{}, false, nil
+	}
+	return awsCredentials{accessKeyID: id, secretAccessKey: secret, sessionToken: c.getenv("AWS_SESSION_TOKEN")}, true, nil
+}
+
+// fromProfile resolves the profile AWS_PROFILE (or default) of the shared
+// config file AWS_CONFIG_FILE (or ~/.aws/config) and the shared credentials
+// file AWS_SHARED_CREDENTIALS_FILE (or ~/.aws/credentials)
+func (c *awsCredentialChain) fromProfile() (awsCredentials, bool, error) {
+	name := c.getenv("AWS_PROFILE")
+	if name == "" {
+		name = "default"
+	}
+	values, found, err := c.profile(name)
+	if err != nil || !found {
+		return awsCredentials{}, false, err
+	}
+	return c.resolveProfile(name, values, true)
+}
+
+// profile returns the values of a profile, the credentials file takes
+// precedence over the config file
+func (c *awsCredentialChain) profile(name string) (map[string]string, bool, error) {
+	section := "profile " + name
+	if name == "default" {
+		section = name
+	}
+	values, inConfig, err := readProfile(c.sharedFile("AWS_CONFIG_FILE", "config"), section)
+	if err != nil {
+		return nil, false, err
+	}
+	credentials, inCredentials, err := readProfile(c.sharedFile("AWS_SHARED_CREDENTIALS_FILE", "credentials"), name)
+	if err != nil {
+		return nil, false, err
+	}
+	for key, value := range credentials {
+		values[key] = value
+	}
+	return values, inConfig || inCredentials, nil
+}
+
+// resolveProfile returns the static keys of a profile or assumes its
+// role_arn, a source profile (assumeRole false) must not assume a role itself
+func (c *awsCredentialChain) resolveProfile(name string, values map[string]string, assumeRole bool) (awsCredentials, bool, error) {
+	for _, key := range []string{"sso_start_url", "sso_session", "credential_process", "mfa_serial"} {
+		if values[key] != "" {
+			return awsCredentials{}, false, fmt.Errorf("profile %s uses %s, which is not supported", name, key)
+		}
+	}
+	role := values["role_arn"]
+	if role == "" {
+		if values["aws_access_key_id"] == "" || values["aws_secret_access_key"] == "" {
+			return awsCredentials{}, false, nil
+		}
+		return awsCredentials{
+			accessKeyID:     values["aws_access_key_id"],
+			secretAccessKey: values["aws_secret_access_key"],
+			sessionToken:    values["aws_session_token"],
+		}, true, nil
+	}
+	if !assumeRole {
+		return awsCredentials{}, false, fmt.Errorf("source_profile %s assumes a role itself, chained roles are not supported", name)
+	}
+	if tokenFile := values["web_identity_token_file"]; tokenFile != "" {
+		creds, err := c.assumeRoleWithWebIdentity(role, tokenFile, values["role_session_name"])
+		return creds, err == nil, err
+	}
+	var source awsCredentials
+	var found bool
+	var err error
+	switch sourceProfile, credentialSource := values["source_profile"], values["credential_source"]; {
+	case sourceProfile == name:
+		// the keys of the profile itself
+		source, found, err = c.resolveProfile(name, map[string]string{"aws_access_key_id": values["aws_access_key_id"], "aws_secret_access_key": values["aws_secret_access_key"], "aws_session_token": values["aws_session_token"]}, false)
+	case sourceProfile != "":
+		var sourceValues map[string]string
+		sourceValues, found, err = c.profile(sourceProfile)
+		if err == nil && found {
+			source, found, err = c.resolveProfile(sourceProfile, sourceValues, false)
+		}
+	case credentialSource == "Environment":
+		source, found, err = c.fromEnv()
+	case credentialSource == "Ec2InstanceMetadata":
+		source, found, err = c.fromInstanceMetadata()
+	case credentialSource == "EcsContainer":
+		source, found, err = c.fromContainer()
+	case credentialSource != "":
+		return awsCredentials{}, false, fmt.Errorf("invalid credential_source %q of profile %s, must be Environment, Ec2InstanceMetadata or EcsContainer", credentialSource, name)
+	default:
+		return awsCredentials{}, false, fmt.Errorf("role_arn of profile %s requires source_profile, credential_source or web_identity_token_file", name)
+	}
+	if err != nil {
+		return awsCredentials{}, false, err
+	}
+	if !found {
+		return awsCredentials{}, false, fmt.Errorf("no source credentials for the role_arn of profile %s", name)
+	}
+	creds, err := c.assumeRole(source, role, values["role_session_name"], values["external_id"])
+	return creds, err == nil, err
+}
+
+// sharedFile returns the path of a shared AWS file, env overrides
+// ~/.aws/name
+func (c *awsCredentialChain) sharedFile(env, name string) string {
+	if path := c.getenv(env); path != "" {
+		return path
+	}
+	if home := c.getenv("HOME"); home != "" {
+		return filepath.Join(home, ".aws", name)
+	}
+	return ""
+}
+
+// readProfile returns the values of section of the ini file at path, a
+// missing file has no sections
+func readProfile(path, section string) (map[string]string, bool, error) {
+	values := map[string]string{}
+	if path == "" {
+		return values, false, nil
+	}
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return values, false, nil
+	}
+	if err != nil {
+		return nil, false, err
+	}
+	defer f.Close()
+	found := false
+	current := ""
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		switch {
+		case line == "" || strings.HasPrefix(line, "#") || strings.HasPrefix(line, ";"):
+		case strings.HasPrefix(line, "[") && strings.HasSuffix(line, "]"):
+			current = strings.Join(strings.Fields(line[1:len(line)-1]), " ")
+			found = found || current == section
+		case current == section:
+			if i := strings.Index(line, "="); i > 0 {
+				values[strings.TrimSpace(line[:i])] = strings.TrimSpace(line[i+1:])
+			}
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, false, err
+	}
+	return values, found, nil
+}
+
+// fromWebIdentity assumes AWS_ROLE_ARN with the token in
+// AWS_WEB_IDENTITY_TOKEN_FILE, as set up by EKS IAM roles for service accounts
+func (c *awsCredentialChain) fromWebIdentity() (awsCredentials, bool, error) {
+	tokenFile, role := c.getenv("AWS_WEB_IDENTITY_TOKEN_FILE"), c.getenv("AWS_ROLE_ARN")
+	if tokenFile == "" && role == "" {
+		return awsCredentials{}, false, nil
+	}
+	if tokenFile == "" || role == "" {
+		return awsCredentials{}, false, fmt.Errorf("AWS_WEB_IDENTITY_TOKEN_FILE and AWS_ROLE_ARN have to be set together")
+	}
+	creds, err := c.assumeRoleWithWebIdentity(role, tokenFile, c.getenv("AWS_ROLE_SESSION_NAME"))
+	return creds, err == nil, err
+}
+
+// assumeRoleWithWebIdentity exchanges the OIDC token in tokenFile for the
+// credentials of role. The token is read on every call, as it is rotated.
+func (c *awsCredentialChain) assumeRoleWithWebIdentity(role, tokenFile, sessionName string) (awsCredentials, error) {
+	token, err := ioutil.ReadFile(tokenFile)
+	if err != nil {
+		return awsCredentials{}, fmt.Errorf("could not read the web identity token: %s", err)
+	}
+	form := c.stsForm("AssumeRoleWithWebIdentity", role, sessionName)
+	form.Set("WebIdentityToken", strings.TrimSpace(string(token)))
+	req, err := http.NewRequest(http.MethodPost, c.stsEndpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return awsCredentials{}, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded; charset=utf-8")
+	return c.fetchSTSCredentials(req)
+}
+
+// assumeRole returns the credentials of role, signed with source
+func (c *awsCredentialChain) assumeRole(source awsCredentials, role, sessionName, externalID string) (awsCredentials, error) {
+	form := c.stsForm("AssumeRole", role, sessionName)
+	if externalID != "" {
+		form.Set("ExternalId", externalID)
+	}
+	body := form.Encode()
+	req, err := http.NewRequest(http.MethodPost, c.stsEndpoint, strings.NewReader(body))
+	if err != nil {
+		return awsCredentials{}, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded; charset=utf-8")
+	signRequest(req, body, c.stsRegion, "sts", source, c.now().UTC())
+	return c.fetchSTSCredentials(req)
+}
+
+func (c *awsCredentialChain) stsForm(action, role, sessionName string) url.Values {
+	if sessionName == "" {
+		sessionName = fmt.Sprintf("mirrormaker-%d", c.now().UnixNano())
+	}
+	return url.Values{"Action": {action}, "Version": {"2011-06-15"}, "RoleArn": {role}, "RoleSessionName": {sessionName}}
+}
+
+// fetchSTSCredentials reads the credentials of an AssumeRole or
+// AssumeRoleWithWebIdentity response
+func (c *awsCredentialChain) fetchSTSCredentials(req *http.Request) (awsCredentials, error) {
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return awsCredentials{}, err
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return awsCredentials{}, err
+	}
+	type stsCredentials struct {
+		AccessKeyID     string `xml:"AccessKeyId"`
+		SecretAccessKey string
+		SessionToken    string
+		Expiration      time.Time
+	}
+	var result struct {
+		AssumeRole  stsCredentials `xml:"AssumeRoleResult>Credentials"`
+		WebIdentity stsCredentials `xml:"AssumeRoleWithWebIdentityResult>Credentials"`
+		Error       struct {
+			Code    string
+			Message string
+		}
+	}
+	if err := xml.Unmarshal(body, &result); err != nil {
+		return awsCredentials{}, fmt.Errorf("invalid STS response (%s): %s", resp.Status, err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return awsCredentials{}, fmt.Errorf("STS returned %s: %s %s", resp.Status, result.Error.Code, result.Error.Message)
+	}
+	creds := result.AssumeRole
+	if creds.AccessKeyID == "" {
+		creds = result.WebIdentity
+	}
+	if creds.AccessKeyID == "" || creds.SecretAccessKey == "" {
+		return awsCredentials{}, fmt.Errorf("incomplete credentials from STS")
+	}
+	return awsCredentials{accessKeyID: creds.AccessKeyID, secretAccessKey: creds.SecretAccessKey, sessionToken: creds.SessionToken, expires: creds.Expiration}, nil
+}
+
+// fromContainer asks the credential endpoint of ECS (and EKS pod identity)
+func (c *awsCredentialChain) fromContainer() (awsCredentials, bool, error) {
+	endpoint := c.getenv("AWS_CONTAINER_CREDENTIALS_FULL_URI")
+	if uri := c.getenv("AWS_CONTAINER_CREDENTIALS_RELATIVE_URI"); uri != "" {
+		endpoint = c.containerHost + uri
+	}
+	if endpoint == "" {
+		return awsCredentials{}, false, nil
+	}
+	req, err := http.NewRequest(http.MethodGet, endpoint, nil)
+	if err != nil {
+		return awsCredentials{}, false, err
+	}
+	if token := c.getenv("AWS_CONTAINER_AUTHORIZATION_TOKEN"); token != "" {
+		req.Header.Set("Authorization", token)
+	}
+	creds, err := c.fetchCredentials(req)
+	return creds, err == nil, err
+}
+
+// fromInstanceMetadata asks the EC2 instance metadata service (IMDSv2) for
+// the credentials of the instance role
+func (c *awsCredentialChain) fromInstanceMetadata() (awsCredentials, bool, error) {
+	if strings.EqualFold(c.getenv("AWS_EC2_METADATA_DISABLED"), "true") {
+		return awsCredentials{}, false, nil
+	}
+	req, err := http.NewRequest(http.MethodPut, c.metadataHost+"/latest/api/token", nil)
+	if err != nil {
+		return awsCredentials{}, false, err
+	}
+	req.Header.Set("X-aws-ec2-metadata-token-ttl-seconds", "21600")
+	token, err := c.fetch(req)
+	if err != nil {
+		// not running on EC2
+		return awsCredentials{}, false, nil
+	}
+	path := c.metadataHost + "/latest/meta-data/iam/security-credentials/"
+	if req, err = http.NewRequest(http.MethodGet, path, nil); err != nil {
+		return awsCredentials{}, false, err
+	}
+	req.Header.Set("X-aws-ec2-metadata-token", string(token))
+	role, err := c.fetch(req)
+	if err != nil {
+		return awsCredentials{}, false, fmt.Errorf("could not get the instance role: %s", err)
+	}
+	if req, err = http.NewRequest(http.MethodGet, path+strings.TrimSpace(strings.SplitN(string(role), "\n", 2)[0]), nil); err != nil {
+		return awsCredentials{}, false, err
+	}
+	req.Header.Set("X-aws-ec2-metadata-token", string(token))
+	creds, err := c.fetchCredentials(req)
+	return creds, err == nil, err
+}
+
+func (c *awsCredentialChain) fetch(req *http.Request) ([]byte, error) {
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%s returned %s", req.URL, resp.Status)
+	}
+	return body, nil
+}
+
+// fetchCredentials reads the credentials in the JSON format of the ECS and
+// EC2 endpoints
+func (c *awsCredentialChain) fetchCredentials(req *http.Request) (awsCredentials, error) {
+	body, err := c.fetch(req)
+	if err != nil {
+		return awsCredentials{}, err
+	}
+	var resp struct {
+		AccessKeyID     string `json:"AccessKeyId"`
+		SecretAccessKey string
+		Token           string
+		Expiration      time.Time
+	}
+	if err := json.Unmarshal(body, &resp); err != nil {
+		return awsCredentials{}, fmt.Errorf("invalid credentials from %s: %s", req.URL, err)
+	}
+	if resp.AccessKeyID == "" || resp.SecretAccessKey == "" {
+		return awsCredentials{}, fmt.Errorf("incomplete credentials from %s", req.URL)
+	}
+	return awsCredentials{accessKeyID: resp.AccessKeyID, secretAccessKey: resp.SecretAccessKey, sessionToken: resp.Token, expires: resp.Expiration}, nil
+}
@@ -0,0 +1,271 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/hex"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPresignMSKConnect(t *testing.T) {
+	now := time.Date(2021, 6, 1, 12, 30, 0, 0, time.UTC)
+	creds := awsCredentials{accessKeyID: "AKIDEXAMPLE", secretAccessKey: "secret", sessionToken: "session token"}
+	signed := presignMSKConnect("eu-west-1", creds, now)
+	u, err := url.Parse(signed)
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, "kafka.eu-west-1.amazonaws.com", u.Host)
+	q := u.Query()
+	assert.Equal(t, "kafka-cluster:Connect", q.Get("Action"))
+	assert.Equal(t, "AKIDEXAMPLE/20210601/eu-west-1/kafka-cluster/aws4_request", q.Get("X-Amz-Credential"))
+	assert.Equal(t, "20210601T123000Z", q.Get("X-Amz-Date"))
+	assert.Equal(t, "900", q.Get("X-Amz-Expires"))
+	assert.Equal(t, "session token", q.Get("X-Amz-Security-Token"))
+	assert.Len(t, q.Get("X-Amz-Signature"), 64)
+	assert.Contains(t, signed, "X-Amz-Security-Token=session%20token", "spaces have to be escaped as %20")
+	assert.Equal(t, signed, presignMSKConnect("eu-west-1", creds, now))
+	creds.secretAccessKey = "other"
+	assert.NotEqual(t, q.Get("X-Amz-Signature"), mustQuery(t, presignMSKConnect("eu-west-1", creds, now)).Get("X-Amz-Signature"))
+}
+
+func TestSigV4SigningKey(t *testing.T) {
+	// the example of the AWS documentation on deriving the signing key
+	key := sigv4SigningKey("wJalrXUtnFEMI/K7MDENG+bPxRfiCYEXAMPLEKEY", "20120215", "us-east-1", "iam")
+	assert.Equal(t, "f4780e2d9f65fa895f9c67b32ce1baf0b0d8a43505a000a1a9e090d414db404d", hex.EncodeToString(key))
+}
+
+func mustQuery(t *testing.T, s string) url.Values {
+	u, err := url.Parse(s)
+	assert.NoError(t, err)
+	return u.Query()
+}
+
+func TestMSKIAMTokenProvider(t *testing.T) {
+	chain := testCredentialChain(map[string]string{"AWS_ACCESS_KEY_ID": "AKIDEXAMPLE", "AWS_SECRET_ACCESS_KEY": "secret"})
+	p := newMSKIAMTokenProvider("eu-west-1", chain)
+	token, err := p.Token()
+	if !assert.NoError(t, err) {
+		return
+	}
+	signed, err := base64.RawURLEncoding.DecodeString(token.Token)
+	assert.NoError(t, err)
+	assert.True(t, strings.HasPrefix(string(signed), "https://kafka.eu-west-1.amazonaws.com/?"), string(signed))
+
+	_, err = newMSKIAMTokenProvider("eu-west-1", testCredentialChain(nil)).Token()
+	assert.Error(t, err, "No error without credentials")
+}
+
+// testCredentialChain uses env as environment and never reaches the real
+// metadata endpoints
+func testCredentialChain(env map[string]string) *awsCredentialChain {
+	c := newAWSCredentialChain("eu-west-1")
+	c.getenv = func(key string) string { return env[key] }
+	c.containerHost = "http://127.0.0.1:0"
+	c.metadataHost = "http://127.0.0.1:0"
+	return c
+}
+
+func TestAWSCredentialChainSharedFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mirrormaker")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "credentials")
+	assert.NoError(t, ioutil.WriteFile(path, []byte("[default]\naws_access_key_id = default\naws_secret_access_key = secret\n\n[mirror]\n# comment\naws_access_key_id=mirror\naws_secret_access_key=secret2\naws_session_token=token\n"), 0600))
+	creds, err := testCredentialChain(map[string]string{"AWS_SHARED_CREDENTIALS_FILE": path, "AWS_PROFILE": "mirror"}).get()
+	assert.NoError(t, err)
+	assert.Equal(t, awsCredentials{accessKeyID: "mirror", secretAccessKey: "secret2", sessionToken: "token"}, creds)
+	creds, err = testCredentialChain(map[string]string{"HOME": dir, "AWS_SHARED_CREDENTIALS_FILE": path}).get()
+	assert.NoError(t, err)
+	assert.Equal(t, "default", creds.accessKeyID)
+	creds, err = testCredentialChain(map[string]string{"AWS_SHARED_CREDENTIALS_FILE": path, "AWS_ACCESS_KEY_ID": "env", "AWS_SECRET_ACCESS_KEY": "secret"}).get()
+	assert.NoError(t, err)
+	assert.Equal(t, "env", creds.accessKeyID, "the environment takes precedence")
+}
+
+func TestAWSCredentialChainEndpoints(t *testing.T) {
+	expiration := time.Now().Add(time.Hour).UTC().Truncate(time.Second)
+	body := `{"AccessKeyId":"temp","SecretAccessKey":"secret","Token":"token","Expiration":"` + expiration.Format(time.RFC3339) + `"}`
+	requests := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		switch {
+		case r.URL.Path == "/v2/credentials/abc" && r.Header.Get("Authorization") == "auth":
+			w.Write([]byte(body))
+		case r.Method == http.MethodPut && r.URL.Path == "/latest/api/token":
+			w.Write([]byte("imds-token"))
+		case r.URL.Path == "/latest/meta-data/iam/security-credentials/" && r.Header.Get("X-aws-ec2-metadata-token") == "imds-token":
+			w.Write([]byte("mirror-role\n"))
+		case r.URL.Path == "/latest/meta-data/iam/security-credentials/mirror-role" && r.Header.Get("X-aws-ec2-metadata-token") == "imds-token":
+			w.Write([]byte(body))
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer server.Close()
+	want := awsCredentials{accessKeyID: "temp", secretAccessKey: "secret", sessionToken: "token", expires: expiration}
+
+	c := testCredentialChain(map[string]string{"AWS_CONTAINER_CREDENTIALS_RELATIVE_URI": "/v2/credentials/abc", "AWS_CONTAINER_AUTHORIZATION_TOKEN": "auth"})
+	c.containerHost = server.URL
+	creds, err := c.get()
+	assert.NoError(t, err)
+	assert.True(t, want.expires.Equal(creds.expires))
+	creds.expires = want.expires
+	assert.Equal(t, want, creds)
+
+	c = testCredentialChain(nil)
+	c.metadataHost = server.URL
+	requests = 0
+	creds, err = c.get()
+	assert.NoError(t, err)
+	assert.Equal(t, "temp", creds.accessKeyID)
+	_, err = c.get()
+	assert.NoError(t, err)
+	assert.Equal(t, 3, requests, "temporary credentials were not cached")
+
+	c = testCredentialChain(map[string]string{"AWS_EC2_METADATA_DISABLED": "true"})
+	c.metadataHost = server.URL
+	_, err = c.get()
+	assert.Error(t, err)
+}
+
+func TestSignRequest(t *testing.T) {
+	// get-vanilla of the AWS Signature Version 4 test suite
+	req, err := http.NewRequest(http.MethodGet, "https://example.amazonaws.com/", nil)
+	if !assert.NoError(t, err) {
+		return
+	}
+	creds := awsCredentials{accessKeyID: "AKIDEXAMPLE", secretAccessKey: "wJalrXUtnFEMI/K7MDENG+bPxRfiCYEXAMPLEKEY"}
+	signRequest(req, "", "us-east-1", "service", creds, time.Date(2015, 8, 30, 12, 36, 0, 0, time.UTC))
+	assert.Equal(t, "AWS4-HMAC-SHA256 Credential=AKIDEXAMPLE/20150830/us-east-1/service/aws4_request, SignedHeaders=host;x-amz-date, Signature=5fa00fa31553b73ebf1942676e86291e8372ff2a2260956d9b8aae1d763fbf31", req.Header.Get("Authorization"))
+}
+
+// stsServer answers AssumeRole and AssumeRoleWithWebIdentity, the instance
+// metadata endpoints fail the test
+func stsServer(t *testing.T, handle func(form url.Values, r *http.Request) (int, string)) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/" || r.Method != http.MethodPost {
+			t.Errorf("another source was asked: %s %s", r.Method, r.URL.Path)
+			http.NotFound(w, r)
+			return
+		}
+		assert.NoError(t, r.ParseForm())
+		status, body := handle(r.PostForm, r)
+		w.WriteHeader(status)
+		w.Write([]byte(body))
+	}))
+}
+
+func stsResponse(action, accessKeyID string, expiration time.Time) string {
+	return `<` + action + `Response xmlns="https://sts.amazonaws.com/doc/2011-06-15/"><` + action + `Result><Credentials>` +
+		`<AccessKeyId>` + accessKeyID + `</AccessKeyId><SecretAccessKey>secret</SecretAccessKey><SessionToken>token</SessionToken>` +
+		`<Expiration>` + expiration.Format(time.RFC3339) + `</Expiration></Credentials></` + action + `Result></` + action + `Response>`
+}
+
+func TestAWSCredentialChainWebIdentity(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mirrormaker")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer os.RemoveAll(dir)
+	tokenFile := filepath.Join(dir, "token")
+	assert.NoError(t, ioutil.WriteFile(tokenFile, []byte("oidc-token\n"), 0600))
+	expiration := time.Now().Add(time.Hour).UTC().Truncate(time.Second)
+	denied := false
+	server := stsServer(t, func(form url.Values, r *http.Request) (int, string) {
+		assert.Equal(t, "AssumeRoleWithWebIdentity", form.Get("Action"))
+		assert.Equal(t, "arn:aws:iam::123456789012:role/mirror", form.Get("RoleArn"))
+		assert.Equal(t, "oidc-token", form.Get("WebIdentityToken"))
+		assert.NotEmpty(t, form.Get("RoleSessionName"))
+		assert.Empty(t, r.Header.Get("Authorization"), "web identity requests are not signed")
+		if denied {
+			return http.StatusForbidden, `<ErrorResponse><Error><Code>AccessDenied</Code><Message>Not authorized</Message></Error></ErrorResponse>`
+		}
+		return http.StatusOK, stsResponse("AssumeRoleWithWebIdentity", "web", expiration)
+	})
+	defer server.Close()
+
+	c := testCredentialChain(map[string]string{"AWS_WEB_IDENTITY_TOKEN_FILE": tokenFile, "AWS_ROLE_ARN": "arn:aws:iam::123456789012:role/mirror"})
+	c.stsEndpoint = server.URL
+	creds, err := c.get()
+	assert.NoError(t, err)
+	assert.Equal(t, "web", creds.accessKeyID)
+	assert.Equal(t, "token", creds.sessionToken)
+	assert.True(t, expiration.Equal(creds.expires))
+
+	// a failing web identity does not fall through to the instance role
+	denied = true
+	c = testCredentialChain(map[string]string{"AWS_WEB_IDENTITY_TOKEN_FILE": tokenFile, "AWS_ROLE_ARN": "arn:aws:iam::123456789012:role/mirror"})
+	c.stsEndpoint = server.URL
+	c.metadataHost = server.URL
+	_, err = c.get()
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "AccessDenied")
+	}
+
+	_, err = testCredentialChain(map[string]string{"AWS_ROLE_ARN": "arn:aws:iam::123456789012:role/mirror"}).get()
+	assert.Error(t, err, "a role without token was ignored")
+}
+
+func TestAWSCredentialChainAssumeRole(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mirrormaker")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer os.RemoveAll(dir)
+	config := filepath.Join(dir, "config")
+	assert.NoError(t, ioutil.WriteFile(config, []byte("[profile mirror]\nrole_arn = arn:aws:iam::123456789012:role/mirror\nsource_profile = base\nexternal_id = ext\n\n"+
+		"[profile env]\nrole_arn = arn:aws:iam::123456789012:role/mirror\ncredential_source = Environment\n\n"+
+		"[profile chained]\nrole_arn = arn:aws:iam::123456789012:role/other\nsource_profile = mirror\n\n"+
+		"[profile sso]\nsso_start_url = https://example.awsapps.com/start\n\n"+
+		"[profile static]\naws_access_key_id = static\naws_secret_access_key = secret\n"), 0600))
+	credentials := filepath.Join(dir, "credentials")
+	assert.NoError(t, ioutil.WriteFile(credentials, []byte("[base]\naws_access_key_id = base\naws_secret_access_key = secret\n"), 0600))
+	expiration := time.Now().Add(time.Hour).UTC().Truncate(time.Second)
+	var signedBy string
+	server := stsServer(t, func(form url.Values, r *http.Request) (int, string) {
+		assert.Equal(t, "AssumeRole", form.Get("Action"))
+		assert.Equal(t, "arn:aws:iam::123456789012:role/mirror", form.Get("RoleArn"))
+		signedBy = strings.SplitN(strings.TrimPrefix(r.Header.Get("Authorization"), "AWS4-HMAC-SHA256 Credential="), "/", 2)[0]
+		return http.StatusOK, stsResponse("AssumeRole", "assumed", expiration)
+	})
+	defer server.Close()
+	chain := func(env map[string]string) *awsCredentialChain {
+		env["AWS_CONFIG_FILE"] = config
+		env["AWS_SHARED_CREDENTIALS_FILE"] = credentials
+		c := testCredentialChain(env)
+		c.stsEndpoint = server.URL
+		return c
+	}
+
+	creds, err := chain(map[string]string{"AWS_PROFILE": "mirror"}).get()
+	assert.NoError(t, err)
+	assert.Equal(t, "assumed", creds.accessKeyID)
+	assert.Equal(t, "base", signedBy, "the role was not assumed with the source_profile")
+
+	creds, err = chain(map[string]string{"AWS_PROFILE": "env", "AWS_ACCESS_KEY_ID": "envkey", "AWS_SECRET_ACCESS_KEY": "secret"}).get()
+	assert.NoError(t, err)
+	assert.Equal(t, "envkey", creds.accessKeyID, "the environment takes precedence")
+	creds, err = chain(map[string]string{"AWS_PROFILE": "env"}).get()
+	assert.Error(t, err, "credential_source Environment without keys")
+
+	creds, err = chain(map[string]string{"AWS_PROFILE": "static"}).get()
+	assert.NoError(t, err)
+	assert.Equal(t, "static", creds.accessKeyID, "profiles of the config file")
+
+	for _, profile := range []string{"chained", "sso"} {
+		_, err = chain(map[string]string{"AWS_PROFILE": profile}).get()
+		assert.Error(t, err, "profile %s", profile)
+	}
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/rcrowley/go-metrics"
+)
+
+// states of the breaker as exported by the producer.breaker_state gauge
+const (
+	breakerClosed int64 = iota
+	breakerOpen
+	breakerHalfOpen
+)
+
+// breaker stops handing messages to the producer while the destination
+// cluster keeps failing. It opens after threshold produce errors within
+// window, waits for cooldown and then half opens: a single message is let
+// through, if it is acknowledged the breaker closes, if it fails the breaker
+// opens again. Acknowledgements have to be reported, so it requires
+// producer.track_successes.
+type breaker struct {
+	threshold int
+	window    time.Duration
+	cooldown  time.Duration
+	gauge     metrics.Gauge
+
+	mu     sync.Mutex
+	state  int64
+	errors []time.Time
+	opened time.Time
+	// probing is set while the message testing a half open breaker is in
+	// flight
+	probing      bool
+	probeStarted time.Time
+	// changed is closed and replaced on every state change
+	changed chan struct{}
+}
+
+// newBreaker returns nil if the threshold is not positive
+func newBreaker(threshold int, window, cooldown time.Duration, registry metrics.Registry) *breaker {
+	if threshold <= 0 {
+		return nil
+	}
+	return &breaker{
+		threshold: threshold,
+		window:    window,
+		cooldown:  cooldown,
+		gauge:     metrics.GetOrRegisterGauge(`producer.breaker_state`, registry),
+		changed:   make(chan struct{}),
+	}
+}
+
+// wait blocks while the breaker is open or another message tests the half
+// open breaker. It returns the error of ctx if it is done first.
+func (b *breaker) wait(ctx context.Context) error {
+	if b == nil {
+		return nil
+	}
+	for {
+		b.mu.Lock()
+		var remaining time.Duration
+		switch b.state {
+		case breakerClosed:
+			b.mu.Unlock()
+			return nil
+		case breakerOpen:
+			if remaining = b.cooldown - time.Since(b.opened); remaining <= 0 {
+				b.setState(breakerHalfOpen)
+				logger.Infof("circuit breaker half open, testing the destination with a single message")
+			}
+		}
+		if b.state == breakerHalfOpen {
+			// a probe without result, e.g. because its session ended, is
+			// replaced after the cooldown
+			if remaining = b.cooldown - time.Since(b.probeStarted); !b.probing || remaining <= 0 {
+				b.probing = true
+				b.probeStarted = time.Now()
+				b.mu.Unlock()
+				return nil
+			}
+		}
+		changed := b.changed
+		b.mu.Unlock()
+		timer := time.NewTimer(remaining)
+		select {
+		case <-changed:
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return ctx.Err()
+		}
+		timer.Stop()
+	}
+}
+
+// result records the outcome of a produced message, err is nil if it was
+// acknowledged
+func (b *breaker) result(err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	now := time.Now()
+	if err == nil {
+		b.errors = b.errors[:0]
+		if b.state == breakerHalfOpen {
+			logger.Infof("circuit breaker closed, the destination recovered")
+			b.setState(breakerClosed)
+		}
+		return
+	}
+	switch b.state {
+	case breakerHalfOpen:
+		logger.Warnf("circuit breaker opened again for %s, the destination is still failing", b.cooldown)
+		b.open(now)
+	case breakerClosed:
+		b.errors = append(b.errors, now)
+		for len(b.errors) > 0 && now.Sub(b.errors[0]) > b.window {
+			b.errors = b.errors[1:]
+		}
+		if len(b.errors) >= b.threshold {
+			logger.Warnf("circuit breaker opened for %s after %d produce errors within %s", b.cooldown, len(b.errors), b.window)
+			b.open(now)
+		}
+	}
+}
+
+func (b *breaker) open(now time.Time) {
+	b.opened = now
+	b.errors = b.errors[:0]
+	b.setState(breakerOpen)
+}
+
+// setState has to be called with mu held
+func (b *breaker) setState(state int64) {
+	b.state = state
+	b.probing = false
+	b.gauge.Update(state)
+	close(b.changed)
+	b.changed = make(chan struct{})
+}
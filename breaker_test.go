@@ -0,0 +1,87 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/Shopify/sarama"
+	"github.com/rcrowley/go-metrics"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBreaker(t *testing.T) {
+	registry := metrics.NewRegistry()
+	b := newBreaker(2, time.Minute, 20*time.Millisecond, registry)
+	state := metrics.GetOrRegisterGauge(`producer.breaker_state`, registry)
+	ctx := context.Background()
+	errProduce := errors.New("produce failed")
+
+	b.result(errProduce)
+	b.result(nil)
+	b.result(errProduce)
+	assert.Equal(t, breakerClosed, state.Value(), "an acknowledgement did not reset the errors")
+	b.result(errProduce)
+	assert.Equal(t, breakerOpen, state.Value())
+
+	short, cancel := context.WithTimeout(ctx, 5*time.Millisecond)
+	defer cancel()
+	assert.Error(t, b.wait(short), "an open breaker let a message through")
+
+	// after the cooldown a single probe goes through
+	start := time.Now()
+	assert.NoError(t, b.wait(ctx))
+	assert.True(t, time.Since(start) >= 10*time.Millisecond, "the cooldown was not awaited")
+	assert.Equal(t, breakerHalfOpen, state.Value())
+	short, cancel = context.WithTimeout(ctx, 5*time.Millisecond)
+	defer cancel()
+	assert.Error(t, b.wait(short), "a second message went through the half open breaker")
+
+	b.result(errProduce)
+	assert.Equal(t, breakerOpen, state.Value(), "a failed probe did not open the breaker")
+	assert.NoError(t, b.wait(ctx))
+	b.result(nil)
+	assert.Equal(t, breakerClosed, state.Value(), "an acknowledged probe did not close the breaker")
+	assert.NoError(t, b.wait(ctx))
+
+	assert.Nil(t, newBreaker(0, time.Minute, time.Second, registry), "breaker is enabled without threshold")
+	assert.NoError(t, (*breaker)(nil).wait(ctx))
+}
+
+func TestBreakerWindow(t *testing.T) {
+	registry := metrics.NewRegistry()
+	b := newBreaker(2, 10*time.Millisecond, time.Minute, registry)
+	b.result(errors.New("produce failed"))
+	time.Sleep(20 * time.Millisecond)
+	b.result(errors.New("produce failed"))
+	assert.Equal(t, breakerClosed, metrics.GetOrRegisterGauge(`producer.breaker_state`, registry).Value(), "errors outside of the window were counted")
+}
+
+func TestConsumeClaimBreaker(t *testing.T) {
+	producer := newTestProducer()
+	consumer := newTestConsumer("hash", producer)
+	consumer.trackSuccesses = true
+	consumer.breaker = newBreaker(1, time.Minute, time.Minute, consumer.metrics)
+	// the session ends while the breaker is open, like on shutdown
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	session := &testSession{ctx: ctx}
+	claim := &testClaim{messages: make(chan *sarama.ConsumerMessage)}
+	done := make(chan error)
+	go func() {
+		done <- consumer.ConsumeClaim(session, claim)
+	}()
+	claim.messages <- &sarama.ConsumerMessage{Topic: "source", Offset: 0, Key: []byte("a"), Value: []byte("Terrible Test")}
+	first := <-producer.input
+	producerError(&sarama.ProducerError{Msg: first, Err: sarama.ErrNotEnoughReplicas}, consumer.metrics)
+	claim.messages <- &sarama.ConsumerMessage{Topic: "source", Offset: 1, Key: []byte("b"), Value: []byte("Terrible Test")}
+	select {
+	case <-producer.input:
+		t.Fatal("a message was produced while the breaker was open")
+	case <-time.After(20 * time.Millisecond):
+	}
+	cancel()
+	assert.NoError(t, <-done, "the end of the session was reported as error")
+	assert.Equal(t, []int64{0}, session.markedOffsets(), "the held back message was marked")
+}
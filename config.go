@@ -0,0 +1,650 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/url"
+	"os"
+	"reflect"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/Shopify/sarama"
+	"github.com/spf13/viper"
+)
+
+// setDefaults registers the default values of all optional settings
+func setDefaults() {
+	setDefaultsOf(viper.GetViper())
+}
+
+// setDefaultsOf registers the defaults on v, reloadConfig validates a config
+// in its own viper before it is applied
+func setDefaultsOf(v *viper.Viper) {
+	v.SetDefault("producer.flush.frequency", 1*time.Second)
+	v.SetDefault("producer.flush.bytes", 5388608)
+	v.SetDefault("graphite.interval", 30*time.Second)
+	v.SetDefault("metrics.statsd.interval", 30*time.Second)
+	v.SetDefault("metrics.flush_on_shutdown", true)
+	v.SetDefault("metrics.graphite.percentiles", defaultGraphitePercentiles)
+	v.SetDefault("metrics.graphite.allow", []string{})
+	v.SetDefault("producer.kafka.tls", false)
+	v.SetDefault("producer.kafka.username", "")
+	v.SetDefault("producer.kafka.password", "")
+	v.SetDefault("producer.preserve_headers", true)
+	v.SetDefault("producer.preserve_timestamp", true)
+	v.SetDefault("producer.allow_tombstones", false)
+	v.SetDefault("producer.strict_key_partition", false)
+	v.SetDefault("producer.partition_header_fallback", "error")
+	v.SetDefault("producer.ordered", false)
+	v.SetDefault("producer.max_inflight", 0)
+	v.SetDefault("producer.enqueue_block_threshold", 1*time.Second)
+	v.SetDefault("producer.auto_create_topic", false)
+	v.SetDefault("producer.topic.partitions", 1)
+	v.SetDefault("producer.topic.replication_factor", 1)
+	v.SetDefault("delivery.at_least_once", false)
+	v.SetDefault("breaker.threshold", 0)
+	v.SetDefault("breaker.window", 1*time.Minute)
+	v.SetDefault("breaker.cooldown", 30*time.Second)
+	v.SetDefault("http.readyz.max_error_age", 30*time.Second)
+	v.SetDefault("producer.partitions.refresh_interval", 1*time.Minute)
+	v.SetDefault("consumer.offsets.initial", "newest")
+	v.SetDefault("consumer.offsets.commit_interval", 10*time.Second)
+	v.SetDefault("consumer.group.rebalance.strategy", "range")
+	v.SetDefault("consumer.group.max_processing_time", 100*time.Millisecond)
+	v.SetDefault("consumer.isolation_level", "read_uncommitted")
+	v.SetDefault("producer.retry.max", 10)
+	v.SetDefault("producer.retry.backoff", 100*time.Millisecond)
+	v.SetDefault("shutdown.timeout", 5*time.Minute)
+	v.SetDefault("startup.retry.attempts", 5)
+	v.SetDefault("startup.retry.backoff", 1*time.Second)
+	v.SetDefault("log.format", "text")
+	v.SetDefault("log.level", "info")
+	v.SetDefault("consumer.lag.interval", 30*time.Second)
+	v.SetDefault("consumer.workers", 1)
+	v.SetDefault("consumer.sample_rate", 1.0)
+	v.SetDefault("topic.key_suffix.buckets", 0)
+	v.SetDefault("http.errors.size", 100)
+	v.SetDefault("transform.envelope", false)
+	v.SetDefault("metrics.per_topic", false)
+	v.SetDefault("consumer.max_messages", 0)
+	v.SetDefault("mirror.stop_after", 0)
+	v.SetDefault("consumer.mode", "group")
+	v.SetDefault("routing.key_prefix.prefix", "")
+	v.SetDefault("routing.key_prefix.topic", "")
+	v.SetDefault("routing.key_prefix.partition", -1)
+	v.SetDefault("consumer.static.partitions", []string{})
+	v.SetDefault("mirror.until", "")
+	v.SetDefault("consumer.fetch.min", 1)
+	v.SetDefault("consumer.fetch.default", 1024*1024)
+	v.SetDefault("consumer.fetch.max", 0)
+	v.SetDefault("producer.max_message_bytes", 1000000)
+	v.SetDefault("producer.random.keep_key", false)
+	v.SetDefault("producer.partitions.halt_on_decrease", false)
+	v.SetDefault("producer.exclude_partitions", []int{})
+	v.SetDefault("tracing.inject_headers", false)
+	v.SetDefault("producer.kafka.kerberos.service_name", "kafka")
+	v.SetDefault("producer.kafka.kerberos.config_file", "/etc/krb5.conf")
+	v.SetDefault("kafka.client_id", "mirrormaker")
+	v.SetDefault("kafka.client_id_hostname", false)
+	v.SetDefault("kafka.client_id_suffix", "")
+	v.SetDefault("kafka.dial_timeout", 30*time.Second)
+	v.SetDefault("kafka.read_timeout", 30*time.Second)
+	v.SetDefault("kafka.write_timeout", 30*time.Second)
+	v.SetDefault("kafka.metadata.refresh_interval", 10*time.Minute)
+	v.SetDefault("offset_sync.enabled", false)
+	v.SetDefault("offset_sync.groups", []string{})
+	v.SetDefault("offset_sync.interval", time.Minute)
+	v.SetDefault("heartbeat.topic", "")
+	v.SetDefault("heartbeat.interval", 5*time.Second)
+	v.SetDefault("heartbeat.source_cluster_id", "")
+}
+
+// envPrefix is prepended to the environment variables overriding the config
+const envPrefix = "MIRRORMAKER"
+
+// bindEnv lets environment variables override the config file, e.g.
+// MIRRORMAKER_PRODUCER_KAFKA_USERNAME overrides producer.kafka.username
+func bindEnv() {
+	bindEnvOf(viper.GetViper())
+}
+
+// bindEnvOf lets environment variables override the settings of v
+func bindEnvOf(v *viper.Viper) {
+	v.SetEnvPrefix(envPrefix)
+	v.SetEnvKeyReplacer(strings.NewReplacer(".", "_"))
+	v.AutomaticEnv()
+}
+
+// requiredKeys have to be set in every config, producer.kafka.topic only
+// without topic.mapping and topic.rename
+var requiredKeys = []string{"consumer.topic", "consumer.group.id", "producer.kafka.nodes", "producer.kafka.topic"}
+
+var partitioners = []string{"hash", "murmur2", "keeppartition", "modulo", "consistent", "roundrobin", "random", "header"}
+
+// validateConfig returns an error naming all required keys which are not set
+func validateConfig() error {
+	var missing []string
+	for _, key := range requiredKeys {
+		if key == "consumer.topic" && strings.EqualFold(viper.GetString("consumer.mode"), "static") {
+			// consumer.static.partitions has the topics
+			continue
+		}
+		if key == "producer.kafka.topic" && (len(viper.GetStringMap("topic.mapping")) > 0 || viper.GetString("topic.rename.pattern") != "") {
+			// every source topic may have its own destination
+			continue
+		}
+		if len(viper.GetStringSlice(key)) == 0 {
+			missing = append(missing, key)
+		}
+	}
+	if len(missing) > 0 {
+		return fmt.Errorf("%s must be set", strings.Join(missing, ", "))
+	}
+	return nil
+}
+
+// maskedSecret replaces the values of secret settings in printConfig
+const maskedSecret = "******"
+
+// secretKey reports whether the value of the key must not be printed, like
+// producer.kafka.password or producer.kafka.oauth.client_secret
+func secretKey(key string) bool {
+	name := key[strings.LastIndex(key, ".")+1:]
+	return strings.Contains(name, "password") || strings.Contains(name, "secret") || name == "token" || strings.HasSuffix(name, "_token")
+}
+
+// printConfig writes the effective settings of the defaults, the config file
+// and the environment as JSON, with the secrets and the passwords of urls
+// masked
+func printConfig(w io.Writer) error {
+	settings := map[string]interface{}{}
+	for _, key := range viper.AllKeys() {
+		value := viper.Get(key)
+		switch v := value.(type) {
+		case time.Duration:
+			value = v.String()
+		case string:
+			if secretKey(key) && v != "" {
+				value = maskedSecret
+			} else if u, err := url.Parse(v); err == nil && u.User != nil {
+				if _, ok := u.User.Password(); ok {
+					// url.URL.String would escape the mask
+					value = strings.Replace(v, u.User.String()+"@", url.User(u.User.Username()).String()+":"+maskedSecret+"@", 1)
+					if value == v {
+						// unusually escaped, the password is left out
+						u.User = url.User(u.User.Username())
+						value = u.String()
+					}
+				}
+			}
+		default:
+			if secretKey(key) && value != nil {
+				value = maskedSecret
+			}
+		}
+		settings[key] = value
+	}
+	// the keys of a map are sorted
+	out, err := json.MarshalIndent(settings, "", "  ")
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(w, "%s\n", out)
+	return err
+}
+
+// checkConfig validates the loaded config without connecting to kafka and
+// returns all problems found
+func checkConfig() []error {
+	var errs []error
+	if err := validateConfig(); err != nil {
+		errs = append(errs, err)
+	}
+	partitioner := strings.ToLower(viper.GetString("producer.partitioner"))
+	if !stringSet(partitioners)[partitioner] {
+		errs = append(errs, fmt.Errorf("invalid producer.partitioner %q, must be one of %s", partitioner, strings.Join(partitioners, ", ")))
+	}
+	if _, err := getKeylessFallback(viper.GetString("producer.hash.keyless_fallback")); err != nil {
+		errs = append(errs, err)
+	}
+	if _, err := getHeaderFallback(viper.GetString("producer.partition_header_fallback")); err != nil {
+		errs = append(errs, err)
+	}
+	cfg := sarama.NewConfig()
+	if version, err := sarama.ParseKafkaVersion(viper.GetString("producer.kafka.version")); err == nil {
+		cfg.Version = version
+	}
+	codec, _ := producerCompression()
+	if err := setCompression(cfg, codec); err != nil {
+		errs = append(errs, err)
+	}
+	if _, err := getRequiredAcks(viper.GetString("producer.required_acks")); err != nil {
+		errs = append(errs, err)
+	}
+	if _, err := clientIDFromConfig(os.Hostname); err != nil {
+		errs = append(errs, err)
+	}
+	if err := setNetTimeouts(cfg, viper.GetDuration("kafka.dial_timeout"), viper.GetDuration("kafka.read_timeout"), viper.GetDuration("kafka.write_timeout")); err != nil {
+		errs = append(errs, err)
+	}
+	if err := setMetadataRefresh(cfg, viper.GetDuration("kafka.metadata.refresh_interval")); err != nil {
+		errs = append(errs, err)
+	}
+	if _, err := proxyURLFromConfig(); err != nil {
+		errs = append(errs, err)
+	}
+	if err := checkSharedClient(); err != nil {
+		errs = append(errs, err)
+	}
+	if err := checkSASL(); err != nil {
+		errs = append(errs, err)
+	}
+	if n := viper.GetInt("producer.max_message_bytes"); n <= 0 || n >= int(sarama.MaxRequestSize) {
+		errs = append(errs, fmt.Errorf("producer.max_message_bytes must be between 1 and %d, got %d", sarama.MaxRequestSize-1, n))
+	}
+	if _, err := getInitialOffset(viper.GetString("consumer.offsets.initial")); err != nil {
+		errs = append(errs, err)
+	}
+	if viper.GetInt("breaker.threshold") > 0 && (viper.GetDuration("breaker.window") <= 0 || viper.GetDuration("breaker.cooldown") <= 0) {
+		errs = append(errs, fmt.Errorf("breaker.window and breaker.cooldown must be positive"))
+	}
+	if viper.GetBool("producer.auto_create_topic") && (viper.GetInt("producer.topic.partitions") <= 0 || viper.GetInt("producer.topic.replication_factor") <= 0) {
+		errs = append(errs, fmt.Errorf("producer.topic.partitions and producer.topic.replication_factor must be positive"))
+	}
+	if viper.GetInt("startup.retry.attempts") < 1 || viper.GetDuration("startup.retry.backoff") < 0 {
+		errs = append(errs, fmt.Errorf("startup.retry.attempts must be at least 1 and startup.retry.backoff must not be negative"))
+	}
+	if viper.GetString("heartbeat.topic") != "" && viper.GetDuration("heartbeat.interval") <= 0 {
+		errs = append(errs, fmt.Errorf("heartbeat.interval must be positive, got %s", viper.GetDuration("heartbeat.interval")))
+	}
+	if err := checkOffsetSync(); err != nil {
+		errs = append(errs, err)
+	}
+	if _, err := newSampler(viper.GetFloat64("consumer.sample_rate")); err != nil {
+		errs = append(errs, err)
+	}
+	if n := viper.GetInt64("consumer.max_messages"); n < 0 {
+		errs = append(errs, fmt.Errorf("consumer.max_messages must not be negative, got %d", n))
+	}
+	if d := viper.GetDuration("mirror.stop_after"); d < 0 {
+		errs = append(errs, fmt.Errorf("mirror.stop_after must not be negative, got %s", d))
+	}
+	if _, err := mirrorUntilFromConfig(); err != nil {
+		errs = append(errs, err)
+	}
+	if _, err := graphitePercentilesFromConfig(); err != nil {
+		errs = append(errs, err)
+	}
+	if _, err := graphiteAllowFromConfig(); err != nil {
+		errs = append(errs, err)
+	}
+	if _, err := keyPrefixRouteFromConfig(); err != nil {
+		errs = append(errs, err)
+	}
+	if _, err := staticAssignmentsFromConfig(); err != nil {
+		errs = append(errs, err)
+	}
+	if n := viper.GetInt("consumer.workers"); n < 1 {
+		errs = append(errs, fmt.Errorf("consumer.workers must be at least 1, got %d", n))
+	}
+	if d := viper.GetDuration("consumer.group.max_processing_time"); d <= 0 {
+		errs = append(errs, fmt.Errorf("consumer.group.max_processing_time must be positive, got %s", d))
+	}
+	if err := setIsolationLevel(cfg, viper.GetString("consumer.isolation_level")); err != nil {
+		errs = append(errs, err)
+	}
+	if err := setFetchSizes(cfg, viper.GetInt32("consumer.fetch.min"), viper.GetInt32("consumer.fetch.default"), viper.GetInt32("consumer.fetch.max")); err != nil {
+		errs = append(errs, err)
+	}
+	if _, err := topicRouterFromConfig(viper.GetViper()); err != nil {
+		errs = append(errs, err)
+	}
+	if overrides, err := topicPartitionersFromConfig(); err != nil {
+		errs = append(errs, err)
+	} else if err := checkPartitionHeader(partitioner, overrides, viper.GetString("producer.partition_header")); err != nil {
+		errs = append(errs, err)
+	}
+	if _, err := newMessageFilter(filterOptions(viper.GetViper())); err != nil {
+		errs = append(errs, err)
+	}
+	if _, err := keyTransformFromConfig(); err != nil {
+		errs = append(errs, err)
+	}
+	if producerTLSEnabled() {
+		// loads the certificates, so unreadable files are reported as well
+		if _, err := newTLSConfig(producerTLSOptions()); err != nil {
+			errs = append(errs, err)
+		}
+	} else if viper.GetString("producer.kafka.tls.server_name") != "" {
+		errs = append(errs, fmt.Errorf("producer.kafka.tls.server_name is set but tls is not enabled"))
+	}
+	return errs
+}
+
+// checkOffsetSync validates the offset_sync settings if it is enabled
+func checkOffsetSync() error {
+	if !viper.GetBool("offset_sync.enabled") {
+		return nil
+	}
+	groups := viper.GetStringSlice("offset_sync.groups")
+	if len(groups) == 0 {
+		return fmt.Errorf("offset_sync.enabled requires offset_sync.groups")
+	}
+	for _, group := range groups {
+		if group == viper.GetString("consumer.group.id") {
+			return fmt.Errorf("offset_sync.groups must not contain consumer.group.id %q, the offsets of mirrormaker itself are not synced", group)
+		}
+	}
+	if d := viper.GetDuration("offset_sync.interval"); d <= 0 {
+		return fmt.Errorf("offset_sync.interval must be positive, got %s", d)
+	}
+	return nil
+}
+
+// staticAssignmentsFromConfig returns the partitions of consumer.mode
+// static, nil for the default consumer group mode
+func staticAssignmentsFromConfig() ([]staticAssignment, error) {
+	switch mode := strings.ToLower(viper.GetString("consumer.mode")); mode {
+	case "group", "":
+		return nil, nil
+	case "static":
+		if viper.GetBool("delivery.at_least_once") {
+			return nil, fmt.Errorf("consumer.mode static does not work with delivery.at_least_once, there are no committed offsets to consume a failed message again from")
+		}
+		return parseStaticAssignments(viper.GetStringSlice("consumer.static.partitions"))
+	default:
+		return nil, fmt.Errorf("invalid consumer.mode %q, must be group or static", mode)
+	}
+}
+
+// producerTLSEnabled reports whether tls is enabled, producer.kafka.tls is
+// either a bool or a table with the tls settings
+func producerTLSEnabled() bool {
+	return viper.GetBool("producer.kafka.tls") || viper.GetBool("producer.kafka.tls.enable")
+}
+
+func producerTLSOptions() TLSOptions {
+	return TLSOptions{
+		CAFile:             viper.GetString("producer.kafka.tls.ca_file"),
+		CertFile:           viper.GetString("producer.kafka.tls.cert_file"),
+		KeyFile:            viper.GetString("producer.kafka.tls.key_file"),
+		InsecureSkipVerify: viper.GetBool("producer.kafka.tls.insecure_skip_verify"),
+		ServerName:         viper.GetString("producer.kafka.tls.server_name"),
+	}
+}
+
+func producerOAuthOptions() oauthOptions {
+	return oauthOptions{
+		TokenURL:     viper.GetString("producer.kafka.oauth.token_url"),
+		ClientID:     viper.GetString("producer.kafka.oauth.client_id"),
+		ClientSecret: viper.GetString("producer.kafka.oauth.client_secret"),
+		Scope:        viper.GetString("producer.kafka.oauth.scope"),
+	}
+}
+
+// producerKerberosConfig returns the settings of SASL GSSAPI, it logs in with
+// the keytab if one is set and with the password otherwise
+func producerKerberosConfig() sarama.GSSAPIConfig {
+	krb := sarama.GSSAPIConfig{
+		AuthType:           sarama.KRB5_USER_AUTH,
+		KeyTabPath:         viper.GetString("producer.kafka.kerberos.keytab_file"),
+		KerberosConfigPath: viper.GetString("producer.kafka.kerberos.config_file"),
+		ServiceName:        viper.GetString("producer.kafka.kerberos.service_name"),
+		Username:           viper.GetString("producer.kafka.kerberos.username"),
+		Password:           viper.GetString("producer.kafka.kerberos.password"),
+		Realm:              viper.GetString("producer.kafka.kerberos.realm"),
+		DisablePAFXFAST:    viper.GetBool("producer.kafka.kerberos.disable_pa_fx_fast"),
+	}
+	if krb.KeyTabPath != "" {
+		krb.AuthType = sarama.KRB5_KEYTAB_AUTH
+	}
+	return krb
+}
+
+// producerCompression returns the codec and level of the producer compression,
+// producer.compression is either the codec or a table with codec and level
+func producerCompression() (string, int) {
+	level := sarama.CompressionLevelDefault
+	if viper.IsSet("producer.compression.level") {
+		level = viper.GetInt("producer.compression.level")
+	}
+	if viper.IsSet("producer.compression.codec") {
+		return viper.GetString("producer.compression.codec"), level
+	}
+	return viper.GetString("producer.compression"), level
+}
+
+// checkSharedClient rejects the TLS and SASL settings of the consumer. The
+// consumer and the producer share the kafka client, which the producer.kafka
+// settings configure, so settings of the consumer would be ignored.
+func checkSharedClient() error {
+	for _, key := range []string{"tls", "sasl", "username", "password", "aws", "oauth", "kerberos"} {
+		if viper.IsSet("consumer.kafka." + key) {
+			return fmt.Errorf("consumer.kafka.%s is not supported, the consumer and the producer share the kafka client, set producer.kafka.%s", key, key)
+		}
+	}
+	return nil
+}
+
+// proxyURLFromConfig returns kafka.proxy.url, the proxy of the kafka client.
+// The consumer and the producer share the client, so there is no proxy per
+// side and consumer.kafka.proxy.url or producer.kafka.proxy.url are rejected
+// instead of being ignored.
+func proxyURLFromConfig() (string, error) {
+	for _, key := range []string{"consumer.kafka.proxy.url", "producer.kafka.proxy.url"} {
+		if viper.GetString(key) != "" {
+			return "", fmt.Errorf("%s is not supported, the consumer and the producer share the kafka client, set kafka.proxy.url", key)
+		}
+	}
+	proxyURL := viper.GetString("kafka.proxy.url")
+	if proxyURL != "" {
+		if _, err := newProxyDialer(proxyURL, &net.Dialer{}); err != nil {
+			return "", err
+		}
+	}
+	return proxyURL, nil
+}
+
+// validClientID matches the client ids accepted by the brokers
+var validClientID = regexp.MustCompile(`\A[A-Za-z0-9._-]+\z`)
+
+// clientIDFromConfig returns kafka.client_id followed by the hostname if
+// kafka.client_id_hostname is set and kafka.client_id_suffix, separated by
+// dashes. Distinct ids let the brokers apply quotas per instance.
+func clientIDFromConfig(hostname func() (string, error)) (string, error) {
+	parts := []string{viper.GetString("kafka.client_id")}
+	if viper.GetBool("kafka.client_id_hostname") {
+		host, err := hostname()
+		if err != nil {
+			return "", fmt.Errorf("could not get the hostname for kafka.client_id_hostname: %s", err)
+		}
+		parts = append(parts, host)
+	}
+	if suffix := viper.GetString("kafka.client_id_suffix"); suffix != "" {
+		parts = append(parts, suffix)
+	}
+	id := strings.Join(parts, "-")
+	if !validClientID.MatchString(id) {
+		return "", fmt.Errorf("invalid client id %q, it may only contain letters, digits, '.', '_' and '-'", id)
+	}
+	return id, nil
+}
+
+func topicRouterFromConfig(v *viper.Viper) (*TopicRouter, error) {
+	r, err := NewTopicRouter(v.GetStringMapStringSlice("topic.mapping"), v.GetString("topic.rename.pattern"), v.GetString("topic.rename.replacement"), v.GetString("producer.kafka.topic"))
+	if err != nil {
+		return nil, err
+	}
+	buckets := v.GetInt("topic.key_suffix.buckets")
+	if buckets < 0 {
+		return nil, fmt.Errorf("topic.key_suffix.buckets must not be negative, got %d", buckets)
+	}
+	r.keySuffixBuckets = int32(buckets)
+	return r, nil
+}
+
+// keyPrefixRouteFromConfig returns the route of routing.key_prefix, nil if
+// no prefix is set
+func keyPrefixRouteFromConfig() (*keyPrefixRoute, error) {
+	return newKeyPrefixRoute(viper.GetString("routing.key_prefix.prefix"), viper.GetString("routing.key_prefix.topic"), viper.GetInt32("routing.key_prefix.partition"))
+}
+
+// topicPartitionersFromConfig returns the partitioners overriding
+// producer.partitioner for single source topics, keyed by the lower case topic
+func topicPartitionersFromConfig() (map[string]string, error) {
+	overrides := map[string]string{}
+	for topic, partitioner := range viper.GetStringMapString("topic.partitioner") {
+		partitioner = strings.ToLower(partitioner)
+		if !stringSet(partitioners)[partitioner] {
+			return nil, fmt.Errorf("invalid topic.partitioner.%s %q, must be one of %s", topic, partitioner, strings.Join(partitioners, ", "))
+		}
+		overrides[strings.ToLower(topic)] = partitioner
+	}
+	return overrides, nil
+}
+
+func filterOptions(v *viper.Viper) FilterOptions {
+	return FilterOptions{
+		ValueRegex:           v.GetString("filter.value.regex"),
+		ValueNegate:          v.GetBool("filter.value.negate"),
+		KeyAllow:             v.GetStringSlice("filter.key.allow"),
+		KeyDeny:              v.GetStringSlice("filter.key.deny"),
+		HeaderName:           v.GetString("filter.header.name"),
+		HeaderValue:          v.GetString("filter.header.value"),
+		HeaderMatchValue:     v.IsSet("filter.header.value"),
+		HeaderForwardMissing: v.GetBool("filter.header.forward_missing"),
+	}
+}
+
+func keyTransformFromConfig() (*keyTransform, error) {
+	return newKeyTransform(viper.GetString("transform.key.prefix"), viper.GetString("transform.key.regex"), viper.GetString("transform.key.replacement"))
+}
+
+// reloadable reports whether a changed setting is applied by reloadConfig
+func reloadable(key string) bool {
+	if strings.HasPrefix(key, "topic.partitioner.") {
+		// the producer partitioner depends on them
+		return false
+	}
+	return strings.HasPrefix(key, "filter.") || strings.HasPrefix(key, "topic.") || key == "producer.kafka.topic" || key == "log.level"
+}
+
+// fileConfig has the settings of the config file in effect, without the
+// defaults and the environment. A reload only replaces its reloadable keys.
+var fileConfig = viper.New()
+
+// readConfigFile reads the config file found by viper into viper and
+// fileConfig
+func readConfigFile() error {
+	if err := viper.ReadInConfig(); err != nil {
+		return err
+	}
+	content, err := ioutil.ReadFile(viper.ConfigFileUsed())
+	if err != nil {
+		return err
+	}
+	// both from the same content, in case the file changed in between
+	settings, err := parseConfigFile(viper.ConfigFileUsed(), content)
+	if err != nil {
+		return err
+	}
+	if err := viper.ReadConfig(bytes.NewReader(content)); err != nil {
+		return err
+	}
+	fileConfig = settings
+	return nil
+}
+
+// parseConfigFile returns the settings of content in the format of file
+func parseConfigFile(file string, content []byte) (*viper.Viper, error) {
+	v := viper.New()
+	v.SetConfigFile(file)
+	if err := v.ReadConfig(bytes.NewReader(content)); err != nil {
+		return nil, err
+	}
+	return v, nil
+}
+
+// replaceFileSettings replaces the settings of the config file in viper, the
+// defaults and the environment are kept
+func replaceFileSettings(settings map[string]interface{}) error {
+	content, err := json.Marshal(settings)
+	if err != nil {
+		return err
+	}
+	// the settings are no longer in the format of the file
+	viper.SetConfigType("json")
+	return viper.ReadConfig(bytes.NewReader(content))
+}
+
+// reloadConfig re-reads the config file and applies the filters, the topic
+// routing and the log level. Only these settings of the new file are taken,
+// all others keep the values they were started with and their changes are
+// logged until the next restart. The new config is validated in its own
+// viper and the destination topics of the new routing are checked like at
+// startup, nothing is changed if either fails.
+func reloadConfig(consumer *Consumer) error {
+	file := viper.ConfigFileUsed()
+	content, err := ioutil.ReadFile(file)
+	if err != nil {
+		return err
+	}
+	next, err := parseConfigFile(file, content)
+	if err != nil {
+		return err
+	}
+	live := viper.New()
+	for _, key := range fileConfig.AllKeys() {
+		if !reloadable(key) {
+			live.Set(key, fileConfig.Get(key))
+		}
+	}
+	for _, key := range next.AllKeys() {
+		if reloadable(key) {
+			live.Set(key, next.Get(key))
+		}
+	}
+	settings := live.AllSettings()
+	v := viper.New()
+	setDefaultsOf(v)
+	bindEnvOf(v)
+	if err := v.MergeConfigMap(settings); err != nil {
+		return err
+	}
+	router, err := topicRouterFromConfig(v)
+	if err != nil {
+		return err
+	}
+	filter, err := newMessageFilter(filterOptions(v))
+	if err != nil {
+		return err
+	}
+	if consumer.checkDestinations != nil {
+		if err := consumer.checkDestinations(router); err != nil {
+			return err
+		}
+	}
+	if err := logger.SetLevel(v.GetString("log.level")); err != nil {
+		return err
+	}
+	if err := replaceFileSettings(settings); err != nil {
+		return err
+	}
+	changed := map[string]bool{}
+	for _, key := range append(fileConfig.AllKeys(), next.AllKeys()...) {
+		if !reloadable(key) && !changed[key] && !reflect.DeepEqual(fileConfig.Get(key), next.Get(key)) {
+			changed[key] = true
+			logger.Warnf("%s changed, restart to apply it", key)
+		}
+	}
+	fileConfig = live
+	consumer.swapRouting(router, filter)
+	logger.Infof("reloaded filters, topic routing and log level from %s", file)
+	return nil
+}
@@ -0,0 +1,715 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/Shopify/sarama"
+	"github.com/rcrowley/go-metrics"
+	"github.com/stretchr/testify/assert"
+)
+
+type testSession struct {
+	// mu guards marked, messages can be marked by the producer goroutines
+	mu     sync.Mutex
+	marked []*sarama.ConsumerMessage
+	// ctx is returned by Context, context.Background() if nil
+	ctx    context.Context
+	claims map[string][]int32
+}
+
+func (s *testSession) Claims() map[string][]int32                                           { return s.claims }
+func (s *testSession) MemberID() string                                                     { return "test" }
+func (s *testSession) GenerationID() int32                                                  { return 1 }
+func (s *testSession) MarkOffset(topic string, partition int32, offset int64, meta string)  {}
+func (s *testSession) Commit()                                                              {}
+func (s *testSession) ResetOffset(topic string, partition int32, offset int64, meta string) {}
+func (s *testSession) Context() context.Context {
+	if s.ctx == nil {
+		return context.Background()
+	}
+	return s.ctx
+}
+func (s *testSession) MarkMessage(msg *sarama.ConsumerMessage, meta string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.marked = append(s.marked, msg)
+}
+
+// markedOffsets returns the offsets of the marked messages
+func (s *testSession) markedOffsets() []int64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	offsets := []int64{}
+	for _, msg := range s.marked {
+		offsets = append(offsets, msg.Offset)
+	}
+	return offsets
+}
+
+type testClaim struct {
+	messages chan *sarama.ConsumerMessage
+}
+
+func newTestClaim(msgs ...*sarama.ConsumerMessage) *testClaim {
+	c := &testClaim{messages: make(chan *sarama.ConsumerMessage, len(msgs))}
+	for _, m := range msgs {
+		c.messages <- m
+	}
+	close(c.messages)
+	return c
+}
+
+func (c *testClaim) Topic() string                            { return "source" }
+func (c *testClaim) Partition() int32                         { return 0 }
+func (c *testClaim) InitialOffset() int64                     { return 0 }
+func (c *testClaim) HighWaterMarkOffset() int64               { return 0 }
+func (c *testClaim) Messages() <-chan *sarama.ConsumerMessage { return c.messages }
+
+type testProducer struct {
+	input chan *sarama.ProducerMessage
+}
+
+func newTestProducer() *testProducer {
+	return &testProducer{input: make(chan *sarama.ProducerMessage, 100)}
+}
+
+func (p *testProducer) AsyncClose()                               {}
+func (p *testProducer) Close() error                              { return nil }
+func (p *testProducer) Input() chan<- *sarama.ProducerMessage     { return p.input }
+func (p *testProducer) Successes() <-chan *sarama.ProducerMessage { return nil }
+func (p *testProducer) Errors() <-chan *sarama.ProducerError      { return nil }
+
+// produced returns all messages enqueued so far
+func (p *testProducer) produced() []*sarama.ProducerMessage {
+	var res []*sarama.ProducerMessage
+	for {
+		select {
+		case m := <-p.input:
+			res = append(res, m)
+		default:
+			return res
+		}
+	}
+}
+
+// newTestConsumer creates a consumer mirroring everything to the topic
+// "destination" with 8 partitions
+func newTestConsumer(partitioner string, producer sarama.AsyncProducer) *Consumer {
+	router, _ := NewTopicRouter(nil, "", "", "destination")
+	return &Consumer{
+		ready:       newReadySignal(),
+		producer:    producer,
+		partitions:  newPartitionCache(func(string) ([]int32, error) { return []int32{0, 1, 2, 3, 4, 5, 6, 7}, nil }, 0),
+		router:      router,
+		partitioner: partitioner,
+		metrics:     metrics.NewRegistry(),
+	}
+}
+
+func TestConsumeClaimSkipsInvalidMessages(t *testing.T) {
+	msgs := []*sarama.ConsumerMessage{
+		{Topic: "source", Partition: 0, Offset: 0, Key: []byte("a"), Value: []byte("Terrible Test")},
+		{Topic: "source", Partition: 0, Offset: 1, Value: []byte("no key")},
+		{Topic: "source", Partition: 0, Offset: 2, Key: []byte("b")},
+		{Topic: "source", Partition: 0, Offset: 3, Key: []byte("c"), Value: []byte("Terrible Test")},
+	}
+	producer := newTestProducer()
+	consumer := newTestConsumer("hash", producer)
+	session := &testSession{}
+	err := consumer.ConsumeClaim(session, newTestClaim(msgs...))
+	assert.NoError(t, err, "Unexpected error %v", err)
+	produced := producer.produced()
+	if assert.Len(t, produced, 2, "valid messages were not forwarded") {
+		assert.Equal(t, sarama.ByteEncoder("a"), produced[0].Key)
+		assert.Equal(t, sarama.ByteEncoder("c"), produced[1].Key)
+	}
+	assert.Len(t, session.marked, 4, "skipped messages were not marked")
+	assert.Equal(t, int64(2), metrics.GetOrRegisterMeter(`messages.skipped`, consumer.metrics).Count())
+	assert.Equal(t, int64(2), metrics.GetOrRegisterMeter(`messages.processed`, consumer.metrics).Count())
+	assert.Equal(t, int64(28), metrics.GetOrRegisterMeter(`bytes.processed`, consumer.metrics).Count())
+}
+
+func TestConsumeClaimFailOnError(t *testing.T) {
+	msgs := []*sarama.ConsumerMessage{
+		{Topic: "source", Partition: 0, Offset: 0, Key: []byte("a"), Value: []byte("Terrible Test")},
+		{Topic: "source", Partition: 0, Offset: 1, Value: []byte("no key")},
+		{Topic: "source", Partition: 0, Offset: 2, Key: []byte("c"), Value: []byte("Terrible Test")},
+	}
+	producer := newTestProducer()
+	consumer := newTestConsumer("hash", producer)
+	consumer.failOnError = true
+	session := &testSession{}
+	err := consumer.ConsumeClaim(session, newTestClaim(msgs...))
+	assert.Error(t, err, "No error occured on an invalid message")
+	assert.Len(t, producer.produced(), 1, "messages after the invalid one were forwarded")
+	assert.Len(t, session.marked, 1, "the invalid message was marked")
+}
+
+func TestConsumeClaimDeadLetter(t *testing.T) {
+	msgs := []*sarama.ConsumerMessage{
+		{Topic: "source", Partition: 0, Offset: 0, Value: []byte("no key")},
+		{Topic: "source", Partition: 0, Offset: 1, Key: []byte("c"), Value: []byte("Terrible Test")},
+	}
+	producer := newTestProducer()
+	consumer := newTestConsumer("hash", producer)
+	consumer.deadLetterTopic = "dlt"
+	consumer.failOnError = true
+	session := &testSession{}
+	err := consumer.ConsumeClaim(session, newTestClaim(msgs...))
+	assert.NoError(t, err, "Unexpected error %v", err)
+	produced := producer.produced()
+	if assert.Len(t, produced, 2) {
+		assert.Equal(t, "dlt", produced[0].Topic, "invalid message was not sent to the dead letter topic")
+		assert.Equal(t, "destination", produced[1].Topic)
+	}
+	assert.Len(t, session.marked, 2)
+}
+
+func TestConsumeClaimDryRun(t *testing.T) {
+	msgs := []*sarama.ConsumerMessage{
+		{Topic: "source", Partition: 0, Offset: 0, Value: []byte("no key")},
+		{Topic: "source", Partition: 0, Offset: 1, Key: []byte("c"), Value: []byte("Terrible Test")},
+	}
+	producer := newTestProducer()
+	consumer := newTestConsumer("hash", producer)
+	consumer.deadLetterTopic = "dlt"
+	consumer.dryRun = true
+	session := &testSession{}
+	err := consumer.ConsumeClaim(session, newTestClaim(msgs...))
+	assert.NoError(t, err, "Unexpected error %v", err)
+	assert.Empty(t, producer.produced(), "messages were produced in dry run mode")
+	assert.Equal(t, int64(1), metrics.GetOrRegisterMeter(`messages.processed`, consumer.metrics).Count())
+	assert.Equal(t, int64(1), metrics.GetOrRegisterMeter(`deadletter.produced`, consumer.metrics).Count())
+}
+
+func TestConsumeClaimFanOut(t *testing.T) {
+	producer := newTestProducer()
+	consumer := newTestConsumer("hash", producer)
+	consumer.router, _ = NewTopicRouter(map[string][]string{"source": {"destination", "missing", "audit"}}, "", "", "")
+	consumer.partitions = newPartitionCache(func(topic string) ([]int32, error) {
+		if topic == "missing" {
+			return nil, sarama.ErrUnknownTopicOrPartition
+		}
+		return []int32{0, 1}, nil
+	}, 0)
+	session := &testSession{}
+	err := consumer.ConsumeClaim(session, newTestClaim(&sarama.ConsumerMessage{Topic: "source", Key: []byte("a"), Value: []byte("Terrible Test")}))
+	assert.NoError(t, err, "Unexpected error %v", err)
+	produced := producer.produced()
+	if assert.Len(t, produced, 2, "a failing destination stopped the others") {
+		assert.Equal(t, "destination", produced[0].Topic)
+		assert.Equal(t, "audit", produced[1].Topic)
+	}
+	assert.Len(t, session.marked, 1)
+	assert.Equal(t, int64(1), metrics.GetOrRegisterMeter(`messages.skipped`, consumer.metrics).Count())
+	assert.Nil(t, consumer.metrics.Get(`destination.audit.processed`), "per topic metrics are opt-in")
+}
+
+func TestConsumeClaimRedact(t *testing.T) {
+	msgs := []*sarama.ConsumerMessage{
+		{Topic: "source", Partition: 0, Offset: 0, Key: []byte("a"), Value: []byte(`{"email": "a@example.com", "id": 1}`)},
+		{Topic: "source", Partition: 0, Offset: 1, Key: []byte("b"), Value: []byte("not json")},
+	}
+	producer := newTestProducer()
+	consumer := newTestConsumer("hash", producer)
+	consumer.redactor = newJSONRedactor([]string{"email"})
+	session := &testSession{}
+	err := consumer.ConsumeClaim(session, newTestClaim(msgs...))
+	assert.NoError(t, err, "Unexpected error %v", err)
+	produced := producer.produced()
+	if assert.Len(t, produced, 2, "non JSON message was dropped") {
+		assert.Equal(t, sarama.ByteEncoder(`{"id":1}`), produced[0].Value)
+		assert.Equal(t, sarama.ByteEncoder("not json"), produced[1].Value)
+	}
+	assert.Equal(t, `{"email": "a@example.com", "id": 1}`, string(msgs[0].Value), "source message was modified")
+	assert.Equal(t, int64(1), metrics.GetOrRegisterMeter(`transform.parse_errors`, consumer.metrics).Count())
+}
+
+func TestConsumeClaimMaxMessageBytes(t *testing.T) {
+	msgs := []*sarama.ConsumerMessage{
+		{Topic: "source", Partition: 0, Offset: 0, Key: []byte("a"), Value: make([]byte, 100)},
+		{Topic: "source", Partition: 0, Offset: 1, Key: []byte("b"), Value: make([]byte, 10)},
+	}
+	producer := newTestProducer()
+	consumer := newTestConsumer("hash", producer)
+	consumer.deadLetterTopic = "dlt"
+	consumer.maxMessageBytes = 64
+	session := &testSession{}
+	err := consumer.ConsumeClaim(session, newTestClaim(msgs...))
+	assert.NoError(t, err, "Unexpected error %v", err)
+	produced := producer.produced()
+	if assert.Len(t, produced, 2) {
+		assert.Equal(t, "dlt", produced[0].Topic, "too large message was not sent to the dead letter topic")
+		assert.Equal(t, "destination", produced[1].Topic)
+	}
+	assert.Len(t, session.marked, 2)
+}
+
+func TestConsumeClaimRoundRobin(t *testing.T) {
+	var msgs []*sarama.ConsumerMessage
+	for i := 0; i < 800; i++ {
+		msgs = append(msgs, &sarama.ConsumerMessage{Topic: "source", Partition: int32(i % 3), Offset: int64(i), Value: []byte("Terrible Test")})
+	}
+	producer := &testProducer{input: make(chan *sarama.ProducerMessage, len(msgs))}
+	consumer := newTestConsumer("roundrobin", producer)
+	consumer.msgOptions.RoundRobin = &roundRobin{}
+	// two claims share the counter of the consumer
+	assert.NoError(t, consumer.ConsumeClaim(&testSession{}, newTestClaim(msgs[:400]...)))
+	assert.NoError(t, consumer.ConsumeClaim(&testSession{}, newTestClaim(msgs[400:]...)))
+	counts := map[int32]int{}
+	for _, m := range producer.produced() {
+		counts[m.Partition]++
+	}
+	assert.Len(t, counts, 8)
+	for p, n := range counts {
+		assert.Equal(t, 100, n, "partition %d did not get its share", p)
+	}
+}
+
+func TestConsumeClaimTombstone(t *testing.T) {
+	msgs := []*sarama.ConsumerMessage{
+		{Topic: "source", Partition: 0, Offset: 0, Key: []byte("a"), Value: []byte(`{"id":1}`)},
+		{Topic: "source", Partition: 0, Offset: 1, Key: []byte("a")},
+	}
+	producer := newTestProducer()
+	consumer := newTestConsumer("hash", producer)
+	consumer.msgOptions.AllowTombstones = true
+	consumer.redactor = newJSONRedactor([]string{"email"})
+	session := &testSession{}
+	err := consumer.ConsumeClaim(session, newTestClaim(msgs...))
+	assert.NoError(t, err, "Unexpected error %v", err)
+	produced := producer.produced()
+	if assert.Len(t, produced, 2, "tombstone was not mirrored") {
+		assert.Equal(t, sarama.ByteEncoder("a"), produced[1].Key)
+		assert.Nil(t, produced[1].Value, "tombstone was mirrored with a value")
+	}
+	assert.Len(t, session.marked, 2)
+	assert.Equal(t, int64(0), metrics.GetOrRegisterMeter(`transform.parse_errors`, consumer.metrics).Count())
+}
+
+func TestConsumeClaimNullKey(t *testing.T) {
+	msgs := []*sarama.ConsumerMessage{
+		{Topic: "source", Partition: 0, Offset: 0, Value: []byte("Terrible Test")},
+		{Topic: "source", Partition: 0, Offset: 1, Key: []byte{}, Value: []byte("Terrible Test")},
+	}
+	producer := newTestProducer()
+	consumer := newTestConsumer("keeppartition", producer)
+	consumer.msgOptions.KeyTransform, _ = newKeyTransform("prefix-", "", "")
+	err := consumer.ConsumeClaim(&testSession{}, newTestClaim(msgs...))
+	assert.NoError(t, err, "Unexpected error %v", err)
+	produced := producer.produced()
+	if assert.Len(t, produced, 2) {
+		assert.Nil(t, produced[0].Key, "null key was not kept")
+		assert.Equal(t, sarama.ByteEncoder("prefix-"), produced[1].Key)
+	}
+}
+
+func TestSetupRebalances(t *testing.T) {
+	consumer := newTestConsumer("hash", newTestProducer())
+	session := &testSession{claims: map[string][]int32{"source": {0, 1}}}
+	for i := 0; i < 3; i++ {
+		assert.NoError(t, consumer.Setup(session))
+		assert.NoError(t, consumer.Cleanup(session))
+	}
+	assert.Equal(t, int64(3), metrics.GetOrRegisterCounter(`consumer.rebalances`, consumer.metrics).Count())
+}
+
+func TestSetupSignalsReadyOnce(t *testing.T) {
+	consumer := newTestConsumer("hash", newTestProducer())
+	session := &testSession{claims: map[string][]int32{"source": {0}}}
+	select {
+	case <-consumer.ready.done():
+		t.Fatal("ready before the first session")
+	default:
+	}
+	// a rebalance racing the startup runs Setup again without Cleanup
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			assert.NotPanics(t, func() { consumer.Setup(session) })
+		}()
+	}
+	wg.Wait()
+	<-consumer.ready.done()
+	assert.NotPanics(t, func() { consumer.Setup(session) })
+}
+
+func TestConsumeClaimTopicPartitioner(t *testing.T) {
+	msgs := []*sarama.ConsumerMessage{
+		{Topic: "source", Partition: 6, Offset: 0, Key: []byte("foobar"), Value: []byte("Terrible Test")},
+		{Topic: "Logs", Partition: 6, Offset: 0, Key: []byte("foobar"), Value: []byte("Terrible Test")},
+	}
+	producer := newTestProducer()
+	consumer := newTestConsumer("murmur2", producer)
+	consumer.topicPartitioners = map[string]string{"logs": "keeppartition"}
+	err := consumer.ConsumeClaim(&testSession{}, newTestClaim(msgs...))
+	assert.NoError(t, err, "Unexpected error %v", err)
+	produced := producer.produced()
+	if assert.Len(t, produced, 2) {
+		assert.Equal(t, murmur2Partition([]byte("foobar"), 8), produced[0].Partition, "the global partitioner was not used")
+		assert.Equal(t, int32(6), produced[1].Partition, "the topic partitioner was not used")
+	}
+}
+
+func TestSendRecordsBlocking(t *testing.T) {
+	producer := &testProducer{input: make(chan *sarama.ProducerMessage, 1)}
+	consumer := newTestConsumer("hash", producer)
+	consumer.enqueueBlockThreshold = 10 * time.Millisecond
+	consumer.send(&sarama.ProducerMessage{Topic: "destination"})
+	timer := metrics.GetOrRegisterTimer(`producer.enqueue_block`, consumer.metrics)
+	assert.Equal(t, int64(0), timer.Count(), "a send with room in the buffer was recorded as blocked")
+
+	go func() {
+		time.Sleep(20 * time.Millisecond)
+		<-producer.input
+	}()
+	consumer.send(&sarama.ProducerMessage{Topic: "destination"})
+	assert.Equal(t, int64(1), timer.Count())
+	assert.True(t, timer.Max() >= int64(10*time.Millisecond), "blocked for %s", time.Duration(timer.Max()))
+	assert.Equal(t, int64(1), metrics.GetOrRegisterCounter(`producer.enqueue_block.exceeded`, consumer.metrics).Count())
+}
+
+func TestConsumeClaimWorkersKeepOrder(t *testing.T) {
+	var msgs []*sarama.ConsumerMessage
+	for i := 0; i < 300; i++ {
+		// values of different size take the workers different times
+		value := fmt.Sprintf(`{"partition":%d,"offset":%d,"password":"%s"}`, i%3, i, strings.Repeat("x", (i*37)%500))
+		msgs = append(msgs, &sarama.ConsumerMessage{Topic: "source", Partition: int32(i % 3), Offset: int64(i), Key: []byte(fmt.Sprint(i)), Value: []byte(value)})
+	}
+	producer := &testProducer{input: make(chan *sarama.ProducerMessage, len(msgs))}
+	consumer := newTestConsumer("hash", producer)
+	consumer.redactor = newJSONRedactor([]string{"password"})
+	consumer.workers = 8
+	session := &testSession{}
+	assert.NoError(t, consumer.ConsumeClaim(session, newTestClaim(msgs...)))
+
+	produced := producer.produced()
+	if assert.Len(t, produced, len(msgs)) {
+		last := map[int]int{}
+		for i, m := range produced {
+			value, _ := m.Value.Encode()
+			var v struct{ Partition, Offset int }
+			assert.NoError(t, json.Unmarshal(value, &v))
+			assert.NotContains(t, string(value), "password")
+			assert.Equal(t, i, v.Offset, "messages are produced in the consumed order")
+			if prev, ok := last[v.Partition]; ok {
+				assert.True(t, v.Offset > prev, "partition %d is out of order", v.Partition)
+			}
+			last[v.Partition] = v.Offset
+		}
+	}
+	marked := session.markedOffsets()
+	for i := range marked {
+		assert.Equal(t, int64(i), marked[i])
+	}
+	assert.Len(t, marked, len(msgs))
+}
+
+func TestConsumeClaimWorkersSkipInvalidMessages(t *testing.T) {
+	msgs := []*sarama.ConsumerMessage{
+		{Topic: "source", Partition: 0, Offset: 0, Key: []byte("a"), Value: []byte("Terrible Test")},
+		{Topic: "source", Partition: 0, Offset: 1, Value: []byte("no key")},
+		{Topic: "source", Partition: 0, Offset: 2, Key: []byte("b"), Value: []byte("Terrible Test")},
+	}
+	producer := newTestProducer()
+	consumer := newTestConsumer("hash", producer)
+	consumer.workers = 2
+	session := &testSession{}
+	assert.NoError(t, consumer.ConsumeClaim(session, newTestClaim(msgs...)))
+	produced := producer.produced()
+	if assert.Len(t, produced, 2) {
+		assert.Equal(t, sarama.ByteEncoder("a"), produced[0].Key)
+		assert.Equal(t, sarama.ByteEncoder("b"), produced[1].Key)
+	}
+	assert.Equal(t, []int64{0, 1, 2}, session.markedOffsets())
+	assert.Equal(t, int64(1), metrics.GetOrRegisterMeter(`messages.skipped`, consumer.metrics).Count())
+}
+
+func TestConsumeClaimWorkersSessionEnd(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	claim := &testClaim{messages: make(chan *sarama.ConsumerMessage)}
+	consumer := newTestConsumer("hash", newTestProducer())
+	consumer.workers = 4
+	// the claim is still open, the ended session stops ConsumeClaim
+	assert.NoError(t, consumer.ConsumeClaim(&testSession{ctx: ctx}, claim))
+	close(claim.messages)
+}
+
+func TestConsumeClaimSampling(t *testing.T) {
+	msgs := []*sarama.ConsumerMessage{
+		{Topic: "source", Partition: 0, Offset: 0, Key: []byte("a"), Value: []byte("Terrible Test")},
+		{Topic: "source", Partition: 0, Offset: 1, Key: []byte("e"), Value: []byte("Terrible Test")},
+	}
+	producer := newTestProducer()
+	consumer := newTestConsumer("hash", producer)
+	consumer.sampler = &sampler{rate: 0.5, random: func() float64 { return 0 }}
+	// murmur2 puts a below and e above the rate
+	assert.True(t, consumer.sampler.keep(msgs[0]))
+	assert.False(t, consumer.sampler.keep(msgs[1]))
+	session := &testSession{}
+	assert.NoError(t, consumer.ConsumeClaim(session, newTestClaim(msgs...)))
+	if produced := producer.produced(); assert.Len(t, produced, 1) {
+		assert.Equal(t, sarama.ByteEncoder("a"), produced[0].Key)
+	}
+	assert.Equal(t, []int64{0, 1}, session.markedOffsets(), "sampled out messages were not marked")
+	assert.Equal(t, int64(1), metrics.GetOrRegisterMeter(`messages.sampled_out`, consumer.metrics).Count())
+}
+
+func TestConsumeClaimKeySuffix(t *testing.T) {
+	msgs := []*sarama.ConsumerMessage{
+		{Topic: "source", Partition: 0, Offset: 0, Key: []byte("foobar"), Value: []byte("Terrible Test")},
+		{Topic: "source", Partition: 0, Offset: 1, Value: []byte("no key")},
+	}
+	producer := newTestProducer()
+	consumer := newTestConsumer("hash", producer)
+	var looked []string
+	consumer.partitions = newPartitionCache(func(topic string) ([]int32, error) {
+		looked = append(looked, topic)
+		return []int32{0, 1}, nil
+	}, 0)
+	consumer.router.keySuffixBuckets = 8
+	assert.NoError(t, consumer.ConsumeClaim(&testSession{}, newTestClaim(msgs...)))
+	if produced := producer.produced(); assert.Len(t, produced, 1) {
+		assert.Equal(t, "destination-6", produced[0].Topic)
+	}
+	assert.Equal(t, []string{"destination-6"}, looked, "the partitions of the sharded topic were not looked up")
+	assert.Equal(t, int64(1), metrics.GetOrRegisterMeter(`messages.skipped`, consumer.metrics).Count())
+}
+
+func TestConsumeClaimEnvelope(t *testing.T) {
+	msgs := []*sarama.ConsumerMessage{
+		{Topic: "source", Partition: 2, Offset: 7, Key: []byte("a"), Value: []byte(`{"id":1,"email":"a@example.com"}`)},
+	}
+	producer := newTestProducer()
+	consumer := newTestConsumer("hash", producer)
+	consumer.redactor = newJSONRedactor([]string{"email"})
+	consumer.envelope = true
+	assert.NoError(t, consumer.ConsumeClaim(&testSession{}, newTestClaim(msgs...)))
+	if produced := producer.produced(); assert.Len(t, produced, 1) {
+		assert.Equal(t, sarama.ByteEncoder("a"), produced[0].Key)
+		value, _ := produced[0].Value.Encode()
+		var e envelope
+		assert.NoError(t, json.Unmarshal(value, &e))
+		assert.Equal(t, envelope{SourceTopic: "source", SourcePartition: 2, SourceOffset: 7, Key: []byte("a"), Value: []byte(`{"id":1}`)}, e, "the redacted value is wrapped")
+	}
+}
+
+func TestConsumeClaimPerTopicMetrics(t *testing.T) {
+	msgs := []*sarama.ConsumerMessage{
+		{Topic: "orders.eu", Partition: 0, Offset: 0, Key: []byte("a"), Value: []byte("Terrible Test")},
+		{Topic: "orders.eu", Partition: 0, Offset: 1, Key: []byte("b"), Value: []byte("Terrible Test")},
+		{Topic: "users", Partition: 0, Offset: 0, Key: []byte("c"), Value: []byte("Terrible Test")},
+	}
+	consumer := newTestConsumer("hash", newTestProducer())
+	consumer.router, _ = NewTopicRouter(nil, "", "", "mirror.all")
+	assert.NoError(t, consumer.ConsumeClaim(&testSession{}, newTestClaim(msgs...)))
+	assert.Nil(t, consumer.metrics.Get(`messages.processed.users`), "per topic metrics are opt-in")
+	assert.Nil(t, consumer.metrics.Get(`destination.mirror_all.processed`), "per topic metrics are opt-in")
+
+	consumer.perTopicMetrics = true
+	assert.NoError(t, consumer.ConsumeClaim(&testSession{}, newTestClaim(msgs...)))
+	assert.Equal(t, int64(2), metrics.GetOrRegisterMeter(`messages.processed.orders_eu`, consumer.metrics).Count())
+	assert.Equal(t, int64(1), metrics.GetOrRegisterMeter(`messages.processed.users`, consumer.metrics).Count())
+	assert.Equal(t, int64(28), metrics.GetOrRegisterMeter(`bytes.processed.orders_eu`, consumer.metrics).Count())
+	assert.Equal(t, int64(3), metrics.GetOrRegisterMeter(`destination.mirror_all.processed`, consumer.metrics).Count())
+	assert.Equal(t, int64(6), metrics.GetOrRegisterMeter(`messages.processed`, consumer.metrics).Count(), "the aggregate is still counted")
+}
+
+func TestConsumeClaimE2ELatency(t *testing.T) {
+	now := time.Now()
+	msgs := []*sarama.ConsumerMessage{
+		{Topic: "source", Partition: 0, Offset: 0, Key: []byte("a"), Value: []byte("Terrible Test"), Timestamp: now.Add(-time.Minute)},
+		// no timestamp and a clock ahead of ours are skipped
+		{Topic: "source", Partition: 0, Offset: 1, Key: []byte("b"), Value: []byte("Terrible Test")},
+		{Topic: "source", Partition: 0, Offset: 2, Key: []byte("c"), Value: []byte("Terrible Test"), Timestamp: now.Add(time.Hour)},
+	}
+	consumer := newTestConsumer("hash", newTestProducer())
+	assert.NoError(t, consumer.ConsumeClaim(&testSession{}, newTestClaim(msgs...)))
+	latency := metrics.GetOrRegisterTimer(`e2e.latency`, consumer.metrics)
+	assert.Equal(t, int64(1), latency.Count())
+	assert.True(t, latency.Min() >= int64(time.Minute), "latency %s is below the age of the message", time.Duration(latency.Min()))
+}
+
+func TestConsumeClaimMaxMessages(t *testing.T) {
+	var msgs []*sarama.ConsumerMessage
+	for i := 0; i < 10; i++ {
+		msgs = append(msgs, &sarama.ConsumerMessage{Topic: "source", Partition: 0, Offset: int64(i), Key: []byte("a"), Value: []byte("Terrible Test")})
+	}
+	for _, workers := range []int{1, 4} {
+		producer := newTestProducer()
+		consumer := newTestConsumer("hash", producer)
+		consumer.workers = workers
+		consumer.limit = newMessageLimit(6)
+		session := &testSession{}
+		assert.NoError(t, consumer.ConsumeClaim(session, newTestClaim(msgs[:4]...)))
+		// a second claim gets the rest of the limit
+		assert.NoError(t, consumer.ConsumeClaim(session, newTestClaim(msgs[4:]...)))
+		assert.Len(t, producer.produced(), 6, "%d workers", workers)
+		assert.Equal(t, []int64{0, 1, 2, 3, 4, 5}, session.markedOffsets(), "messages after the limit were marked")
+		<-consumer.limit.done()
+	}
+}
+
+func TestConsumeClaimMaxMessagesFiltered(t *testing.T) {
+	var msgs []*sarama.ConsumerMessage
+	for i := 0; i < 10; i++ {
+		key := "a"
+		if i%2 == 1 {
+			key = "drop"
+		}
+		msgs = append(msgs, &sarama.ConsumerMessage{Topic: "source", Partition: 0, Offset: int64(i), Key: []byte(key), Value: []byte("Terrible Test")})
+	}
+	for _, workers := range []int{1, 4} {
+		producer := newTestProducer()
+		consumer := newTestConsumer("hash", producer)
+		consumer.workers = workers
+		consumer.filter = &messageFilter{keyDeny: map[string]bool{"drop": true}}
+		consumer.limit = newMessageLimit(3)
+		session := &testSession{}
+		assert.NoError(t, consumer.ConsumeClaim(session, newTestClaim(msgs...)))
+		assert.Len(t, producer.produced(), 3, "filtered messages were counted, %d workers", workers)
+		assert.Equal(t, int64(2), metrics.GetOrRegisterMeter(`messages.filtered`, consumer.metrics).Count(), "%d workers", workers)
+		assert.Equal(t, []int64{0, 1, 2, 3, 4}, session.markedOffsets(), "messages after the limit were marked, %d workers", workers)
+		<-consumer.limit.done()
+	}
+}
+
+func TestConsumeClaimMaxMessagesDeadLetter(t *testing.T) {
+	msgs := []*sarama.ConsumerMessage{
+		{Topic: "source", Partition: 0, Offset: 0, Value: []byte("no key")},
+		{Topic: "source", Partition: 0, Offset: 1, Key: []byte("c"), Value: []byte("Terrible Test")},
+		{Topic: "source", Partition: 0, Offset: 2, Key: []byte("d"), Value: []byte("Terrible Test")},
+	}
+	producer := newTestProducer()
+	consumer := newTestConsumer("hash", producer)
+	consumer.deadLetterTopic = "dlt"
+	consumer.limit = newMessageLimit(1)
+	session := &testSession{}
+	assert.NoError(t, consumer.ConsumeClaim(session, newTestClaim(msgs...)))
+	produced := producer.produced()
+	if assert.Len(t, produced, 2, "the dead lettered message was counted") {
+		assert.Equal(t, "dlt", produced[0].Topic)
+		assert.Equal(t, "destination", produced[1].Topic)
+	}
+	assert.Equal(t, []int64{0, 1}, session.markedOffsets())
+	<-consumer.limit.done()
+}
+
+func TestConsumeClaimHaltOnDecrease(t *testing.T) {
+	var msgs []*sarama.ConsumerMessage
+	for i := 0; i < 6; i++ {
+		msgs = append(msgs, &sarama.ConsumerMessage{Topic: "source", Partition: 1, Offset: int64(i), Key: []byte("a"), Value: []byte("Terrible Test")})
+	}
+	for _, workers := range []int{1, 4} {
+		producer := newTestProducer()
+		consumer := newTestConsumer("keeppartition", producer)
+		consumer.workers = workers
+		var calls int32
+		// the destination topic loses all but one partition after the third message
+		consumer.partitions = newPartitionCache(func(string) ([]int32, error) {
+			if atomic.AddInt32(&calls, 1) > 3 {
+				return []int32{0}, nil
+			}
+			return []int32{0, 1, 2, 3}, nil
+		}, time.Nanosecond)
+		consumer.partitions.haltOnDecrease = true
+		session := &testSession{}
+		assert.NoError(t, consumer.ConsumeClaim(session, newTestClaim(msgs...)))
+		<-consumer.partitions.done()
+		if workers == 1 {
+			assert.Equal(t, []int64{0, 1, 2}, session.markedOffsets(), "messages after the decrease were marked")
+		} else {
+			// the workers may notice the decrease ahead of the forwarded message
+			assert.True(t, len(session.markedOffsets()) <= 3, "messages after the decrease were marked")
+		}
+		assert.Len(t, producer.produced(), len(session.markedOffsets()), "%d workers", workers)
+	}
+}
+
+func TestConsumeClaimUntil(t *testing.T) {
+	until := time.Unix(1600000000, 0)
+	var msgs []*sarama.ConsumerMessage
+	for i := 0; i < 6; i++ {
+		msgs = append(msgs, &sarama.ConsumerMessage{Topic: "source", Partition: 0, Offset: int64(i), Key: []byte("a"), Value: []byte("Terrible Test"), Timestamp: until.Add(time.Duration(i-3) * time.Second)})
+	}
+	for _, workers := range []int{1, 4} {
+		producer := newTestProducer()
+		consumer := newTestConsumer("hash", producer)
+		consumer.workers = workers
+		consumer.until = newTimeLimit(until)
+		session := &testSession{}
+		assert.NoError(t, consumer.ConsumeClaim(session, newTestClaim(msgs...)))
+		assert.Len(t, producer.produced(), 4, "%d workers", workers)
+		assert.Equal(t, []int64{0, 1, 2, 3}, session.markedOffsets(), "messages after mirror.until were marked")
+		<-consumer.until.done()
+	}
+}
+
+// closingProducer closes its input like sarama's producer, sends after Close
+// panic
+type closingProducer struct {
+	*testProducer
+	closed chan struct{}
+}
+
+func (p *closingProducer) Close() error {
+	close(p.input)
+	close(p.closed)
+	return nil
+}
+
+func TestConsumeClaimAfterProducerClose(t *testing.T) {
+	producer := &closingProducer{testProducer: newTestProducer(), closed: make(chan struct{})}
+	consumer := newTestConsumer("hash", producer)
+	consumer.input = &producerInput{}
+	session := &testSession{}
+	claim := &testClaim{messages: make(chan *sarama.ConsumerMessage)}
+	done := make(chan error)
+	go func() {
+		done <- consumer.ConsumeClaim(session, claim)
+	}()
+	claim.messages <- &sarama.ConsumerMessage{Topic: "source", Partition: 0, Offset: 0, Key: []byte("a"), Value: []byte("Terrible Test")}
+	for len(session.markedOffsets()) == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	// the claim is still running when the shutdown closes the producer
+	assert.NoError(t, consumer.closeProducer())
+	<-producer.closed
+	claim.messages <- &sarama.ConsumerMessage{Topic: "source", Partition: 0, Offset: 1, Key: []byte("a"), Value: []byte("Terrible Test")}
+	select {
+	case err := <-done:
+		assert.NoError(t, err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("the claim did not end after the producer was closed")
+	}
+	assert.Equal(t, []int64{0}, session.markedOffsets(), "a message sent after the close was marked")
+}
+
+func TestConsumeClaimKeyPrefix(t *testing.T) {
+	msgs := []*sarama.ConsumerMessage{
+		{Topic: "source", Partition: 6, Offset: 0, Key: []byte("sys:reload"), Value: []byte("Terrible Test")},
+		{Topic: "source", Partition: 6, Offset: 1, Key: []byte("foobar"), Value: []byte("Terrible Test")},
+	}
+	producer := newTestProducer()
+	consumer := newTestConsumer("murmur2", producer)
+	consumer.keyPrefix, _ = newKeyPrefixRoute("sys:", "system", 3)
+	err := consumer.ConsumeClaim(&testSession{}, newTestClaim(msgs...))
+	assert.NoError(t, err, "Unexpected error %v", err)
+	produced := producer.produced()
+	if assert.Len(t, produced, 2) {
+		assert.Equal(t, "system", produced[0].Topic, "the prefixed key was not routed")
+		assert.Equal(t, int32(3), produced[0].Partition, "the prefixed key was not routed")
+		assert.Equal(t, "destination", produced[1].Topic)
+		assert.Equal(t, murmur2Partition([]byte("foobar"), 8), produced[1].Partition, "the partitioner was not used for other keys")
+	}
+}
@@ -0,0 +1,36 @@
+package main
+
+import (
+	"strconv"
+
+	"github.com/Shopify/sarama"
+)
+
+// headers added to messages on the dead letter topic
+const (
+	deadLetterErrorHeader     = "mirrormaker.error"
+	deadLetterTopicHeader     = "mirrormaker.source.topic"
+	deadLetterPartitionHeader = "mirrormaker.source.partition"
+	deadLetterOffsetHeader    = "mirrormaker.source.offset"
+)
+
+// deadLetterMsg wraps a message which could not be mirrored for the dead letter
+// topic. Key, value and headers are kept as they are, the reason and the origin
+// of the message are added as headers.
+func deadLetterMsg(topic string, origmsg *sarama.ConsumerMessage, cause error) *sarama.ProducerMessage {
+	msg := &sarama.ProducerMessage{
+		Topic:   topic,
+		Value:   sarama.ByteEncoder(origmsg.Value),
+		Headers: copyHeaders(origmsg.Headers),
+	}
+	if origmsg.Key != nil {
+		msg.Key = sarama.ByteEncoder(origmsg.Key)
+	}
+	msg.Headers = append(msg.Headers,
+		sarama.RecordHeader{Key: []byte(deadLetterErrorHeader), Value: []byte(cause.Error())},
+		sarama.RecordHeader{Key: []byte(deadLetterTopicHeader), Value: []byte(origmsg.Topic)},
+		sarama.RecordHeader{Key: []byte(deadLetterPartitionHeader), Value: []byte(strconv.FormatInt(int64(origmsg.Partition), 10))},
+		sarama.RecordHeader{Key: []byte(deadLetterOffsetHeader), Value: []byte(strconv.FormatInt(origmsg.Offset, 10))},
+	)
+	return msg
+}
@@ -0,0 +1,34 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/Shopify/sarama"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDeadLetterMsg(t *testing.T) {
+	msg := sarama.ConsumerMessage{
+		Topic:     "source",
+		Partition: 3,
+		Offset:    42,
+		Value:     []byte("Terrible Test"),
+		Headers:   []*sarama.RecordHeader{{Key: []byte("traceid"), Value: []byte("abc")}},
+	}
+	c := deadLetterMsg("dlt", &msg, fmt.Errorf("key is not set"))
+	assert.Equal(t, "dlt", c.Topic)
+	assert.Nil(t, c.Key, "Key was set on a keyless message")
+	assert.Equal(t, sarama.ByteEncoder(msg.Value), c.Value)
+	assert.Equal(t, []sarama.RecordHeader{
+		{Key: []byte("traceid"), Value: []byte("abc")},
+		{Key: []byte(deadLetterErrorHeader), Value: []byte("key is not set")},
+		{Key: []byte(deadLetterTopicHeader), Value: []byte("source")},
+		{Key: []byte(deadLetterPartitionHeader), Value: []byte("3")},
+		{Key: []byte(deadLetterOffsetHeader), Value: []byte("42")},
+	}, c.Headers)
+
+	msg.Key = []byte("Terrible Test")
+	c = deadLetterMsg("dlt", &msg, fmt.Errorf("key is not set"))
+	assert.Equal(t, sarama.ByteEncoder(msg.Key), c.Key, "Key was not kept")
+}
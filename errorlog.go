@@ -0,0 +1,88 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/Shopify/sarama"
+)
+
+// errorLog keeps the last errors in a ring buffer of fixed size for GET
+// /errors, for environments where the logs are hard to get at. All methods
+// are safe for concurrent use and may be called on a nil errorLog.
+type errorLog struct {
+	mu      sync.Mutex
+	entries []errorEntry
+	// next is the index the next error is written to
+	next int
+	full bool
+	now  func() time.Time
+}
+
+// errorEntry is an error in the body of GET /errors
+type errorEntry struct {
+	Time time.Time `json:"time"`
+	// Source is consumer, producer or mirror
+	Source string `json:"source"`
+	Error  string `json:"error"`
+	// Fields are the topic, partition and offset, if known
+	Fields Fields `json:"fields,omitempty"`
+}
+
+// newErrorLog returns an errorLog keeping the last size errors, nil if size
+// is not positive
+func newErrorLog(size int) *errorLog {
+	if size <= 0 {
+		return nil
+	}
+	return &errorLog{entries: make([]errorEntry, size), now: time.Now}
+}
+
+// add records the error, replacing the oldest one if the buffer is full
+func (l *errorLog) add(source string, err error, fields Fields) {
+	if l == nil {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.entries[l.next] = errorEntry{Time: l.now(), Source: source, Error: err.Error(), Fields: fields}
+	l.next = (l.next + 1) % len(l.entries)
+	if l.next == 0 {
+		l.full = true
+	}
+}
+
+// addConsumerError records an error of the consumer group, with the
+// partition if it is known
+func (l *errorLog) addConsumerError(err error) {
+	var fields Fields
+	if e, ok := err.(*sarama.ConsumerError); ok {
+		fields = Fields{"topic": e.Topic, "partition": e.Partition}
+	}
+	l.add("consumer", err, fields)
+}
+
+// addProducerError records a message which could not be produced
+func (l *errorLog) addProducerError(e *sarama.ProducerError) {
+	l.add("producer", e.Err, Fields{"topic": e.Msg.Topic, "partition": e.Msg.Partition})
+}
+
+// last returns the recorded errors, the oldest first
+func (l *errorLog) last() []errorEntry {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if !l.full {
+		return append([]errorEntry{}, l.entries[:l.next]...)
+	}
+	return append(append([]errorEntry{}, l.entries[l.next:]...), l.entries[:l.next]...)
+}
+
+// register adds the GET /errors endpoint to the mux
+func (l *errorLog) register(mux *http.ServeMux) {
+	mux.HandleFunc("/errors", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(l.last())
+	})
+}
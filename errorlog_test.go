@@ -0,0 +1,76 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Shopify/sarama"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestErrorLogRing(t *testing.T) {
+	l := newErrorLog(3)
+	assert.Empty(t, l.last())
+	for i := 0; i < 5; i++ {
+		l.add("mirror", fmt.Errorf("error %d", i), nil)
+	}
+	var msgs []string
+	for _, e := range l.last() {
+		msgs = append(msgs, e.Error)
+	}
+	assert.Equal(t, []string{"error 2", "error 3", "error 4"}, msgs, "the oldest errors are replaced")
+	assert.Len(t, l.entries, 3)
+
+	assert.Nil(t, newErrorLog(0))
+	var disabled *errorLog
+	disabled.add("mirror", errors.New("ignored"), nil)
+}
+
+func TestErrorLogConcurrent(t *testing.T) {
+	l := newErrorLog(10)
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				l.add("producer", errors.New("failed"), nil)
+				l.last()
+			}
+		}()
+	}
+	wg.Wait()
+	assert.Len(t, l.last(), 10)
+}
+
+func TestErrorLogEndpoint(t *testing.T) {
+	l := newErrorLog(10)
+	l.now = func() time.Time { return time.Date(2021, 6, 1, 12, 0, 0, 0, time.UTC) }
+	l.addConsumerError(&sarama.ConsumerError{Topic: "source", Partition: 3, Err: sarama.ErrOutOfBrokers})
+	l.addProducerError(&sarama.ProducerError{Msg: &sarama.ProducerMessage{Topic: "destination", Partition: 1}, Err: sarama.ErrNotEnoughReplicas})
+	mux := http.NewServeMux()
+	l.register(mux)
+	rec := httptest.NewRecorder()
+	mux.ServeHTTP(rec, httptest.NewRequest("GET", "/errors", nil))
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, "application/json", rec.Header().Get("Content-Type"))
+	var entries []struct {
+		Time   time.Time
+		Source string
+		Error  string
+		Fields map[string]interface{}
+	}
+	if assert.NoError(t, json.Unmarshal(rec.Body.Bytes(), &entries)) && assert.Len(t, entries, 2) {
+		assert.Equal(t, "consumer", entries[0].Source)
+		assert.Equal(t, map[string]interface{}{"topic": "source", "partition": float64(3)}, entries[0].Fields)
+		assert.Equal(t, "producer", entries[1].Source)
+		assert.Equal(t, sarama.ErrNotEnoughReplicas.Error(), entries[1].Error)
+		assert.Equal(t, l.now(), entries[1].Time)
+	}
+}
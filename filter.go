@@ -0,0 +1,116 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"regexp"
+
+	"github.com/Shopify/sarama"
+)
+
+// FilterOptions describes which messages are mirrored, the zero value
+// mirrors everything
+type FilterOptions struct {
+	// ValueRegex has to match the message value, matching is done on the raw bytes
+	ValueRegex string
+	// ValueNegate mirrors only messages not matching ValueRegex
+	ValueNegate bool
+	// HeaderName selects messages by a header, HeaderValue is only compared
+	// if HeaderMatchValue is set, otherwise the presence of the header is enough
+	HeaderName       string
+	HeaderValue      string
+	HeaderMatchValue bool
+	// HeaderForwardMissing mirrors messages which don't have the header at all
+	HeaderForwardMissing bool
+	// KeyAllow lists the keys which are mirrored, if empty all keys not
+	// listed in KeyDeny are mirrored
+	KeyAllow []string
+	// KeyDeny lists keys which are never mirrored, it takes precedence over
+	// KeyAllow
+	KeyDeny []string
+}
+
+// messageFilter decides which consumed messages are mirrored
+type messageFilter struct {
+	valueRegex  *regexp.Regexp
+	valueNegate bool
+	keyAllow    map[string]bool
+	keyDeny     map[string]bool
+
+	headerName           []byte
+	headerValue          []byte
+	headerMatchValue     bool
+	headerForwardMissing bool
+}
+
+// newMessageFilter compiles the filter options, it returns nil if no filter
+// is configured
+func newMessageFilter(opts FilterOptions) (*messageFilter, error) {
+	if opts.ValueRegex == "" && len(opts.KeyAllow) == 0 && len(opts.KeyDeny) == 0 && opts.HeaderName == "" {
+		return nil, nil
+	}
+	f := &messageFilter{
+		valueNegate:          opts.ValueNegate,
+		keyAllow:             stringSet(opts.KeyAllow),
+		keyDeny:              stringSet(opts.KeyDeny),
+		headerMatchValue:     opts.HeaderMatchValue,
+		headerForwardMissing: opts.HeaderForwardMissing,
+	}
+	if opts.HeaderName != "" {
+		f.headerName = []byte(opts.HeaderName)
+		f.headerValue = []byte(opts.HeaderValue)
+	}
+	if opts.ValueRegex != "" {
+		re, err := regexp.Compile(opts.ValueRegex)
+		if err != nil {
+			return nil, fmt.Errorf("invalid filter.value.regex: %s", err)
+		}
+		f.valueRegex = re
+	}
+	return f, nil
+}
+
+func stringSet(values []string) map[string]bool {
+	set := make(map[string]bool, len(values))
+	for _, v := range values {
+		set[v] = true
+	}
+	return set
+}
+
+// shouldForward reports whether the message passes the filter. A nil filter
+// forwards everything.
+func (f *messageFilter) shouldForward(msg *sarama.ConsumerMessage) bool {
+	if f == nil {
+		return true
+	}
+	if f.keyDeny[string(msg.Key)] {
+		return false
+	}
+	if len(f.keyAllow) > 0 && !f.keyAllow[string(msg.Key)] {
+		return false
+	}
+	if f.valueRegex != nil && f.valueRegex.Match(msg.Value) == f.valueNegate {
+		return false
+	}
+	return true
+}
+
+// matchHeader reports whether the message passes the header filter. A nil
+// filter or a filter without header forwards everything.
+func (f *messageFilter) matchHeader(msg *sarama.ConsumerMessage) bool {
+	if f == nil || f.headerName == nil {
+		return true
+	}
+	found := false
+	for _, h := range msg.Headers {
+		if h == nil || !bytes.Equal(h.Key, f.headerName) {
+			continue
+		}
+		if !f.headerMatchValue || bytes.Equal(h.Value, f.headerValue) {
+			return true
+		}
+		found = true
+	}
+	return !found && f.headerForwardMissing
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/Shopify/sarama"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMessageFilterValue(t *testing.T) {
+	f, err := newMessageFilter(FilterOptions{})
+	assert.NoError(t, err, "Unexpected error %v", err)
+	assert.True(t, f.shouldForward(&sarama.ConsumerMessage{Value: []byte("anything")}), "empty filter dropped a message")
+
+	f, err = newMessageFilter(FilterOptions{ValueRegex: `^\{"type":"order"`})
+	assert.NoError(t, err, "Unexpected error %v", err)
+	assert.True(t, f.shouldForward(&sarama.ConsumerMessage{Value: []byte(`{"type":"order","id":1}`)}), "matching message was dropped")
+	assert.False(t, f.shouldForward(&sarama.ConsumerMessage{Value: []byte(`{"type":"user","id":1}`)}), "non matching message was forwarded")
+	assert.False(t, f.shouldForward(&sarama.ConsumerMessage{}), "message without value was forwarded")
+
+	f, err = newMessageFilter(FilterOptions{ValueRegex: `^\{"type":"order"`, ValueNegate: true})
+	assert.NoError(t, err, "Unexpected error %v", err)
+	assert.False(t, f.shouldForward(&sarama.ConsumerMessage{Value: []byte(`{"type":"order","id":1}`)}), "negated match was forwarded")
+	assert.True(t, f.shouldForward(&sarama.ConsumerMessage{Value: []byte(`{"type":"user","id":1}`)}), "negated non match was dropped")
+
+	_, err = newMessageFilter(FilterOptions{ValueRegex: `(`})
+	assert.Error(t, err, "No error occured on an invalid regex")
+}
+
+func TestMessageFilterKey(t *testing.T) {
+	msg := func(key string) *sarama.ConsumerMessage {
+		return &sarama.ConsumerMessage{Key: []byte(key), Value: []byte("Terrible Test")}
+	}
+	f, err := newMessageFilter(FilterOptions{KeyDeny: []string{"tenant-2"}})
+	assert.NoError(t, err, "Unexpected error %v", err)
+	assert.False(t, f.shouldForward(msg("tenant-2")), "denied key was forwarded")
+	assert.True(t, f.shouldForward(msg("tenant-1")), "unlisted key was dropped without allow list")
+
+	f, err = newMessageFilter(FilterOptions{KeyAllow: []string{"tenant-1", "tenant-2"}})
+	assert.NoError(t, err, "Unexpected error %v", err)
+	assert.True(t, f.shouldForward(msg("tenant-1")), "allowed key was dropped")
+	assert.False(t, f.shouldForward(msg("tenant-3")), "unlisted key was forwarded with allow list")
+	assert.False(t, f.shouldForward(&sarama.ConsumerMessage{Value: []byte("Terrible Test")}), "keyless message was forwarded with allow list")
+
+	//deny takes precedence over allow
+	f, err = newMessageFilter(FilterOptions{KeyAllow: []string{"tenant-1", "tenant-2"}, KeyDeny: []string{"tenant-2"}})
+	assert.NoError(t, err, "Unexpected error %v", err)
+	assert.True(t, f.shouldForward(msg("tenant-1")), "allowed key was dropped")
+	assert.False(t, f.shouldForward(msg("tenant-2")), "key in allow and deny list was forwarded")
+}
+
+func TestMessageFilterHeader(t *testing.T) {
+	msg := func(headers ...string) *sarama.ConsumerMessage {
+		m := &sarama.ConsumerMessage{Value: []byte("Terrible Test")}
+		for i := 0; i < len(headers); i += 2 {
+			m.Headers = append(m.Headers, &sarama.RecordHeader{Key: []byte(headers[i]), Value: []byte(headers[i+1])})
+		}
+		return m
+	}
+	//presence only
+	f, err := newMessageFilter(FilterOptions{HeaderName: "region"})
+	assert.NoError(t, err, "Unexpected error %v", err)
+	assert.True(t, f.matchHeader(msg("region", "us")), "message with header was dropped")
+	assert.True(t, f.matchHeader(msg("region", "")), "message with empty header was dropped")
+	assert.False(t, f.matchHeader(msg("tenant", "1")), "message without header was forwarded")
+	assert.False(t, f.matchHeader(msg()), "message without headers was forwarded")
+
+	//exact value
+	f, err = newMessageFilter(FilterOptions{HeaderName: "region", HeaderValue: "eu", HeaderMatchValue: true})
+	assert.NoError(t, err, "Unexpected error %v", err)
+	assert.True(t, f.matchHeader(msg("tenant", "1", "region", "eu")), "matching message was dropped")
+	assert.True(t, f.matchHeader(msg("region", "us", "region", "eu")), "message with a matching duplicate header was dropped")
+	assert.False(t, f.matchHeader(msg("region", "us")), "message with another value was forwarded")
+	assert.False(t, f.matchHeader(msg()), "message without headers was forwarded")
+
+	//forward messages without the header
+	f, err = newMessageFilter(FilterOptions{HeaderName: "region", HeaderValue: "eu", HeaderMatchValue: true, HeaderForwardMissing: true})
+	assert.NoError(t, err, "Unexpected error %v", err)
+	assert.True(t, f.matchHeader(msg()), "message without headers was dropped")
+	assert.False(t, f.matchHeader(msg("region", "us")), "message with another value was forwarded")
+
+	f, err = newMessageFilter(FilterOptions{KeyDeny: []string{"a"}})
+	assert.NoError(t, err, "Unexpected error %v", err)
+	assert.True(t, f.matchHeader(msg()), "filter without header dropped a message")
+}
+
+func TestConsumeClaimFiltered(t *testing.T) {
+	msgs := []*sarama.ConsumerMessage{
+		{Topic: "source", Partition: 0, Offset: 0, Key: []byte("a"), Value: []byte("keep me")},
+		{Topic: "source", Partition: 0, Offset: 1, Key: []byte("b"), Value: []byte("drop me")},
+	}
+	producer := newTestProducer()
+	consumer := newTestConsumer("hash", producer)
+	consumer.filter, _ = newMessageFilter(FilterOptions{ValueRegex: "^keep"})
+	session := &testSession{}
+	err := consumer.ConsumeClaim(session, newTestClaim(msgs...))
+	assert.NoError(t, err, "Unexpected error %v", err)
+	assert.Len(t, producer.produced(), 1, "filtered message was forwarded")
+	assert.Len(t, session.marked, 2, "filtered message was not marked")
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"fmt"
+	"path"
+	"strings"
+
+	"github.com/rcrowley/go-metrics"
+	"github.com/spf13/viper"
+)
+
+// defaultGraphitePercentiles are the percentiles graphite.Graphite reports
+// for timers and histograms
+var defaultGraphitePercentiles = []float64{0.5, 0.75, 0.95, 0.99, 0.999}
+
+// graphitePercentilesFromConfig returns metrics.graphite.percentiles, all of
+// them between 0 and 1
+func graphitePercentilesFromConfig() ([]float64, error) {
+	var percentiles []float64
+	switch value := viper.Get("metrics.graphite.percentiles").(type) {
+	case []float64:
+		percentiles = value
+	case []interface{}:
+		for _, v := range value {
+			switch p := v.(type) {
+			case float64:
+				percentiles = append(percentiles, p)
+			case int64:
+				percentiles = append(percentiles, float64(p))
+			default:
+				return nil, fmt.Errorf("invalid metrics.graphite.percentiles, %v is no number", v)
+			}
+		}
+	default:
+		return nil, fmt.Errorf("invalid metrics.graphite.percentiles, must be a list of numbers")
+	}
+	for _, p := range percentiles {
+		if p < 0 || p > 1 {
+			return nil, fmt.Errorf("invalid metrics.graphite.percentiles, %v is not between 0 and 1", p)
+		}
+	}
+	return percentiles, nil
+}
+
+// graphiteAllowFromConfig returns the patterns of metrics.graphite.allow
+func graphiteAllowFromConfig() ([]string, error) {
+	patterns := viper.GetStringSlice("metrics.graphite.allow")
+	for _, pattern := range patterns {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return nil, fmt.Errorf("invalid pattern %q in metrics.graphite.allow: %s", pattern, err)
+		}
+	}
+	return patterns, nil
+}
+
+// allowedMetrics returns a registry with the metrics of r whose name without
+// prefix matches one of the patterns (path.Match syntax, e.g. messages.*).
+// Without patterns r is returned as it is.
+func allowedMetrics(r metrics.Registry, prefix string, patterns []string) metrics.Registry {
+	if len(patterns) == 0 {
+		return r
+	}
+	allowed := metrics.NewRegistry()
+	r.Each(func(name string, metric interface{}) {
+		for _, pattern := range patterns {
+			if ok, _ := path.Match(pattern, strings.TrimPrefix(name, prefix)); ok {
+				// the names are unique in r
+				_ = allowed.Register(name, metric)
+				return
+			}
+		}
+	})
+	return allowed
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/rcrowley/go-metrics"
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestGraphitePercentilesFromConfig(t *testing.T) {
+	defer viper.Reset()
+	viper.Reset()
+	setDefaults()
+	percentiles, err := graphitePercentilesFromConfig()
+	assert.NoError(t, err)
+	assert.Equal(t, defaultGraphitePercentiles, percentiles)
+
+	viper.SetConfigType("toml")
+	assert.NoError(t, viper.ReadConfig(bytes.NewBufferString("[metrics]\ngraphite.percentiles = [0.5, 0.99]\n")))
+	percentiles, err = graphitePercentilesFromConfig()
+	assert.NoError(t, err)
+	assert.Equal(t, []float64{0.5, 0.99}, percentiles)
+
+	assert.NoError(t, viper.ReadConfig(bytes.NewBufferString("[metrics]\ngraphite.percentiles = [1]\n")))
+	percentiles, err = graphitePercentilesFromConfig()
+	assert.NoError(t, err)
+	assert.Equal(t, []float64{1}, percentiles)
+
+	assert.NoError(t, viper.ReadConfig(bytes.NewBufferString("[metrics]\ngraphite.percentiles = [95.0]\n")))
+	_, err = graphitePercentilesFromConfig()
+	assert.Error(t, err, "No error occured on a percentile above 1")
+
+	assert.NoError(t, viper.ReadConfig(bytes.NewBufferString("[metrics]\ngraphite.percentiles = [\"p95\"]\n")))
+	_, err = graphitePercentilesFromConfig()
+	assert.Error(t, err, "No error occured on a string percentile")
+}
+
+func TestGraphiteAllowFromConfig(t *testing.T) {
+	defer viper.Reset()
+	viper.Reset()
+	setDefaults()
+	allow, err := graphiteAllowFromConfig()
+	assert.NoError(t, err)
+	assert.Empty(t, allow)
+
+	viper.Set("metrics.graphite.allow", []string{"messages.*"})
+	allow, err = graphiteAllowFromConfig()
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"messages.*"}, allow)
+
+	viper.Set("metrics.graphite.allow", []string{"messages.[a"})
+	_, err = graphiteAllowFromConfig()
+	assert.Error(t, err, "No error occured on an invalid pattern")
+}
+
+func TestAllowedMetrics(t *testing.T) {
+	r := metrics.NewPrefixedRegistry("group.")
+	metrics.GetOrRegisterMeter(`messages.processed`, r)
+	metrics.GetOrRegisterMeter(`messages.skipped`, r)
+	metrics.GetOrRegisterTimer(`producer.produce_latency`, r)
+	metrics.GetOrRegisterCounter(`producer.inflight`, r)
+
+	assert.Equal(t, r, allowedMetrics(r, "group.", nil), "all metrics are reported without patterns")
+
+	allowed := allowedMetrics(r, "group.", []string{"messages.*", "producer.produce_latency"})
+	var names []string
+	allowed.Each(func(name string, metric interface{}) {
+		names = append(names, name)
+	})
+	assert.ElementsMatch(t, []string{"group.messages.processed", "group.messages.skipped", "group.producer.produce_latency"}, names)
+	assert.Equal(t, r.Get("messages.processed"), allowed.Get("group.messages.processed"), "the metric was copied instead of shared")
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+// health tracks the state reported by the /healthz and /readyz endpoints.
+// All methods are safe for concurrent use and may be called on a nil health.
+type health struct {
+	// joined is 1 while the consumer is part of a consumer group session
+	joined int32
+	// lastProducerError is the unix nano timestamp of the last producer error
+	lastProducerError int64
+	// maxErrorAge is how long a producer error keeps the instance unready
+	maxErrorAge time.Duration
+}
+
+func (h *health) setJoined(joined bool) {
+	if h == nil {
+		return
+	}
+	var v int32
+	if joined {
+		v = 1
+	}
+	atomic.StoreInt32(&h.joined, v)
+}
+
+func (h *health) producerError(t time.Time) {
+	if h == nil {
+		return
+	}
+	atomic.StoreInt64(&h.lastProducerError, t.UnixNano())
+}
+
+// ready returns nil if the consumer has joined its group and there was no
+// recent producer error
+func (h *health) ready(now time.Time) error {
+	if atomic.LoadInt32(&h.joined) == 0 {
+		return fmt.Errorf("consumer has not joined the consumer group")
+	}
+	last := atomic.LoadInt64(&h.lastProducerError)
+	if last != 0 && now.Sub(time.Unix(0, last)) < h.maxErrorAge {
+		return fmt.Errorf("last producer error at %s", time.Unix(0, last).UTC().Format(time.RFC3339))
+	}
+	return nil
+}
+
+// register adds the health endpoints to the mux
+func (h *health) register(mux *http.ServeMux) {
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintln(w, "ok")
+	})
+	mux.HandleFunc("/readyz", func(w http.ResponseWriter, r *http.Request) {
+		if err := h.ready(time.Now()); err != nil {
+			http.Error(w, err.Error(), http.StatusServiceUnavailable)
+			return
+		}
+		fmt.Fprintln(w, "ok")
+	})
+}
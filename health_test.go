@@ -0,0 +1,38 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHealthReady(t *testing.T) {
+	h := &health{maxErrorAge: 30 * time.Second}
+	now := time.Now()
+	assert.Error(t, h.ready(now), "ready before the consumer joined")
+	h.setJoined(true)
+	assert.NoError(t, h.ready(now), "not ready after the consumer joined")
+	h.producerError(now.Add(-10 * time.Second))
+	assert.Error(t, h.ready(now), "ready with a recent producer error")
+	assert.NoError(t, h.ready(now.Add(time.Minute)), "not ready although the producer error is old")
+	h.setJoined(false)
+	assert.Error(t, h.ready(now.Add(time.Minute)), "ready while the consumer is rejoining")
+}
+
+func TestHealthEndpoints(t *testing.T) {
+	h := &health{maxErrorAge: 30 * time.Second}
+	mux := http.NewServeMux()
+	h.register(mux)
+	for path, code := range map[string]int{"/healthz": http.StatusOK, "/readyz": http.StatusServiceUnavailable} {
+		rec := httptest.NewRecorder()
+		mux.ServeHTTP(rec, httptest.NewRequest("GET", path, nil))
+		assert.Equal(t, code, rec.Code, "unexpected status for %s", path)
+	}
+	h.setJoined(true)
+	rec := httptest.NewRecorder()
+	mux.ServeHTTP(rec, httptest.NewRequest("GET", "/readyz", nil))
+	assert.Equal(t, http.StatusOK, rec.Code, "unexpected status for /readyz")
+}
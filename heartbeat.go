@@ -0,0 +1,84 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/Shopify/sarama"
+	"github.com/rcrowley/go-metrics"
+)
+
+// heartbeatPayload is the JSON value of a heartbeat message
+type heartbeatPayload struct {
+	SourceClusterID string `json:"source_cluster_id"`
+	// Timestamp is in unix milliseconds
+	Timestamp int64 `json:"timestamp"`
+}
+
+// heartbeat periodically produces a message to topic, like the heartbeats of
+// MirrorMaker 2, so consumers of the destination can tell a working mirror
+// from one without source traffic. Heartbeats are no mirrored messages, they
+// carry no metadata and never touch the consumed offsets.
+type heartbeat struct {
+	topic           string
+	sourceClusterID string
+	registry        metrics.Registry
+	now             func() time.Time
+}
+
+func newHeartbeat(topic, sourceClusterID string, registry metrics.Registry) *heartbeat {
+	return &heartbeat{topic: topic, sourceClusterID: sourceClusterID, registry: registry, now: time.Now}
+}
+
+func (h *heartbeat) message() *sarama.ProducerMessage {
+	now := h.now()
+	// marshalling the struct can't fail
+	value, _ := json.Marshal(heartbeatPayload{SourceClusterID: h.sourceClusterID, Timestamp: now.UnixNano() / int64(time.Millisecond)})
+	return &sarama.ProducerMessage{
+		Topic: h.topic,
+		Key:   sarama.StringEncoder(h.sourceClusterID),
+		Value: sarama.ByteEncoder(value),
+		// used by the manual partitioners, the others place it by the key
+		Partition: 0,
+		Timestamp: now,
+	}
+}
+
+// run hands a heartbeat to the producer input every interval until ctx is
+// done
+func (h *heartbeat) run(ctx context.Context, interval time.Duration, input chan<- *sarama.ProducerMessage) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			select {
+			case input <- h.message():
+				metrics.GetOrRegisterMeter(`heartbeat.produced`, h.registry).Mark(1)
+			case <-ctx.Done():
+				return
+			}
+		}
+	}
+}
+
+// clusterID asks the controller for the id of the cluster, it requires kafka
+// 0.10.1 or newer
+func clusterID(client sarama.Client, topic string) (string, error) {
+	controller, err := client.Controller()
+	if err != nil {
+		return "", err
+	}
+	resp, err := controller.GetMetadata(&sarama.MetadataRequest{Version: 2, Topics: []string{topic}})
+	if err != nil {
+		return "", err
+	}
+	if resp.ClusterID == nil {
+		return "", fmt.Errorf("the cluster has no id")
+	}
+	return *resp.ClusterID, nil
+}
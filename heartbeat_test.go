@@ -0,0 +1,45 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/Shopify/sarama"
+	"github.com/rcrowley/go-metrics"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHeartbeatMessage(t *testing.T) {
+	h := newHeartbeat("heartbeats", "source-cluster", metrics.NewRegistry())
+	h.now = func() time.Time { return time.Unix(1600000000, 5e6) }
+	msg := h.message()
+	assert.Equal(t, "heartbeats", msg.Topic)
+	assert.Equal(t, sarama.StringEncoder("source-cluster"), msg.Key)
+	assert.Equal(t, time.Unix(1600000000, 5e6), msg.Timestamp)
+	assert.Nil(t, msg.Metadata, "heartbeats are no mirrored messages")
+	value, err := msg.Value.Encode()
+	assert.NoError(t, err)
+	var payload heartbeatPayload
+	assert.NoError(t, json.Unmarshal(value, &payload))
+	assert.Equal(t, heartbeatPayload{SourceClusterID: "source-cluster", Timestamp: 1600000000005}, payload)
+}
+
+func TestHeartbeatRun(t *testing.T) {
+	registry := metrics.NewRegistry()
+	h := newHeartbeat("heartbeats", "source-cluster", registry)
+	input := make(chan *sarama.ProducerMessage)
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		h.run(ctx, time.Millisecond, input)
+		close(done)
+	}()
+	<-input
+	<-input
+	// a blocked producer does not keep run from stopping
+	cancel()
+	<-done
+	assert.True(t, metrics.GetOrRegisterMeter(`heartbeat.produced`, registry).Count() >= 2)
+}
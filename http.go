@@ -0,0 +1,29 @@
+package main
+
+import (
+	"net/http"
+)
+
+// httpServers holds one mux per listen address, endpoints configured on the
+// same address share a single server
+type httpServers map[string]*http.ServeMux
+
+// mux returns the mux serving the given address, creating it if necessary
+func (s httpServers) mux(addr string) *http.ServeMux {
+	if m, ok := s[addr]; ok {
+		return m
+	}
+	m := http.NewServeMux()
+	s[addr] = m
+	return m
+}
+
+// start launches a http server for every address
+func (s httpServers) start() {
+	for addr, mux := range s {
+		logger.Infof("Launched http server on %s", addr)
+		go func(addr string, mux *http.ServeMux) {
+			logger.Fatalf("%s", http.ListenAndServe(addr, mux))
+		}(addr, mux)
+	}
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"context"
+	"sync"
+
+	"github.com/Shopify/sarama"
+)
+
+// offsetTracker marks the messages of a claim in the order they were
+// consumed, but only once everything produced for them is acknowledged.
+// The producer acknowledges out of order, e.g. if the messages of a source
+// partition go to several destination partitions, and marking a message
+// commits all offsets before it.
+type offsetTracker struct {
+	mu      sync.Mutex
+	session sarama.ConsumerGroupSession
+	pending []*trackedMsg
+}
+
+// trackedMsg is a consumed message which is not marked yet
+type trackedMsg struct {
+	tracker *offsetTracker
+	message *sarama.ConsumerMessage
+	// refs counts the unacknowledged produced messages and ConsumeClaim
+	// itself until it is done with the message
+	refs int
+}
+
+func newOffsetTracker(session sarama.ConsumerGroupSession) *offsetTracker {
+	return &offsetTracker{session: session}
+}
+
+// track starts tracking a consumed message, ConsumeClaim has to release it
+// once it handed all produced messages to the producer
+func (t *offsetTracker) track(message *sarama.ConsumerMessage) *trackedMsg {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	m := &trackedMsg{tracker: t, message: message, refs: 1}
+	t.pending = append(t.pending, m)
+	return m
+}
+
+// acquire adds a produced message which has to be acknowledged
+func (m *trackedMsg) acquire() {
+	m.tracker.mu.Lock()
+	defer m.tracker.mu.Unlock()
+	m.refs++
+}
+
+// release drops a reference and marks all messages up to the first one
+// which is still referenced
+func (m *trackedMsg) release() {
+	t := m.tracker
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	m.refs--
+	for len(t.pending) > 0 && t.pending[0].refs == 0 {
+		t.session.MarkMessage(t.pending[0].message, "")
+		t.pending[0] = nil
+		t.pending = t.pending[1:]
+	}
+}
+
+// inflightWindow limits the number of produced messages which are not
+// acknowledged yet, a nil window is unlimited
+type inflightWindow chan struct{}
+
+func newInflightWindow(size int) inflightWindow {
+	if size <= 0 {
+		return nil
+	}
+	return make(inflightWindow, size)
+}
+
+// acquire blocks until there is room in the window or ctx is done
+func (w inflightWindow) acquire(ctx context.Context) error {
+	if w == nil {
+		return nil
+	}
+	select {
+	case w <- struct{}{}:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (w inflightWindow) release() {
+	if w == nil {
+		return
+	}
+	<-w
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/Shopify/sarama"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestOffsetTracker(t *testing.T) {
+	session := &testSession{}
+	tracker := newOffsetTracker(session)
+	var tracked []*trackedMsg
+	for i := 0; i < 3; i++ {
+		m := tracker.track(&sarama.ConsumerMessage{Offset: int64(i)})
+		m.acquire()
+		m.release()
+		tracked = append(tracked, m)
+	}
+	assert.Empty(t, session.markedOffsets())
+	tracked[2].release()
+	tracked[1].release()
+	assert.Empty(t, session.markedOffsets(), "messages were marked before the first one")
+	tracked[0].release()
+	assert.Equal(t, []int64{0, 1, 2}, session.markedOffsets())
+}
+
+func TestInflightWindow(t *testing.T) {
+	var w inflightWindow
+	assert.NoError(t, w.acquire(context.Background()), "nil window is not unlimited")
+	w.release()
+	w = newInflightWindow(1)
+	assert.NoError(t, w.acquire(context.Background()))
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	assert.Error(t, w.acquire(ctx), "acquired a full window")
+	w.release()
+	assert.NoError(t, w.acquire(context.Background()))
+}
+
+func TestConsumeClaimInflightWindow(t *testing.T) {
+	var msgs []*sarama.ConsumerMessage
+	for i := 0; i < 5; i++ {
+		msgs = append(msgs, &sarama.ConsumerMessage{Topic: "source", Offset: int64(i), Key: []byte{byte(i)}, Value: []byte("Terrible Test")})
+	}
+	// a slow producer which acknowledges only when told to
+	producer := newTestProducer()
+	consumer := newTestConsumer("hash", producer)
+	consumer.trackSuccesses = true
+	consumer.window = newInflightWindow(2)
+	session := &testSession{}
+	done := make(chan error)
+	go func() {
+		done <- consumer.ConsumeClaim(session, newTestClaim(msgs...))
+	}()
+	next := func() *sarama.ProducerMessage {
+		select {
+		case msg := <-producer.input:
+			return msg
+		case <-time.After(time.Second):
+			t.Fatal("no message was produced")
+			return nil
+		}
+	}
+	ack := func(msg *sarama.ProducerMessage) {
+		msg.Metadata.(*msgMetadata).done(nil)
+	}
+	first, second := next(), next()
+	select {
+	case <-producer.input:
+		t.Fatal("produced more messages than the window allows")
+	case <-time.After(20 * time.Millisecond):
+	}
+	assert.Empty(t, session.markedOffsets(), "messages were marked before they were acknowledged")
+	ack(second)
+	third := next()
+	assert.Empty(t, session.markedOffsets(), "a message was marked before the one consumed before it")
+	ack(first)
+	assert.Equal(t, []int64{0, 1}, session.markedOffsets())
+	ack(third)
+	fourth, fifth := next(), next()
+	ack(fifth)
+	ack(fourth)
+	assert.NoError(t, <-done)
+	assert.Equal(t, []int64{0, 1, 2, 3, 4}, session.markedOffsets())
+}
+
+func TestConsumeClaimInflightWindowSessionEnd(t *testing.T) {
+	msgs := []*sarama.ConsumerMessage{
+		{Topic: "source", Offset: 0, Key: []byte("a"), Value: []byte("Terrible Test")},
+		{Topic: "source", Offset: 1, Key: []byte("b"), Value: []byte("Terrible Test")},
+	}
+	producer := newTestProducer()
+	consumer := newTestConsumer("hash", producer)
+	consumer.trackSuccesses = true
+	consumer.window = newInflightWindow(1)
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	session := &testSession{ctx: ctx}
+	assert.NoError(t, consumer.ConsumeClaim(session, newTestClaim(msgs...)), "the end of the session was reported as error")
+	assert.Len(t, producer.produced(), 1)
+	assert.Empty(t, session.markedOffsets())
+}
+
+func TestConsumeClaimAtLeastOnce(t *testing.T) {
+	var msgs []*sarama.ConsumerMessage
+	for i := 0; i < 3; i++ {
+		msgs = append(msgs, &sarama.ConsumerMessage{Topic: "source", Offset: int64(i), Key: []byte{byte(i)}, Value: []byte("Terrible Test")})
+	}
+	producer := newTestProducer()
+	consumer := newTestConsumer("hash", producer)
+	consumer.trackSuccesses = true
+	consumer.atLeastOnce = true
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	consumer.setRestart(cancel)
+	session := &testSession{ctx: ctx}
+	assert.NoError(t, consumer.ConsumeClaim(session, newTestClaim(msgs...)))
+	produced := producer.produced()
+	if !assert.Len(t, produced, 3) {
+		return
+	}
+	assert.Empty(t, session.markedOffsets(), "messages were marked before they were acknowledged")
+	produced[0].Metadata.(*msgMetadata).done(nil)
+	producerError(&sarama.ProducerError{Msg: produced[1], Err: sarama.ErrNotEnoughReplicas}, consumer.metrics)
+	produced[2].Metadata.(*msgMetadata).done(nil)
+	assert.Equal(t, []int64{0}, session.markedOffsets(), "the failed message or the ones after it were marked")
+	assert.Error(t, ctx.Err(), "the session was not restarted")
+}
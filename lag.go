@@ -0,0 +1,157 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/Shopify/sarama"
+	"github.com/rcrowley/go-metrics"
+)
+
+// lagMonitor periodically exposes the lag of every partition claimed by this
+// instance as a consumer.lag.<topic>.<partition> gauge. All methods may be
+// called on a nil lagMonitor.
+type lagMonitor struct {
+	mu sync.Mutex
+	// claims are the partitions of the current consumer group session
+	claims map[string][]int32
+	// gauges are the names of the currently registered lag gauges
+	gauges   map[string]bool
+	registry metrics.Registry
+	// newest returns the high-water mark of a partition
+	newest func(topic string, partition int32) (int64, error)
+	// committed returns the committed offsets of the consumer group
+	committed func(claims map[string][]int32) (map[string]map[int32]int64, error)
+}
+
+func newLagMonitor(client sarama.Client, group string, registry metrics.Registry) *lagMonitor {
+	return &lagMonitor{
+		gauges:   map[string]bool{},
+		registry: registry,
+		newest: func(topic string, partition int32) (int64, error) {
+			return client.GetOffset(topic, partition, sarama.OffsetNewest)
+		},
+		committed: func(claims map[string][]int32) (map[string]map[int32]int64, error) {
+			return fetchCommittedOffsets(client, group, claims)
+		},
+	}
+}
+
+// fetchCommittedOffsets asks the group coordinator for the committed offsets
+// of the claimed partitions. Partitions without a commit are reported as -1.
+func fetchCommittedOffsets(client sarama.Client, group string, claims map[string][]int32) (map[string]map[int32]int64, error) {
+	coordinator, err := client.Coordinator(group)
+	if err != nil {
+		return nil, err
+	}
+	req := &sarama.OffsetFetchRequest{Version: 1, ConsumerGroup: group}
+	for topic, partitions := range claims {
+		for _, partition := range partitions {
+			req.AddPartition(topic, partition)
+		}
+	}
+	resp, err := coordinator.FetchOffset(req)
+	if err != nil {
+		return nil, err
+	}
+	offsets := map[string]map[int32]int64{}
+	for topic, partitions := range claims {
+		offsets[topic] = map[int32]int64{}
+		for _, partition := range partitions {
+			block := resp.GetBlock(topic, partition)
+			if block == nil {
+				return nil, fmt.Errorf("no committed offset returned for %s/%d", topic, partition)
+			}
+			if block.Err != sarama.ErrNoError {
+				return nil, block.Err
+			}
+			offsets[topic][partition] = block.Offset
+		}
+	}
+	return offsets, nil
+}
+
+// assign replaces the monitored partitions, it is called whenever a consumer
+// group session starts or ends
+func (l *lagMonitor) assign(claims map[string][]int32) {
+	if l == nil {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.claims = claims
+	l.unregisterStale()
+}
+
+// unregisterStale removes the gauges of partitions which are not claimed
+// anymore. The caller must hold mu.
+func (l *lagMonitor) unregisterStale() {
+	current := map[string]bool{}
+	for topic, partitions := range l.claims {
+		for _, partition := range partitions {
+			current[lagGaugeName(topic, partition)] = true
+		}
+	}
+	for name := range l.gauges {
+		if !current[name] {
+			l.registry.Unregister(name)
+			delete(l.gauges, name)
+		}
+	}
+}
+
+// update refreshes the lag gauges of all claimed partitions
+func (l *lagMonitor) update() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if len(l.claims) == 0 {
+		return nil
+	}
+	committed, err := l.committed(l.claims)
+	if err != nil {
+		return err
+	}
+	for topic, partitions := range l.claims {
+		for _, partition := range partitions {
+			offset, ok := committed[topic][partition]
+			if !ok || offset < 0 {
+				// nothing committed yet, the lag is unknown
+				continue
+			}
+			newest, err := l.newest(topic, partition)
+			if err != nil {
+				return err
+			}
+			lag := newest - offset
+			if lag < 0 {
+				lag = 0
+			}
+			name := lagGaugeName(topic, partition)
+			metrics.GetOrRegisterGauge(name, l.registry).Update(lag)
+			l.gauges[name] = true
+		}
+	}
+	return nil
+}
+
+// run updates the lag every interval until ctx is done
+func (l *lagMonitor) run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := l.update(); err != nil {
+				logger.With(Fields{"error": err}).Warnf("could not update the consumer lag")
+			}
+		}
+	}
+}
+
+func lagGaugeName(topic string, partition int32) string {
+	return fmt.Sprintf("consumer.lag.%s.%d", topic, partition)
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/rcrowley/go-metrics"
+	"github.com/stretchr/testify/assert"
+)
+
+func newTestLagMonitor(registry metrics.Registry, committed map[string]map[int32]int64) *lagMonitor {
+	return &lagMonitor{
+		gauges:   map[string]bool{},
+		registry: registry,
+		newest: func(topic string, partition int32) (int64, error) {
+			return 100, nil
+		},
+		committed: func(map[string][]int32) (map[string]map[int32]int64, error) {
+			return committed, nil
+		},
+	}
+}
+
+func TestLagMonitor(t *testing.T) {
+	registry := metrics.NewRegistry()
+	l := newTestLagMonitor(registry, map[string]map[int32]int64{
+		"source": {0: 40, 1: -1},
+		"other":  {3: 100},
+	})
+	l.assign(map[string][]int32{"source": {0, 1}, "other": {3}})
+	assert.NoError(t, l.update())
+
+	assert.Equal(t, int64(60), registry.Get("consumer.lag.source.0").(metrics.Gauge).Value())
+	assert.Nil(t, registry.Get("consumer.lag.source.1"), "partitions without commit have no lag")
+	assert.Equal(t, int64(0), registry.Get("consumer.lag.other.3").(metrics.Gauge).Value())
+
+	// a rebalance took away the other topic
+	l.assign(map[string][]int32{"source": {0, 1}})
+	assert.NotNil(t, registry.Get("consumer.lag.source.0"))
+	assert.Nil(t, registry.Get("consumer.lag.other.3"))
+
+	l.assign(nil)
+	assert.Nil(t, registry.Get("consumer.lag.source.0"))
+	assert.NoError(t, l.update())
+}
+
+func TestLagMonitorNil(t *testing.T) {
+	var l *lagMonitor
+	l.assign(map[string][]int32{"source": {0}})
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/Shopify/sarama"
+	"github.com/spf13/viper"
+)
+
+// messageLimit stops mirroring after max forwarded messages, e.g. to copy
+// exactly that many records for a backfill. Filtered, sampled out and dead
+// lettered messages are not counted. Messages are reserved atomically,
+// so concurrent claims never mirror more than max. All methods may be called
+// on a nil messageLimit, which has no limit.
+type messageLimit struct {
+	max int64
+	// count is the reserved messages, forwarded the forwarded ones, both are
+	// accessed atomically
+	count     int64
+	forwarded int64
+	once      sync.Once
+	reached   chan struct{}
+}
+
+// newMessageLimit returns nil if max is not positive
+func newMessageLimit(max int64) *messageLimit {
+	if max <= 0 {
+		return nil
+	}
+	return &messageLimit{max: max, reached: make(chan struct{})}
+}
+
+// take reserves a message, it reports false once max messages were taken.
+// A reserved message is either confirmed once it was forwarded or released.
+func (l *messageLimit) take() bool {
+	if l == nil {
+		return true
+	}
+	if atomic.AddInt64(&l.count, 1) > l.max {
+		atomic.AddInt64(&l.count, -1)
+		return false
+	}
+	return true
+}
+
+// confirm counts a reserved message as forwarded, the last one closes done
+func (l *messageLimit) confirm() {
+	if l == nil {
+		return
+	}
+	if atomic.AddInt64(&l.forwarded, 1) == l.max {
+		l.once.Do(func() { close(l.reached) })
+	}
+}
+
+// release frees the slot of a reserved message which was not forwarded, it
+// is consumed again or went to the dead letter topic
+func (l *messageLimit) release() {
+	if l == nil {
+		return
+	}
+	atomic.AddInt64(&l.count, -1)
+}
+
+// exhausted reports whether max messages were taken
+func (l *messageLimit) exhausted() bool {
+	return l != nil && atomic.LoadInt64(&l.count) >= l.max
+}
+
+// done is closed once the limit is reached, it blocks forever without limit
+func (l *messageLimit) done() <-chan struct{} {
+	if l == nil {
+		return nil
+	}
+	return l.reached
+}
+
+// timeLimit stops mirroring at the first message with a timestamp after
+// until, e.g. to replay a time range. All methods may be called on a nil
+// timeLimit, which has no limit.
+type timeLimit struct {
+	until   time.Time
+	once    sync.Once
+	reached chan struct{}
+}
+
+// newTimeLimit returns nil for the zero time
+func newTimeLimit(until time.Time) *timeLimit {
+	if until.IsZero() {
+		return nil
+	}
+	return &timeLimit{until: until, reached: make(chan struct{})}
+}
+
+// allows reports whether the message is before the limit, the first message
+// after it closes done
+func (l *timeLimit) allows(message *sarama.ConsumerMessage) bool {
+	if l == nil || !message.Timestamp.After(l.until) {
+		return true
+	}
+	l.once.Do(func() { close(l.reached) })
+	return false
+}
+
+// done is closed once a message after the limit was consumed, it blocks
+// forever without limit
+func (l *timeLimit) done() <-chan struct{} {
+	if l == nil {
+		return nil
+	}
+	return l.reached
+}
+
+// mirrorUntilFromConfig returns the time of mirror.until, RFC 3339 or unix
+// milliseconds, the zero time if it is not set
+func mirrorUntilFromConfig() (time.Time, error) {
+	until := viper.GetString("mirror.until")
+	if until == "" {
+		return time.Time{}, nil
+	}
+	ms, err := parseResetTimestamp(until)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid mirror.until: %s", err)
+	}
+	return time.Unix(0, ms*int64(time.Millisecond)), nil
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/Shopify/sarama"
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMessageLimit(t *testing.T) {
+	var unlimited *messageLimit
+	assert.Nil(t, newMessageLimit(0))
+	assert.True(t, unlimited.take())
+	assert.Nil(t, unlimited.done())
+	assert.False(t, unlimited.exhausted())
+
+	l := newMessageLimit(100)
+	assert.False(t, l.exhausted())
+	var taken int64
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 50; j++ {
+				if l.take() {
+					atomic.AddInt64(&taken, 1)
+					l.confirm()
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	assert.Equal(t, int64(100), taken, "concurrent claims took more than the limit")
+	assert.True(t, l.exhausted())
+	select {
+	case <-l.done():
+	default:
+		t.Fatal("done was not closed")
+	}
+
+	l = newMessageLimit(2)
+	assert.True(t, l.take())
+	l.confirm()
+	assert.True(t, l.take())
+	assert.False(t, l.take())
+	// the message was not forwarded, its slot is free again
+	l.release()
+	assert.False(t, l.exhausted())
+	select {
+	case <-l.done():
+		t.Fatal("done was closed for a released message")
+	default:
+	}
+	assert.True(t, l.take())
+	l.confirm()
+	<-l.done()
+}
+
+func TestTimeLimit(t *testing.T) {
+	var unlimited *timeLimit
+	assert.Nil(t, newTimeLimit(time.Time{}))
+	assert.True(t, unlimited.allows(&sarama.ConsumerMessage{Timestamp: time.Now()}))
+	assert.Nil(t, unlimited.done())
+
+	until := time.Unix(1600000000, 0)
+	l := newTimeLimit(until)
+	assert.True(t, l.allows(&sarama.ConsumerMessage{Timestamp: until}))
+	select {
+	case <-l.done():
+		t.Fatal("done was closed before the limit")
+	default:
+	}
+	assert.False(t, l.allows(&sarama.ConsumerMessage{Timestamp: until.Add(time.Millisecond)}))
+	assert.False(t, l.allows(&sarama.ConsumerMessage{Timestamp: until.Add(time.Second)}))
+	<-l.done()
+}
+
+func TestMirrorUntilFromConfig(t *testing.T) {
+	viper.Reset()
+	setDefaults()
+	until, err := mirrorUntilFromConfig()
+	assert.NoError(t, err)
+	assert.True(t, until.IsZero())
+
+	viper.Set("mirror.until", "2020-09-13T12:26:40Z")
+	until, err = mirrorUntilFromConfig()
+	assert.NoError(t, err)
+	assert.True(t, until.Equal(time.Unix(1600000000, 0)))
+
+	viper.Set("mirror.until", "1600000000000")
+	until, err = mirrorUntilFromConfig()
+	assert.NoError(t, err)
+	assert.True(t, until.Equal(time.Unix(1600000000, 0)))
+
+	viper.Set("mirror.until", "yesterday")
+	_, err = mirrorUntilFromConfig()
+	assert.Error(t, err)
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Fields are additional values attached to a log entry
+type Fields map[string]interface{}
+
+var levelNames = map[string]string{
+	"debug": "Debug",
+	"info":  "Info",
+	"warn":  "Warning",
+	"error": "Error",
+	"fatal": "Fatal",
+}
+
+var levelOrder = map[string]int32{
+	"debug": 0,
+	"info":  1,
+	"warn":  2,
+	"error": 3,
+	"fatal": 4,
+}
+
+// logOutput is shared by a logger and all loggers derived from it with With
+type logOutput struct {
+	mu    sync.Mutex
+	out   io.Writer
+	json  bool
+	level int32
+	now   func() time.Time
+}
+
+// Logger writes log entries either as plain text lines or as json objects
+type Logger struct {
+	*logOutput
+	fields Fields
+}
+
+// logger is used for all log output of mirrormaker
+var logger = NewLogger(os.Stderr)
+
+func NewLogger(out io.Writer) *Logger {
+	return &Logger{logOutput: &logOutput{out: out, level: levelOrder["info"], now: time.Now}}
+}
+
+// SetLevel sets the minimum level of logged entries: debug, info, warn or error
+func (l *Logger) SetLevel(level string) error {
+	lvl, ok := levelOrder[strings.ToLower(level)]
+	if !ok || lvl == levelOrder["fatal"] {
+		return fmt.Errorf("invalid log.level %q, must be debug, info, warn or error", level)
+	}
+	atomic.StoreInt32(&l.level, lvl)
+	return nil
+}
+
+// Enabled reports whether entries of the level are logged, it allows to skip
+// building expensive entries
+func (l *Logger) Enabled(level string) bool {
+	return levelOrder[level] >= atomic.LoadInt32(&l.level)
+}
+
+// SetFormat switches between the text and the json format
+func (l *Logger) SetFormat(format string) error {
+	switch strings.ToLower(format) {
+	case "text", "":
+		l.json = false
+	case "json":
+		l.json = true
+	default:
+		return fmt.Errorf("invalid log.format %q, must be text or json", format)
+	}
+	return nil
+}
+
+// With returns a logger which adds the fields to every entry
+func (l *Logger) With(fields Fields) *Logger {
+	merged := make(Fields, len(l.fields)+len(fields))
+	for k, v := range l.fields {
+		merged[k] = v
+	}
+	for k, v := range fields {
+		merged[k] = v
+	}
+	return &Logger{logOutput: l.logOutput, fields: merged}
+}
+
+func (l *Logger) Debugf(format string, args ...interface{}) { l.log("debug", format, args...) }
+func (l *Logger) Infof(format string, args ...interface{})  { l.log("info", format, args...) }
+func (l *Logger) Warnf(format string, args ...interface{})  { l.log("warn", format, args...) }
+func (l *Logger) Errorf(format string, args ...interface{}) { l.log("error", format, args...) }
+
+// Fatalf logs the entry and exits with status 1
+func (l *Logger) Fatalf(format string, args ...interface{}) {
+	l.log("fatal", format, args...)
+	os.Exit(1)
+}
+
+// Panicf logs the entry and panics with the message
+func (l *Logger) Panicf(format string, args ...interface{}) {
+	l.log("fatal", format, args...)
+	panic(fmt.Sprintf(format, args...))
+}
+
+func (l *Logger) log(level, format string, args ...interface{}) {
+	if !l.Enabled(level) {
+		return
+	}
+	msg := fmt.Sprintf(format, args...)
+	var b bytes.Buffer
+	if l.json {
+		entry := make(map[string]interface{}, len(l.fields)+3)
+		for k, v := range l.fields {
+			if err, ok := v.(error); ok {
+				v = err.Error()
+			}
+			entry[k] = v
+		}
+		entry["time"] = l.now().Format(time.RFC3339Nano)
+		entry["level"] = level
+		entry["msg"] = msg
+		if err := json.NewEncoder(&b).Encode(entry); err != nil {
+			fmt.Fprintf(&b, "{\"level\":\"error\",\"msg\":%q}\n", "could not encode log entry: "+err.Error())
+		}
+	} else {
+		fmt.Fprintf(&b, "%s %s: %s", l.now().Format("2006/01/02 15:04:05"), levelNames[level], msg)
+		keys := make([]string, 0, len(l.fields))
+		for k := range l.fields {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			v := fmt.Sprint(l.fields[k])
+			if strings.ContainsAny(v, " \t\"=") {
+				v = fmt.Sprintf("%q", v)
+			}
+			fmt.Fprintf(&b, " %s=%s", k, v)
+		}
+		b.WriteByte('\n')
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.out.Write(b.Bytes())
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func newTestLogger(format string) (*Logger, *bytes.Buffer) {
+	var b bytes.Buffer
+	l := NewLogger(&b)
+	l.now = func() time.Time { return time.Date(2021, 6, 1, 12, 0, 0, 0, time.UTC) }
+	l.SetFormat(format)
+	return l, &b
+}
+
+func TestLoggerText(t *testing.T) {
+	l, b := newTestLogger("text")
+	l.Infof("enabled kafka %s", "tls")
+	l.With(Fields{"topic": "orders", "partition": 3, "error": fmt.Errorf("key is not set")}).Errorf("could not mirror message")
+	assert.Equal(t, "2021/06/01 12:00:00 Info: enabled kafka tls\n"+
+		"2021/06/01 12:00:00 Error: could not mirror message error=\"key is not set\" partition=3 topic=orders\n", b.String())
+}
+
+func TestLoggerJSON(t *testing.T) {
+	l, b := newTestLogger("json")
+	l.With(Fields{"topic": "orders", "partition": 3}).With(Fields{"error": fmt.Errorf("key is not set")}).Warnf("could not mirror message")
+	var entry map[string]interface{}
+	assert.NoError(t, json.Unmarshal(b.Bytes(), &entry))
+	assert.Equal(t, map[string]interface{}{
+		"time":      "2021-06-01T12:00:00Z",
+		"level":     "warn",
+		"msg":       "could not mirror message",
+		"topic":     "orders",
+		"partition": float64(3),
+		"error":     "key is not set",
+	}, entry)
+	assert.Error(t, l.SetFormat("xml"), "No error occured on an invalid format")
+}
+
+func TestLoggerLevel(t *testing.T) {
+	l, b := newTestLogger("text")
+	assert.False(t, l.Enabled("debug"), "debug is enabled by default")
+	l.Debugf("hidden")
+	assert.Empty(t, b.String(), "debug entry was logged at info level")
+	assert.NoError(t, l.SetLevel("warn"))
+	l.With(Fields{"topic": "orders"}).Infof("hidden")
+	l.Warnf("shown")
+	assert.Equal(t, "2021/06/01 12:00:00 Warning: shown\n", b.String())
+	assert.NoError(t, l.SetLevel("DEBUG"))
+	assert.True(t, l.Enabled("debug"))
+	assert.Error(t, l.SetLevel("fatal"), "No error occured on level fatal")
+	assert.Error(t, l.SetLevel("verbose"), "No error occured on an invalid level")
+}
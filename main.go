@@ -1,22 +1,23 @@
 package main
 
 import (
+	"compress/gzip"
+	"context"
 	"flag"
 	"fmt"
-	"log"
+	"math/rand"
 	"net"
 	"os"
 	"os/signal"
 	"runtime"
 	"runtime/pprof"
+	"strconv"
 	"strings"
+	"sync"
 	"syscall"
 	"time"
-	"context"
-	"sync"
 
 	"github.com/Shopify/sarama"
-	"crypto/tls"
 	graphite "github.com/cyberdelia/go-metrics-graphite"
 	"github.com/rcrowley/go-metrics"
 
@@ -26,12 +27,19 @@ import (
 var (
 	configFolder = flag.String("config", "/etc/mirrormaker", "path to the config directory")
 	versionFlag  = flag.Bool("version", false, "print the version of the program")
+	checkFlag    = flag.Bool("check", false, "validate the config and exit without connecting to kafka")
+	resetToTime  = flag.String("reset-offsets-to-timestamp", "", "commit the offsets of the first messages at or after the `timestamp` (RFC 3339 or unix milliseconds) for the consumer group and exit, requires --confirm")
+	resetFlag    = flag.String("reset-offsets", "", "commit the earliest or latest offsets for the consumer group and exit, requires --confirm")
+	confirmFlag  = flag.Bool("confirm", false, "confirm an offset reset, without it the new offsets are only printed")
+	printFlag    = flag.Bool("print-config", false, "print the effective config (defaults, config file and environment) as JSON with the secrets masked and exit")
 )
 var githash, shorthash, builddate, buildtime string
 var cpuprofile = flag.String("cpuprofile", "", "write cpu profile to `file`")
 var memprofile = flag.String("memprofile", "", "write memory profile to `file`")
 
 func main() {
+	// mirror.stop_after is measured from here
+	startTime := time.Now()
 	flag.Parse()
 	// only provide version information if --version was specified
 	if *versionFlag {
@@ -41,111 +49,632 @@ func main() {
 	viper.SetConfigName("config")      // name of config file (without extension)
 	viper.AddConfigPath(*configFolder) // path to look for the config file in
 	viper.AddConfigPath(".")           // optionally look for config in the working directory
-	viper.SetDefault("producer.flush.fequency", 1*time.Second)
-	viper.SetDefault("producer.flush.bytes", 5388608)
-	viper.SetDefault("graphite.interval", 30*time.Second)
-	viper.SetDefault("producer.kafka.tls", false)
-	viper.SetDefault("producer.kafka.username", "")
-	viper.SetDefault("producer.kafka.password", "")
-	err := viper.ReadInConfig() // Find and read the config file
-	if err != nil {             // Handle errors reading the config file
-		panic(fmt.Errorf("fatal error config file: %s \n", err))
+	setDefaults()
+	bindEnv()
+	if err := readConfigFile(); err != nil {
+		logger.Fatalf("could not read the config file: %s", err)
+	}
+	if err := logger.SetFormat(viper.GetString("log.format")); err != nil {
+		logger.Fatalf("%s", err)
+	}
+	if err := logger.SetLevel(viper.GetString("log.level")); err != nil {
+		logger.Fatalf("%s", err)
+	}
+	if viper.IsSet("producer.flush.fequency") {
+		// older configs used the misspelled key, it is still used unless the
+		// correct one is set as well
+		logger.Warnf("producer.flush.fequency is deprecated, use producer.flush.frequency")
+		viper.SetDefault("producer.flush.frequency", viper.Get("producer.flush.fequency"))
+	}
+	if *printFlag {
+		if err := printConfig(os.Stdout); err != nil {
+			logger.Fatalf("could not print the config: %s", err)
+		}
+		os.Exit(0)
+	}
+	if *checkFlag {
+		errs := checkConfig()
+		for _, err := range errs {
+			logger.Errorf("%s", err)
+		}
+		if len(errs) > 0 {
+			os.Exit(1)
+		}
+		logger.Infof("config %s is valid", viper.ConfigFileUsed())
+		os.Exit(0)
+	}
+	if err := validateConfig(); err != nil {
+		logger.Fatalf("invalid config: %s", err)
 	}
 
 	if *cpuprofile != "" {
 		f, err := os.Create(*cpuprofile)
 		if err != nil {
-			log.Fatal("could not create CPU profile: ", err)
+			logger.Fatalf("could not create CPU profile: %s", err)
 		}
 		defer f.Close()
 		if err := pprof.StartCPUProfile(f); err != nil {
-			log.Fatal("could not start CPU profile: ", err)
+			logger.Fatalf("could not start CPU profile: %s", err)
 		}
 		defer pprof.StopCPUProfile()
 	}
 	if *memprofile != "" {
 		f, err := os.Create(*memprofile)
 		if err != nil {
-			log.Fatal("could not create memory profile: ", err)
+			logger.Fatalf("could not create memory profile: %s", err)
 		}
 		defer f.Close()
 		runtime.GC() // get up-to-date statistics
 		if err := pprof.WriteHeapProfile(f); err != nil {
-			log.Fatal("could not write memory profile: ", err)
+			logger.Fatalf("could not write memory profile: %s", err)
 		}
 	}
 	kafkaVersion, err := sarama.ParseKafkaVersion(viper.GetString("producer.kafka.version"))
 	if err != nil {
-		log.Println("Warning: Could not parse producer.kafka.version string, fallback to oldest stable version")
+		logger.Warnf("Could not parse producer.kafka.version string, fallback to oldest stable version")
 	}
 	// initialize kafka connection
 	cfg := sarama.NewConfig()
 	cfg.Version = kafkaVersion
-	cfg.ClientID = "mirrormaker"
-	cfg.Producer.Return.Successes = false
+	// the client is shared by the consumer group and the producer, so both
+	// use the same id
+	cfg.ClientID, err = clientIDFromConfig(os.Hostname)
+	if err != nil {
+		logger.Fatalf("%s", err)
+	}
+	logger.Infof("using kafka client id %s", cfg.ClientID)
+	if err := setNetTimeouts(cfg, viper.GetDuration("kafka.dial_timeout"), viper.GetDuration("kafka.read_timeout"), viper.GetDuration("kafka.write_timeout")); err != nil {
+		logger.Fatalf("%s", err)
+	}
+	logger.Infof("kafka connections time out after %s dialing, %s reading and %s writing", cfg.Net.DialTimeout, cfg.Net.ReadTimeout, cfg.Net.WriteTimeout)
+	if err := setMetadataRefresh(cfg, viper.GetDuration("kafka.metadata.refresh_interval")); err != nil {
+		logger.Fatalf("%s", err)
+	}
+	logger.Infof("kafka metadata is refreshed every %s", cfg.Metadata.RefreshFrequency)
+	// tracking successes costs throughput, so it is only enabled on request
+	cfg.Producer.Return.Successes = viper.GetBool("producer.track_successes")
+	maxInflight := viper.GetInt("producer.max_inflight")
+	if maxInflight < 0 {
+		logger.Fatalf("producer.max_inflight must not be negative, got %d", maxInflight)
+	}
+	if maxInflight > 0 {
+		// offsets are marked once the producer acknowledged the messages
+		cfg.Producer.Return.Successes = true
+		logger.Infof("at most %d messages are in flight, offsets are marked once they are acknowledged", maxInflight)
+	}
+	if threshold := viper.GetInt("breaker.threshold"); threshold > 0 {
+		if viper.GetDuration("breaker.window") <= 0 || viper.GetDuration("breaker.cooldown") <= 0 {
+			logger.Fatalf("breaker.window and breaker.cooldown must be positive")
+		}
+		// the breaker closes on acknowledged messages
+		cfg.Producer.Return.Successes = true
+		logger.Infof("circuit breaker opens after %d produce errors within %s", threshold, viper.GetDuration("breaker.window"))
+	}
+	atLeastOnce := viper.GetBool("delivery.at_least_once")
+	if atLeastOnce {
+		cfg.Producer.Return.Successes = true
+		logger.Infof("at least once delivery, messages which could not be produced are consumed again")
+	}
+	if n := viper.GetInt64("consumer.max_messages"); n < 0 {
+		logger.Fatalf("consumer.max_messages must not be negative, got %d", n)
+	} else if n > 0 {
+		logger.Infof("stopping after %d messages", n)
+	}
+	if d := viper.GetDuration("mirror.stop_after"); d < 0 {
+		logger.Fatalf("mirror.stop_after must not be negative, got %s", d)
+	}
+	mirrorUntil, err := mirrorUntilFromConfig()
+	if err != nil {
+		logger.Fatalf("%s", err)
+	}
+	if !mirrorUntil.IsZero() {
+		logger.Infof("stopping at the first message after %s", mirrorUntil.UTC().Format(time.RFC3339))
+	}
+	workers := viper.GetInt("consumer.workers")
+	if workers < 1 {
+		logger.Fatalf("consumer.workers must be at least 1, got %d", workers)
+	}
+	percentiles, err := graphitePercentilesFromConfig()
+	if err != nil {
+		logger.Fatalf("%s", err)
+	}
+	allow, err := graphiteAllowFromConfig()
+	if err != nil {
+		logger.Fatalf("%s", err)
+	}
+	if viper.GetString("heartbeat.topic") != "" && viper.GetDuration("heartbeat.interval") <= 0 {
+		logger.Fatalf("heartbeat.interval must be positive, got %s", viper.GetDuration("heartbeat.interval"))
+	}
+	sampler, err := newSampler(viper.GetFloat64("consumer.sample_rate"))
+	if err != nil {
+		logger.Fatalf("%s", err)
+	}
+	if sampler != nil {
+		logger.Warnf("only %g of the messages are mirrored (consumer.sample_rate), this is not meant for production mirroring", sampler.rate)
+	}
+	offsetSync := viper.GetBool("offset_sync.enabled")
+	if offsetSync {
+		if err := checkOffsetSync(); err != nil {
+			logger.Fatalf("%s", err)
+		}
+		// the offset mapping is built from the acknowledged messages
+		cfg.Producer.Return.Successes = true
+		logger.Infof("syncing the offsets of the consumer groups %s every %s", strings.Join(viper.GetStringSlice("offset_sync.groups"), ", "), viper.GetDuration("offset_sync.interval"))
+	}
 	cfg.Producer.Return.Errors = true
-	cfg.Producer.Compression = getCompressionCodec(viper.GetString("producer.compression"))
-	cfg.Producer.Retry.Max = 10
+	codec, level := producerCompression()
+	if err := setCompression(cfg, codec); err != nil {
+		logger.Fatalf("%s", err)
+	}
+	if err := setCompressionLevel(cfg, level); err != nil {
+		logger.Warnf("%s, using the default level", err)
+	}
+	cfg.Producer.RequiredAcks, err = getRequiredAcks(viper.GetString("producer.required_acks"))
+	if err != nil {
+		logger.Fatalf("%s", err)
+	}
+	cfg.Producer.MaxMessageBytes = viper.GetInt("producer.max_message_bytes")
+	if cfg.Producer.MaxMessageBytes <= 0 || cfg.Producer.MaxMessageBytes >= int(sarama.MaxRequestSize) {
+		logger.Fatalf("producer.max_message_bytes must be between 1 and %d, got %d", sarama.MaxRequestSize-1, cfg.Producer.MaxMessageBytes)
+	}
+	logger.Infof("producer accepts messages up to %d bytes", cfg.Producer.MaxMessageBytes)
+	cfg.Producer.Retry.Max = viper.GetInt("producer.retry.max")
+	if cfg.Producer.Retry.Max < 0 {
+		logger.Fatalf("producer.retry.max must not be negative, got %d", cfg.Producer.Retry.Max)
+	}
+	cfg.Producer.Retry.Backoff = viper.GetDuration("producer.retry.backoff")
+	if cfg.Producer.Retry.Backoff <= 0 {
+		logger.Fatalf("producer.retry.backoff must be positive, got %s", cfg.Producer.Retry.Backoff)
+	}
+	if viper.GetBool("producer.ordered") {
+		if err := enableOrdering(cfg, viper.GetString("producer.required_acks"), viper.GetString("producer.partitioner")); err != nil {
+			logger.Fatalf("%s", err)
+		}
+		logger.Infof("enabled ordered mode, the producer sends one request per broker at a time")
+	} else if viper.GetBool("producer.idempotent") {
+		if err := enableIdempotence(cfg, viper.GetString("producer.required_acks")); err != nil {
+			logger.Fatalf("%s", err)
+		}
+		logger.Infof("enabled idempotent producer")
+	}
+	// all producer settings have to be in place before the client is created
+	cfg.Producer.Flush.Frequency = viper.GetDuration("producer.flush.frequency")
+	cfg.Producer.Flush.Bytes = viper.GetInt("producer.flush.bytes")
+	cfg.Producer.Flush.Messages = viper.GetInt("producer.flush.messages")
+	logger.Infof("producer flushes every %s, at %d bytes or at %d messages", cfg.Producer.Flush.Frequency, cfg.Producer.Flush.Bytes, cfg.Producer.Flush.Messages)
+	partitioner := strings.ToLower(viper.GetString("producer.partitioner"))
+	if partitioner == "keeppartition" || partitioner == "modulo" || partitioner == "consistent" || partitioner == "roundrobin" || partitioner == "header" {
+		cfg.Producer.Partitioner = sarama.NewManualPartitioner
+	}
+	headerFallback, err := getHeaderFallback(viper.GetString("producer.partition_header_fallback"))
+	if err != nil {
+		logger.Fatalf("%s", err)
+	}
+	keylessFallback, err := getKeylessFallback(viper.GetString("producer.hash.keyless_fallback"))
+	if err != nil {
+		logger.Fatalf("%s", err)
+	}
+	if partitioner == "hash" && keylessFallback == "roundrobin" {
+		cfg.Producer.Partitioner = newKeylessManualPartitioner(sarama.NewHashPartitioner)
+	}
+	if partitioner == "murmur2" {
+		cfg.Producer.Partitioner = NewMurmur2Partitioner
+	}
+	topicPartitioners, err := topicPartitionersFromConfig()
+	if err != nil {
+		logger.Fatalf("%s", err)
+	}
+	if err := checkPartitionHeader(partitioner, topicPartitioners, viper.GetString("producer.partition_header")); err != nil {
+		logger.Fatalf("%s", err)
+	}
+	usesRandom := partitioner == "random" || headerFallback == "random"
+	for _, p := range topicPartitioners {
+		usesRandom = usesRandom || p == "random"
+	}
+	randomPartitions, err := randomPartitionsFromConfig(usesRandom)
+	if err != nil {
+		logger.Fatalf("%s", err)
+	}
+	if randomPartitions != nil {
+		if len(randomPartitions.excluded) > 0 {
+			logger.Infof("the random partitioner leaves out the partitions %v", viper.GetIntSlice("producer.exclude_partitions"))
+		}
+		if partitioner == "random" {
+			// set by PartitionMsg
+			cfg.Producer.Partitioner = sarama.NewManualPartitioner
+		}
+	}
+	keyPrefix, err := keyPrefixRouteFromConfig()
+	if err != nil {
+		logger.Fatalf("%s", err)
+	}
+	if keyPrefix.forcesPartition() {
+		// set by mirrorMsg for matching keys and picked before producing for
+		// the others
+		cfg.Producer.Partitioner = sarama.NewManualPartitioner
+	}
+	if len(topicPartitioners) > 0 {
+		// the producer only sees the destination topic, so the partitions
+		// are picked before producing
+		cfg.Producer.Partitioner = sarama.NewManualPartitioner
+		for topic, p := range topicPartitioners {
+			if viper.GetBool("producer.ordered") {
+				if err := orderedPartitioner(p); err != nil {
+					logger.Fatalf("%s (topic.partitioner.%s)", err, topic)
+				}
+			}
+			logger.Infof("Using partitioner %s for topic %s", p, topic)
+			warnIgnoredKeys(p)
+		}
+	}
 	// Setup Consumer
-	cfg.Consumer.Offsets.Initial = sarama.OffsetNewest
+	cfg.Consumer.Offsets.Initial, err = getInitialOffset(viper.GetString("consumer.offsets.initial"))
+	if err != nil {
+		logger.Fatalf("%s", err)
+	}
+	logger.Infof("consumer groups without committed offsets start at the %s offset", viper.GetString("consumer.offsets.initial"))
 	// cfg.Consumer.Offsets.ResetOffsets = false
-	cfg.Consumer.Offsets.CommitInterval = 10 * time.Second
-	cfg.Consumer.Group.Rebalance.Strategy = sarama.BalanceStrategyRange
+	cfg.Consumer.Offsets.CommitInterval = viper.GetDuration("consumer.offsets.commit_interval")
+	if cfg.Consumer.Offsets.CommitInterval <= 0 {
+		logger.Fatalf("consumer.offsets.commit_interval must be positive, got %s", cfg.Consumer.Offsets.CommitInterval)
+	}
+	dryRun := viper.GetBool("dry_run")
+	if dryRun {
+		// nothing is produced, so nothing may be committed either
+		cfg.Consumer.Offsets.AutoCommit.Enable = false
+		logger.Warnf("DRY RUN: messages are not produced and offsets are not committed")
+	}
+	cfg.Consumer.Group.Rebalance.Strategy, err = getRebalanceStrategy(viper.GetString("consumer.group.rebalance.strategy"))
+	if err != nil {
+		logger.Warnf("%s, fallback to range", err)
+	}
+	cfg.Consumer.MaxProcessingTime = viper.GetDuration("consumer.group.max_processing_time")
+	if cfg.Consumer.MaxProcessingTime <= 0 {
+		logger.Fatalf("consumer.group.max_processing_time must be positive, got %s", cfg.Consumer.MaxProcessingTime)
+	}
+	if err := setIsolationLevel(cfg, viper.GetString("consumer.isolation_level")); err != nil {
+		logger.Fatalf("%s", err)
+	}
+	logger.Infof("consumer isolation level is %s", strings.ToLower(viper.GetString("consumer.isolation_level")))
 	cfg.Consumer.Return.Errors = true // allows to use ConsumerGroup.Errors()
-	if viper.GetBool("producer.kafka.tls") {
+	if err := setFetchSizes(cfg, viper.GetInt32("consumer.fetch.min"), viper.GetInt32("consumer.fetch.default"), viper.GetInt32("consumer.fetch.max")); err != nil {
+		logger.Fatalf("%s", err)
+	}
+	logger.Infof("consumer fetches at least %d, by default %d and at most %d bytes (0 is unlimited)", cfg.Consumer.Fetch.Min, cfg.Consumer.Fetch.Default, cfg.Consumer.Fetch.Max)
+	if int(cfg.Consumer.Fetch.Max) > cfg.Producer.MaxMessageBytes {
+		logger.Warnf("consumer.fetch.max (%d) is larger than producer.max_message_bytes (%d), larger messages are handled like other messages which can't be mirrored", cfg.Consumer.Fetch.Max, cfg.Producer.MaxMessageBytes)
+	}
+	if err := checkSharedClient(); err != nil {
+		logger.Fatalf("%s", err)
+	}
+	if producerTLSEnabled() {
 		cfg.Net.TLS.Enable = true
-		cfg.Net.TLS.Config = &tls.Config{MinVersion: tls.VersionTLS12}
-		log.Println("Info: enabled kafka tls")
+		cfg.Net.TLS.Config, err = newTLSConfig(producerTLSOptions())
+		if err != nil {
+			logger.Fatalf("%s", err)
+		}
+		if cfg.Net.TLS.Config.InsecureSkipVerify {
+			logger.Warnf("kafka tls certificate verification is disabled")
+		}
+		logger.Infof("enabled kafka tls")
+	} else if viper.GetString("producer.kafka.tls.server_name") != "" {
+		logger.Fatalf("producer.kafka.tls.server_name is set but tls is not enabled")
+	}
+	if err := setSASL(cfg); err != nil {
+		logger.Fatalf("%s", err)
+	}
+	if cfg.Net.SASL.Enable {
+		logger.Infof("setup kafka sasl with %s", saslMechanism())
 	}
-	if viper.GetString("producer.kafka.username") != "" && viper.GetString("producer.kafka.password") != "" {
-		cfg.Net.SASL.Enable = true
-		cfg.Net.SASL.User = viper.GetString("producer.kafka.username")
-		cfg.Net.SASL.Password = viper.GetString("producer.kafka.password")
-		cfg.Net.SASL.Mechanism = sarama.SASLTypePlaintext
-		log.Println("Info: setup kafka sasl")
+	proxyURL, err := proxyURLFromConfig()
+	if err != nil {
+		logger.Fatalf("%s", err)
+	}
+	if proxyURL != "" {
+		cfg.Net.Proxy.Dialer, err = newProxyDialer(proxyURL, &net.Dialer{Timeout: cfg.Net.DialTimeout, KeepAlive: cfg.Net.KeepAlive})
+		if err != nil {
+			logger.Fatalf("%s", err)
+		}
+		cfg.Net.Proxy.Enable = true
+		logger.Infof("connecting to kafka through a proxy")
 	}
 
-	client, err := sarama.NewClient(viper.GetStringSlice("producer.kafka.nodes"), cfg)
+	if viper.GetInt("startup.retry.attempts") < 1 || viper.GetDuration("startup.retry.backoff") < 0 {
+		logger.Fatalf("startup.retry.attempts must be at least 1 and startup.retry.backoff must not be negative")
+	}
+	// a SIGTERM while the brokers are unavailable stops the retries
+	signalchannel := make(chan os.Signal, 1)
+	signal.Notify(signalchannel, os.Interrupt, syscall.SIGINT, syscall.SIGTERM)
+	var client sarama.Client
+	err = retry(viper.GetInt("startup.retry.attempts"), viper.GetDuration("startup.retry.backoff"), signalchannel, "connect to kafka", func() error {
+		var err error
+		client, err = sarama.NewClient(viper.GetStringSlice("producer.kafka.nodes"), cfg)
+		return err
+	})
+	if err == errRetryStopped {
+		logger.Infof("stopped while connecting to kafka")
+		os.Exit(0)
+	}
 	if err != nil {
-		log.Fatal(err)
+		logger.Fatalf("%s", err)
 	}
-	cfg.Producer.Flush.Frequency = viper.GetDuration("producer.flush.fequency")
-	cfg.Producer.Flush.Bytes = viper.GetInt("producer.flush.bytes")
-	partitioner := strings.ToLower(viper.GetString("producer.partitioner"))
-	if partitioner == "keeppartition" || partitioner == "modulo" {
-		cfg.Producer.Partitioner = sarama.NewManualPartitioner
+	router, err := topicRouterFromConfig(viper.GetViper())
+	if err != nil {
+		logger.Fatalf("%s", err)
 	}
-	producerTopic := viper.GetString("producer.kafka.topic")
-	part, err := client.Partitions(producerTopic)
+	consumerTopics := strings.Split(viper.GetString("consumer.topic"), ",")
+	staticAssignments, err := staticAssignmentsFromConfig()
 	if err != nil {
-		log.Fatalf("could not get partitions for target topic: %s", err)
+		logger.Fatalf("%s", err)
+	}
+	if staticAssignments != nil {
+		consumerTopics = staticTopics(staticAssignments)
+	}
+	if *resetToTime != "" || *resetFlag != "" {
+		var target func(string, int32) (int64, error)
+		if *resetToTime != "" {
+			millis, err := parseResetTimestamp(*resetToTime)
+			if err != nil {
+				logger.Fatalf("%s", err)
+			}
+			target = timestampOffsets(client.GetOffset, millis)
+		} else {
+			target, err = getResetTarget(*resetFlag, client.GetOffset)
+			if err != nil {
+				logger.Fatalf("%s", err)
+			}
+		}
+		resets, err := resetOffsets(client, viper.GetString("consumer.group.id"), consumerTopics, target, *confirmFlag)
+		if err != nil {
+			logger.Fatalf("could not reset the offsets: %s", err)
+		}
+		printResets(os.Stdout, resets)
+		client.Close()
+		if !*confirmFlag {
+			logger.Warnf("nothing was committed, add --confirm to reset the offsets of %s", viper.GetString("consumer.group.id"))
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
+	partitionTTL := partitionCacheTTL(viper.GetDuration("producer.partitions.refresh_interval"), cfg.Metadata.RefreshFrequency)
+	if partitionTTL != viper.GetDuration("producer.partitions.refresh_interval") {
+		logger.Infof("refreshing the partition counts every %s like the kafka metadata instead of producer.partitions.refresh_interval", partitionTTL)
 	}
-	numPartitions := len(part)
-	log.Printf("number partitions: %d", numPartitions)
+	partitions := newPartitionCache(client.Partitions, partitionTTL)
+	if viper.GetBool("producer.partitions.halt_on_decrease") {
+		usesKeepPartition := partitioner == "keeppartition"
+		for _, p := range topicPartitioners {
+			usesKeepPartition = usesKeepPartition || p == "keeppartition"
+		}
+		if !usesKeepPartition {
+			logger.Warnf("producer.partitions.halt_on_decrease only applies to the keepPartition partitioner, ignoring it")
+		}
+		partitions.haltOnDecrease = usesKeepPartition
+	}
+	autoCreate := viper.GetBool("producer.auto_create_topic")
+	topicDetail := &sarama.TopicDetail{
+		NumPartitions:     viper.GetInt32("producer.topic.partitions"),
+		ReplicationFactor: int16(viper.GetInt("producer.topic.replication_factor")),
+	}
+	if autoCreate && (topicDetail.NumPartitions <= 0 || topicDetail.ReplicationFactor <= 0) {
+		logger.Fatalf("producer.topic.partitions and producer.topic.replication_factor must be positive")
+	}
+	// the admin is only connected once a topic is missing
+	var admin sarama.ClusterAdmin
+	getAdmin := func() (topicCreator, error) {
+		if admin == nil {
+			a, err := sarama.NewClusterAdmin(viper.GetStringSlice("producer.kafka.nodes"), cfg)
+			if err != nil {
+				return nil, err
+			}
+			admin = a
+		}
+		return admin, nil
+	}
+	closeAdmin := func() {
+		if admin != nil {
+			admin.Close()
+			admin = nil
+		}
+	}
+	// checkDestinations creates the missing destination topics of router and
+	// checks them for keeppartition. It runs at startup and before a reloaded
+	// routing is applied, to fail before any data flows instead of aborting
+	// the claims of the partitions which are missing on the destination.
+	checkDestinations := func(router *TopicRouter) error {
+		// the admin is not kept open between reloads
+		defer closeAdmin()
+		for _, source := range consumerTopics {
+			topics, err := router.ResolveDestinationTopics(source)
+			if err != nil {
+				return err
+			}
+			// every bucket is checked, the partition cache is filled per topic
+			topics = router.ShardedTopics(topics)
+			keepPartition := partitioner == "keeppartition"
+			if p, ok := topicPartitioners[strings.ToLower(source)]; ok {
+				keepPartition = p == "keeppartition"
+			}
+			var sourcePartitions []int32
+			if keepPartition {
+				sourcePartitions, err = client.Partitions(source)
+				if err != nil {
+					return fmt.Errorf("could not get partitions for source topic %s: %s", source, err)
+				}
+			}
+			for _, topic := range topics {
+				if autoCreate {
+					created, err := createMissingTopic(client.Partitions, getAdmin, topic, topicDetail)
+					if err != nil {
+						return err
+					}
+					if created {
+						logger.With(Fields{"topic": topic}).Infof("created the destination topic with %d partitions and replication factor %d", topicDetail.NumPartitions, topicDetail.ReplicationFactor)
+					}
+				}
+				numPartitions, err := partitions.Get(topic)
+				if err != nil {
+					return err
+				}
+				logger.Debugf("number partitions of %s: %d", topic, numPartitions)
+				if keepPartition {
+					if err := checkKeepPartition(source, int32(len(sourcePartitions)), topic, numPartitions); err != nil {
+						return err
+					}
+				}
+			}
+		}
+		return nil
+	}
+	if err := checkDestinations(router); err != nil {
+		logger.Fatalf("%s", err)
+	}
+	heartbeatTopic := viper.GetString("heartbeat.topic")
+	if autoCreate && heartbeatTopic != "" {
+		created, err := createMissingTopic(client.Partitions, getAdmin, heartbeatTopic, topicDetail)
+		if err != nil {
+			logger.Fatalf("%s", err)
+		}
+		if created {
+			logger.With(Fields{"topic": heartbeatTopic}).Infof("created the heartbeat topic with %d partitions and replication factor %d", topicDetail.NumPartitions, topicDetail.ReplicationFactor)
+		}
+	}
+	if keyPrefix != nil && keyPrefix.topic != "" {
+		if autoCreate {
+			created, err := createMissingTopic(client.Partitions, getAdmin, keyPrefix.topic, topicDetail)
+			if err != nil {
+				logger.Fatalf("%s", err)
+			}
+			if created {
+				logger.With(Fields{"topic": keyPrefix.topic}).Infof("created the key prefix topic with %d partitions and replication factor %d", topicDetail.NumPartitions, topicDetail.ReplicationFactor)
+			}
+		}
+		numPartitions, err := partitions.Get(keyPrefix.topic)
+		if err != nil {
+			logger.Fatalf("%s", err)
+		}
+		if keyPrefix.partition >= numPartitions {
+			logger.Fatalf("routing.key_prefix.partition %d does not exist on %s with %d partitions", keyPrefix.partition, keyPrefix.topic, numPartitions)
+		}
+	}
+	closeAdmin()
 	// connect to consuming kafka
 	producer, err := sarama.NewAsyncProducerFromClient(client)
 	if err != nil {
-		log.Fatalf("could not open kafka connection: %s", err)
+		logger.Fatalf("could not open kafka connection: %s", err)
 	}
 
-	signalchannel := make(chan os.Signal, 1)
-	signal.Notify(signalchannel, os.Interrupt, syscall.SIGINT, syscall.SIGTERM)
+	pausechannel := make(chan os.Signal, 1)
+	signal.Notify(pausechannel, syscall.SIGUSR1, syscall.SIGUSR2)
+	reloadchannel := make(chan os.Signal, 1)
+	signal.Notify(reloadchannel, syscall.SIGHUP)
 
 	// connect to consuming kafka
 	ctx, cancel := context.WithCancel(context.Background())
-	consumerGroup, err := sarama.NewConsumerGroupFromClient(viper.GetString("consumer.group.id"), client)
-	if err != nil {
-		log.Fatalf("could not start consumer group from client: %s", err)
+	var consumerGroup sarama.ConsumerGroup
+	// closed once the static partitions are mirrored, nil with a consumer group
+	var staticDone <-chan struct{}
+	if staticAssignments != nil {
+		static, err := newStaticConsumerGroup(client, staticAssignments)
+		if err != nil {
+			logger.Fatalf("could not start the consumer from client: %s", err)
+		}
+		logger.Infof("consuming %d static partitions without a consumer group (consumer.mode static)", len(staticAssignments))
+		consumerGroup, staticDone = static, static.done()
+	} else {
+		consumerGroup, err = sarama.NewConsumerGroupFromClient(viper.GetString("consumer.group.id"), client)
+		if err != nil {
+			logger.Fatalf("could not start consumer group from client: %s", err)
+		}
 	}
 	pfxRegistry := metrics.NewPrefixedRegistry(viper.GetString("consumer.group.id") + ".")
+	healthState := &health{maxErrorAge: viper.GetDuration("http.readyz.max_error_age")}
+	if cfg.Producer.Return.Successes {
+		go trackSuccesses(producer, pfxRegistry)
+	}
+	partitions.changed = func(topic string, from, to int32) {
+		metrics.GetOrRegisterCounter(`partition_count_changed`, pfxRegistry).Inc(1)
+	}
+	filter, err := newMessageFilter(filterOptions(viper.GetViper()))
+	if err != nil {
+		logger.Fatalf("%s", err)
+	}
+	keyTransform, err := keyTransformFromConfig()
+	if err != nil {
+		logger.Fatalf("%s", err)
+	}
 	consumer := Consumer{
-		ready: make(chan bool),
-		producer: producer,
-		numPartitions: int32(numPartitions),
-		producerTopic: producerTopic,
-		partitioner: partitioner,
-		metrics: pfxRegistry,
+		ready:             newReadySignal(),
+		producer:          producer,
+		partitions:        partitions,
+		router:            router,
+		partitioner:       partitioner,
+		topicPartitioners: topicPartitioners,
+		metrics:           pfxRegistry,
+		msgOptions: MsgOptions{
+			DropHeaders:        !viper.GetBool("producer.preserve_headers"),
+			DropTimestamp:      !viper.GetBool("producer.preserve_timestamp"),
+			KeyTransform:       keyTransform,
+			RoundRobin:         &roundRobin{},
+			KeylessFallback:    keylessFallback,
+			AllowTombstones:    viper.GetBool("producer.allow_tombstones"),
+			StrictKeyPartition: viper.GetBool("producer.strict_key_partition"),
+			PartitionHeader:    viper.GetString("producer.partition_header"),
+			HeaderFallback:     headerFallback,
+			InjectTraceHeaders: viper.GetBool("tracing.inject_headers"),
+			Random:             randomPartitions,
+		},
+		health:                healthState,
+		deadLetterTopic:       viper.GetString("deadletter.topic"),
+		failOnError:           viper.GetBool("consumer.fail_on_error"),
+		trackSuccesses:        cfg.Producer.Return.Successes,
+		filter:                filter,
+		throttle:              newThrottle(viper.GetFloat64("producer.rate_limit"), viper.GetFloat64("producer.byte_rate_limit")),
+		logMessages:           viper.GetBool("log.messages"),
+		dryRun:                dryRun,
+		pause:                 newPauser(),
+		redactor:              newJSONRedactor(viper.GetStringSlice("transform.json.redact")),
+		maxMessageBytes:       cfg.Producer.MaxMessageBytes,
+		window:                newInflightWindow(maxInflight),
+		atLeastOnce:           atLeastOnce,
+		breaker:               newBreaker(viper.GetInt("breaker.threshold"), viper.GetDuration("breaker.window"), viper.GetDuration("breaker.cooldown"), pfxRegistry),
+		assignments:           newAssignments(pfxRegistry),
+		enqueueBlockThreshold: viper.GetDuration("producer.enqueue_block_threshold"),
+		workers:               workers,
+		sampler:               sampler,
+		errors:                newErrorLog(viper.GetInt("http.errors.size")),
+		envelope:              viper.GetBool("transform.envelope"),
+		perTopicMetrics:       viper.GetBool("metrics.per_topic"),
+		checkDestinations:     checkDestinations,
+		limit:                 newMessageLimit(viper.GetInt64("consumer.max_messages")),
+		until:                 newTimeLimit(mirrorUntil),
+		input:                 &producerInput{},
+		keyPrefix:             keyPrefix,
+	}
+	// the lag of the static partitions has no committed offsets to start from
+	if interval := viper.GetDuration("consumer.lag.interval"); interval > 0 && staticAssignments == nil {
+		consumer.lag = newLagMonitor(client, viper.GetString("consumer.group.id"), pfxRegistry)
+		go consumer.lag.run(ctx, interval)
+	}
+	go partitions.run(ctx)
+	if offsetSync && !dryRun {
+		consumer.offsetMapping = newOffsetMapping()
+		go newOffsetSyncer(client, consumer.offsetMapping, viper.GetStringSlice("offset_sync.groups")).run(ctx, viper.GetDuration("offset_sync.interval"))
+	}
+	servers := httpServers{}
+	if viper.GetString("http.address") != "" {
+		healthState.register(servers.mux(viper.GetString("http.address")))
+		consumer.pause.register(servers.mux(viper.GetString("http.address")))
+		currentBuildInfo().register(servers.mux(viper.GetString("http.address")))
+		consumer.assignments.register(servers.mux(viper.GetString("http.address")))
+		if consumer.errors != nil {
+			consumer.errors.register(servers.mux(viper.GetString("http.address")))
+		}
 	}
+	if viper.GetString("metrics.prometheus.address") != "" {
+		servers.mux(viper.GetString("metrics.prometheus.address")).Handle("/metrics", prometheusHandler(pfxRegistry, viper.GetString("consumer.group.id"), currentBuildInfo()))
+	}
+	servers.start()
 	wg := &sync.WaitGroup{}
 	wg.Add(1)
 	go func() {
@@ -154,146 +683,882 @@ func main() {
 			// `Consume` should be called inside an infinite loop, when a
 			// server-side rebalance happens, the consumer session will need to be
 			// recreated to get the new claims
-			if err := consumerGroup.Consume(ctx, strings.Split(viper.GetString("consumer.topic"), ","), &consumer); err != nil {
-				log.Panicf("Error from consumer: %v", err)
+			healthState.setJoined(false)
+			sessionCtx, cancelSession := context.WithCancel(ctx)
+			consumer.setRestart(cancelSession)
+			if err := consumerGroup.Consume(sessionCtx, consumerTopics, &consumer); err != nil {
+				logger.Panicf("Error from consumer: %v", err)
 			}
+			cancelSession()
 			// check if context was cancelled, signaling that the consumer should stop
 			if ctx.Err() != nil {
 				return
 			}
-			consumer.ready = make(chan bool)
 		}
 	}()
-	<-consumer.ready
+	if heartbeatTopic != "" && !dryRun {
+		sourceClusterID := viper.GetString("heartbeat.source_cluster_id")
+		if sourceClusterID == "" {
+			if sourceClusterID, err = clusterID(client, heartbeatTopic); err != nil {
+				logger.With(Fields{"error": err}).Warnf("could not get the cluster id for the heartbeats, set heartbeat.source_cluster_id")
+			}
+		}
+		logger.Infof("producing heartbeats to %s every %s", heartbeatTopic, viper.GetDuration("heartbeat.interval"))
+		// stopped with the consumer, before the producer is closed
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			newHeartbeat(heartbeatTopic, sourceClusterID, pfxRegistry).run(ctx, viper.GetDuration("heartbeat.interval"), producer.Input())
+		}()
+	}
+	<-consumer.ready.done()
 
 	metrics.NewRegisteredMeter(`messages.processed`, pfxRegistry)
+	metrics.GetOrRegisterMeter(`bytes.processed`, pfxRegistry)
+	metrics.GetOrRegisterMeter(`consumer.errors`, pfxRegistry)
+	metrics.GetOrRegisterMeter(`producer.errors`, pfxRegistry)
+	metrics.GetOrRegisterMeter(`deadletter.produced`, pfxRegistry)
+	metrics.GetOrRegisterMeter(`messages.skipped`, pfxRegistry)
+	metrics.GetOrRegisterMeter(`messages.filtered`, pfxRegistry)
+	metrics.GetOrRegisterMeter(`messages.filtered_header`, pfxRegistry)
+	metrics.GetOrRegisterMeter(`messages.sampled_out`, pfxRegistry)
+	metrics.GetOrRegisterMeter(`transform.parse_errors`, pfxRegistry)
+	metrics.GetOrRegisterTimer(`messages.throttled_wait`, pfxRegistry)
+	metrics.GetOrRegisterTimer(`e2e.latency`, pfxRegistry)
+	metrics.GetOrRegisterCounter(`consumer.rebalances`, pfxRegistry)
+	// the reporters outlive the consumer and the producer, so their last
+	// flush has the final counts
+	metricsCtx, stopMetrics := context.WithCancel(context.Background())
+	defer stopMetrics()
+	reporters := &sync.WaitGroup{}
+	flushOnShutdown := viper.GetBool("metrics.flush_on_shutdown")
 	if viper.GetString("graphite.address") != "" {
-		log.Println(`Launched metrics producer socket`)
+		logger.Infof(`Launched metrics producer socket`)
 		addr, err := net.ResolveTCPAddr("tcp", viper.GetString("graphite.address"))
 		if err != nil {
-			log.Fatalln(err)
+			logger.Fatalf("%s", err)
 		}
-		go graphite.Graphite(pfxRegistry, viper.GetDuration("graphite.interval"), viper.GetString("graphite.prefix"), addr)
+		graphiteCfg := graphite.Config{
+			Addr:          addr,
+			FlushInterval: viper.GetDuration("graphite.interval"),
+			DurationUnit:  time.Nanosecond,
+			Prefix:        viper.GetString("graphite.prefix"),
+			Percentiles:   percentiles,
+		}
+		reporters.Add(1)
+		go func() {
+			defer reporters.Done()
+			reportMetrics(metricsCtx, graphiteCfg.FlushInterval, flushOnShutdown, "graphite", func() error {
+				// metrics registered since the last report are picked up
+				graphiteCfg.Registry = allowedMetrics(pfxRegistry, viper.GetString("consumer.group.id")+".", allow)
+				return graphite.Once(graphiteCfg)
+			})
+		}()
+	}
+	if viper.GetString("metrics.statsd.address") != "" {
+		logger.Infof(`Launched statsd metrics reporter`)
+		statsd := newStatsdReporter(pfxRegistry, viper.GetString("metrics.statsd.prefix"))
+		reporters.Add(1)
+		go func() {
+			defer reporters.Done()
+			statsd.run(metricsCtx, viper.GetDuration("metrics.statsd.interval"), viper.GetString("metrics.statsd.address"), flushOnShutdown)
+		}()
+	}
+	logger.Infof("Connection to Zookeeper and Kafka established.")
+	logger.Infof("Using partitioner %s", partitioner)
+	warnIgnoredKeys(partitioner)
+	// nil blocks forever if mirroring is not limited in time
+	var stopAfter <-chan time.Time
+	if d := viper.GetDuration("mirror.stop_after"); d > 0 {
+		stopAfter = time.After(d - time.Since(startTime))
 	}
-	log.Println("Connection to Zookeeper and Kafka established.")
-	log.Printf("Using partitioner %s\n", partitioner)
+
+	// set when mirroring stops because of an error, after the graceful shutdown
+	exitCode := 0
 
 runloop:
 	for {
 		select {
 		case <-signalchannel:
 			break runloop
+		case s := <-pausechannel:
+			if s == syscall.SIGUSR1 {
+				consumer.pause.pause()
+			} else {
+				consumer.pause.resume()
+			}
+		case <-reloadchannel:
+			if err := reloadConfig(&consumer); err != nil {
+				logger.With(Fields{"error": err}).Errorf("could not reload the config, keeping the old one")
+			}
 		case <-ctx.Done():
 			break runloop
+		case <-consumer.limit.done():
+			logger.Infof("%d messages were forwarded (consumer.max_messages), shutting down", viper.GetInt64("consumer.max_messages"))
+			break runloop
+		case <-consumer.until.done():
+			logger.Infof("consumed a message after mirror.until, shutting down")
+			break runloop
+		case <-staticDone:
+			logger.Infof("the static partitions are mirrored, shutting down")
+			break runloop
+		case <-partitions.done():
+			logger.Errorf("a destination topic lost partitions (producer.partitions.halt_on_decrease), shutting down")
+			exitCode = 1
+			break runloop
+		case <-stopAfter:
+			logger.Infof("mirrored for %s (mirror.stop_after), shutting down", viper.GetDuration("mirror.stop_after"))
+			break runloop
 		case e := <-consumerGroup.Errors():
-			log.Println(e)
+			logger.With(Fields{"error": e}).Errorf("consumer error")
 			metrics.GetOrRegisterMeter(`consumer.errors`, pfxRegistry).Mark(1)
+			consumer.errors.addConsumerError(e)
 		case e := <-producer.Errors():
-			log.Println(e)
-			metrics.GetOrRegisterMeter(`producer.errors`, pfxRegistry).Mark(1)
+			producerError(e, pfxRegistry)
+			consumer.errors.addProducerError(e)
+			healthState.producerError(time.Now())
 		}
 	}
-	c1 := make(chan string, 1)
+	// stop consuming first so no new messages reach the producer, then flush
+	// and close the producer
+	shutdownTimeout := viper.GetDuration("shutdown.timeout")
+	consumerClosed := make(chan struct{})
+	producerClosed := make(chan struct{})
 	go func() {
-		if err = consumerGroup.Close(); err != nil {
-			log.Println("Error closing the consumer", err)
+		if err := consumerGroup.Close(); err != nil {
+			logger.With(Fields{"error": err}).Errorf("could not close the consumer")
 		}
 		cancel()
 		wg.Wait()
-		c1 <- "consumer"
-	}()
-	go func() {
-		if err = producer.Close(); err != nil {
-			log.Println("Error closing the producer", err)
-		}
-		client.Close()
-		c1 <- "producer"
+		close(consumerClosed)
 	}()
-	var closecnt int
+	// keep draining the producer errors while the claims finish, otherwise
+	// the producer and with it the claims could block
+	producerErrors := producer.Errors()
+	timeout := time.After(shutdownTimeout)
 	for {
 		select {
-		case res := <-c1:
-			fmt.Printf("Successfully closed %s\n", res)
-			closecnt++
-			if closecnt == 2 {
-				os.Exit(0)
+		case e := <-producerErrors:
+			producerError(e, pfxRegistry)
+			consumer.errors.addProducerError(e)
+		case <-consumerClosed:
+			logger.Infof("Successfully closed consumer")
+			consumerClosed = nil
+			// Close drains the remaining errors itself
+			producerErrors = nil
+			go func() {
+				if err := consumer.closeProducer(); err != nil {
+					logger.With(Fields{"error": err}).Errorf("could not close the producer")
+				}
+				client.Close()
+				close(producerClosed)
+			}()
+		case <-producerClosed:
+			logger.Infof("Successfully closed producer")
+			stopMetrics()
+			reporters.Wait()
+			if exitCode != 0 {
+				os.Exit(exitCode)
 			}
-		case <-time.After(5 * time.Minute):
-			fmt.Println("could not stop consumer or producer within the defined timeout of 5 minutes")
+			// return instead of exiting so the deferred profiles are written
+			return
+		case <-timeout:
+			logger.Errorf("could not stop consumer or producer within the defined timeout of %s", shutdownTimeout)
+			stopMetrics()
+			reporters.Wait()
 			os.Exit(1)
 		}
 	}
 }
 
-func getCompressionCodec(comp string) sarama.CompressionCodec {
-	switch comp {
+// reportMetrics calls report every interval until ctx is done, then a last
+// time if flushOnShutdown is set so the final counts are not lost with the
+// last interval
+func reportMetrics(ctx context.Context, interval time.Duration, flushOnShutdown bool, sink string, report func() error) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if err := report(); err != nil {
+				logger.With(Fields{"error": err}).Warnf("could not send metrics to %s", sink)
+			}
+		case <-ctx.Done():
+			if !flushOnShutdown {
+				return
+			}
+			if err := report(); err != nil {
+				logger.With(Fields{"error": err}).Warnf("could not flush the metrics to %s on shutdown", sink)
+			}
+			return
+		}
+	}
+}
+
+// destinationPartition returns the partition the producer will send the
+// message to, or -1 if the partitioner picks it randomly
+func destinationPartition(partitioner string, msg *sarama.ProducerMessage, numPartitions int32) int32 {
+	var p sarama.Partitioner
+	switch partitioner {
+	case "keeppartition", "modulo", "consistent", "roundrobin", "header":
+		return msg.Partition
+	case "hash":
+		p = sarama.NewHashPartitioner(msg.Topic)
+	case "murmur2":
+		p = NewMurmur2Partitioner(msg.Topic)
+	default:
+		return -1
+	}
+	if msg.Key == nil {
+		return -1
+	}
+	partition, err := p.Partition(msg, numPartitions)
+	if err != nil {
+		return -1
+	}
+	return partition
+}
+
+// pickPartition returns the partition a message built by PartitionMsg goes
+// to, including the ones the producer would pick itself. It is used for the
+// manual partitioner of the producer.
+func pickPartition(partitioner string, msg *sarama.ProducerMessage, numPartitions int32, opts MsgOptions) int32 {
+	if p := destinationPartition(partitioner, msg, numPartitions); p >= 0 {
+		return p
+	}
+	if (partitioner == "hash" && opts.KeylessFallback == "roundrobin") || (partitioner == "random" && opts.Random != nil) {
+		// set by PartitionMsg
+		return msg.Partition
+	}
+	return rand.Int31n(numPartitions)
+}
+
+// checkKeepPartition returns an error if the destination topic has less
+// partitions than the source topic, keeppartition could not mirror the
+// messages of the partitions missing on the destination
+func checkKeepPartition(source string, sourcePartitions int32, destination string, destPartitions int32) error {
+	if destPartitions < sourcePartitions {
+		return fmt.Errorf("keeppartition needs at least as many partitions on the destination as on the source, but %s has %d and %s only %d partitions", source, sourcePartitions, destination, destPartitions)
+	}
+	return nil
+}
+
+func getCompressionCodec(comp string) (sarama.CompressionCodec, error) {
+	switch strings.ToLower(comp) {
 	case "snappy":
-		return sarama.CompressionSnappy
+		return sarama.CompressionSnappy, nil
 	case "gzip":
-		return sarama.CompressionGZIP
+		return sarama.CompressionGZIP, nil
 	case "lz4":
-		return sarama.CompressionLZ4
+		return sarama.CompressionLZ4, nil
+	case "zstd":
+		return sarama.CompressionZSTD, nil
+	case "", "none":
+		return sarama.CompressionNone, nil
+	default:
+		return sarama.CompressionNone, fmt.Errorf("invalid producer.compression %q, must be none, gzip, snappy, lz4 or zstd", comp)
+	}
+}
+
+// setCompression configures the producer compression, cfg.Version must be set
+// since not every codec is supported by older brokers
+func setCompression(cfg *sarama.Config, comp string) error {
+	codec, err := getCompressionCodec(comp)
+	if err != nil {
+		return err
+	}
+	if codec == sarama.CompressionZSTD && !cfg.Version.IsAtLeast(sarama.V2_1_0_0) {
+		return fmt.Errorf("producer.compression zstd requires producer.kafka.version 2.1.0 or newer, got %s", cfg.Version)
+	}
+	cfg.Producer.Compression = codec
+	return nil
+}
+
+// setCompressionLevel configures the level of the codec set by
+// setCompression. Only gzip supports levels, zstd and lz4 always use their
+// default level. cfg is not changed if the level is invalid for the codec.
+func setCompressionLevel(cfg *sarama.Config, level int) error {
+	if level == sarama.CompressionLevelDefault {
+		return nil
+	}
+	if cfg.Producer.Compression != sarama.CompressionGZIP {
+		return fmt.Errorf("producer.compression.level is not supported by %s compression", cfg.Producer.Compression)
+	}
+	if level < gzip.BestSpeed || level > gzip.BestCompression {
+		return fmt.Errorf("producer.compression.level must be between %d and %d for gzip, got %d", gzip.BestSpeed, gzip.BestCompression, level)
+	}
+	cfg.Producer.CompressionLevel = level
+	return nil
+}
+
+// setIsolationLevel sets the isolation level of the consumer, read_committed
+// skips the messages of aborted transactions and requires kafka >= 0.11
+func setIsolationLevel(cfg *sarama.Config, level string) error {
+	switch strings.ToLower(level) {
+	case "read_uncommitted":
+		cfg.Consumer.IsolationLevel = sarama.ReadUncommitted
+	case "read_committed":
+		if !cfg.Version.IsAtLeast(sarama.V0_11_0_0) {
+			return fmt.Errorf("consumer.isolation_level read_committed requires producer.kafka.version >= 0.11.0.0")
+		}
+		cfg.Consumer.IsolationLevel = sarama.ReadCommitted
+	default:
+		return fmt.Errorf("invalid consumer.isolation_level %q, must be read_uncommitted or read_committed", level)
+	}
+	return nil
+}
+
+func getInitialOffset(initial string) (int64, error) {
+	switch strings.ToLower(initial) {
+	case "oldest":
+		return sarama.OffsetOldest, nil
+	case "newest":
+		return sarama.OffsetNewest, nil
+	default:
+		return 0, fmt.Errorf("invalid consumer.offsets.initial %q, must be oldest or newest", initial)
+	}
+}
+
+// getRebalanceStrategy returns the range strategy alongside an error for
+// unknown strategies
+func getRebalanceStrategy(strategy string) (sarama.BalanceStrategy, error) {
+	switch strings.ToLower(strategy) {
+	case "range":
+		return sarama.BalanceStrategyRange, nil
+	case "roundrobin":
+		return sarama.BalanceStrategyRoundRobin, nil
+	case "sticky":
+		return sarama.BalanceStrategySticky, nil
 	default:
-		return sarama.CompressionNone
+		return sarama.BalanceStrategyRange, fmt.Errorf("unknown consumer.group.rebalance.strategy %q", strategy)
 	}
 }
 
-func PartitionMsg(partitioner, topic string, origmsg *sarama.ConsumerMessage, numPartitions int32) (sarama.ProducerMessage, error) {
+func getRequiredAcks(acks string) (sarama.RequiredAcks, error) {
+	switch strings.ToLower(acks) {
+	case "none":
+		return sarama.NoResponse, nil
+	case "local", "":
+		return sarama.WaitForLocal, nil
+	case "all":
+		return sarama.WaitForAll, nil
+	default:
+		return 0, fmt.Errorf("invalid producer.required_acks %q, must be none, local or all", acks)
+	}
+}
+
+// enableIdempotence configures the producer to be idempotent, which requires
+// acks from all replicas and a single in flight request per broker.
+// requiredAcks is the configured producer.required_acks, setting it to
+// anything but all conflicts with idempotence.
+func enableIdempotence(cfg *sarama.Config, requiredAcks string) error {
+	if requiredAcks != "" && strings.ToLower(requiredAcks) != "all" {
+		return fmt.Errorf("producer.idempotent requires producer.required_acks to be all, got %q", requiredAcks)
+	}
+	if cfg.Producer.Retry.Max < 1 {
+		return fmt.Errorf("producer.idempotent requires producer.retry.max to be at least 1")
+	}
+	if !cfg.Version.IsAtLeast(sarama.V0_11_0_0) {
+		return fmt.Errorf("producer.idempotent requires producer.kafka.version 0.11.0.0 or newer, got %s", cfg.Version)
+	}
+	cfg.Producer.Idempotent = true
+	cfg.Producer.RequiredAcks = sarama.WaitForAll
+	cfg.Net.MaxOpenRequests = 1
+	return nil
+}
+
+// enableOrdering keeps the order of the messages of every source partition,
+// or of every key for the hash based partitioners. ConsumeClaim hands the
+// messages of a claim to the producer in the order they were consumed, but
+// with several requests in flight a retried request can overtake the ones
+// sent after it. Idempotence limits the producer to one request per broker
+// and lets the broker reject duplicates and out of order batches.
+func enableOrdering(cfg *sarama.Config, requiredAcks, partitioner string) error {
+	if err := orderedPartitioner(partitioner); err != nil {
+		return err
+	}
+	if err := enableIdempotence(cfg, requiredAcks); err != nil {
+		return fmt.Errorf("%s (required by producer.ordered)", err)
+	}
+	return nil
+}
+
+// orderedPartitioner returns an error if the partitioner does not keep the
+// order of a partition or key
+func orderedPartitioner(partitioner string) error {
+	switch strings.ToLower(partitioner) {
+	case "random", "roundrobin":
+		return fmt.Errorf("producer.ordered does not work with the %s partitioner, it spreads the messages of a partition over all destination partitions", partitioner)
+	}
+	return nil
+}
+
+// getKeylessFallback parses how the hash partitioner handles messages
+// without a key
+func getKeylessFallback(fallback string) (string, error) {
+	switch strings.ToLower(fallback) {
+	case "error", "":
+		return "error", nil
+	case "random", "roundrobin":
+		return strings.ToLower(fallback), nil
+	default:
+		return "", fmt.Errorf("invalid producer.hash.keyless_fallback %q, must be error, random or roundrobin", fallback)
+	}
+}
+
+// getHeaderFallback parses what the header partitioner does with messages
+// without a valid partition header: error or any other partitioner
+func getHeaderFallback(fallback string) (string, error) {
+	fallback = strings.ToLower(fallback)
+	if fallback == "" || fallback == "error" {
+		return "error", nil
+	}
+	if fallback == "header" || !stringSet(partitioners)[fallback] {
+		return "", fmt.Errorf("invalid producer.partition_header_fallback %q, must be error or a partitioner other than header", fallback)
+	}
+	return fallback, nil
+}
+
+// checkPartitionHeader returns an error if the header partitioner is used
+// without producer.partition_header
+func checkPartitionHeader(partitioner string, topicPartitioners map[string]string, header string) error {
+	if header != "" {
+		return nil
+	}
+	if partitioner == "header" {
+		return fmt.Errorf("the header partitioner requires producer.partition_header")
+	}
+	for topic, p := range topicPartitioners {
+		if p == "header" {
+			return fmt.Errorf("the header partitioner of topic.partitioner.%s requires producer.partition_header", topic)
+		}
+	}
+	return nil
+}
+
+// headerPartition returns the partition of the last header named name, it
+// has to be a decimal partition of the destination topic
+func headerPartition(headers []*sarama.RecordHeader, name string, numPartitions int32) (int32, bool) {
+	var value []byte
+	found := false
+	for _, h := range headers {
+		if h != nil && string(h.Key) == name {
+			value, found = h.Value, true
+		}
+	}
+	if !found {
+		return 0, false
+	}
+	partition, err := strconv.ParseInt(strings.TrimSpace(string(value)), 10, 32)
+	if err != nil || partition < 0 || partition >= int64(numPartitions) {
+		return 0, false
+	}
+	return int32(partition), true
+}
+
+// setNetTimeouts sets the timeouts of the broker connections, unreachable
+// brokers fail after the dial timeout instead of hanging the startup
+func setNetTimeouts(cfg *sarama.Config, dial, read, write time.Duration) error {
+	if dial <= 0 || read <= 0 || write <= 0 {
+		return fmt.Errorf("kafka.dial_timeout, kafka.read_timeout and kafka.write_timeout must be positive, got %s, %s and %s", dial, read, write)
+	}
+	cfg.Net.DialTimeout = dial
+	cfg.Net.ReadTimeout = read
+	cfg.Net.WriteTimeout = write
+	return nil
+}
+
+// setMetadataRefresh sets how often the client refreshes the metadata of the
+// cluster, i.e. the partitions of the topics and the brokers
+func setMetadataRefresh(cfg *sarama.Config, interval time.Duration) error {
+	if interval <= 0 {
+		return fmt.Errorf("kafka.metadata.refresh_interval must be positive, got %s", interval)
+	}
+	cfg.Metadata.RefreshFrequency = interval
+	return nil
+}
+
+// partitionCacheTTL returns the ttl of the partition cache. The cache reads
+// the metadata of the client, it refreshes at least as often as the metadata
+// unless refreshing is disabled.
+func partitionCacheTTL(ttl, metadataRefresh time.Duration) time.Duration {
+	if ttl > metadataRefresh {
+		return metadataRefresh
+	}
+	return ttl
+}
+
+// setFetchSizes configures how many bytes the consumer fetches per request
+// and partition, a max of 0 means unlimited
+func setFetchSizes(cfg *sarama.Config, min, def, max int32) error {
+	if min < 1 {
+		return fmt.Errorf("consumer.fetch.min must be at least 1, got %d", min)
+	}
+	if def < min {
+		return fmt.Errorf("consumer.fetch.default (%d) must not be smaller than consumer.fetch.min (%d)", def, min)
+	}
+	if max < 0 || (max > 0 && max < def) {
+		return fmt.Errorf("consumer.fetch.max (%d) must be 0 or not smaller than consumer.fetch.default (%d)", max, def)
+	}
+	cfg.Consumer.Fetch.Min = min
+	cfg.Consumer.Fetch.Default = def
+	cfg.Consumer.Fetch.Max = max
+	return nil
+}
+
+// MsgOptions controls which parts of the source message are carried over
+// into the mirrored message. The zero value mirrors everything.
+type MsgOptions struct {
+	// DropHeaders discards the record headers of the source message
+	DropHeaders bool
+	// DropTimestamp leaves the timestamp unset so sarama stamps the message
+	// with the time it is added to a produce set
+	DropTimestamp bool
+	// KeyTransform rewrites the key before it is partitioned and encoded
+	KeyTransform *keyTransform
+	// RoundRobin is the counter of the roundrobin partitioner and of keyless
+	// messages of the consistent partitioner, shared by all claims
+	RoundRobin *roundRobin
+	// KeylessFallback is what the hash partitioner does with keyless
+	// messages: error (the default), random or roundrobin
+	KeylessFallback string
+	// AllowTombstones mirrors messages with a null value (tombstones of
+	// compacted topics) as null values instead of rejecting them
+	AllowTombstones bool
+	// InjectTraceHeaders sets a W3C traceparent header continuing the trace of
+	// the source message, or starting a new one
+	InjectTraceHeaders bool
+	// StrictKeyPartition rejects keyed messages if the partitioner picks the
+	// partition without the key
+	StrictKeyPartition bool
+	// PartitionHeader is the header carrying the destination partition for
+	// the header partitioner
+	PartitionHeader string
+	// HeaderFallback is the partitioner used by the header partitioner if the
+	// header is missing or invalid, error rejects these messages
+	HeaderFallback string
+	// Random picks the partitions of the random partitioner, nil leaves them
+	// to the producer
+	Random *randomPartitions
+}
+
+// warnIgnoredKeys warns that keyed messages are not placed by their key
+// unless producer.strict_key_partition rejects them
+func warnIgnoredKeys(partitioner string) {
+	if ignoresKey(partitioner) && !viper.GetBool("producer.strict_key_partition") {
+		logger.Warnf("the %s partitioner picks the partitions without the keys, keyed messages keep their key but are not placed by it. Set producer.strict_key_partition to reject them", partitioner)
+	}
+}
+
+// ignoresKey reports whether the partitioner picks an explicit partition
+// without looking at the key. The key is still mirrored, but consumers of
+// the destination can't expect all messages of a key in one partition.
+func ignoresKey(partitioner string) bool {
+	switch partitioner {
+	case "keeppartition", "modulo", "roundrobin", "header":
+		return true
+	}
+	return false
+}
+
+func PartitionMsg(partitioner, topic string, origmsg *sarama.ConsumerMessage, numPartitions int32, opts MsgOptions) (sarama.ProducerMessage, error) {
 	if partitioner == "" || topic == "" {
 		return sarama.ProducerMessage{}, fmt.Errorf("configuration error, partitioner or topic was not set.")
 	}
-	if len(origmsg.Value) == 0 {
-		return sarama.ProducerMessage{}, fmt.Errorf("value is not set")
+	//a nil interface, a nil ByteEncoder would be sent as an empty value
+	var value sarama.Encoder
+	if origmsg.Value != nil || !opts.AllowTombstones {
+		if len(origmsg.Value) == 0 {
+			return sarama.ProducerMessage{}, fmt.Errorf("value is not set")
+		}
+		value = sarama.ByteEncoder(origmsg.Value)
 	}
 	if origmsg.Partition < 0 {
 		return sarama.ProducerMessage{}, fmt.Errorf("the source message has a negative value for its partition")
 	}
+	key := opts.KeyTransform.apply(origmsg.Key)
+	//null keys stay null, an empty key would be partitioned and compacted as a
+	//key of its own
+	var encodedKey sarama.Encoder
+	if key != nil {
+		encodedKey = sarama.ByteEncoder(key)
+	}
+	var msg sarama.ProducerMessage
 	switch partitioner {
 	case "hash":
 		//by default sarama is using a hash partitioner
-		if len(origmsg.Key) == 0 {
+		if len(key) > 0 {
+			msg = sarama.ProducerMessage{Topic: topic, Key: encodedKey, Value: value}
+			break
+		}
+		switch opts.KeylessFallback {
+		case "random":
+			//sarama's hash partitioner picks a random partition for keyless messages
+			msg = sarama.ProducerMessage{Topic: topic, Value: value}
+		case "roundrobin":
+			if opts.RoundRobin == nil {
+				return sarama.ProducerMessage{}, fmt.Errorf("configuration error, the roundrobin fallback has no round robin counter")
+			}
+			msg = sarama.ProducerMessage{Topic: topic, Partition: opts.RoundRobin.next(numPartitions), Value: value}
+		default:
 			return sarama.ProducerMessage{}, fmt.Errorf("key is not set, we can't use the hash function for this type of messages")
 		}
-		return sarama.ProducerMessage{Topic: topic, Key: sarama.ByteEncoder(origmsg.Key), Value: sarama.ByteEncoder(origmsg.Value)}, nil
+	case "murmur2":
+		//the partition is picked by the murmur2 partitioner, same as the java producer would
+		if len(key) == 0 {
+			return sarama.ProducerMessage{}, fmt.Errorf("key is not set, we can't use the murmur2 function for this type of messages")
+		}
+		msg = sarama.ProducerMessage{Topic: topic, Key: encodedKey, Value: value}
 	case "keeppartition":
 		//we set the target partition is set to the source partition
+		//the partition counts are checked at startup, this catches partitions
+		//added to the source later on
 		if origmsg.Partition > numPartitions-1 {
 			return sarama.ProducerMessage{}, fmt.Errorf("the dest topic has less partitions than the source, this is an invalid configuration and not compatible with keep partition.")
 		}
-		return sarama.ProducerMessage{Topic: topic, Partition: origmsg.Partition, Key: sarama.ByteEncoder(origmsg.Key), Value: sarama.ByteEncoder(origmsg.Value)}, nil
+		msg = sarama.ProducerMessage{Topic: topic, Partition: origmsg.Partition, Key: encodedKey, Value: value}
 	case "modulo":
 		//we will calculate a new target partition using the modulo function.
 		targetPartition := origmsg.Partition % numPartitions
 		if targetPartition > numPartitions-1 {
 			return sarama.ProducerMessage{}, fmt.Errorf("the target partition does not exist on the destination topic")
 		}
-		return sarama.ProducerMessage{Topic: topic, Partition: targetPartition, Key: sarama.ByteEncoder(origmsg.Key), Value: sarama.ByteEncoder(origmsg.Value)}, nil
+		msg = sarama.ProducerMessage{Topic: topic, Partition: targetPartition, Key: encodedKey, Value: value}
+	case "consistent":
+		//keyed messages are hashed onto the destination partitions so every key
+		//stays in one partition, keyless messages are spread round robin
+		var targetPartition int32
+		if len(key) > 0 {
+			targetPartition = murmur2Partition(key, numPartitions)
+		} else if opts.RoundRobin != nil {
+			targetPartition = opts.RoundRobin.next(numPartitions)
+		} else {
+			return sarama.ProducerMessage{}, fmt.Errorf("configuration error, the consistent partitioner has no round robin counter")
+		}
+		msg = sarama.ProducerMessage{Topic: topic, Partition: targetPartition, Key: encodedKey, Value: value}
+	case "roundrobin":
+		//every message goes to the next partition, spreading bursts evenly
+		if opts.RoundRobin == nil {
+			return sarama.ProducerMessage{}, fmt.Errorf("configuration error, the roundrobin partitioner has no round robin counter")
+		}
+		msg = sarama.ProducerMessage{Topic: topic, Partition: opts.RoundRobin.next(numPartitions), Key: encodedKey, Value: value}
 	case "random":
-		return sarama.ProducerMessage{Topic: topic, Value: sarama.ByteEncoder(origmsg.Value)}, nil
+		if opts.Random == nil {
+			//sarama's hash partitioner picks a random partition for keyless messages
+			msg = sarama.ProducerMessage{Topic: topic, Value: value}
+			break
+		}
+		//the producer uses the manual partitioner
+		partition, err := opts.Random.next(numPartitions)
+		if err != nil {
+			return sarama.ProducerMessage{}, err
+		}
+		msg = sarama.ProducerMessage{Topic: topic, Partition: partition, Value: value}
+		if opts.Random.keepKey {
+			msg.Key = encodedKey
+		}
+	case "header":
+		//a routing hint header of the source message picks the partition
+		if partition, ok := headerPartition(origmsg.Headers, opts.PartitionHeader, numPartitions); ok {
+			msg = sarama.ProducerMessage{Topic: topic, Partition: partition, Key: encodedKey, Value: value}
+			break
+		}
+		if opts.HeaderFallback == "" || opts.HeaderFallback == "error" || opts.HeaderFallback == "header" {
+			return sarama.ProducerMessage{}, fmt.Errorf("the partition header %s is missing or not a partition of the destination topic", opts.PartitionHeader)
+		}
+		//headers and timestamp are set below
+		fallbackOpts := opts
+		fallbackOpts.DropHeaders, fallbackOpts.DropTimestamp, fallbackOpts.InjectTraceHeaders = true, true, false
+		fallback, err := PartitionMsg(opts.HeaderFallback, topic, origmsg, numPartitions, fallbackOpts)
+		if err != nil {
+			return sarama.ProducerMessage{}, err
+		}
+		//the producer uses the manual partitioner for the header partitioner
+		fallback.Partition = pickPartition(opts.HeaderFallback, &fallback, numPartitions, opts)
+		msg = sarama.ProducerMessage{Topic: topic, Partition: fallback.Partition, Key: fallback.Key, Value: fallback.Value}
 	default:
 		return sarama.ProducerMessage{}, fmt.Errorf("invalid partitioner defined")
 	}
+	//the random partitioner only keeps keys with producer.random.keep_key
+	if opts.StrictKeyPartition && msg.Key != nil && (ignoresKey(partitioner) || partitioner == "random") {
+		return sarama.ProducerMessage{}, fmt.Errorf("the message has a key but the %s partitioner does not use it to pick the partition (producer.strict_key_partition)", partitioner)
+	}
+	if !opts.DropHeaders {
+		msg.Headers = copyHeaders(origmsg.Headers)
+	}
+	if opts.InjectTraceHeaders {
+		msg.Headers = injectTraceparent(msg.Headers, origmsg.Headers)
+	}
+	if !opts.DropTimestamp {
+		msg.Timestamp = sourceTimestamp(origmsg)
+	}
+	return msg, nil
+}
+
+// sourceTimestamp returns the timestamp of the source message. Messages from
+// brokers without timestamp support (or log append time brokers which did not
+// report one) carry the zero value, in that case the current time is used.
+// Note that the destination topic has to use message.timestamp.type=CreateTime,
+// with LogAppendTime the broker overwrites whatever we send.
+func sourceTimestamp(origmsg *sarama.ConsumerMessage) time.Time {
+	if origmsg.Timestamp.IsZero() || origmsg.Timestamp.Unix() <= 0 {
+		return time.Now()
+	}
+	return origmsg.Timestamp
+}
+
+// e2eLatency returns the time from the source timestamp of the message until
+// now. Messages without a timestamp (see sourceTimestamp) and ones from the
+// future, caused by clock skew to the source producers or brokers, have
+// none.
+func e2eLatency(origmsg *sarama.ConsumerMessage, now time.Time) (time.Duration, bool) {
+	if origmsg.Timestamp.IsZero() || origmsg.Timestamp.Unix() <= 0 || origmsg.Timestamp.After(now) {
+		return 0, false
+	}
+	return now.Sub(origmsg.Timestamp), true
+}
+
+// copyHeaders converts the headers of a consumed record into the form the
+// producer expects, skipping nil entries
+func copyHeaders(headers []*sarama.RecordHeader) []sarama.RecordHeader {
+	if len(headers) == 0 {
+		return nil
+	}
+	res := make([]sarama.RecordHeader, 0, len(headers))
+	for _, h := range headers {
+		if h == nil {
+			continue
+		}
+		res = append(res, sarama.RecordHeader{Key: h.Key, Value: h.Value})
+	}
+	return res
+}
+
+// messageSize returns the size of the key, value and headers of a message
+func messageSize(message *sarama.ConsumerMessage) int64 {
+	size := len(message.Key) + len(message.Value)
+	for _, h := range message.Headers {
+		if h == nil {
+			continue
+		}
+		size += len(h.Key) + len(h.Value)
+	}
+	return int64(size)
 }
 
 // Consumer represents a Sarama consumer group consumer
 type Consumer struct {
-	ready chan bool
-	producer sarama.AsyncProducer
-	numPartitions int32
-	producerTopic string
+	// ready is signalled once the first session started
+	ready       *readySignal
+	producer    sarama.AsyncProducer
+	partitions  *partitionCache
+	router      *TopicRouter
 	partitioner string
-	metrics metrics.Registry
+	// topicPartitioners override partitioner per source topic, the
+	// producer uses the partitions picked by mirrorMsg if there are any
+	topicPartitioners map[string]string
+	metrics           metrics.Registry
+	msgOptions        MsgOptions
+	health            *health
+	deadLetterTopic   string
+	failOnError       bool
+	trackSuccesses    bool
+	filter            *messageFilter
+	// reloadMu guards router and filter which are swapped on SIGHUP
+	reloadMu    sync.RWMutex
+	throttle    *throttle
+	logMessages bool
+	lag         *lagMonitor
+	// assignments are the claims of the current session
+	assignments     *assignments
+	dryRun          bool
+	pause           *pauser
+	redactor        *jsonRedactor
+	maxMessageBytes int
+	// window limits the unacknowledged messages, nil if offsets are marked
+	// as soon as the messages are handed to the producer
+	window inflightWindow
+	// atLeastOnce marks offsets once the messages are acknowledged and
+	// restarts the session if a message could not be produced
+	atLeastOnce bool
+	// restartMu guards restart which ends the current session
+	restartMu sync.Mutex
+	restart   func()
+	// breaker stops producing while the destination keeps failing, nil if
+	// disabled
+	breaker *breaker
+	// enqueueBlockThreshold is the time blocked on the producer input after
+	// which a send counts as backpressure event, 0 disables the counter
+	enqueueBlockThreshold time.Duration
+	// offsetMapping records the destination offsets of mirrored messages for
+	// the offset sync, nil if disabled
+	offsetMapping *offsetMapping
+	// workers prepare the messages of a claim concurrently if more than one
+	workers int
+	// sampler drops messages which are not sampled, nil forwards all
+	sampler *sampler
+	// errors keeps the last errors for GET /errors, nil if disabled
+	errors *errorLog
+	// envelope wraps the values in a JSON envelope with the source topic,
+	// partition and offset
+	envelope bool
+	// perTopicMetrics adds messages.processed and bytes.processed meters per
+	// source topic and destination.<topic>.processed per destination topic
+	perTopicMetrics bool
+	// checkDestinations creates and checks the destination topics of a
+	// reloaded router, nil skips the checks
+	checkDestinations func(*TopicRouter) error
+	// limit stops mirroring after consumer.max_messages, nil if unlimited
+	limit *messageLimit
+	// until stops mirroring at the first message after mirror.until, nil if
+	// unlimited
+	until *timeLimit
+	// input guards the sends against the shutdown of the producer
+	input *producerInput
+	// keyPrefix routes the messages with routing.key_prefix.prefix, nil if
+	// not configured
+	keyPrefix *keyPrefixRoute
+}
+
+// readySignal is closed once, every session runs Setup and a rebalance can
+// run it again before anybody waited for the signal
+type readySignal struct {
+	once sync.Once
+	ch   chan struct{}
+}
+
+func newReadySignal() *readySignal {
+	return &readySignal{ch: make(chan struct{})}
+}
+
+func (r *readySignal) signal() {
+	r.once.Do(func() { close(r.ch) })
+}
+
+// done is closed once signal was called
+func (r *readySignal) done() <-chan struct{} {
+	return r.ch
 }
 
 // Setup is run at the beginning of a new session, before ConsumeClaim
-func (consumer *Consumer) Setup(sarama.ConsumerGroupSession) error {
+func (consumer *Consumer) Setup(session sarama.ConsumerGroupSession) error {
 	// Mark the consumer as ready
-	close(consumer.ready)
+	consumer.ready.signal()
+	consumer.health.setJoined(true)
+	consumer.lag.assign(session.Claims())
+	consumer.assignments.assign(session.MemberID(), session.GenerationID(), session.Claims())
+	// every session starts with a rebalance, frequent ones point to too short
+	// session timeouts or slow claims
+	metrics.GetOrRegisterCounter(`consumer.rebalances`, consumer.metrics).Inc(1)
+	logger.With(Fields{"member_id": session.MemberID(), "generation_id": session.GenerationID(), "claims": session.Claims()}).Infof("consumer group session started")
 	return nil
 }
 
 // Cleanup is run at the end of a session, once all ConsumeClaim goroutines have exited
-func (consumer *Consumer) Cleanup(sarama.ConsumerGroupSession) error {
+func (consumer *Consumer) Cleanup(session sarama.ConsumerGroupSession) error {
+	consumer.health.setJoined(false)
+	consumer.lag.assign(nil)
+	consumer.assignments.assign(session.MemberID(), session.GenerationID(), nil)
 	return nil
 }
 
@@ -303,17 +1568,467 @@ func (consumer *Consumer) ConsumeClaim(session sarama.ConsumerGroupSession, clai
 	// Do not move the code below to a goroutine.
 	// The `ConsumeClaim` itself is called within a goroutine, see:
 	// https://github.com/Shopify/sarama/blob/master/consumer_group.go#L27-L29
+	// messages are marked once all their produced messages are acknowledged,
+	// without a window as soon as they are handed to the producer
+	tracker := newOffsetTracker(session)
+	if consumer.workers > 1 {
+		return consumer.consumeParallel(session, claim, tracker)
+	}
 	for message := range claim.Messages() {
-		msg, err := PartitionMsg(consumer.partitioner, consumer.producerTopic, message, consumer.numPartitions)
-		if err != nil {
-			log.Println(err)
+		if err := consumer.pause.wait(session.Context()); err != nil {
+			// the session ended while paused, the message is consumed again
+			return nil
+		}
+		if !consumer.until.allows(message) || consumer.limit.exhausted() {
+			// mirror.until or consumer.max_messages is reached, the message
+			// stays unmarked
+			return nil
+		}
+		if ok, err := consumer.forward(session, tracker.track(message), consumer.prepare(message)); !ok {
+			return err
+		}
+	}
+	return nil
+}
+
+// pendingMsg is a consumed message handed to the workers, result receives it
+// once it is prepared
+type pendingMsg struct {
+	message *sarama.ConsumerMessage
+	result  chan preparedMsg
+}
+
+// consumeParallel prepares the messages of the claim with consumer.workers
+// goroutines, the expensive part with JSON redaction or tracing. They are
+// forwarded in the order they were consumed, so the order within every source
+// partition is kept.
+func (consumer *Consumer) consumeParallel(session sarama.ConsumerGroupSession, claim sarama.ConsumerGroupClaim, tracker *offsetTracker) error {
+	ctx, cancel := context.WithCancel(session.Context())
+	defer cancel()
+	jobs := make(chan *pendingMsg)
+	// bounds the messages prepared ahead of the forwarded one
+	pending := make(chan *pendingMsg, consumer.workers)
+	for i := 0; i < consumer.workers; i++ {
+		go func() {
+			for p := range jobs {
+				p.result <- consumer.prepare(p.message)
+			}
+		}()
+	}
+	go func() {
+		defer close(pending)
+		defer close(jobs)
+		for message := range claim.Messages() {
+			p := &pendingMsg{message: message, result: make(chan preparedMsg, 1)}
+			select {
+			case pending <- p:
+			case <-ctx.Done():
+				return
+			}
+			select {
+			case jobs <- p:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	for {
+		var p *pendingMsg
+		var prepared preparedMsg
+		select {
+		case p = <-pending:
+			if p == nil {
+				return nil
+			}
+		case <-ctx.Done():
+			// the session ended, the messages are consumed again
+			return nil
+		}
+		select {
+		case prepared = <-p.result:
+		case <-ctx.Done():
+			return nil
+		}
+		if err := consumer.pause.wait(ctx); err != nil {
+			return nil
+		}
+		if !consumer.until.allows(p.message) || consumer.limit.exhausted() {
+			return nil
+		}
+		if ok, err := consumer.forward(session, tracker.track(p.message), prepared); !ok {
 			return err
 		}
-		consumer.producer.Input() <- &msg
+	}
+}
+
+// preparedMsg is a consumed message filtered, routed, transformed and
+// partitioned for all its destinations, ready to be forwarded
+type preparedMsg struct {
+	// filtered is the meter of the filter which dropped the message, if any
+	filtered string
+	// err is set if the destinations could not be resolved
+	err    error
+	topics []string
+	// msgs and errs are the mirrored message or its error per topic
+	msgs []sarama.ProducerMessage
+	errs []error
+}
+
+// prepare does everything which does not depend on the order of the
+// messages, it may run concurrently for the messages of a claim
+func (consumer *Consumer) prepare(message *sarama.ConsumerMessage) preparedMsg {
+	filter := consumer.currentFilter()
+	if !filter.shouldForward(message) {
+		return preparedMsg{filtered: `messages.filtered`}
+	}
+	if !filter.matchHeader(message) {
+		return preparedMsg{filtered: `messages.filtered_header`}
+	}
+	if !consumer.sampler.keep(message) {
+		return preparedMsg{filtered: `messages.sampled_out`}
+	}
+	source := consumer.redactValue(message)
+	if consumer.envelope {
+		source = wrapEnvelope(source)
+	}
+	topics, err := consumer.currentRouter().ResolveMessageTopics(message)
+	if err != nil {
+		return preparedMsg{err: err}
+	}
+	topics = consumer.keyPrefix.topics(message.Key, topics)
+	prepared := preparedMsg{topics: topics, msgs: make([]sarama.ProducerMessage, len(topics)), errs: make([]error, len(topics))}
+	for i, topic := range topics {
+		prepared.msgs[i], prepared.errs[i] = consumer.mirrorMsg(source, topic)
+	}
+	return prepared
+}
+
+// forward enqueues the prepared messages of a consumed message. It returns
+// false if the claim has to end, with the error to return from ConsumeClaim.
+func (consumer *Consumer) forward(session sarama.ConsumerGroupSession, tracked *trackedMsg, prepared preparedMsg) (bool, error) {
+	message := tracked.message
+	if consumer.partitions.halted() {
+		// a destination topic lost partitions, the message is consumed again
+		// once that is sorted out
+		return false, nil
+	}
+	if prepared.filtered != "" {
+		metrics.GetOrRegisterMeter(prepared.filtered, consumer.metrics).Mark(1)
+		tracked.release()
+		return true, nil
+	}
+	if prepared.err != nil {
+		if err := consumer.mirrorError(session.Context(), tracked, prepared.err); err != nil {
+			return false, claimError(session, err)
+		}
+		tracked.release()
+		return true, nil
+	}
+	if !consumer.limit.take() {
+		// consumer.max_messages were forwarded, the message stays unmarked
+		return false, nil
+	}
+	forwarded := false
+	if latency, ok := e2eLatency(message, time.Now()); ok {
+		metrics.GetOrRegisterTimer(`e2e.latency`, consumer.metrics).Update(latency)
+	}
+	// every destination is tried, a failing one does not stop the others
+	for i, topic := range prepared.topics {
+		msg, err := prepared.msgs[i], prepared.errs[i]
+		if err != nil {
+			if err := consumer.mirrorError(session.Context(), tracked, err); err != nil {
+				consumer.limit.release()
+				return false, claimError(session, err)
+			}
+			continue
+		}
+		waited, err := consumer.throttle.wait(session.Context(), len(message.Key)+len(message.Value))
+		if err != nil {
+			// the session ended while throttled, the message is consumed again
+			consumer.limit.release()
+			return false, nil
+		}
+		if waited > 0 {
+			metrics.GetOrRegisterTimer(`messages.throttled_wait`, consumer.metrics).Update(waited)
+		}
+		if err := consumer.enqueue(session.Context(), &msg, tracked); err != nil {
+			// the session ended while the window was full or the producer
+			// was closed, the message is consumed again
+			consumer.limit.release()
+			return false, nil
+		}
+		forwarded = true
 		metrics.GetOrRegisterMeter(`messages.processed`, consumer.metrics).Mark(1)
+		metrics.GetOrRegisterMeter(`bytes.processed`, consumer.metrics).Mark(messageSize(message))
+		if consumer.perTopicMetrics {
+			metrics.GetOrRegisterMeter(`destination.`+metricTopic(topic)+`.processed`, consumer.metrics).Mark(1)
+			name := metricTopic(message.Topic)
+			metrics.GetOrRegisterMeter(`messages.processed.`+name, consumer.metrics).Mark(1)
+			metrics.GetOrRegisterMeter(`bytes.processed.`+name, consumer.metrics).Mark(messageSize(message))
+		}
+
+		if consumer.logMessages || logger.Enabled("debug") {
+			consumer.logMessage(message, &msg)
+		}
+	}
+	if forwarded {
+		consumer.limit.confirm()
+	} else {
+		// every destination failed, the message does not count
+		consumer.limit.release()
+	}
+	tracked.release()
+	return true, nil
+}
+
+// metricTopic returns the topic as part of a metric name, graphite would take
+// the dots of a topic as separators
+func metricTopic(topic string) string {
+	return strings.Replace(topic, ".", "_", -1)
+}
+
+// claimError returns the error which ends ConsumeClaim, errors caused by the
+// end of the session or the shutdown are not reported
+func claimError(session sarama.ConsumerGroupSession, err error) error {
+	if session.Context().Err() != nil || err == errProducerClosed {
+		return nil
+	}
+	return err
+}
 
-		// log.Printf("Message claimed: timestamp = %v, partition = %d, topic = %s, value = %s", message.Timestamp, message.Partition, message.Topic, string(message.Value))
-		session.MarkMessage(message, "")
+// enqueue hands the message to the producer unless in dry run mode. With
+// trackSuccesses the message counts as in flight until it is acknowledged.
+// With a window the source message is not marked before the acknowledgement
+// and enqueue blocks while the window is full or the breaker is open, it fails
+// if ctx is done or the producer is closed.
+func (consumer *Consumer) enqueue(ctx context.Context, msg *sarama.ProducerMessage, tracked *trackedMsg) error {
+	if consumer.dryRun {
+		return nil
+	}
+	if err := consumer.breaker.wait(ctx); err != nil {
+		return err
+	}
+	if consumer.trackSuccesses {
+		md := &msgMetadata{enqueued: time.Now()}
+		if consumer.window != nil || consumer.atLeastOnce {
+			if err := consumer.window.acquire(ctx); err != nil {
+				return err
+			}
+			tracked.acquire()
+			// a failure ends the session the message was consumed in, not
+			// the one running when it is reported
+			restart := consumer.sessionRestart()
+			md.done = func(err error) {
+				consumer.window.release()
+				if err != nil && consumer.atLeastOnce {
+					// the message stays unmarked and with it all consumed
+					// after it, the next session starts at its offset
+					restart()
+					return
+				}
+				tracked.release()
+			}
+		}
+		if consumer.breaker != nil {
+			done := md.done
+			md.done = func(err error) {
+				consumer.breaker.result(err)
+				if done != nil {
+					done(err)
+				}
+			}
+		}
+		if consumer.offsetMapping != nil && msg.Topic != consumer.deadLetterTopic {
+			source := tracked.message
+			md.acked = func(partition int32, offset int64) {
+				consumer.offsetMapping.record(source, msg.Topic, partition, offset)
+			}
+		}
+		msg.Metadata = md
+		metrics.GetOrRegisterCounter(`producer.inflight`, consumer.metrics).Inc(1)
+	}
+	if !consumer.send(msg) {
+		// the claim outlived the shutdown, the message stays unmarked
+		return errProducerClosed
+	}
+	return nil
+}
+
+// send hands the message to the producer, it returns false once the producer
+// is closed. Sends blocking on a full producer buffer are recorded as
+// producer.enqueue_block timer, the ones blocking for at least
+// enqueueBlockThreshold are counted in producer.enqueue_block.exceeded as
+// well.
+func (consumer *Consumer) send(msg *sarama.ProducerMessage) bool {
+	if !consumer.input.acquire() {
+		return false
+	}
+	defer consumer.input.release()
+	select {
+	case consumer.producer.Input() <- msg:
+		return true
+	default:
+	}
+	start := time.Now()
+	consumer.producer.Input() <- msg
+	blocked := time.Since(start)
+	metrics.GetOrRegisterTimer(`producer.enqueue_block`, consumer.metrics).Update(blocked)
+	if consumer.enqueueBlockThreshold > 0 && blocked >= consumer.enqueueBlockThreshold {
+		metrics.GetOrRegisterCounter(`producer.enqueue_block.exceeded`, consumer.metrics).Inc(1)
+	}
+	return true
+}
+
+// closeProducer closes the producer once the running sends are done, later
+// sends fail with errProducerClosed instead of panicking
+func (consumer *Consumer) closeProducer() error {
+	consumer.input.close()
+	return consumer.producer.Close()
+}
+
+// redactValue returns the message with the configured JSON fields removed
+// from its value. Messages whose value is not JSON are returned unchanged.
+func (consumer *Consumer) redactValue(message *sarama.ConsumerMessage) *sarama.ConsumerMessage {
+	if consumer.redactor == nil || len(message.Value) == 0 {
+		return message
+	}
+	value, err := consumer.redactor.apply(message.Value)
+	if err != nil {
+		metrics.GetOrRegisterMeter(`transform.parse_errors`, consumer.metrics).Mark(1)
+		return message
+	}
+	redacted := *message
+	redacted.Value = value
+	return &redacted
+}
+
+// mirrorError handles a message which could not be mirrored. It is sent to the
+// dead letter topic or skipped, unless failOnError is set, then the error is
+// returned.
+func (consumer *Consumer) mirrorError(ctx context.Context, tracked *trackedMsg, err error) error {
+	message := tracked.message
+	logger.With(Fields{"topic": message.Topic, "partition": message.Partition, "offset": message.Offset, "error": err}).Errorf("could not mirror message")
+	consumer.errors.add("mirror", err, Fields{"topic": message.Topic, "partition": message.Partition, "offset": message.Offset})
+	if consumer.deadLetterTopic != "" {
+		// hand the message over to the dead letter topic instead of stopping the claim
+		if err := consumer.enqueue(ctx, deadLetterMsg(consumer.deadLetterTopic, message, err), tracked); err != nil {
+			return err
+		}
+		metrics.GetOrRegisterMeter(`deadletter.produced`, consumer.metrics).Mark(1)
+	} else if consumer.failOnError {
+		return err
+	} else {
+		metrics.GetOrRegisterMeter(`messages.skipped`, consumer.metrics).Mark(1)
 	}
 	return nil
 }
+
+// setRestart sets the function ending the current consumer group session,
+// the next session consumes the partitions again from the committed offsets
+func (consumer *Consumer) setRestart(cancel context.CancelFunc) {
+	var once sync.Once
+	consumer.restartMu.Lock()
+	defer consumer.restartMu.Unlock()
+	consumer.restart = func() {
+		once.Do(func() {
+			logger.Warnf("a message could not be produced, rejoining the consumer group to consume it again")
+			cancel()
+		})
+	}
+}
+
+// sessionRestart returns the function ending the current session
+func (consumer *Consumer) sessionRestart() func() {
+	consumer.restartMu.Lock()
+	defer consumer.restartMu.Unlock()
+	if consumer.restart == nil {
+		return func() {}
+	}
+	return consumer.restart
+}
+
+func (consumer *Consumer) currentFilter() *messageFilter {
+	consumer.reloadMu.RLock()
+	defer consumer.reloadMu.RUnlock()
+	return consumer.filter
+}
+
+func (consumer *Consumer) currentRouter() *TopicRouter {
+	consumer.reloadMu.RLock()
+	defer consumer.reloadMu.RUnlock()
+	return consumer.router
+}
+
+// swapRouting replaces the router and filter used by the claims
+func (consumer *Consumer) swapRouting(router *TopicRouter, filter *messageFilter) {
+	consumer.reloadMu.Lock()
+	defer consumer.reloadMu.Unlock()
+	consumer.router = router
+	consumer.filter = filter
+}
+
+// mirrorMsg builds the message which is sent to topic on the destination
+// cluster
+func (consumer *Consumer) mirrorMsg(message *sarama.ConsumerMessage, topic string) (sarama.ProducerMessage, error) {
+	numPartitions, err := consumer.partitions.Get(topic)
+	if err != nil {
+		return sarama.ProducerMessage{}, err
+	}
+	partitioner := consumer.partitionerFor(message.Topic)
+	msg, err := PartitionMsg(partitioner, topic, message, numPartitions, consumer.msgOptions)
+	if err != nil {
+		return msg, err
+	}
+	if consumer.keyPrefix.match(message.Key) && consumer.keyPrefix.forcesPartition() {
+		if consumer.keyPrefix.partition >= numPartitions {
+			return sarama.ProducerMessage{}, fmt.Errorf("routing.key_prefix.partition %d does not exist on %s with %d partitions", consumer.keyPrefix.partition, topic, numPartitions)
+		}
+		msg.Partition = consumer.keyPrefix.partition
+	} else if consumer.manualPartitions() {
+		msg.Partition = pickPartition(partitioner, &msg, numPartitions, consumer.msgOptions)
+	}
+	// the producer would reject the message asynchronously, fail it here so
+	// it takes the dead letter path
+	if size := producerMessageSize(&msg); consumer.maxMessageBytes > 0 && size > consumer.maxMessageBytes {
+		return sarama.ProducerMessage{}, fmt.Errorf("message of %d bytes exceeds producer.max_message_bytes (%d)", size, consumer.maxMessageBytes)
+	}
+	return msg, nil
+}
+
+// manualPartitions reports whether the partitions are picked before
+// producing, the producer uses the manual partitioner then
+func (consumer *Consumer) manualPartitions() bool {
+	return len(consumer.topicPartitioners) > 0 || consumer.keyPrefix.forcesPartition()
+}
+
+// partitionerFor returns the partitioner of a source topic
+func (consumer *Consumer) partitionerFor(topic string) string {
+	if partitioner, ok := consumer.topicPartitioners[strings.ToLower(topic)]; ok {
+		return partitioner
+	}
+	return consumer.partitioner
+}
+
+// logMessage logs where a message was mirrored to. The destination partition
+// is -1 if it is picked randomly by the producer.
+func (consumer *Consumer) logMessage(message *sarama.ConsumerMessage, msg *sarama.ProducerMessage) {
+	partition := int32(-1)
+	if consumer.manualPartitions() || (consumer.partitioner == "random" && consumer.msgOptions.Random != nil) {
+		partition = msg.Partition
+	} else if numPartitions, err := consumer.partitions.Get(msg.Topic); err == nil {
+		partition = destinationPartition(consumer.partitioner, msg, numPartitions)
+	}
+	entry := logger.With(Fields{
+		"timestamp":             message.Timestamp,
+		"topic":                 message.Topic,
+		"partition":             message.Partition,
+		"offset":                message.Offset,
+		"destination_topic":     msg.Topic,
+		"destination_partition": partition,
+	})
+	if consumer.logMessages {
+		entry.Infof("Message mirrored")
+	} else {
+		entry.Debugf("Message mirrored")
+	}
+}
@@ -1,7 +1,10 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"testing"
+	"time"
 
 	"github.com/Shopify/sarama"
 	"github.com/stretchr/testify/assert"
@@ -91,12 +94,12 @@ func TestPartitionMsgModulo(t *testing.T) {
 	var numPartitionsMore int32 = 32
 	for _, b := range goodmsgs {
 		//check good messages and the expected outcome
-		c, err := PartitionMsg("modulo", "empty", &b, numPartitionsLess)
+		c, err := PartitionMsg("modulo", "empty", &b, numPartitionsLess, MsgOptions{})
 		assert.NoError(t, err, "Unexpected error %v", err)
 		assert.LessOrEqual(t, c.Partition, numPartitionsLess-1, "The outgoing partition is not available, source partition: %d target partition: %d we only have partition 0 to %d", b.Partition, c.Partition, numPartitionsLess-1)
 		assert.NotEmpty(t, c.Key, "Key is empty after partitioning")
 		assert.NotEmpty(t, c.Value, "Value is emptry afer partitioning")
-		c, err = PartitionMsg("modulo", "empty", &b, numPartitionsMore)
+		c, err = PartitionMsg("modulo", "empty", &b, numPartitionsMore, MsgOptions{})
 		assert.NoError(t, err, "Unexpected error %v", err)
 		assert.LessOrEqual(t, c.Partition, numPartitionsMore-1, "The outgoing partition is not available, source partition: %d target partition: %d we only have partition 0 to %d", b.Partition, c.Partition, numPartitionsMore-1)
 	}
@@ -104,17 +107,17 @@ func TestPartitionMsgModulo(t *testing.T) {
 	msg := sarama.ConsumerMessage{
 		Partition: 8,
 	}
-	_, err := PartitionMsg("modulo", "", &msg, numPartitionsLess)
+	_, err := PartitionMsg("modulo", "", &msg, numPartitionsLess, MsgOptions{})
 	assert.Error(t, err, "No error occured on unset topic")
-	_, err = PartitionMsg("", "empty", &msg, numPartitionsLess)
+	_, err = PartitionMsg("", "empty", &msg, numPartitionsLess, MsgOptions{})
 	assert.Error(t, err, "No error occured on unset partitioning type")
-	_, err = PartitionMsg("modulo", "empty", &msg, numPartitionsLess)
+	_, err = PartitionMsg("modulo", "empty", &msg, numPartitionsLess, MsgOptions{})
 	assert.Error(t, err, "No error occured on a message without value")
 	msg = sarama.ConsumerMessage{
 		Partition: -8,
 		Value:     []byte("Terrible Test"),
 	}
-	_, err = PartitionMsg("modulo", "empty", &msg, numPartitionsLess)
+	_, err = PartitionMsg("modulo", "empty", &msg, numPartitionsLess, MsgOptions{})
 	assert.Error(t, err, "No error occured on a negative source partition")
 }
 
@@ -122,7 +125,7 @@ func TestPartitionMsgHash(t *testing.T) {
 	var numPartitionsLess int32 = 8
 	for _, b := range goodmsgs {
 		//check good messages and the expected outcome
-		c, err := PartitionMsg("hash", "empty", &b, numPartitionsLess)
+		c, err := PartitionMsg("hash", "empty", &b, numPartitionsLess, MsgOptions{})
 		assert.NoError(t, err, "Unexpected error %v", err)
 		assert.NotEmpty(t, c.Key, "Key is empty after partitioning")
 		assert.NotEmpty(t, c.Value, "Value is emptry afer partitioning")
@@ -131,25 +134,64 @@ func TestPartitionMsgHash(t *testing.T) {
 	msg := sarama.ConsumerMessage{
 		Partition: 8,
 	}
-	_, err := PartitionMsg("hash", "", &msg, numPartitionsLess)
+	_, err := PartitionMsg("hash", "", &msg, numPartitionsLess, MsgOptions{})
 	assert.Error(t, err, "No error occured on unset topic")
-	_, err = PartitionMsg("", "empty", &msg, numPartitionsLess)
+	_, err = PartitionMsg("", "empty", &msg, numPartitionsLess, MsgOptions{})
 	assert.Error(t, err, "No error occured on unset partitioning type")
-	_, err = PartitionMsg("hash", "empty", &msg, numPartitionsLess)
+	_, err = PartitionMsg("hash", "empty", &msg, numPartitionsLess, MsgOptions{})
 	assert.Error(t, err, "No error occured on a message without value")
 	msg = sarama.ConsumerMessage{
 		Partition: -8,
 		Value:     []byte("Terrible Test"),
 	}
-	_, err = PartitionMsg("hash", "empty", &msg, numPartitionsLess)
+	_, err = PartitionMsg("hash", "empty", &msg, numPartitionsLess, MsgOptions{})
 	assert.Error(t, err, "No error occured on a negative source partition")
 }
 
+func TestPartitionMsgMurmur2(t *testing.T) {
+	var numPartitions int32 = 8
+	for _, b := range goodmsgs {
+		c, err := PartitionMsg("murmur2", "empty", &b, numPartitions, MsgOptions{})
+		assert.NoError(t, err, "Unexpected error %v", err)
+		assert.Equal(t, sarama.ByteEncoder(b.Key), c.Key, "Key was changed during partitioning")
+		assert.NotEmpty(t, c.Value, "Value is emptry afer partitioning")
+	}
+	msg := sarama.ConsumerMessage{
+		Partition: 8,
+		Value:     []byte("Terrible Test"),
+	}
+	_, err := PartitionMsg("murmur2", "empty", &msg, numPartitions, MsgOptions{})
+	assert.Error(t, err, "No error occured on a message without key")
+}
+
+func TestPartitionMsgNullKey(t *testing.T) {
+	var numPartitions int32 = 8
+	msg := sarama.ConsumerMessage{
+		Partition: 3,
+		Value:     []byte("Terrible Test"),
+	}
+	opts := MsgOptions{RoundRobin: &roundRobin{}}
+	for _, p := range []string{"keeppartition", "modulo", "consistent", "roundrobin", "random"} {
+		c, err := PartitionMsg(p, "empty", &msg, numPartitions, opts)
+		assert.NoError(t, err, "Unexpected error %v", err)
+		assert.Nil(t, c.Key, "null key was not kept for partitioner %s", p)
+	}
+	_, err := PartitionMsg("hash", "empty", &msg, numPartitions, opts)
+	assert.EqualError(t, err, "key is not set, we can't use the hash function for this type of messages")
+	//empty keys are kept as they are
+	msg.Key = []byte{}
+	c, err := PartitionMsg("keeppartition", "empty", &msg, numPartitions, opts)
+	assert.NoError(t, err, "Unexpected error %v", err)
+	assert.Equal(t, sarama.ByteEncoder{}, c.Key, "empty key was not kept")
+	_, err = PartitionMsg("hash", "empty", &msg, numPartitions, opts)
+	assert.EqualError(t, err, "key is not set, we can't use the hash function for this type of messages")
+}
+
 func TestPartitionMsgKeepPartition(t *testing.T) {
 	var numPartitionsSame int32 = 18
 	for _, b := range goodmsgs {
 		//check good messages and the expected outcome
-		c, err := PartitionMsg("keeppartition", "empty", &b, numPartitionsSame)
+		c, err := PartitionMsg("keeppartition", "empty", &b, numPartitionsSame, MsgOptions{})
 		assert.Equal(t, b.Partition, c.Partition, "The source partition %d does not equal to the destination partition %d", b.Partition, c.Partition)
 		assert.NoError(t, err, "Unexpected error %v", err)
 		assert.NotEmpty(t, c.Key, "Key is empty after partitioning")
@@ -159,23 +201,455 @@ func TestPartitionMsgKeepPartition(t *testing.T) {
 	msg := sarama.ConsumerMessage{
 		Partition: 8,
 	}
-	_, err := PartitionMsg("keeppartition", "", &msg, numPartitionsSame)
+	_, err := PartitionMsg("keeppartition", "", &msg, numPartitionsSame, MsgOptions{})
 	assert.Error(t, err, "No error occured on unset topic")
-	_, err = PartitionMsg("", "empty", &msg, numPartitionsSame)
+	_, err = PartitionMsg("", "empty", &msg, numPartitionsSame, MsgOptions{})
 	assert.Error(t, err, "No error occured on unset partitioning type")
-	_, err = PartitionMsg("keeppartition", "empty", &msg, numPartitionsSame)
+	_, err = PartitionMsg("keeppartition", "empty", &msg, numPartitionsSame, MsgOptions{})
 	assert.Error(t, err, "No error occured on a message without value")
 	msg = sarama.ConsumerMessage{
 		Partition: -8,
 		Value:     []byte("Terrible Test"),
 	}
-	_, err = PartitionMsg("keeppartition", "empty", &msg, numPartitionsSame)
+	_, err = PartitionMsg("keeppartition", "empty", &msg, numPartitionsSame, MsgOptions{})
 	assert.Error(t, err, "No error occured on a negative source partition")
 	//source topic got more partitions then the destination must fail
 	msg = sarama.ConsumerMessage{
 		Partition: 30,
 		Value:     []byte("Terrible Test"),
 	}
-	_, err = PartitionMsg("keeppartition", "empty", &msg, numPartitionsSame)
+	_, err = PartitionMsg("keeppartition", "empty", &msg, numPartitionsSame, MsgOptions{})
 	assert.Error(t, err, "No error occured if the source partition does not exist on the target topic")
 }
+
+func TestPartitionMsgHeaders(t *testing.T) {
+	var numPartitions int32 = 8
+	msg := sarama.ConsumerMessage{
+		Partition: 3,
+		Value:     []byte("Terrible Test"),
+		Key:       []byte("Terrible Test"),
+		Headers: []*sarama.RecordHeader{
+			{Key: []byte("traceid"), Value: []byte("abc")},
+			nil,
+			{Key: []byte("region"), Value: []byte("eu")},
+		},
+	}
+	for _, p := range []string{"hash", "keeppartition", "modulo", "random"} {
+		c, err := PartitionMsg(p, "empty", &msg, numPartitions, MsgOptions{})
+		assert.NoError(t, err, "Unexpected error %v", err)
+		assert.Equal(t, []sarama.RecordHeader{
+			{Key: []byte("traceid"), Value: []byte("abc")},
+			{Key: []byte("region"), Value: []byte("eu")},
+		}, c.Headers, "Headers were not copied for partitioner %s", p)
+		c, err = PartitionMsg(p, "empty", &msg, numPartitions, MsgOptions{DropHeaders: true})
+		assert.NoError(t, err, "Unexpected error %v", err)
+		assert.Empty(t, c.Headers, "Headers were copied although disabled for partitioner %s", p)
+	}
+	//messages without headers must not get any
+	c, err := PartitionMsg("hash", "empty", &goodmsgs[0], numPartitions, MsgOptions{})
+	assert.NoError(t, err, "Unexpected error %v", err)
+	assert.Nil(t, c.Headers, "Headers were set on a message without headers")
+}
+
+func TestPartitionMsgTimestamp(t *testing.T) {
+	var numPartitions int32 = 8
+	ts := time.Date(2021, 6, 1, 12, 0, 0, 0, time.UTC)
+	msg := sarama.ConsumerMessage{
+		Partition: 3,
+		Value:     []byte("Terrible Test"),
+		Key:       []byte("Terrible Test"),
+		Timestamp: ts,
+	}
+	for _, p := range []string{"hash", "keeppartition", "modulo", "random"} {
+		c, err := PartitionMsg(p, "empty", &msg, numPartitions, MsgOptions{})
+		assert.NoError(t, err, "Unexpected error %v", err)
+		assert.Equal(t, ts, c.Timestamp, "Timestamp was not copied for partitioner %s", p)
+		c, err = PartitionMsg(p, "empty", &msg, numPartitions, MsgOptions{DropTimestamp: true})
+		assert.NoError(t, err, "Unexpected error %v", err)
+		assert.True(t, c.Timestamp.IsZero(), "Timestamp was copied although disabled for partitioner %s", p)
+	}
+	//source messages without a timestamp get the current time
+	before := time.Now()
+	c, err := PartitionMsg("hash", "empty", &goodmsgs[0], numPartitions, MsgOptions{})
+	assert.NoError(t, err, "Unexpected error %v", err)
+	assert.False(t, c.Timestamp.Before(before), "Timestamp %v of a message without timestamp is older than %v", c.Timestamp, before)
+	msg.Timestamp = time.Unix(0, 0)
+	c, err = PartitionMsg("hash", "empty", &msg, numPartitions, MsgOptions{})
+	assert.NoError(t, err, "Unexpected error %v", err)
+	assert.False(t, c.Timestamp.Before(before), "Timestamp %v of a message with epoch timestamp is older than %v", c.Timestamp, before)
+}
+
+func TestPartitionMsgTombstone(t *testing.T) {
+	var numPartitions int32 = 8
+	msg := sarama.ConsumerMessage{
+		Partition: 3,
+		Key:       []byte("Terrible Test"),
+		Headers:   []*sarama.RecordHeader{{Key: []byte("partition"), Value: []byte("1")}},
+	}
+	for _, p := range partitioners {
+		_, err := PartitionMsg(p, "empty", &msg, numPartitions, MsgOptions{RoundRobin: &roundRobin{}, PartitionHeader: "partition"})
+		assert.Error(t, err, "No error occured on a tombstone without allow_tombstones for partitioner %s", p)
+		c, err := PartitionMsg(p, "empty", &msg, numPartitions, MsgOptions{RoundRobin: &roundRobin{}, PartitionHeader: "partition", AllowTombstones: true})
+		assert.NoError(t, err, "Unexpected error %v", err)
+		assert.Nil(t, c.Value, "Tombstone value is not nil for partitioner %s", p)
+	}
+	//empty but present values are not tombstones
+	msg.Value = []byte{}
+	_, err := PartitionMsg("hash", "empty", &msg, numPartitions, MsgOptions{AllowTombstones: true})
+	assert.Error(t, err, "No error occured on an empty value")
+}
+
+func TestPartitionMsgStrictKeyPartition(t *testing.T) {
+	var numPartitions int32 = 8
+	headers := []*sarama.RecordHeader{{Key: []byte("partition"), Value: []byte("1")}}
+	keyed := sarama.ConsumerMessage{Partition: 3, Key: []byte("Terrible Test"), Value: []byte("Terrible Test"), Headers: headers}
+	keyless := sarama.ConsumerMessage{Partition: 3, Value: []byte("Terrible Test"), Headers: headers}
+	opts := MsgOptions{RoundRobin: &roundRobin{}, StrictKeyPartition: true, PartitionHeader: "partition"}
+	for _, p := range partitioners {
+		_, err := PartitionMsg(p, "empty", &keyed, numPartitions, opts)
+		if ignoresKey(p) {
+			assert.Error(t, err, "No error occured on a keyed message for partitioner %s", p)
+		} else {
+			assert.NoError(t, err, "Unexpected error for partitioner %s", p)
+		}
+		if p == "hash" || p == "murmur2" {
+			continue
+		}
+		_, err = PartitionMsg(p, "empty", &keyless, numPartitions, opts)
+		assert.NoError(t, err, "Unexpected error on a keyless message for partitioner %s", p)
+	}
+	c, err := PartitionMsg("modulo", "empty", &keyed, numPartitions, MsgOptions{})
+	assert.NoError(t, err, "keys are mirrored without strict_key_partition")
+	assert.Equal(t, sarama.ByteEncoder("Terrible Test"), c.Key)
+}
+
+func TestPartitionMsgHeader(t *testing.T) {
+	var numPartitions int32 = 8
+	header := func(value string) []*sarama.RecordHeader {
+		return []*sarama.RecordHeader{{Key: []byte("other"), Value: []byte("2")}, {Key: []byte("route.partition"), Value: []byte(value)}}
+	}
+	msg := sarama.ConsumerMessage{Partition: 3, Key: []byte("Terrible Test"), Value: []byte("Terrible Test"), Headers: header("5")}
+	opts := MsgOptions{PartitionHeader: "route.partition"}
+	c, err := PartitionMsg("header", "empty", &msg, numPartitions, opts)
+	assert.NoError(t, err, "Unexpected error %v", err)
+	assert.Equal(t, int32(5), c.Partition)
+	assert.Equal(t, sarama.ByteEncoder("Terrible Test"), c.Key)
+	assert.Len(t, c.Headers, 2, "the headers were not copied")
+
+	for _, invalid := range []string{"8", "-1", "five", ""} {
+		msg.Headers = header(invalid)
+		_, err = PartitionMsg("header", "empty", &msg, numPartitions, opts)
+		assert.Error(t, err, "No error occured on the partition header %q", invalid)
+	}
+	msg.Headers = nil
+	_, err = PartitionMsg("header", "empty", &msg, numPartitions, opts)
+	assert.Error(t, err, "No error occured on a missing partition header")
+
+	opts.HeaderFallback = "murmur2"
+	c, err = PartitionMsg("header", "empty", &msg, numPartitions, opts)
+	assert.NoError(t, err, "Unexpected error %v", err)
+	assert.Equal(t, murmur2Partition([]byte("Terrible Test"), numPartitions), c.Partition, "the fallback partitioner was not used")
+	msg.Headers = header("9")
+	opts.HeaderFallback = "keeppartition"
+	c, err = PartitionMsg("header", "empty", &msg, numPartitions, opts)
+	assert.NoError(t, err, "Unexpected error %v", err)
+	assert.Equal(t, int32(3), c.Partition, "an out of range partition header did not use the fallback")
+	assert.Len(t, c.Headers, 2, "the headers were not copied with the fallback")
+}
+
+func TestGetHeaderFallback(t *testing.T) {
+	for in, want := range map[string]string{"": "error", "Error": "error", "Hash": "hash", "keeppartition": "keeppartition"} {
+		got, err := getHeaderFallback(in)
+		assert.NoError(t, err)
+		assert.Equal(t, want, got)
+	}
+	_, err := getHeaderFallback("header")
+	assert.Error(t, err)
+	_, err = getHeaderFallback("leastloaded")
+	assert.Error(t, err)
+	assert.Error(t, checkPartitionHeader("header", nil, ""))
+	assert.Error(t, checkPartitionHeader("hash", map[string]string{"logs": "header"}, ""))
+	assert.NoError(t, checkPartitionHeader("header", nil, "route.partition"))
+	assert.NoError(t, checkPartitionHeader("hash", nil, ""))
+}
+
+func TestSetCompression(t *testing.T) {
+	cfg := sarama.NewConfig()
+	cfg.Version = sarama.V2_0_0_0
+	assert.NoError(t, setCompression(cfg, "GZIP"))
+	assert.Equal(t, sarama.CompressionGZIP, cfg.Producer.Compression)
+	assert.NoError(t, setCompression(cfg, ""))
+	assert.Equal(t, sarama.CompressionNone, cfg.Producer.Compression)
+	assert.EqualError(t, setCompression(cfg, "snapy"), `invalid producer.compression "snapy", must be none, gzip, snappy, lz4 or zstd`)
+	assert.Error(t, setCompression(cfg, "zstd"), "zstd was accepted for kafka 2.0")
+	cfg.Version = sarama.V2_1_0_0
+	assert.NoError(t, setCompression(cfg, "zstd"))
+	assert.Equal(t, sarama.CompressionZSTD, cfg.Producer.Compression)
+}
+
+func TestSetCompressionLevel(t *testing.T) {
+	cfg := sarama.NewConfig()
+	assert.NoError(t, setCompressionLevel(cfg, sarama.CompressionLevelDefault))
+	assert.Error(t, setCompressionLevel(cfg, 3), "level was accepted without compression")
+	assert.NoError(t, setCompression(cfg, "gzip"))
+	assert.NoError(t, setCompressionLevel(cfg, 9))
+	assert.Equal(t, 9, cfg.Producer.CompressionLevel)
+	assert.EqualError(t, setCompressionLevel(cfg, 10), "producer.compression.level must be between 1 and 9 for gzip, got 10")
+	assert.Equal(t, 9, cfg.Producer.CompressionLevel, "invalid level was set")
+	cfg.Version = sarama.V2_1_0_0
+	assert.NoError(t, setCompression(cfg, "zstd"))
+	assert.EqualError(t, setCompressionLevel(cfg, 3), "producer.compression.level is not supported by zstd compression")
+}
+
+func TestEnableIdempotence(t *testing.T) {
+	cfg := sarama.NewConfig()
+	cfg.Version = sarama.V2_0_0_0
+	assert.NoError(t, enableIdempotence(cfg, ""), "default acks must be accepted")
+	assert.True(t, cfg.Producer.Idempotent)
+	assert.Equal(t, sarama.WaitForAll, cfg.Producer.RequiredAcks)
+	assert.Equal(t, 1, cfg.Net.MaxOpenRequests)
+	assert.NoError(t, cfg.Validate(), "sarama does not accept the config")
+	assert.NoError(t, enableIdempotence(sarama.NewConfig(), "all"), "acks all must be accepted")
+
+	assert.Error(t, enableIdempotence(cfg, "local"), "No error occured on conflicting acks")
+	cfg = sarama.NewConfig()
+	cfg.Version = sarama.V2_0_0_0
+	cfg.Producer.Retry.Max = 0
+	assert.Error(t, enableIdempotence(cfg, "all"), "No error occured without retries")
+	cfg = sarama.NewConfig()
+	cfg.Version = sarama.V0_10_2_0
+	assert.Error(t, enableIdempotence(cfg, "all"), "No error occured on an old kafka version")
+}
+
+func TestDestinationPartition(t *testing.T) {
+	msg := &sarama.ProducerMessage{Topic: "empty", Partition: 5, Key: sarama.StringEncoder("foobar")}
+	assert.Equal(t, int32(5), destinationPartition("keeppartition", msg, 16))
+	assert.Equal(t, int32(5), destinationPartition("modulo", msg, 16))
+	assert.Equal(t, int32(14), destinationPartition("murmur2", msg, 16))
+	hash, err := sarama.NewHashPartitioner("empty").Partition(msg, 16)
+	assert.NoError(t, err)
+	assert.Equal(t, hash, destinationPartition("hash", msg, 16))
+	assert.Equal(t, int32(-1), destinationPartition("random", msg, 16))
+	assert.Equal(t, int32(-1), destinationPartition("hash", &sarama.ProducerMessage{Topic: "empty"}, 16))
+}
+
+func TestCheckKeepPartition(t *testing.T) {
+	assert.NoError(t, checkKeepPartition("source", 8, "dest", 8))
+	assert.NoError(t, checkKeepPartition("source", 4, "dest", 8))
+	err := checkKeepPartition("source", 8, "dest", 4)
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "source has 8 and dest only 4")
+	}
+}
+
+func TestSetIsolationLevel(t *testing.T) {
+	cfg := sarama.NewConfig()
+	cfg.Version = sarama.V2_0_0_0
+	assert.NoError(t, setIsolationLevel(cfg, "Read_Committed"))
+	assert.Equal(t, sarama.ReadCommitted, cfg.Consumer.IsolationLevel)
+	assert.NoError(t, setIsolationLevel(cfg, "read_uncommitted"))
+	assert.Equal(t, sarama.ReadUncommitted, cfg.Consumer.IsolationLevel)
+	assert.Error(t, setIsolationLevel(cfg, "committed"))
+	cfg.Version = sarama.V0_10_2_0
+	assert.Error(t, setIsolationLevel(cfg, "read_committed"))
+}
+
+func TestSetNetTimeouts(t *testing.T) {
+	cfg := sarama.NewConfig()
+	assert.NoError(t, setNetTimeouts(cfg, 5*time.Second, 10*time.Second, 15*time.Second))
+	assert.Equal(t, 5*time.Second, cfg.Net.DialTimeout)
+	assert.Equal(t, 10*time.Second, cfg.Net.ReadTimeout)
+	assert.Equal(t, 15*time.Second, cfg.Net.WriteTimeout)
+	assert.Error(t, setNetTimeouts(cfg, 0, 10*time.Second, 15*time.Second))
+	assert.Error(t, setNetTimeouts(cfg, 5*time.Second, 10*time.Second, -time.Second))
+}
+
+func TestSetMetadataRefresh(t *testing.T) {
+	cfg := sarama.NewConfig()
+	assert.NoError(t, setMetadataRefresh(cfg, 30*time.Second))
+	assert.Equal(t, 30*time.Second, cfg.Metadata.RefreshFrequency)
+	assert.Error(t, setMetadataRefresh(cfg, 0))
+	assert.Error(t, setMetadataRefresh(cfg, -time.Second))
+}
+
+func TestPartitionCacheTTL(t *testing.T) {
+	assert.Equal(t, time.Minute, partitionCacheTTL(time.Minute, 10*time.Minute))
+	assert.Equal(t, 30*time.Second, partitionCacheTTL(time.Minute, 30*time.Second), "the cache refreshes no slower than the metadata")
+	assert.Equal(t, time.Duration(0), partitionCacheTTL(0, 30*time.Second), "disabled refreshing stays disabled")
+}
+
+func TestPickPartition(t *testing.T) {
+	msg := &sarama.ProducerMessage{Topic: "empty", Partition: 5, Key: sarama.StringEncoder("foobar")}
+	assert.Equal(t, destinationPartition("hash", msg, 16), pickPartition("hash", msg, 16, MsgOptions{}))
+	assert.Equal(t, int32(14), pickPartition("murmur2", msg, 16, MsgOptions{}))
+	assert.Equal(t, int32(5), pickPartition("keeppartition", msg, 16, MsgOptions{}))
+	keyless := &sarama.ProducerMessage{Topic: "empty", Partition: 3}
+	assert.Equal(t, int32(3), pickPartition("hash", keyless, 16, MsgOptions{KeylessFallback: "roundrobin"}), "round robin partition was not kept")
+	for i := 0; i < 100; i++ {
+		p := pickPartition("random", msg, 4, MsgOptions{})
+		assert.True(t, p >= 0 && p < 4, "partition %d is out of range", p)
+	}
+}
+
+func TestMessageSize(t *testing.T) {
+	msg := &sarama.ConsumerMessage{
+		Key:     []byte("key"),
+		Value:   []byte("value"),
+		Headers: []*sarama.RecordHeader{{Key: []byte("h"), Value: []byte("v1")}, nil},
+	}
+	assert.Equal(t, int64(11), messageSize(msg))
+	assert.Equal(t, int64(0), messageSize(&sarama.ConsumerMessage{}))
+}
+
+func TestPartitionMsgKeyTransform(t *testing.T) {
+	tr, _ := newKeyTransform("tenant-1:", "", "")
+	msg := sarama.ConsumerMessage{Partition: 3, Key: []byte("key"), Value: []byte("Terrible Test")}
+	for _, p := range []string{"hash", "murmur2", "keeppartition", "modulo"} {
+		c, err := PartitionMsg(p, "empty", &msg, 8, MsgOptions{KeyTransform: tr})
+		assert.NoError(t, err, "Unexpected error %v", err)
+		assert.Equal(t, sarama.ByteEncoder("tenant-1:key"), c.Key, "transformed key was not encoded for partitioner %s", p)
+	}
+	assert.Equal(t, []byte("key"), msg.Key, "source message was modified")
+
+	// the hash partitioners need the transformed key
+	empty, _ := newKeyTransform("", ".*", "")
+	_, err := PartitionMsg("hash", "empty", &msg, 8, MsgOptions{KeyTransform: empty})
+	assert.Error(t, err, "No error occured on an empty transformed key")
+}
+
+func TestSetFetchSizes(t *testing.T) {
+	cfg := sarama.NewConfig()
+	assert.NoError(t, setFetchSizes(cfg, 1024, 4096, 8192))
+	assert.Equal(t, int32(1024), cfg.Consumer.Fetch.Min)
+	assert.Equal(t, int32(4096), cfg.Consumer.Fetch.Default)
+	assert.Equal(t, int32(8192), cfg.Consumer.Fetch.Max)
+	assert.NoError(t, cfg.Validate(), "sarama does not accept the config")
+	assert.NoError(t, setFetchSizes(cfg, 1, 1024*1024, 0), "unlimited max must be accepted")
+	assert.NoError(t, setFetchSizes(cfg, 10, 10, 10), "equal sizes must be accepted")
+
+	assert.Error(t, setFetchSizes(cfg, 0, 1024, 0), "No error occured on a min of 0")
+	assert.Error(t, setFetchSizes(cfg, 2048, 1024, 0), "No error occured on default < min")
+	assert.Error(t, setFetchSizes(cfg, 1, 4096, 1024), "No error occured on max < default")
+	assert.Error(t, setFetchSizes(cfg, 1, 4096, -1), "No error occured on a negative max")
+}
+
+func TestPartitionMsgConsistent(t *testing.T) {
+	opts := MsgOptions{RoundRobin: &roundRobin{}}
+	// keyed messages of all source partitions end up in the partition of their key
+	for _, source := range []int32{0, 5, 11} {
+		msg := sarama.ConsumerMessage{Partition: source, Key: []byte("foobar"), Value: []byte("Terrible Test")}
+		c, err := PartitionMsg("consistent", "empty", &msg, 16, opts)
+		assert.NoError(t, err, "Unexpected error %v", err)
+		assert.Equal(t, int32(14), c.Partition)
+		assert.Equal(t, sarama.ByteEncoder("foobar"), c.Key)
+	}
+	// keyless messages are spread round robin
+	var partitions []int32
+	for i := 0; i < 4; i++ {
+		msg := sarama.ConsumerMessage{Partition: 7, Value: []byte("Terrible Test")}
+		c, err := PartitionMsg("consistent", "empty", &msg, 3, opts)
+		assert.NoError(t, err, "Unexpected error %v", err)
+		partitions = append(partitions, c.Partition)
+	}
+	assert.Equal(t, []int32{0, 1, 2, 0}, partitions)
+
+	_, err := PartitionMsg("consistent", "empty", &sarama.ConsumerMessage{Value: []byte("Terrible Test")}, 3, MsgOptions{})
+	assert.Error(t, err, "No error occured without round robin counter")
+	assert.Equal(t, int32(3), destinationPartition("consistent", &sarama.ProducerMessage{Partition: 3}, 8))
+}
+
+func TestPartitionMsgHashKeylessFallback(t *testing.T) {
+	msg := sarama.ConsumerMessage{Partition: 7, Value: []byte("Terrible Test")}
+	_, err := PartitionMsg("hash", "empty", &msg, 4, MsgOptions{})
+	assert.Error(t, err, "keyless message was accepted without fallback")
+	_, err = PartitionMsg("hash", "empty", &msg, 4, MsgOptions{KeylessFallback: "error"})
+	assert.Error(t, err, "keyless message was accepted with the error fallback")
+
+	c, err := PartitionMsg("hash", "empty", &msg, 4, MsgOptions{KeylessFallback: "random"})
+	assert.NoError(t, err, "Unexpected error %v", err)
+	assert.Nil(t, c.Key, "the hash partitioner only picks a random partition without key")
+
+	opts := MsgOptions{KeylessFallback: "roundrobin", RoundRobin: &roundRobin{}}
+	var partitions []int32
+	for i := 0; i < 5; i++ {
+		c, err = PartitionMsg("hash", "empty", &msg, 4, opts)
+		assert.NoError(t, err, "Unexpected error %v", err)
+		assert.Nil(t, c.Key)
+		partitions = append(partitions, c.Partition)
+	}
+	assert.Equal(t, []int32{0, 1, 2, 3, 0}, partitions)
+
+	// keyed messages are not affected by the fallback
+	keyed := sarama.ConsumerMessage{Key: []byte("a"), Value: []byte("Terrible Test")}
+	c, err = PartitionMsg("hash", "empty", &keyed, 4, opts)
+	assert.NoError(t, err, "Unexpected error %v", err)
+	assert.Equal(t, sarama.ByteEncoder("a"), c.Key)
+}
+
+func TestGetKeylessFallback(t *testing.T) {
+	for in, want := range map[string]string{"": "error", "error": "error", "Random": "random", "roundRobin": "roundrobin"} {
+		got, err := getKeylessFallback(in)
+		assert.NoError(t, err, "Unexpected error %v", err)
+		assert.Equal(t, want, got)
+	}
+	_, err := getKeylessFallback("murmur2")
+	assert.Error(t, err, "No error occured on an invalid fallback")
+}
+
+func TestKeylessManualPartitioner(t *testing.T) {
+	p := newKeylessManualPartitioner(sarama.NewHashPartitioner)("empty")
+	partition, err := p.Partition(&sarama.ProducerMessage{Partition: 3}, 8)
+	assert.NoError(t, err, "Unexpected error %v", err)
+	assert.Equal(t, int32(3), partition, "keyless message did not keep its partition")
+
+	keyed := &sarama.ProducerMessage{Partition: 3, Key: sarama.StringEncoder("foobar")}
+	want, _ := sarama.NewHashPartitioner("empty").Partition(keyed, 8)
+	partition, err = p.Partition(keyed, 8)
+	assert.NoError(t, err, "Unexpected error %v", err)
+	assert.Equal(t, want, partition, "keyed message was not hashed")
+	assert.True(t, p.RequiresConsistency())
+}
+
+func TestReportMetrics(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	reports := make(chan struct{}, 100)
+	done := make(chan struct{})
+	go func() {
+		reportMetrics(ctx, time.Millisecond, true, "test", func() error {
+			select {
+			case reports <- struct{}{}:
+			default:
+			}
+			return errors.New("graphite is down")
+		})
+		close(done)
+	}()
+	// failing reports don't stop the reporter
+	<-reports
+	<-reports
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("the reporter did not stop")
+	}
+
+	flushed := 0
+	reportMetrics(ctx, time.Hour, true, "test", func() error { flushed++; return nil })
+	assert.Equal(t, 1, flushed, "the metrics were not flushed on shutdown")
+	reportMetrics(ctx, time.Hour, false, "test", func() error { flushed++; return nil })
+	assert.Equal(t, 1, flushed, "the metrics were flushed with flush_on_shutdown disabled")
+}
+
+func TestE2ELatency(t *testing.T) {
+	now := time.Date(2021, 6, 1, 12, 0, 0, 0, time.UTC)
+	latency, ok := e2eLatency(&sarama.ConsumerMessage{Timestamp: now.Add(-time.Second)}, now)
+	assert.True(t, ok)
+	assert.Equal(t, time.Second, latency)
+	_, ok = e2eLatency(&sarama.ConsumerMessage{}, now)
+	assert.False(t, ok, "a message without timestamp has a latency")
+	_, ok = e2eLatency(&sarama.ConsumerMessage{Timestamp: time.Unix(0, 0)}, now)
+	assert.False(t, ok, "a message with epoch timestamp has a latency")
+	_, ok = e2eLatency(&sarama.ConsumerMessage{Timestamp: now.Add(time.Second)}, now)
+	assert.False(t, ok, "a message from the future has a latency")
+}
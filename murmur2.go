@@ -0,0 +1,76 @@
+package main
+
+import (
+	"math/rand"
+
+	"github.com/Shopify/sarama"
+)
+
+// murmur2 is the hash function the java kafka client uses in its default
+// partitioner (org.apache.kafka.common.utils.Utils.murmur2)
+func murmur2(data []byte) int32 {
+	const (
+		seed uint32 = 0x9747b28c
+		m    uint32 = 0x5bd1e995
+		r           = 24
+	)
+	length := len(data)
+	h := seed ^ uint32(length)
+	length4 := length / 4
+	for i := 0; i < length4; i++ {
+		i4 := i * 4
+		k := uint32(data[i4]) | uint32(data[i4+1])<<8 | uint32(data[i4+2])<<16 | uint32(data[i4+3])<<24
+		k *= m
+		k ^= k >> r
+		k *= m
+		h *= m
+		h ^= k
+	}
+	tail := length &^ 3
+	switch length % 4 {
+	case 3:
+		h ^= uint32(data[tail+2]) << 16
+		fallthrough
+	case 2:
+		h ^= uint32(data[tail+1]) << 8
+		fallthrough
+	case 1:
+		h ^= uint32(data[tail])
+		h *= m
+	}
+	h ^= h >> 13
+	h *= m
+	h ^= h >> 15
+	return int32(h)
+}
+
+// murmur2Partition returns the partition the java producer picks for the key
+func murmur2Partition(key []byte, numPartitions int32) int32 {
+	return (murmur2(key) & 0x7fffffff) % numPartitions
+}
+
+type murmur2Partitioner struct {
+	random *rand.Rand
+}
+
+// NewMurmur2Partitioner is a sarama.PartitionerConstructor which places keyed
+// messages on the same partition as the java producer would. Messages without
+// a key are distributed randomly.
+func NewMurmur2Partitioner(topic string) sarama.Partitioner {
+	return &murmur2Partitioner{random: rand.New(rand.NewSource(rand.Int63()))}
+}
+
+func (p *murmur2Partitioner) Partition(message *sarama.ProducerMessage, numPartitions int32) (int32, error) {
+	if message.Key == nil {
+		return int32(p.random.Intn(int(numPartitions))), nil
+	}
+	key, err := message.Key.Encode()
+	if err != nil {
+		return -1, err
+	}
+	return murmur2Partition(key, numPartitions), nil
+}
+
+func (p *murmur2Partitioner) RequiresConsistency() bool {
+	return true
+}
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/Shopify/sarama"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMurmur2(t *testing.T) {
+	//test vectors from the java client (UtilsTest.testMurmur2)
+	cases := map[string]int32{
+		"21":                         -973932308,
+		"foobar":                     -790332482,
+		"a-little-bit-long-string":   -985981536,
+		"a-little-bit-longer-string": -1486304829,
+		"lkjh234lh9fiuh90y23oiuhsafujhadof229phr9h19h89h8": -58897971,
+		"abc": 479470107,
+	}
+	for key, hash := range cases {
+		assert.Equal(t, hash, murmur2([]byte(key)), "wrong hash for key %s", key)
+	}
+}
+
+func TestMurmur2Partitioner(t *testing.T) {
+	//partitions as computed by the java DefaultPartitioner
+	cases := map[string]int32{
+		"21":     12,
+		"foobar": 14,
+		"abc":    11,
+	}
+	p := NewMurmur2Partitioner("empty")
+	assert.True(t, p.RequiresConsistency(), "partitioner must be consistent")
+	for key, partition := range cases {
+		c, err := p.Partition(&sarama.ProducerMessage{Key: sarama.StringEncoder(key)}, 16)
+		assert.NoError(t, err, "Unexpected error %v", err)
+		assert.Equal(t, partition, c, "wrong partition for key %s", key)
+	}
+	c, err := p.Partition(&sarama.ProducerMessage{}, 16)
+	assert.NoError(t, err, "Unexpected error %v", err)
+	assert.True(t, c >= 0 && c < 16, "keyless message got an invalid partition %d", c)
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// oauthOptions configure the client credentials flow of SASL OAUTHBEARER
+type oauthOptions struct {
+	TokenURL     string
+	ClientID     string
+	ClientSecret string
+	// Scope is optional, multiple scopes are separated by spaces
+	Scope string
+}
+
+// newOAuthTokenProvider returns the access tokens of an OAuth 2.0 client
+// credentials grant (RFC 6749 section 4.4), as issued by Keycloak or Okta
+func newOAuthTokenProvider(opts oauthOptions, client *http.Client) *tokenProvider {
+	p := newTokenProvider(nil)
+	p.fetch = func() (string, time.Time, error) {
+		return fetchOAuthToken(client, opts, p.now())
+	}
+	return p
+}
+
+func fetchOAuthToken(client *http.Client, opts oauthOptions, now time.Time) (string, time.Time, error) {
+	form := url.Values{"grant_type": {"client_credentials"}}
+	if opts.Scope != "" {
+		form.Set("scope", opts.Scope)
+	}
+	req, err := http.NewRequest(http.MethodPost, opts.TokenURL, strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	req.SetBasicAuth(url.QueryEscape(opts.ClientID), url.QueryEscape(opts.ClientSecret))
+	resp, err := client.Do(req)
+	if err != nil {
+		return "", time.Time{}, fmt.Errorf("could not fetch an oauth token: %s", err)
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return "", time.Time{}, fmt.Errorf("could not fetch an oauth token: %s", err)
+	}
+	var token struct {
+		AccessToken      string `json:"access_token"`
+		ExpiresIn        int64  `json:"expires_in"`
+		Error            string `json:"error"`
+		ErrorDescription string `json:"error_description"`
+	}
+	if err := json.Unmarshal(body, &token); err != nil {
+		return "", time.Time{}, fmt.Errorf("invalid oauth token response (%s): %s", resp.Status, err)
+	}
+	if resp.StatusCode != http.StatusOK || token.AccessToken == "" {
+		return "", time.Time{}, fmt.Errorf("could not fetch an oauth token (%s): %s %s", resp.Status, token.Error, token.ErrorDescription)
+	}
+	// tokens without expiry are refreshed like ones valid for an hour
+	expiresIn := time.Hour
+	if token.ExpiresIn > 0 {
+		expiresIn = time.Duration(token.ExpiresIn) * time.Second
+	}
+	return token.AccessToken, now.Add(expiresIn), nil
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestOAuthTokenProvider(t *testing.T) {
+	requests := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		user, password, _ := r.BasicAuth()
+		if r.Method != http.MethodPost || r.FormValue("grant_type") != "client_credentials" || user != "mirrormaker" || password != "s3cret" {
+			w.WriteHeader(http.StatusUnauthorized)
+			w.Write([]byte(`{"error":"invalid_client","error_description":"bad credentials"}`))
+			return
+		}
+		assert.Equal(t, "kafka write", r.FormValue("scope"))
+		w.Write([]byte(`{"access_token":"token` + string(rune('0'+requests)) + `","token_type":"Bearer","expires_in":300}`))
+	}))
+	defer server.Close()
+	opts := oauthOptions{TokenURL: server.URL, ClientID: "mirrormaker", ClientSecret: "s3cret", Scope: "kafka write"}
+	now := time.Now()
+	p := newOAuthTokenProvider(opts, server.Client())
+	p.now = func() time.Time { return now }
+	token, err := p.Token()
+	assert.NoError(t, err)
+	assert.Equal(t, "token1", token.Token)
+	token, _ = p.Token()
+	assert.Equal(t, "token1", token.Token, "the token was not cached")
+	now = now.Add(4*time.Minute + time.Second)
+	token, _ = p.Token()
+	assert.Equal(t, "token2", token.Token, "the token was not refreshed before it expired")
+
+	opts.ClientSecret = "wrong"
+	_, err = newOAuthTokenProvider(opts, server.Client()).Token()
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "invalid_client")
+	}
+}
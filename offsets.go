@@ -0,0 +1,132 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/Shopify/sarama"
+)
+
+// offsetReset is the committed offset of a partition before and after a reset
+type offsetReset struct {
+	topic     string
+	partition int32
+	// before is negative if the group had no committed offset
+	before int64
+	after  int64
+}
+
+// parseResetTimestamp parses an RFC 3339 timestamp or unix milliseconds into
+// unix milliseconds
+func parseResetTimestamp(s string) (int64, error) {
+	if ms, err := strconv.ParseInt(s, 10, 64); err == nil {
+		return ms, nil
+	}
+	t, err := time.Parse(time.RFC3339, s)
+	if err != nil {
+		return 0, fmt.Errorf("invalid timestamp %q, must be RFC 3339 or unix milliseconds", s)
+	}
+	return t.UnixNano() / int64(time.Millisecond), nil
+}
+
+// timestampOffsets returns the offset of the first message at or after the
+// timestamp. Partitions without such a message are reset to the newest offset.
+func timestampOffsets(getOffset func(topic string, partition int32, time int64) (int64, error), millis int64) func(string, int32) (int64, error) {
+	return func(topic string, partition int32) (int64, error) {
+		offset, err := getOffset(topic, partition, millis)
+		if err != nil {
+			return 0, err
+		}
+		if offset >= 0 {
+			return offset, nil
+		}
+		logger.With(Fields{"topic": topic, "partition": partition}).Warnf("no message at or after the timestamp, resetting to the newest offset")
+		return getOffset(topic, partition, sarama.OffsetNewest)
+	}
+}
+
+// getResetTarget returns the offsets of a --reset-offsets mode
+func getResetTarget(mode string, getOffset func(topic string, partition int32, time int64) (int64, error)) (func(string, int32) (int64, error), error) {
+	var time int64
+	switch strings.ToLower(mode) {
+	case "earliest":
+		time = sarama.OffsetOldest
+	case "latest":
+		time = sarama.OffsetNewest
+	default:
+		return nil, fmt.Errorf("invalid --reset-offsets %q, must be earliest or latest", mode)
+	}
+	return func(topic string, partition int32) (int64, error) {
+		return getOffset(topic, partition, time)
+	}, nil
+}
+
+// printResets writes the offsets before and after a reset as a table
+func printResets(w io.Writer, resets []offsetReset) {
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(tw, "TOPIC\tPARTITION\tBEFORE\tAFTER")
+	for _, reset := range resets {
+		before := "none"
+		if reset.before >= 0 {
+			before = strconv.FormatInt(reset.before, 10)
+		}
+		fmt.Fprintf(tw, "%s\t%d\t%s\t%d\n", reset.topic, reset.partition, before, reset.after)
+	}
+	tw.Flush()
+}
+
+// resetOffsets resolves the offsets returned by target for all partitions of
+// the topics and commits them if commit is set. The consumer group must not
+// have active members, otherwise the broker rejects the commit.
+func resetOffsets(client sarama.Client, group string, topics []string, target func(topic string, partition int32) (int64, error), commit bool) ([]offsetReset, error) {
+	om, err := sarama.NewOffsetManagerFromClient(group, client)
+	if err != nil {
+		return nil, err
+	}
+	var resets []offsetReset
+	var poms []sarama.PartitionOffsetManager
+	closeAll := func() error {
+		if err := om.Close(); err != nil {
+			return err
+		}
+		for _, pom := range poms {
+			if err := pom.Close(); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	for _, topic := range topics {
+		partitions, err := client.Partitions(topic)
+		if err != nil {
+			closeAll()
+			return nil, err
+		}
+		for _, partition := range partitions {
+			offset, err := target(topic, partition)
+			if err != nil {
+				closeAll()
+				return nil, fmt.Errorf("could not get the offset of %s/%d: %s", topic, partition, err)
+			}
+			pom, err := om.ManagePartition(topic, partition)
+			if err != nil {
+				closeAll()
+				return nil, err
+			}
+			poms = append(poms, pom)
+			before, _ := pom.NextOffset()
+			// MarkOffset only moves forward and ResetOffset only backwards
+			pom.ResetOffset(offset, "")
+			pom.MarkOffset(offset, "")
+			resets = append(resets, offsetReset{topic: topic, partition: partition, before: before, after: offset})
+		}
+	}
+	if commit {
+		om.Commit()
+	}
+	return resets, closeAll()
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/Shopify/sarama"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseResetTimestamp(t *testing.T) {
+	ms, err := parseResetTimestamp("1600000000000")
+	assert.NoError(t, err)
+	assert.Equal(t, int64(1600000000000), ms)
+	ms, err = parseResetTimestamp("2020-09-13T12:26:40Z")
+	assert.NoError(t, err)
+	assert.Equal(t, int64(1600000000000), ms)
+	ms, err = parseResetTimestamp("2020-09-13T14:26:40.5+02:00")
+	assert.NoError(t, err)
+	assert.Equal(t, int64(1600000000500), ms)
+	_, err = parseResetTimestamp("yesterday")
+	assert.Error(t, err, "No error occured on an invalid timestamp")
+}
+
+func TestTimestampOffsets(t *testing.T) {
+	millis := time.Now().UnixNano() / int64(time.Millisecond)
+	target := timestampOffsets(func(topic string, partition int32, ts int64) (int64, error) {
+		switch {
+		case ts == sarama.OffsetNewest:
+			return 500, nil
+		case partition == 0:
+			return 42, nil
+		default:
+			// no message at or after the timestamp
+			return -1, nil
+		}
+	}, millis)
+	offset, err := target("source", 0)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(42), offset)
+	offset, err = target("source", 1)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(500), offset, "partition without newer messages was not reset to the newest offset")
+}
+
+func TestResetOffsets(t *testing.T) {
+	broker := sarama.NewMockBroker(t, 1)
+	defer broker.Close()
+	broker.SetHandlerByMap(map[string]sarama.MockResponse{
+		"MetadataRequest": sarama.NewMockMetadataResponse(t).
+			SetBroker(broker.Addr(), broker.BrokerID()).
+			SetLeader("source", 0, broker.BrokerID()).
+			SetLeader("source", 1, broker.BrokerID()),
+		"FindCoordinatorRequest": sarama.NewMockFindCoordinatorResponse(t).
+			SetCoordinator(sarama.CoordinatorGroup, "group", broker),
+		"OffsetFetchRequest": sarama.NewMockOffsetFetchResponse(t).
+			SetOffset("group", "source", 0, 100, "", sarama.ErrNoError).
+			SetOffset("group", "source", 1, 5, "", sarama.ErrNoError),
+		"OffsetCommitRequest": sarama.NewMockOffsetCommitResponse(t).
+			SetError("group", "source", 0, sarama.ErrNoError).
+			SetError("group", "source", 1, sarama.ErrNoError),
+	})
+	cfg := sarama.NewConfig()
+	cfg.Version = sarama.V1_0_0_0
+	cfg.Consumer.Return.Errors = true
+	client, err := sarama.NewClient([]string{broker.Addr()}, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	resets, err := resetOffsets(client, "group", []string{"source"}, func(topic string, partition int32) (int64, error) {
+		return 50, nil
+	}, true)
+	assert.NoError(t, err)
+	assert.ElementsMatch(t, []offsetReset{
+		{topic: "source", partition: 0, before: 100, after: 50},
+		{topic: "source", partition: 1, before: 5, after: 50},
+	}, resets)
+
+	var committed []int64
+	for _, rr := range broker.History() {
+		if req, ok := rr.Request.(*sarama.OffsetCommitRequest); ok {
+			for _, partition := range []int32{0, 1} {
+				if offset, _, err := req.Offset("source", partition); err == nil {
+					committed = append(committed, offset)
+				}
+			}
+		}
+	}
+	assert.Equal(t, []int64{50, 50}, committed, "offsets were not committed once")
+}
+
+func TestGetResetTarget(t *testing.T) {
+	getOffset := func(topic string, partition int32, time int64) (int64, error) {
+		if time == sarama.OffsetOldest {
+			return 10, nil
+		}
+		return 500, nil
+	}
+	target, err := getResetTarget("earliest", getOffset)
+	assert.NoError(t, err)
+	offset, _ := target("source", 0)
+	assert.Equal(t, int64(10), offset)
+	target, err = getResetTarget("Latest", getOffset)
+	assert.NoError(t, err)
+	offset, _ = target("source", 0)
+	assert.Equal(t, int64(500), offset)
+	_, err = getResetTarget("oldest", getOffset)
+	assert.Error(t, err, "No error occured on an invalid mode")
+}
+
+func TestPrintResets(t *testing.T) {
+	var buf bytes.Buffer
+	printResets(&buf, []offsetReset{
+		{topic: "source", partition: 0, before: 100, after: 50},
+		{topic: "source", partition: 11, before: -1, after: 7},
+	})
+	assert.Equal(t, "TOPIC   PARTITION  BEFORE  AFTER\n"+
+		"source  0          100     50\n"+
+		"source  11         none    7\n", buf.String())
+}
@@ -0,0 +1,238 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/Shopify/sarama"
+)
+
+// offsetSyncHistory is the number of offset pairs kept per source and
+// destination partition
+const offsetSyncHistory = 1000
+
+// partitionLink connects a source partition with a destination partition its
+// messages were mirrored to
+type partitionLink struct {
+	sourceTopic     string
+	sourcePartition int32
+	topic           string
+	partition       int32
+}
+
+// offsetPair is the source offset of a message and the destination offset of
+// its mirrored copy
+type offsetPair struct {
+	source      int64
+	destination int64
+}
+
+// offsetMapping records the offsets of acknowledged messages, like the offset
+// syncs of MirrorMaker 2. All methods may be called on a nil offsetMapping.
+type offsetMapping struct {
+	mu    sync.Mutex
+	pairs map[partitionLink][]offsetPair
+}
+
+func newOffsetMapping() *offsetMapping {
+	return &offsetMapping{pairs: map[partitionLink][]offsetPair{}}
+}
+
+// record adds the destination offset of an acknowledged message. Pairs which
+// are not ahead of the last one in both partitions, e.g. after a retry, are
+// ignored so the pairs of a link stay sorted.
+func (m *offsetMapping) record(source *sarama.ConsumerMessage, topic string, partition int32, offset int64) {
+	if m == nil {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	link := partitionLink{sourceTopic: source.Topic, sourcePartition: source.Partition, topic: topic, partition: partition}
+	pairs := m.pairs[link]
+	if n := len(pairs); n > 0 && (pairs[n-1].source >= source.Offset || pairs[n-1].destination >= offset) {
+		return
+	}
+	if len(pairs) == offsetSyncHistory {
+		pairs = append(pairs[:0], pairs[1:]...)
+	}
+	m.pairs[link] = append(pairs, offsetPair{source: source.Offset, destination: offset})
+}
+
+// translate returns the destination offsets for the committed source offsets.
+// The offset of a destination partition is the one after the last message
+// mirrored before the committed source offset, with several source
+// partitions the smallest of them, so nothing is skipped. Destination
+// partitions are left out if a source partition has no commit or its commit
+// is older than the recorded pairs.
+func (m *offsetMapping) translate(committed map[string]map[int32]int64) map[string]map[int32]int64 {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	type destination struct {
+		topic     string
+		partition int32
+	}
+	translated := map[destination]int64{}
+	unknown := map[destination]bool{}
+	for link, pairs := range m.pairs {
+		d := destination{link.topic, link.partition}
+		offset, ok := committed[link.sourceTopic][link.sourcePartition]
+		if !ok || offset < 0 {
+			unknown[d] = true
+			continue
+		}
+		// the first pair of a message which was not consumed yet
+		i := sort.Search(len(pairs), func(i int) bool { return pairs[i].source >= offset })
+		if i == 0 {
+			unknown[d] = true
+			continue
+		}
+		if current, ok := translated[d]; !ok || pairs[i-1].destination+1 < current {
+			translated[d] = pairs[i-1].destination + 1
+		}
+	}
+	offsets := map[string]map[int32]int64{}
+	for d, offset := range translated {
+		if unknown[d] {
+			continue
+		}
+		if offsets[d.topic] == nil {
+			offsets[d.topic] = map[int32]int64{}
+		}
+		offsets[d.topic][d.partition] = offset
+	}
+	return offsets
+}
+
+// partitions returns the source and destination partitions with recorded
+// pairs
+func (m *offsetMapping) partitions() (sources, destinations map[string][]int32) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	sources, destinations = map[string][]int32{}, map[string][]int32{}
+	seen := map[partitionLink]bool{}
+	for link := range m.pairs {
+		source := partitionLink{sourceTopic: link.sourceTopic, sourcePartition: link.sourcePartition}
+		if !seen[source] {
+			seen[source] = true
+			sources[link.sourceTopic] = append(sources[link.sourceTopic], link.sourcePartition)
+		}
+		destination := partitionLink{topic: link.topic, partition: link.partition}
+		if !seen[destination] {
+			seen[destination] = true
+			destinations[link.topic] = append(destinations[link.topic], link.partition)
+		}
+	}
+	return sources, destinations
+}
+
+// offsetSyncer periodically commits the translated offsets of consumer groups
+// of the source topics for the destination topics, so their consumers can
+// switch to the mirror
+type offsetSyncer struct {
+	mapping *offsetMapping
+	groups  []string
+	// committed returns the committed offsets of a group, -1 for partitions
+	// without a commit
+	committed func(group string, partitions map[string][]int32) (map[string]map[int32]int64, error)
+	commit    func(group string, offsets map[string]map[int32]int64) error
+}
+
+func newOffsetSyncer(client sarama.Client, mapping *offsetMapping, groups []string) *offsetSyncer {
+	return &offsetSyncer{
+		mapping: mapping,
+		groups:  groups,
+		committed: func(group string, partitions map[string][]int32) (map[string]map[int32]int64, error) {
+			return fetchCommittedOffsets(client, group, partitions)
+		},
+		commit: func(group string, offsets map[string]map[int32]int64) error {
+			return commitGroupOffsets(client, group, offsets)
+		},
+	}
+}
+
+// sync commits the translated offsets of the group. Offsets are only moved
+// forward, a group which got ahead on the destination is left alone.
+func (s *offsetSyncer) sync(group string) error {
+	sources, destinations := s.mapping.partitions()
+	if len(sources) == 0 {
+		return nil
+	}
+	committed, err := s.committed(group, sources)
+	if err != nil {
+		return fmt.Errorf("could not fetch the source offsets: %s", err)
+	}
+	current, err := s.committed(group, destinations)
+	if err != nil {
+		return fmt.Errorf("could not fetch the destination offsets: %s", err)
+	}
+	offsets := map[string]map[int32]int64{}
+	for topic, partitions := range s.mapping.translate(committed) {
+		for partition, offset := range partitions {
+			if offset <= current[topic][partition] {
+				continue
+			}
+			if offsets[topic] == nil {
+				offsets[topic] = map[int32]int64{}
+			}
+			offsets[topic][partition] = offset
+		}
+	}
+	if len(offsets) == 0 {
+		return nil
+	}
+	return s.commit(group, offsets)
+}
+
+// run syncs the offsets of all groups every interval until ctx is done
+func (s *offsetSyncer) run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			for _, group := range s.groups {
+				if err := s.sync(group); err != nil {
+					logger.With(Fields{"group": group, "error": err}).Warnf("could not sync the consumer group offsets")
+				}
+			}
+		}
+	}
+}
+
+// commitGroupOffsets commits the offsets for the group without joining it,
+// the broker rejects this while the group has active members
+func commitGroupOffsets(client sarama.Client, group string, offsets map[string]map[int32]int64) error {
+	coordinator, err := client.Coordinator(group)
+	if err != nil {
+		return err
+	}
+	req := &sarama.OffsetCommitRequest{
+		Version:                 2,
+		ConsumerGroup:           group,
+		ConsumerGroupGeneration: sarama.GroupGenerationUndefined,
+		// the retention of the broker (offsets.retention.minutes)
+		RetentionTime: -1,
+	}
+	for topic, partitions := range offsets {
+		for partition, offset := range partitions {
+			req.AddBlock(topic, partition, offset, 0, "")
+		}
+	}
+	resp, err := coordinator.CommitOffset(req)
+	if err != nil {
+		return err
+	}
+	for topic, partitions := range resp.Errors {
+		for partition, kerr := range partitions {
+			if kerr != sarama.ErrNoError {
+				return fmt.Errorf("could not commit the offset of %s/%d: %s", topic, partition, kerr)
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/Shopify/sarama"
+	"github.com/stretchr/testify/assert"
+)
+
+func sourceMsg(topic string, partition int32, offset int64) *sarama.ConsumerMessage {
+	return &sarama.ConsumerMessage{Topic: topic, Partition: partition, Offset: offset}
+}
+
+func TestOffsetMappingTranslate(t *testing.T) {
+	m := newOffsetMapping()
+	// source/0 goes to dest/0, source/1 is spread over dest/0 and dest/1
+	m.record(sourceMsg("source", 0, 10), "dest", 0, 100)
+	m.record(sourceMsg("source", 0, 11), "dest", 0, 101)
+	m.record(sourceMsg("source", 1, 5), "dest", 0, 102)
+	m.record(sourceMsg("source", 1, 6), "dest", 1, 50)
+	m.record(sourceMsg("source", 0, 12), "dest", 0, 103)
+	// a retried message is ignored
+	m.record(sourceMsg("source", 0, 11), "dest", 0, 104)
+
+	offsets := m.translate(map[string]map[int32]int64{"source": {0: 12, 1: 7}})
+	// dest/0 has source/0 up to offset 11 (dest 101) and source/1 up to 5 (102)
+	assert.Equal(t, map[string]map[int32]int64{"dest": {0: 102, 1: 51}}, offsets)
+
+	offsets = m.translate(map[string]map[int32]int64{"source": {0: 100, 1: 100}})
+	assert.Equal(t, map[string]map[int32]int64{"dest": {0: 103, 1: 51}}, offsets, "commits ahead of the mirror use the last pair")
+
+	offsets = m.translate(map[string]map[int32]int64{"source": {0: 12, 1: 6}})
+	assert.Equal(t, map[string]map[int32]int64{"dest": {0: 102}}, offsets, "dest/1 has nothing before the commit")
+
+	offsets = m.translate(map[string]map[int32]int64{"source": {0: 12, 1: -1}})
+	assert.Empty(t, offsets, "partitions without commit leave their destinations alone")
+
+	sources, destinations := m.partitions()
+	assert.ElementsMatch(t, []int32{0, 1}, sources["source"])
+	assert.ElementsMatch(t, []int32{0, 1}, destinations["dest"])
+}
+
+func TestOffsetMappingHistory(t *testing.T) {
+	m := newOffsetMapping()
+	for i := int64(0); i < offsetSyncHistory+10; i++ {
+		m.record(sourceMsg("source", 0, i), "dest", 0, i+1000)
+	}
+	link := partitionLink{sourceTopic: "source", sourcePartition: 0, topic: "dest", partition: 0}
+	assert.Len(t, m.pairs[link], offsetSyncHistory)
+	assert.Equal(t, int64(10), m.pairs[link][0].source)
+	assert.Empty(t, m.translate(map[string]map[int32]int64{"source": {0: 5}}), "commits older than the history are not translated")
+}
+
+func TestOffsetMappingNil(t *testing.T) {
+	var m *offsetMapping
+	m.record(sourceMsg("source", 0, 1), "dest", 0, 1)
+}
+
+func TestOffsetSyncerSync(t *testing.T) {
+	m := newOffsetMapping()
+	m.record(sourceMsg("source", 0, 10), "dest", 0, 100)
+	m.record(sourceMsg("source", 1, 10), "dest", 1, 200)
+	var committed map[string]map[int32]int64
+	s := &offsetSyncer{
+		mapping: m,
+		groups:  []string{"app"},
+		committed: func(group string, partitions map[string][]int32) (map[string]map[int32]int64, error) {
+			assert.Equal(t, "app", group)
+			if _, ok := partitions["source"]; ok {
+				return map[string]map[int32]int64{"source": {0: 11, 1: 11}}, nil
+			}
+			// dest/1 is already ahead
+			return map[string]map[int32]int64{"dest": {0: -1, 1: 300}}, nil
+		},
+		commit: func(group string, offsets map[string]map[int32]int64) error {
+			committed = offsets
+			return nil
+		},
+	}
+	assert.NoError(t, s.sync("app"))
+	assert.Equal(t, map[string]map[int32]int64{"dest": {0: 101}}, committed)
+
+	committed = nil
+	s.mapping = newOffsetMapping()
+	assert.NoError(t, s.sync("app"))
+	assert.Nil(t, committed, "nothing mirrored yet")
+}
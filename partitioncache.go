@@ -0,0 +1,128 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// partitionCache caches the number of partitions per destination topic. The
+// counts are fetched lazily and refreshed once they are older than the ttl,
+// so repartitioned destination topics are picked up without a restart.
+type partitionCache struct {
+	mu         sync.Mutex
+	partitions func(topic string) ([]int32, error)
+	ttl        time.Duration
+	now        func() time.Time
+	entries    map[string]partitionCacheEntry
+	// changed is called with the old and the new count when the partition
+	// count of a topic changed
+	changed func(topic string, from, to int32)
+	// haltOnDecrease stops the mirroring once a topic lost partitions, the
+	// messages of keepPartition would go to other partitions or fail
+	haltOnDecrease bool
+	haltOnce       sync.Once
+	halt           chan struct{}
+}
+
+type partitionCacheEntry struct {
+	count   int32
+	fetched time.Time
+}
+
+// newPartitionCache creates a cache which uses the partitions function
+// (usually sarama.Client.Partitions) to look up topics. A ttl <= 0 disables
+// refreshing.
+func newPartitionCache(partitions func(topic string) ([]int32, error), ttl time.Duration) *partitionCache {
+	return &partitionCache{
+		partitions: partitions,
+		ttl:        ttl,
+		now:        time.Now,
+		entries:    map[string]partitionCacheEntry{},
+		halt:       make(chan struct{}),
+	}
+}
+
+// Get returns the number of partitions of the topic. If a refresh fails the
+// previous count is kept. Once halted it only returns errors.
+func (c *partitionCache) Get(topic string) (int32, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.halted() {
+		return 0, fmt.Errorf("a destination topic lost partitions, mirroring is halted (producer.partitions.halt_on_decrease)")
+	}
+	now := c.now()
+	entry, ok := c.entries[topic]
+	if ok && (c.ttl <= 0 || now.Sub(entry.fetched) < c.ttl) {
+		return entry.count, nil
+	}
+	part, err := c.partitions(topic)
+	if err == nil && len(part) == 0 {
+		err = fmt.Errorf("topic %s has no partitions", topic)
+	}
+	if err != nil {
+		if ok {
+			logger.With(Fields{"topic": topic, "error": err}).Warnf("could not refresh partitions, keeping %d", entry.count)
+			return entry.count, nil
+		}
+		return 0, fmt.Errorf("could not get partitions for target topic %s: %s", topic, err)
+	}
+	if count := int32(len(part)); ok && entry.count != count {
+		logger.With(Fields{"topic": topic, "from": entry.count, "to": count}).Warnf("the number of partitions of the destination topic changed from %d to %d", entry.count, count)
+		if c.changed != nil {
+			c.changed(topic, entry.count, count)
+		}
+		if count < entry.count && c.haltOnDecrease {
+			c.haltOnce.Do(func() { close(c.halt) })
+			return 0, fmt.Errorf("the number of partitions of %s decreased from %d to %d, mirroring is halted (producer.partitions.halt_on_decrease)", topic, entry.count, count)
+		}
+	}
+	c.entries[topic] = partitionCacheEntry{count: int32(len(part)), fetched: now}
+	return int32(len(part)), nil
+}
+
+// done is closed once the mirroring halts because a topic lost partitions
+func (c *partitionCache) done() <-chan struct{} {
+	return c.halt
+}
+
+// halted reports whether a topic lost partitions with haltOnDecrease
+func (c *partitionCache) halted() bool {
+	if c == nil {
+		return false
+	}
+	select {
+	case <-c.halt:
+		return true
+	default:
+		return false
+	}
+}
+
+// run refreshes the counts of all cached topics every ttl until ctx is done,
+// so changes are noticed without messages for the topic
+func (c *partitionCache) run(ctx context.Context) {
+	if c.ttl <= 0 {
+		return
+	}
+	ticker := time.NewTicker(c.ttl)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			c.mu.Lock()
+			topics := make([]string, 0, len(c.entries))
+			for topic := range c.entries {
+				topics = append(topics, topic)
+			}
+			c.mu.Unlock()
+			for _, topic := range topics {
+				// the error is logged or returned to the next message
+				_, _ = c.Get(topic)
+			}
+		}
+	}
+}
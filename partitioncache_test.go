@@ -0,0 +1,120 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPartitionCache(t *testing.T) {
+	calls := 0
+	partitions := map[string][]int32{"a": {0, 1, 2}, "b": {0}}
+	var fail error
+	c := newPartitionCache(func(topic string) ([]int32, error) {
+		calls++
+		if fail != nil {
+			return nil, fail
+		}
+		return partitions[topic], nil
+	}, time.Minute)
+	now := time.Now()
+	c.now = func() time.Time { return now }
+
+	n, err := c.Get("a")
+	assert.NoError(t, err, "Unexpected error %v", err)
+	assert.Equal(t, int32(3), n)
+	n, err = c.Get("b")
+	assert.NoError(t, err, "Unexpected error %v", err)
+	assert.Equal(t, int32(1), n)
+	_, err = c.Get("a")
+	assert.NoError(t, err, "Unexpected error %v", err)
+	assert.Equal(t, 2, calls, "cached topic was looked up again")
+
+	//refresh after the ttl
+	partitions["a"] = []int32{0, 1, 2, 3}
+	now = now.Add(2 * time.Minute)
+	n, err = c.Get("a")
+	assert.NoError(t, err, "Unexpected error %v", err)
+	assert.Equal(t, int32(4), n, "partition count was not refreshed")
+
+	//failed refreshes keep the old value
+	fail = fmt.Errorf("broker unavailable")
+	now = now.Add(2 * time.Minute)
+	n, err = c.Get("a")
+	assert.NoError(t, err, "Unexpected error %v", err)
+	assert.Equal(t, int32(4), n, "partition count was lost on a failed refresh")
+	_, err = c.Get("unknown")
+	assert.Error(t, err, "No error occured on an unknown topic")
+
+	fail = nil
+	_, err = c.Get("empty")
+	assert.Error(t, err, "No error occured on a topic without partitions")
+}
+
+func TestPartitionCacheChanged(t *testing.T) {
+	partitions := []int32{0, 1, 2, 3}
+	c := newPartitionCache(func(topic string) ([]int32, error) { return partitions, nil }, time.Minute)
+	now := time.Now()
+	c.now = func() time.Time { return now }
+	var changes [][2]int32
+	c.changed = func(topic string, from, to int32) {
+		assert.Equal(t, "a", topic)
+		changes = append(changes, [2]int32{from, to})
+	}
+
+	_, err := c.Get("a")
+	assert.NoError(t, err)
+	partitions = []int32{0, 1}
+	now = now.Add(2 * time.Minute)
+	n, err := c.Get("a")
+	assert.NoError(t, err, "a decrease halted without haltOnDecrease")
+	assert.Equal(t, int32(2), n)
+	assert.Equal(t, [][2]int32{{4, 2}}, changes)
+	assert.False(t, c.halted())
+
+	c.haltOnDecrease = true
+	partitions = []int32{0, 1, 2}
+	now = now.Add(2 * time.Minute)
+	_, err = c.Get("a")
+	assert.NoError(t, err, "an increase halted")
+	partitions = []int32{0}
+	now = now.Add(2 * time.Minute)
+	_, err = c.Get("a")
+	assert.Error(t, err, "No error occured on a decrease")
+	assert.Equal(t, [][2]int32{{4, 2}, {2, 3}, {3, 1}}, changes)
+	<-c.done()
+	assert.True(t, c.halted())
+	_, err = c.Get("b")
+	assert.Error(t, err, "No error occured after halting")
+}
+
+func TestPartitionCacheRun(t *testing.T) {
+	var mu sync.Mutex
+	partitions := []int32{0, 1}
+	changed := make(chan int32, 1)
+	c := newPartitionCache(func(topic string) ([]int32, error) {
+		mu.Lock()
+		defer mu.Unlock()
+		return partitions, nil
+	}, 10*time.Millisecond)
+	c.changed = func(topic string, from, to int32) { changed <- to }
+	_, err := c.Get("a")
+	assert.NoError(t, err)
+	mu.Lock()
+	partitions = []int32{0, 1, 2}
+	mu.Unlock()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go c.run(ctx)
+	select {
+	case n := <-changed:
+		assert.Equal(t, int32(3), n)
+	case <-time.After(5 * time.Second):
+		t.Fatal("the change was not noticed without a message")
+	}
+}
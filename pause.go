@@ -0,0 +1,95 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sync"
+)
+
+// pauser stops the claims from mirroring while paused. All methods are safe
+// for concurrent use, wait and paused may also be called on a nil pauser.
+type pauser struct {
+	mu sync.Mutex
+	// resumed is closed while not paused
+	resumed chan struct{}
+}
+
+func newPauser() *pauser {
+	resumed := make(chan struct{})
+	close(resumed)
+	return &pauser{resumed: resumed}
+}
+
+func (p *pauser) pause() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	select {
+	case <-p.resumed:
+		p.resumed = make(chan struct{})
+		logger.Infof("Mirroring paused")
+	default:
+	}
+}
+
+func (p *pauser) resume() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	select {
+	case <-p.resumed:
+	default:
+		close(p.resumed)
+		logger.Infof("Mirroring resumed")
+	}
+}
+
+func (p *pauser) paused() bool {
+	if p == nil {
+		return false
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	select {
+	case <-p.resumed:
+		return false
+	default:
+		return true
+	}
+}
+
+// wait blocks while paused. It returns the error of ctx if ctx is done first.
+func (p *pauser) wait(ctx context.Context) error {
+	if p == nil {
+		return nil
+	}
+	p.mu.Lock()
+	resumed := p.resumed
+	p.mu.Unlock()
+	select {
+	case <-resumed:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// register adds the POST /pause and /resume endpoints to the mux
+func (p *pauser) register(mux *http.ServeMux) {
+	handle := func(f func()) http.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request) {
+			if r.Method != http.MethodPost {
+				w.Header().Set("Allow", http.MethodPost)
+				http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+				return
+			}
+			f()
+			if p.paused() {
+				fmt.Fprintln(w, "paused")
+			} else {
+				fmt.Fprintln(w, "running")
+			}
+		}
+	}
+	mux.HandleFunc("/pause", handle(p.pause))
+	mux.HandleFunc("/resume", handle(p.resume))
+}
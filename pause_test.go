@@ -0,0 +1,82 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/Shopify/sarama"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPauser(t *testing.T) {
+	p := newPauser()
+	assert.NoError(t, p.wait(context.Background()))
+
+	p.pause()
+	assert.True(t, p.paused())
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	assert.Equal(t, context.DeadlineExceeded, p.wait(ctx), "wait did not block while paused")
+
+	done := make(chan error)
+	go func() { done <- p.wait(context.Background()) }()
+	p.resume()
+	select {
+	case err := <-done:
+		assert.NoError(t, err)
+	case <-time.After(time.Second):
+		t.Fatal("wait did not return after resume")
+	}
+	assert.False(t, p.paused())
+
+	var nilPauser *pauser
+	assert.NoError(t, nilPauser.wait(context.Background()))
+}
+
+func TestPauserHandler(t *testing.T) {
+	p := newPauser()
+	mux := http.NewServeMux()
+	p.register(mux)
+
+	rec := httptest.NewRecorder()
+	mux.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/pause", nil))
+	assert.Equal(t, http.StatusMethodNotAllowed, rec.Code)
+	assert.False(t, p.paused())
+
+	rec = httptest.NewRecorder()
+	mux.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/pause", nil))
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, "paused\n", rec.Body.String())
+
+	rec = httptest.NewRecorder()
+	mux.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/resume", nil))
+	assert.Equal(t, "running\n", rec.Body.String())
+}
+
+func TestConsumeClaimPaused(t *testing.T) {
+	producer := newTestProducer()
+	consumer := newTestConsumer("hash", producer)
+	consumer.pause = newPauser()
+	consumer.pause.pause()
+	ctx, cancel := context.WithCancel(context.Background())
+	session := &testSession{ctx: ctx}
+	done := make(chan error)
+	go func() {
+		done <- consumer.ConsumeClaim(session, newTestClaim(&sarama.ConsumerMessage{Topic: "source", Key: []byte("a")}))
+	}()
+	time.Sleep(10 * time.Millisecond)
+	assert.Empty(t, producer.produced(), "message was produced while paused")
+
+	// ending the session must not be blocked by the pause
+	cancel()
+	select {
+	case err := <-done:
+		assert.NoError(t, err)
+	case <-time.After(time.Second):
+		t.Fatal("paused claim did not stop")
+	}
+	assert.Empty(t, session.marked, "messages were marked while paused")
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/Shopify/sarama"
+	"github.com/rcrowley/go-metrics"
+)
+
+// msgMetadata is attached to every mirrored message as
+// sarama.ProducerMessage.Metadata and returned with its success or error
+type msgMetadata struct {
+	// enqueued is the time the message was handed to the producer
+	enqueued time.Time
+	// done is called with the error once the message is acknowledged or
+	// failed, if set
+	done func(err error)
+	// acked is called with the destination partition and offset once the
+	// message is acknowledged, if set
+	acked func(partition int32, offset int64)
+}
+
+// errProducerClosed is returned for messages enqueued after the producer was
+// closed
+var errProducerClosed = errors.New("the producer is closed")
+
+// producerInput guards the sends to the producer input against the shutdown.
+// sarama closes the input in Close, a claim still running at that point
+// would panic sending to it. All methods may be called on a nil
+// producerInput, which does not guard anything.
+type producerInput struct {
+	mu     sync.RWMutex
+	closed bool
+}
+
+// acquire reports whether messages may be sent, release has to be called
+// after the send if so
+func (p *producerInput) acquire() bool {
+	if p == nil {
+		return true
+	}
+	p.mu.RLock()
+	if p.closed {
+		p.mu.RUnlock()
+		return false
+	}
+	return true
+}
+
+func (p *producerInput) release() {
+	if p != nil {
+		p.mu.RUnlock()
+	}
+}
+
+// close waits for the running sends, the producer can be closed afterwards
+func (p *producerInput) close() {
+	if p == nil {
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.closed = true
+}
+
+// successClock remembers when the producer acknowledged the last message.
+// Until the first acknowledgement it counts from its creation.
+type successClock struct {
+	// last is in unix nanoseconds and accessed atomically
+	last int64
+	now  func() time.Time
+}
+
+func newSuccessClock(now func() time.Time) *successClock {
+	return &successClock{last: now().UnixNano(), now: now}
+}
+
+func (c *successClock) success() {
+	atomic.StoreInt64(&c.last, c.now().UnixNano())
+}
+
+// secondsSince returns the whole seconds since the last acknowledgement
+func (c *successClock) secondsSince() int64 {
+	return int64(c.now().Sub(time.Unix(0, atomic.LoadInt64(&c.last))) / time.Second)
+}
+
+// trackSuccesses drains the successes of the producer until it is closed and
+// records the produce latency of every acknowledged message. The
+// producer.seconds_since_last_success gauge reveals stalls of the destination
+// while messages are consumed.
+func trackSuccesses(producer sarama.AsyncProducer, registry metrics.Registry) {
+	success := metrics.GetOrRegisterMeter(`producer.success`, registry)
+	latency := metrics.GetOrRegisterTimer(`producer.produce_latency`, registry)
+	inflight := metrics.GetOrRegisterCounter(`producer.inflight`, registry)
+	clock := newSuccessClock(time.Now)
+	registry.GetOrRegister(`producer.seconds_since_last_success`, metrics.NewFunctionalGauge(clock.secondsSince))
+	for msg := range producer.Successes() {
+		success.Mark(1)
+		clock.success()
+		if md, ok := msg.Metadata.(*msgMetadata); ok {
+			latency.UpdateSince(md.enqueued)
+			inflight.Dec(1)
+			if md.acked != nil {
+				md.acked(msg.Partition, msg.Offset)
+			}
+			if md.done != nil {
+				md.done(nil)
+			}
+		}
+	}
+}
+
+// producerError logs and counts a failed produce
+func producerError(e *sarama.ProducerError, registry metrics.Registry) {
+	logger.With(Fields{"topic": e.Msg.Topic, "partition": e.Msg.Partition, "error": e.Err}).Errorf("could not produce message")
+	metrics.GetOrRegisterMeter(`producer.errors`, registry).Mark(1)
+	if md, ok := e.Msg.Metadata.(*msgMetadata); ok {
+		metrics.GetOrRegisterCounter(`producer.inflight`, registry).Dec(1)
+		if md.done != nil {
+			md.done(e.Err)
+		}
+	}
+}
+
+// producerMessageSize returns the size sarama accounts for the message when
+// checking it against cfg.Producer.MaxMessageBytes, assuming the record batch
+// format of kafka 0.11 and newer which is the larger estimate
+func producerMessageSize(msg *sarama.ProducerMessage) int {
+	// see sarama.ProducerMessage.byteSize
+	size := 5*binary.MaxVarintLen32 + binary.MaxVarintLen64 + 1
+	for _, h := range msg.Headers {
+		size += len(h.Key) + len(h.Value) + 2*binary.MaxVarintLen32
+	}
+	if msg.Key != nil {
+		size += msg.Key.Length()
+	}
+	if msg.Value != nil {
+		size += msg.Value.Length()
+	}
+	return size
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/Shopify/sarama"
+	"github.com/rcrowley/go-metrics"
+	"github.com/stretchr/testify/assert"
+)
+
+type testSuccessProducer struct {
+	testProducer
+	successes chan *sarama.ProducerMessage
+}
+
+func (p *testSuccessProducer) Successes() <-chan *sarama.ProducerMessage { return p.successes }
+
+func TestTrackSuccesses(t *testing.T) {
+	producer := &testSuccessProducer{successes: make(chan *sarama.ProducerMessage, 2)}
+	producer.successes <- &sarama.ProducerMessage{Metadata: &msgMetadata{enqueued: time.Now().Add(-time.Second)}}
+	producer.successes <- &sarama.ProducerMessage{}
+	close(producer.successes)
+	registry := metrics.NewRegistry()
+	trackSuccesses(producer, registry)
+	assert.Equal(t, int64(2), metrics.GetOrRegisterMeter(`producer.success`, registry).Count())
+	latency := metrics.GetOrRegisterTimer(`producer.produce_latency`, registry)
+	assert.Equal(t, int64(1), latency.Count(), "latency was not recorded once")
+	assert.True(t, latency.Max() >= int64(time.Second), "latency %d is too low", latency.Max())
+}
+
+func TestSuccessClock(t *testing.T) {
+	now := time.Date(2021, 6, 1, 12, 0, 0, 0, time.UTC)
+	clock := newSuccessClock(func() time.Time { return now })
+	now = now.Add(90 * time.Second)
+	assert.Equal(t, int64(90), clock.secondsSince(), "the clock does not count from its creation")
+	clock.success()
+	now = now.Add(1500 * time.Millisecond)
+	assert.Equal(t, int64(1), clock.secondsSince())
+
+	producer := &testSuccessProducer{successes: make(chan *sarama.ProducerMessage)}
+	close(producer.successes)
+	registry := metrics.NewRegistry()
+	trackSuccesses(producer, registry)
+	gauge, ok := registry.Get(`producer.seconds_since_last_success`).(metrics.Gauge)
+	if assert.True(t, ok, "the gauge is not registered") {
+		assert.Equal(t, int64(0), gauge.Value())
+	}
+}
+
+func TestInflight(t *testing.T) {
+	producer := newTestProducer()
+	consumer := newTestConsumer("hash", producer)
+	consumer.trackSuccesses = true
+	session := &testSession{}
+	msgs := []*sarama.ConsumerMessage{
+		{Topic: "source", Offset: 0, Key: []byte("a"), Value: []byte("Terrible Test")},
+		{Topic: "source", Offset: 1, Key: []byte("b"), Value: []byte("Terrible Test")},
+		{Topic: "source", Offset: 2, Key: []byte("c"), Value: []byte("Terrible Test")},
+	}
+	err := consumer.ConsumeClaim(session, newTestClaim(msgs...))
+	assert.NoError(t, err, "Unexpected error %v", err)
+	inflight := metrics.GetOrRegisterCounter(`producer.inflight`, consumer.metrics)
+	assert.Equal(t, int64(3), inflight.Count())
+
+	produced := producer.produced()
+	successes := &testSuccessProducer{successes: make(chan *sarama.ProducerMessage, 2)}
+	successes.successes <- produced[0]
+	successes.successes <- produced[1]
+	close(successes.successes)
+	trackSuccesses(successes, consumer.metrics)
+	assert.Equal(t, int64(1), inflight.Count())
+
+	producerError(&sarama.ProducerError{Msg: produced[2], Err: sarama.ErrRequestTimedOut}, consumer.metrics)
+	assert.Equal(t, int64(0), inflight.Count())
+}
+
+func TestProducerMessageSize(t *testing.T) {
+	msg := &sarama.ProducerMessage{
+		Key:     sarama.ByteEncoder("key"),
+		Value:   sarama.ByteEncoder("value"),
+		Headers: []sarama.RecordHeader{{Key: []byte("h"), Value: []byte("v")}},
+	}
+	// 36 bytes record overhead, 2 + 10 for the header
+	assert.Equal(t, 36+3+5+12, producerMessageSize(msg))
+	assert.Equal(t, 36, producerMessageSize(&sarama.ProducerMessage{}))
+}
+
+func TestOrderedRetries(t *testing.T) {
+	broker := sarama.NewMockBroker(t, 1)
+	defer broker.Close()
+	// the first request fails and is retried after the ones sent after it,
+	// unless only one request is in flight
+	broker.SetHandlerByMap(map[string]sarama.MockResponse{
+		"MetadataRequest": sarama.NewMockMetadataResponse(t).
+			SetBroker(broker.Addr(), broker.BrokerID()).
+			SetLeader("destination", 0, broker.BrokerID()),
+		"InitProducerIDRequest": sarama.NewMockWrapper(&sarama.InitProducerIDResponse{ProducerID: 1}),
+		"ProduceRequest": sarama.NewMockSequence(
+			sarama.NewMockProduceResponse(t).SetVersion(3).SetError("destination", 0, sarama.ErrNotLeaderForPartition),
+			sarama.NewMockProduceResponse(t).SetVersion(3),
+		),
+	})
+	cfg := sarama.NewConfig()
+	cfg.Version = sarama.V0_11_0_0
+	cfg.Producer.Partitioner = sarama.NewManualPartitioner
+	cfg.Producer.Return.Successes = true
+	cfg.Producer.Flush.MaxMessages = 1
+	cfg.Producer.Retry.Backoff = 10 * time.Millisecond
+	assert.NoError(t, enableOrdering(cfg, "all", "keeppartition"))
+	producer, err := sarama.NewAsyncProducer([]string{broker.Addr()}, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer producer.Close()
+
+	var msgs []*sarama.ConsumerMessage
+	for i := 0; i < 10; i++ {
+		msgs = append(msgs, &sarama.ConsumerMessage{Topic: "source", Partition: 0, Offset: int64(i), Value: []byte{byte(i)}})
+	}
+	consumer := newTestConsumer("keeppartition", producer)
+	assert.NoError(t, consumer.ConsumeClaim(&testSession{}, newTestClaim(msgs...)))
+	for i := 0; i < len(msgs); i++ {
+		select {
+		case msg := <-producer.Successes():
+			value, _ := msg.Value.Encode()
+			assert.Equal(t, []byte{byte(i)}, value, "message %d was produced out of order", i)
+		case err := <-producer.Errors():
+			t.Fatal(err)
+		case <-time.After(5 * time.Second):
+			t.Fatalf("only %d of %d messages were produced", i, len(msgs))
+		}
+	}
+	requests := 0
+	for _, rr := range broker.History() {
+		if _, ok := rr.Request.(*sarama.ProduceRequest); ok {
+			requests++
+		}
+	}
+	assert.Greater(t, requests, len(msgs), "no request was retried")
+}
+
+func TestEnableOrdering(t *testing.T) {
+	cfg := sarama.NewConfig()
+	cfg.Version = sarama.V2_0_0_0
+	assert.NoError(t, enableOrdering(cfg, "", "hash"))
+	assert.True(t, cfg.Producer.Idempotent)
+	assert.Equal(t, 1, cfg.Net.MaxOpenRequests)
+	assert.Error(t, enableOrdering(sarama.NewConfig(), "", "roundrobin"), "No error occured on the roundrobin partitioner")
+	assert.Error(t, enableOrdering(cfg, "local", "hash"), "No error occured on conflicting acks")
+}
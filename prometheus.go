@@ -0,0 +1,85 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/rcrowley/go-metrics"
+)
+
+var prometheusQuantiles = []float64{0.5, 0.75, 0.95, 0.99}
+
+// prometheusHandler serves the metrics of the registry and the build info in
+// the prometheus text format. The consumer group prefix of the registry is
+// stripped from the metric names and exposed as the group label instead.
+func prometheusHandler(r metrics.Registry, group string, build buildInfo) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		build.writePrometheus(w, group)
+		writePrometheus(w, r, group)
+	})
+}
+
+func writePrometheus(w io.Writer, r metrics.Registry, group string) {
+	all := map[string]interface{}{}
+	r.Each(func(name string, i interface{}) {
+		all[strings.TrimPrefix(name, group+".")] = i
+	})
+	names := make([]string, 0, len(all))
+	for name := range all {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	labels := fmt.Sprintf(`group="%s"`, escapeLabel(group))
+	for _, name := range names {
+		pname := "mirrormaker_" + prometheusName(name)
+		switch m := all[name].(type) {
+		case metrics.Meter:
+			fmt.Fprintf(w, "# TYPE %s_total counter\n", pname)
+			fmt.Fprintf(w, "%s_total{%s} %d\n", pname, labels, m.Count())
+		case metrics.Counter:
+			fmt.Fprintf(w, "# TYPE %s gauge\n", pname)
+			fmt.Fprintf(w, "%s{%s} %d\n", pname, labels, m.Count())
+		case metrics.Gauge:
+			fmt.Fprintf(w, "# TYPE %s gauge\n", pname)
+			fmt.Fprintf(w, "%s{%s} %d\n", pname, labels, m.Value())
+		case metrics.GaugeFloat64:
+			fmt.Fprintf(w, "# TYPE %s gauge\n", pname)
+			fmt.Fprintf(w, "%s{%s} %g\n", pname, labels, m.Value())
+		case metrics.Timer:
+			// timers record nanoseconds, prometheus wants seconds
+			t := m.Snapshot()
+			writeSummary(w, pname+"_seconds", labels, t.Percentiles(prometheusQuantiles), float64(t.Sum())/1e9, t.Count(), 1e9)
+		case metrics.Histogram:
+			h := m.Snapshot()
+			writeSummary(w, pname, labels, h.Percentiles(prometheusQuantiles), float64(h.Sum()), h.Count(), 1)
+		}
+	}
+}
+
+func writeSummary(w io.Writer, pname, labels string, percentiles []float64, sum float64, count int64, div float64) {
+	fmt.Fprintf(w, "# TYPE %s summary\n", pname)
+	for i, q := range prometheusQuantiles {
+		fmt.Fprintf(w, "%s{%s,quantile=\"%g\"} %g\n", pname, labels, q, percentiles[i]/div)
+	}
+	fmt.Fprintf(w, "%s_sum{%s} %g\n", pname, labels, sum)
+	fmt.Fprintf(w, "%s_count{%s} %d\n", pname, labels, count)
+}
+
+// prometheusName replaces every character which is not allowed in a
+// prometheus metric name with an underscore
+func prometheusName(name string) string {
+	return strings.Map(func(r rune) rune {
+		if (r >= 'a' && r <= 'z') || (r >= 'A' && r <= 'Z') || (r >= '0' && r <= '9') || r == '_' || r == ':' {
+			return r
+		}
+		return '_'
+	}, name)
+}
+
+func escapeLabel(value string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(value)
+}
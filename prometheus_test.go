@@ -0,0 +1,31 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/rcrowley/go-metrics"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWritePrometheus(t *testing.T) {
+	r := metrics.NewPrefixedRegistry("my-group.")
+	metrics.GetOrRegisterMeter(`messages.processed`, r).Mark(3)
+	metrics.GetOrRegisterMeter(`producer.errors`, r)
+	metrics.GetOrRegisterTimer(`producer.produce_latency`, r).Update(2 * time.Second)
+	var b bytes.Buffer
+	writePrometheus(&b, r, "my-group")
+	out := b.String()
+	assert.Contains(t, out, "# TYPE mirrormaker_messages_processed_total counter\n")
+	assert.Contains(t, out, "mirrormaker_messages_processed_total{group=\"my-group\"} 3\n")
+	assert.Contains(t, out, "mirrormaker_producer_errors_total{group=\"my-group\"} 0\n")
+	assert.Contains(t, out, "mirrormaker_producer_produce_latency_seconds{group=\"my-group\",quantile=\"0.5\"} 2\n")
+	assert.Contains(t, out, "mirrormaker_producer_produce_latency_seconds_count{group=\"my-group\"} 1\n")
+	assert.Less(t, bytes.Index(b.Bytes(), []byte("messages_processed")), bytes.Index(b.Bytes(), []byte("producer_errors")), "metrics are not sorted")
+}
+
+func TestPrometheusName(t *testing.T) {
+	assert.Equal(t, "consumer_lag_my_topic_0", prometheusName("consumer.lag.my-topic.0"))
+	assert.Equal(t, "messages_processed", prometheusName("messages.processed"))
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+
+	"golang.org/x/net/proxy"
+)
+
+// newProxyDialer returns a dialer connecting through the proxy at rawURL,
+// either socks5://[user:password@]host[:port] or
+// http://[user:password@]host[:port] using HTTP CONNECT. The proxy itself is
+// dialed with forward.
+func newProxyDialer(rawURL string, forward *net.Dialer) (proxy.Dialer, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid proxy url %q: %s", rawURL, err)
+	}
+	if u.Host == "" {
+		return nil, fmt.Errorf("invalid proxy url %q: the host is missing", rawURL)
+	}
+	switch u.Scheme {
+	case "socks5", "socks5h":
+		return proxy.FromURL(u, forward)
+	case "http":
+		host := u.Host
+		if u.Port() == "" {
+			host = net.JoinHostPort(u.Hostname(), "80")
+		}
+		return &httpConnectDialer{proxyAddr: host, user: u.User, forward: forward}, nil
+	default:
+		return nil, fmt.Errorf("unsupported proxy scheme %q in %q, must be socks5 or http", u.Scheme, rawURL)
+	}
+}
+
+// httpConnectDialer tunnels connections through an HTTP proxy with the
+// CONNECT method
+type httpConnectDialer struct {
+	proxyAddr string
+	// user is sent as basic auth if set
+	user    *url.Userinfo
+	forward *net.Dialer
+}
+
+func (d *httpConnectDialer) Dial(network, addr string) (net.Conn, error) {
+	conn, err := d.forward.Dial(network, d.proxyAddr)
+	if err != nil {
+		return nil, err
+	}
+	if d.forward.Timeout > 0 {
+		conn.SetDeadline(time.Now().Add(d.forward.Timeout))
+	}
+	req := &http.Request{
+		Method: http.MethodConnect,
+		URL:    &url.URL{Opaque: addr},
+		Host:   addr,
+		Header: http.Header{},
+	}
+	if d.user != nil {
+		password, _ := d.user.Password()
+		req.SetBasicAuth(d.user.Username(), password)
+		// SetBasicAuth sets the header for servers, proxies expect it here
+		req.Header.Set("Proxy-Authorization", req.Header.Get("Authorization"))
+		req.Header.Del("Authorization")
+	}
+	if err := req.Write(conn); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("could not send CONNECT to the proxy %s: %s", d.proxyAddr, err)
+	}
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, req)
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("could not read the CONNECT response of the proxy %s: %s", d.proxyAddr, err)
+	}
+	// the body of a successful CONNECT is the tunnel, so it is not closed
+	if resp.StatusCode != http.StatusOK {
+		conn.Close()
+		return nil, fmt.Errorf("proxy %s refused to connect to %s: %s", d.proxyAddr, addr, resp.Status)
+	}
+	conn.SetDeadline(time.Time{})
+	if br.Buffered() > 0 {
+		// the broker never speaks first, but don't lose anything read ahead
+		return &bufferedConn{Conn: conn, r: br}, nil
+	}
+	return conn, nil
+}
+
+// bufferedConn reads what was buffered while reading the CONNECT response
+// before reading from the connection
+type bufferedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c *bufferedConn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
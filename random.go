@@ -0,0 +1,73 @@
+package main
+
+import (
+	"fmt"
+	"math/rand"
+
+	"github.com/spf13/viper"
+)
+
+// randomPartitions picks the partitions of the random partitioner instead of
+// the producer, so partitions can be left out, e.g. while they are
+// decommissioned, and the keys can be mirrored although they don't place the
+// messages. It is safe for concurrent use.
+type randomPartitions struct {
+	excluded map[int32]bool
+	// keepKey mirrors the keys, the random partitioner drops them otherwise
+	keepKey bool
+}
+
+func newRandomPartitions(excluded []int32, keepKey bool) *randomPartitions {
+	r := &randomPartitions{excluded: map[int32]bool{}, keepKey: keepKey}
+	for _, p := range excluded {
+		r.excluded[p] = true
+	}
+	return r
+}
+
+// next returns a random partition of a topic with numPartitions partitions
+// which is not excluded
+func (r *randomPartitions) next(numPartitions int32) (int32, error) {
+	allowed := numPartitions
+	for p := range r.excluded {
+		if p < numPartitions {
+			allowed--
+		}
+	}
+	if allowed <= 0 {
+		return 0, fmt.Errorf("all %d partitions of the destination topic are excluded (producer.exclude_partitions)", numPartitions)
+	}
+	n := rand.Int31n(allowed)
+	for p := int32(0); p < numPartitions; p++ {
+		if r.excluded[p] {
+			continue
+		}
+		if n == 0 {
+			return p, nil
+		}
+		n--
+	}
+	// not reached, n is below the number of allowed partitions
+	return 0, fmt.Errorf("no partition left to pick")
+}
+
+// randomPartitionsFromConfig returns the random partitions of
+// producer.exclude_partitions and producer.random.keep_key, nil if neither
+// is set. usesRandom tells whether any topic uses the random partitioner.
+func randomPartitionsFromConfig(usesRandom bool) (*randomPartitions, error) {
+	keepKey := viper.GetBool("producer.random.keep_key")
+	var excluded []int32
+	for _, p := range viper.GetIntSlice("producer.exclude_partitions") {
+		if p < 0 {
+			return nil, fmt.Errorf("invalid partition %d in producer.exclude_partitions", p)
+		}
+		excluded = append(excluded, int32(p))
+	}
+	if !keepKey && len(excluded) == 0 {
+		return nil, nil
+	}
+	if !usesRandom {
+		return nil, fmt.Errorf("producer.exclude_partitions and producer.random.keep_key require the random partitioner")
+	}
+	return newRandomPartitions(excluded, keepKey), nil
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/Shopify/sarama"
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRandomPartitionsExcluded(t *testing.T) {
+	r := newRandomPartitions([]int32{0, 2, 9}, false)
+	seen := map[int32]bool{}
+	for i := 0; i < 1000; i++ {
+		p, err := r.next(4)
+		assert.NoError(t, err)
+		assert.False(t, p == 0 || p == 2, "excluded partition %d was picked", p)
+		assert.True(t, p >= 0 && p < 4, "partition %d is out of range", p)
+		seen[p] = true
+	}
+	assert.Equal(t, map[int32]bool{1: true, 3: true}, seen, "not all allowed partitions were picked")
+
+	_, err := newRandomPartitions([]int32{0, 1}, false).next(2)
+	assert.Error(t, err, "No error occured with all partitions excluded")
+}
+
+func TestPartitionMsgRandom(t *testing.T) {
+	msg := sarama.ConsumerMessage{Partition: 3, Key: []byte("Terrible Test"), Value: []byte("Terrible Test")}
+	c, err := PartitionMsg("random", "empty", &msg, 8, MsgOptions{})
+	assert.NoError(t, err)
+	assert.Nil(t, c.Key, "the key was kept without producer.random.keep_key")
+
+	opts := MsgOptions{Random: newRandomPartitions([]int32{1, 2, 3, 4, 5, 6, 7}, true)}
+	for i := 0; i < 100; i++ {
+		c, err = PartitionMsg("random", "empty", &msg, 8, opts)
+		assert.NoError(t, err)
+		assert.Equal(t, int32(0), c.Partition, "an excluded partition received a message")
+		assert.Equal(t, sarama.ByteEncoder("Terrible Test"), c.Key, "the key was not kept")
+		assert.Equal(t, int32(0), pickPartition("random", &c, 8, opts), "the manual partition was not kept")
+	}
+
+	opts.StrictKeyPartition = true
+	_, err = PartitionMsg("random", "empty", &msg, 8, opts)
+	assert.Error(t, err, "No error occured on a kept key with producer.strict_key_partition")
+
+	//the header fallback leaves out the excluded partitions as well
+	opts = MsgOptions{Random: newRandomPartitions([]int32{0, 1, 2}, false), PartitionHeader: "partition", HeaderFallback: "random"}
+	for i := 0; i < 100; i++ {
+		c, err = PartitionMsg("header", "empty", &msg, 4, opts)
+		assert.NoError(t, err)
+		assert.Equal(t, int32(3), c.Partition, "an excluded partition received a message")
+	}
+}
+
+func TestRandomPartitionsFromConfig(t *testing.T) {
+	defer viper.Reset()
+	viper.Reset()
+	setDefaults()
+	r, err := randomPartitionsFromConfig(true)
+	assert.NoError(t, err)
+	assert.Nil(t, r)
+
+	viper.Set("producer.exclude_partitions", []int{1, 3})
+	r, err = randomPartitionsFromConfig(true)
+	assert.NoError(t, err)
+	assert.Equal(t, map[int32]bool{1: true, 3: true}, r.excluded)
+	assert.False(t, r.keepKey)
+	_, err = randomPartitionsFromConfig(false)
+	assert.Error(t, err, "No error occured without the random partitioner")
+
+	viper.Set("producer.exclude_partitions", []int{-1})
+	_, err = randomPartitionsFromConfig(true)
+	assert.Error(t, err, "No error occured on a negative partition")
+
+	viper.Set("producer.exclude_partitions", []int{})
+	viper.Set("producer.random.keep_key", true)
+	r, err = randomPartitionsFromConfig(true)
+	assert.NoError(t, err)
+	assert.True(t, r.keepKey)
+}
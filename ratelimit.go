@@ -0,0 +1,93 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// rateLimiter is a token bucket refilled with rate tokens per second holding
+// at most one second worth of tokens. Callers may take more tokens than
+// available, the debt is paid off by waiting.
+type rateLimiter struct {
+	mu     sync.Mutex
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+// newRateLimiter returns nil (no limit) if rate is not positive
+func newRateLimiter(rate float64) *rateLimiter {
+	if rate <= 0 {
+		return nil
+	}
+	burst := rate
+	if burst < 1 {
+		burst = 1
+	}
+	return &rateLimiter{rate: rate, burst: burst, tokens: burst, last: time.Now()}
+}
+
+// reserve takes n tokens and returns how long the caller has to wait for them
+func (l *rateLimiter) reserve(n float64, now time.Time) time.Duration {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if elapsed := now.Sub(l.last); elapsed > 0 {
+		l.tokens += elapsed.Seconds() * l.rate
+		if l.tokens > l.burst {
+			l.tokens = l.burst
+		}
+		l.last = now
+	}
+	l.tokens -= n
+	if l.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-l.tokens / l.rate * float64(time.Second))
+}
+
+// throttle combines a message and a byte rate limit, whichever is more
+// restrictive wins. Bytes are counted before compression.
+type throttle struct {
+	messages *rateLimiter
+	bytes    *rateLimiter
+}
+
+// newThrottle returns nil if neither limit is set
+func newThrottle(messageRate, byteRate float64) *throttle {
+	t := &throttle{messages: newRateLimiter(messageRate), bytes: newRateLimiter(byteRate)}
+	if t.messages == nil && t.bytes == nil {
+		return nil
+	}
+	return t
+}
+
+// wait blocks until a message of the given size may be sent or the context is
+// done. It returns the time spent waiting. A nil throttle never blocks.
+func (t *throttle) wait(ctx context.Context, size int) (time.Duration, error) {
+	if t == nil {
+		return 0, nil
+	}
+	now := time.Now()
+	var d time.Duration
+	if t.messages != nil {
+		d = t.messages.reserve(1, now)
+	}
+	if t.bytes != nil {
+		if bd := t.bytes.reserve(float64(size), now); bd > d {
+			d = bd
+		}
+	}
+	if d <= 0 {
+		return 0, nil
+	}
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return d, nil
+	case <-ctx.Done():
+		return 0, ctx.Err()
+	}
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRateLimiterReserve(t *testing.T) {
+	assert.Nil(t, newRateLimiter(0), "a zero rate must not limit")
+	l := newRateLimiter(10)
+	now := l.last
+	//the initial burst is one second worth of tokens
+	for i := 0; i < 10; i++ {
+		assert.Equal(t, time.Duration(0), l.reserve(1, now), "burst token %d was throttled", i)
+	}
+	assert.Equal(t, 100*time.Millisecond, l.reserve(1, now), "wait time for the first throttled token")
+	assert.Equal(t, 200*time.Millisecond, l.reserve(1, now), "wait time does not accumulate")
+	//refill after waiting
+	now = now.Add(time.Second)
+	assert.Equal(t, time.Duration(0), l.reserve(1, now))
+	//the bucket never holds more than the burst
+	now = now.Add(time.Hour)
+	assert.Equal(t, 500*time.Millisecond, l.reserve(15, now))
+}
+
+func TestThrottleWait(t *testing.T) {
+	var th *throttle
+	d, err := th.wait(context.Background(), 100)
+	assert.NoError(t, err)
+	assert.Equal(t, time.Duration(0), d, "nil throttle waited")
+	assert.Nil(t, newThrottle(0, 0), "no limits must not throttle")
+
+	th = newThrottle(1000, 1)
+	d, err = th.wait(context.Background(), 1)
+	assert.NoError(t, err)
+	assert.Equal(t, time.Duration(0), d)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	//the byte limit is the more restrictive one
+	_, err = th.wait(ctx, 1)
+	assert.Error(t, err, "wait did not return on a cancelled context")
+
+	th = newThrottle(1, 1000)
+	_, err = th.wait(context.Background(), 1)
+	assert.NoError(t, err)
+	//the message limit is the more restrictive one
+	_, err = th.wait(ctx, 1)
+	assert.Error(t, err, "wait did not return on a cancelled context")
+}
@@ -0,0 +1,39 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"time"
+)
+
+// maxRetryBackoff caps the exponential backoff between two attempts
+const maxRetryBackoff = time.Minute
+
+// errRetryStopped is returned by retry if a signal arrived while waiting
+var errRetryStopped = errors.New("stopped by a signal")
+
+// retry calls f up to attempts times until it succeeds, doubling the backoff
+// after every failed attempt. It returns the last error of f, or
+// errRetryStopped if a signal arrives on stop while waiting.
+func retry(attempts int, backoff time.Duration, stop <-chan os.Signal, what string, f func() error) error {
+	var err error
+	for attempt := 1; ; attempt++ {
+		if err = f(); err == nil {
+			return nil
+		}
+		if attempt >= attempts {
+			return err
+		}
+		logger.With(Fields{"error": err, "attempt": attempt, "attempts": attempts}).Warnf("could not %s, retrying in %s", what, backoff)
+		timer := time.NewTimer(backoff)
+		select {
+		case <-timer.C:
+		case <-stop:
+			timer.Stop()
+			return errRetryStopped
+		}
+		if backoff *= 2; backoff > maxRetryBackoff {
+			backoff = maxRetryBackoff
+		}
+	}
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRetry(t *testing.T) {
+	calls := 0
+	err := retry(3, time.Millisecond, nil, "connect", func() error {
+		calls++
+		if calls < 3 {
+			return errors.New("no brokers")
+		}
+		return nil
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, 3, calls)
+
+	calls = 0
+	err = retry(2, time.Millisecond, nil, "connect", func() error {
+		calls++
+		return errors.New("no brokers")
+	})
+	assert.EqualError(t, err, "no brokers")
+	assert.Equal(t, 2, calls)
+
+	calls = 0
+	err = retry(0, time.Millisecond, nil, "connect", func() error {
+		calls++
+		return errors.New("no brokers")
+	})
+	assert.Error(t, err)
+	assert.Equal(t, 1, calls, "a single attempt is always made")
+}
+
+func TestRetryStopped(t *testing.T) {
+	stop := make(chan os.Signal, 1)
+	stop <- syscall.SIGTERM
+	calls := 0
+	err := retry(5, time.Hour, stop, "connect", func() error {
+		calls++
+		return errors.New("no brokers")
+	})
+	assert.Equal(t, errRetryStopped, err)
+	assert.Equal(t, 1, calls)
+}
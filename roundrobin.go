@@ -0,0 +1,42 @@
+package main
+
+import (
+	"sync/atomic"
+
+	"github.com/Shopify/sarama"
+)
+
+// roundRobin hands out partitions cyclically. It is safe for concurrent use,
+// so a single counter can be shared by all claims.
+type roundRobin struct {
+	counter uint32
+}
+
+// next returns the next partition of a topic with numPartitions partitions
+func (r *roundRobin) next(numPartitions int32) int32 {
+	return int32((atomic.AddUint32(&r.counter, 1) - 1) % uint32(numPartitions))
+}
+
+type keylessManualPartitioner struct {
+	keyed sarama.Partitioner
+}
+
+// newKeylessManualPartitioner wraps a sarama.PartitionerConstructor so that
+// messages without a key keep the partition set by PartitionMsg, e.g. by the
+// round robin fallback of the hash partitioner
+func newKeylessManualPartitioner(keyed sarama.PartitionerConstructor) sarama.PartitionerConstructor {
+	return func(topic string) sarama.Partitioner {
+		return &keylessManualPartitioner{keyed: keyed(topic)}
+	}
+}
+
+func (p *keylessManualPartitioner) Partition(message *sarama.ProducerMessage, numPartitions int32) (int32, error) {
+	if message.Key == nil {
+		return message.Partition, nil
+	}
+	return p.keyed.Partition(message, numPartitions)
+}
+
+func (p *keylessManualPartitioner) RequiresConsistency() bool {
+	return true
+}
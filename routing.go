@@ -0,0 +1,169 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/Shopify/sarama"
+)
+
+// TopicRouter resolves the destination topics of a consumed message
+type TopicRouter struct {
+	// mapping maps source topics to one or more destination topics. Viper
+	// lowercases all keys, so lookups fall back to the lowercased source topic.
+	mapping map[string][]string
+	// rename rewrites source topics matching the pattern using replacement
+	rename      *regexp.Regexp
+	replacement string
+	// fallback is used for source topics without a mapping
+	fallback string
+	// keySuffixBuckets shards the destination topics by key, messages go to
+	// <topic>-<bucket> with the bucket taken from the murmur2 hash of the key.
+	// 0 disables it.
+	keySuffixBuckets int32
+}
+
+// NewTopicRouter creates a router from the topic.mapping config, the
+// topic.rename pattern and replacement and the default destination topic.
+// The pattern has to match the whole source topic, the replacement may refer
+// to capture groups as $1 or ${1}.
+func NewTopicRouter(mapping map[string][]string, pattern, replacement, fallback string) (*TopicRouter, error) {
+	if len(mapping) == 0 && pattern == "" && fallback == "" {
+		return nil, fmt.Errorf("neither producer.kafka.topic, topic.mapping nor topic.rename is configured")
+	}
+	for src, dsts := range mapping {
+		if len(dsts) == 0 {
+			return nil, fmt.Errorf("topic.mapping for %s has no destination topic", src)
+		}
+		for _, dst := range dsts {
+			if dst == "" {
+				return nil, fmt.Errorf("topic.mapping for %s has an empty destination topic", src)
+			}
+		}
+	}
+	r := &TopicRouter{mapping: mapping, fallback: fallback}
+	if pattern != "" {
+		if replacement == "" {
+			return nil, fmt.Errorf("topic.rename.pattern is set but topic.rename.replacement is empty")
+		}
+		re, err := regexp.Compile("^(?:" + pattern + ")$")
+		if err != nil {
+			return nil, fmt.Errorf("invalid topic.rename.pattern: %s", err)
+		}
+		r.rename = re
+		r.replacement = replacement
+	}
+	return r, nil
+}
+
+// ResolveDestinationTopics returns the topics messages from sourceTopic are
+// mirrored to. Only topic.mapping can fan out to more than one topic.
+func (r *TopicRouter) ResolveDestinationTopics(sourceTopic string) ([]string, error) {
+	if dsts, ok := r.mapping[sourceTopic]; ok {
+		return dsts, nil
+	}
+	if dsts, ok := r.mapping[strings.ToLower(sourceTopic)]; ok {
+		return dsts, nil
+	}
+	if r.rename != nil {
+		if match := r.rename.FindStringSubmatchIndex(sourceTopic); match != nil {
+			dst := string(r.rename.ExpandString(nil, r.replacement, sourceTopic, match))
+			if dst == "" {
+				return nil, fmt.Errorf("topic.rename produced an empty destination for topic %s", sourceTopic)
+			}
+			return []string{dst}, nil
+		}
+	}
+	if r.fallback == "" {
+		return nil, fmt.Errorf("no destination configured for topic %s, set topic.mapping or producer.kafka.topic", sourceTopic)
+	}
+	return []string{r.fallback}, nil
+}
+
+// ResolveMessageTopics returns the topics the message is mirrored to, the
+// destination topics of its source topic with the bucket of its key appended
+// if topic.key_suffix.buckets is set
+func (r *TopicRouter) ResolveMessageTopics(message *sarama.ConsumerMessage) ([]string, error) {
+	topics, err := r.ResolveDestinationTopics(message.Topic)
+	if err != nil || r.keySuffixBuckets == 0 {
+		return topics, err
+	}
+	if message.Key == nil {
+		return nil, fmt.Errorf("topic.key_suffix.buckets requires a key, the message of %s/%d has none", message.Topic, message.Partition)
+	}
+	bucket := keyBucket(message.Key, r.keySuffixBuckets)
+	sharded := make([]string, len(topics))
+	for i, topic := range topics {
+		sharded[i] = fmt.Sprintf("%s-%d", topic, bucket)
+	}
+	return sharded, nil
+}
+
+// ShardedTopics returns all topics messages for the destination topics may go
+// to, every bucket of every topic if topic.key_suffix.buckets is set
+func (r *TopicRouter) ShardedTopics(topics []string) []string {
+	if r.keySuffixBuckets == 0 {
+		return topics
+	}
+	var sharded []string
+	for _, topic := range topics {
+		for bucket := int32(0); bucket < r.keySuffixBuckets; bucket++ {
+			sharded = append(sharded, fmt.Sprintf("%s-%d", topic, bucket))
+		}
+	}
+	return sharded
+}
+
+// keyBucket returns the bucket of the key, the same as the partition the
+// murmur2 partitioner picks
+func keyBucket(key []byte, buckets int32) int32 {
+	return murmur2Partition(key, buckets)
+}
+
+// keyPrefixRoute sends the messages whose key starts with prefix, e.g.
+// control messages mixed into a data topic, to their own topic or partition.
+// All methods may be called on a nil keyPrefixRoute, which matches nothing.
+type keyPrefixRoute struct {
+	prefix []byte
+	// topic replaces the destination topics if set
+	topic string
+	// partition replaces the partition of the partitioner, -1 keeps it
+	partition int32
+}
+
+// newKeyPrefixRoute returns nil without prefix
+func newKeyPrefixRoute(prefix, topic string, partition int32) (*keyPrefixRoute, error) {
+	if prefix == "" {
+		if topic != "" || partition >= 0 {
+			return nil, fmt.Errorf("routing.key_prefix.topic and routing.key_prefix.partition require routing.key_prefix.prefix")
+		}
+		return nil, nil
+	}
+	if topic == "" && partition < 0 {
+		return nil, fmt.Errorf("routing.key_prefix.prefix requires routing.key_prefix.topic or routing.key_prefix.partition")
+	}
+	if partition < -1 {
+		return nil, fmt.Errorf("invalid routing.key_prefix.partition %d, must be a partition or -1", partition)
+	}
+	return &keyPrefixRoute{prefix: []byte(prefix), topic: topic, partition: partition}, nil
+}
+
+func (r *keyPrefixRoute) match(key []byte) bool {
+	return r != nil && bytes.HasPrefix(key, r.prefix)
+}
+
+// topics returns the topic of matching keys instead of topics
+func (r *keyPrefixRoute) topics(key []byte, topics []string) []string {
+	if r.match(key) && r.topic != "" {
+		return []string{r.topic}
+	}
+	return topics
+}
+
+// forcesPartition reports whether the route picks the partitions of matching
+// keys, the producer has to use the manual partitioner then
+func (r *keyPrefixRoute) forcesPartition() bool {
+	return r != nil && r.partition >= 0
+}
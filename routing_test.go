@@ -0,0 +1,149 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/Shopify/sarama"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestResolveDestinationTopics(t *testing.T) {
+	r, err := NewTopicRouter(map[string][]string{"orders": {"mirror_orders"}, "users": {"mirror_users"}}, "", "", "default")
+	assert.NoError(t, err, "Unexpected error %v", err)
+	dst, err := r.ResolveDestinationTopics("orders")
+	assert.NoError(t, err, "Unexpected error %v", err)
+	assert.Equal(t, []string{"mirror_orders"}, dst)
+	dst, err = r.ResolveDestinationTopics("Users")
+	assert.NoError(t, err, "Unexpected error %v", err)
+	assert.Equal(t, []string{"mirror_users"}, dst, "mapping lookup is not case insensitive")
+	dst, err = r.ResolveDestinationTopics("other")
+	assert.NoError(t, err, "Unexpected error %v", err)
+	assert.Equal(t, []string{"default"}, dst, "unmapped topic did not use the fallback")
+
+	r, err = NewTopicRouter(map[string][]string{"orders": {"mirror_orders"}}, "", "", "")
+	assert.NoError(t, err, "Unexpected error %v", err)
+	_, err = r.ResolveDestinationTopics("other")
+	assert.Error(t, err, "No error occured on an unmapped topic without fallback")
+
+	_, err = NewTopicRouter(nil, "", "", "")
+	assert.Error(t, err, "No error occured without mapping and fallback")
+	_, err = NewTopicRouter(map[string][]string{"orders": {""}}, "", "", "")
+	assert.Error(t, err, "No error occured on an empty destination")
+}
+
+func TestResolveDestinationTopicRename(t *testing.T) {
+	r, err := NewTopicRouter(map[string][]string{"source-orders": {"orders"}}, `source-(\w+)-(\d+)`, "mirror-${2}-$1", "")
+	assert.NoError(t, err, "Unexpected error %v", err)
+	dst, err := r.ResolveDestinationTopics("source-users-42")
+	assert.NoError(t, err, "Unexpected error %v", err)
+	assert.Equal(t, []string{"mirror-42-users"}, dst, "capture groups were not replaced")
+	dst, err = r.ResolveDestinationTopics("source-orders")
+	assert.NoError(t, err, "Unexpected error %v", err)
+	assert.Equal(t, []string{"orders"}, dst, "static mapping does not take precedence")
+	_, err = r.ResolveDestinationTopics("prefixed-source-users-42")
+	assert.Error(t, err, "pattern matched only a part of the topic")
+
+	r, err = NewTopicRouter(nil, `source-(.*)`, "mirror-$1", "default")
+	assert.NoError(t, err, "Unexpected error %v", err)
+	dst, err = r.ResolveDestinationTopics("source-logs")
+	assert.NoError(t, err, "Unexpected error %v", err)
+	assert.Equal(t, []string{"mirror-logs"}, dst)
+	dst, err = r.ResolveDestinationTopics("logs")
+	assert.NoError(t, err, "Unexpected error %v", err)
+	assert.Equal(t, []string{"default"}, dst, "non matching topic did not use the fallback")
+
+	_, err = NewTopicRouter(nil, `source-(.*`, "mirror-$1", "")
+	assert.Error(t, err, "No error occured on an invalid pattern")
+	_, err = NewTopicRouter(nil, `source-(.*)`, "", "")
+	assert.Error(t, err, "No error occured on a pattern without replacement")
+}
+
+func TestResolveDestinationTopicsFanOut(t *testing.T) {
+	r, err := NewTopicRouter(map[string][]string{"orders": {"mirror_orders", "audit_orders"}}, "", "", "default")
+	assert.NoError(t, err, "Unexpected error %v", err)
+	dst, err := r.ResolveDestinationTopics("orders")
+	assert.NoError(t, err, "Unexpected error %v", err)
+	assert.Equal(t, []string{"mirror_orders", "audit_orders"}, dst)
+
+	_, err = NewTopicRouter(map[string][]string{"orders": {}}, "", "", "")
+	assert.Error(t, err, "No error occured without destination")
+	_, err = NewTopicRouter(map[string][]string{"orders": {"mirror_orders", ""}}, "", "", "")
+	assert.Error(t, err, "No error occured on an empty destination")
+}
+
+func TestKeyBucketStable(t *testing.T) {
+	counts := make([]int, 8)
+	for i := 0; i < 8000; i++ {
+		key := []byte(fmt.Sprintf("customer-%d", i))
+		bucket := keyBucket(key, 8)
+		assert.Equal(t, bucket, keyBucket(key, 8), "the bucket of a key changed")
+		counts[bucket]++
+	}
+	for bucket, n := range counts {
+		assert.InDelta(t, 1000, n, 200, "bucket %d is unbalanced", bucket)
+	}
+	// fixed values, changing them moves keys to other topics
+	assert.Equal(t, int32(6), keyBucket([]byte("foobar"), 8))
+	assert.Equal(t, int32(4), keyBucket([]byte("a"), 8))
+}
+
+func TestResolveMessageTopicsKeySuffix(t *testing.T) {
+	r, err := NewTopicRouter(map[string][]string{"orders": {"mirror_orders", "audit"}}, "", "", "default")
+	if !assert.NoError(t, err) {
+		return
+	}
+	msg := &sarama.ConsumerMessage{Topic: "orders", Key: []byte("foobar")}
+	topics, err := r.ResolveMessageTopics(msg)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"mirror_orders", "audit"}, topics, "no suffix without buckets")
+
+	r.keySuffixBuckets = 8
+	topics, err = r.ResolveMessageTopics(msg)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"mirror_orders-6", "audit-6"}, topics)
+	_, err = r.ResolveMessageTopics(&sarama.ConsumerMessage{Topic: "orders"})
+	assert.Error(t, err, "keyless messages have no bucket")
+
+	r.keySuffixBuckets = 2
+	assert.Equal(t, []string{"mirror_orders-0", "mirror_orders-1", "audit-0", "audit-1"}, r.ShardedTopics([]string{"mirror_orders", "audit"}))
+}
+
+func TestKeyPrefixRoute(t *testing.T) {
+	r, err := newKeyPrefixRoute("sys:", "system", -1)
+	assert.NoError(t, err)
+	assert.True(t, r.match([]byte("sys:reload")))
+	assert.False(t, r.match([]byte("user:sys:")))
+	assert.False(t, r.match(nil))
+	assert.Equal(t, []string{"system"}, r.topics([]byte("sys:reload"), []string{"a", "b"}))
+	assert.Equal(t, []string{"a", "b"}, r.topics([]byte("user:1"), []string{"a", "b"}))
+	assert.False(t, r.forcesPartition())
+
+	r, err = newKeyPrefixRoute("sys:", "", 2)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"a"}, r.topics([]byte("sys:reload"), []string{"a"}), "without a topic the mapped ones are kept")
+	assert.True(t, r.forcesPartition())
+
+	var none *keyPrefixRoute
+	assert.False(t, none.match([]byte("sys:reload")))
+	assert.Equal(t, []string{"a"}, none.topics([]byte("sys:reload"), []string{"a"}))
+	assert.False(t, none.forcesPartition())
+}
+
+func TestNewKeyPrefixRouteInvalid(t *testing.T) {
+	r, err := newKeyPrefixRoute("", "", -1)
+	assert.NoError(t, err)
+	assert.Nil(t, r, "no prefix disables the route")
+	for _, c := range []struct {
+		prefix, topic string
+		partition     int32
+	}{
+		{"", "system", -1},
+		{"", "", 0},
+		{"sys:", "", -1},
+		{"sys:", "system", -2},
+	} {
+		_, err := newKeyPrefixRoute(c.prefix, c.topic, c.partition)
+		assert.Error(t, err, "%+v", c)
+	}
+}
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"math/rand"
+
+	"github.com/Shopify/sarama"
+)
+
+// sampler forwards only a fraction of the messages, e.g. to build a small
+// representative copy of a topic. Keyed messages are sampled by the murmur2
+// hash of their key, so all messages of a key are either kept or dropped.
+// A nil sampler keeps everything.
+type sampler struct {
+	rate float64
+	// random returns a number in [0, 1), used for keyless messages
+	random func() float64
+}
+
+// newSampler returns a sampler keeping the rate of the messages, nil if the
+// rate keeps all of them
+func newSampler(rate float64) (*sampler, error) {
+	if math.IsNaN(rate) || rate < 0 || rate > 1 {
+		return nil, fmt.Errorf("consumer.sample_rate must be between 0 and 1, got %g", rate)
+	}
+	if rate == 1 {
+		return nil, nil
+	}
+	return &sampler{rate: rate, random: rand.Float64}, nil
+}
+
+// keep reports whether the message is sampled
+func (s *sampler) keep(msg *sarama.ConsumerMessage) bool {
+	if s == nil {
+		return true
+	}
+	if msg.Key == nil {
+		return s.random() < s.rate
+	}
+	return float64(murmur2(msg.Key)&0x7fffffff)/(1<<31) < s.rate
+}
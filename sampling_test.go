@@ -0,0 +1,46 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/Shopify/sarama"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNewSampler(t *testing.T) {
+	s, err := newSampler(1)
+	assert.NoError(t, err)
+	assert.Nil(t, s, "a rate of 1 keeps everything")
+	assert.True(t, s.keep(&sarama.ConsumerMessage{}))
+	for _, rate := range []float64{-0.1, 1.5} {
+		_, err := newSampler(rate)
+		assert.Error(t, err, "rate %g", rate)
+	}
+	s, err = newSampler(0)
+	assert.NoError(t, err)
+	assert.False(t, s.keep(&sarama.ConsumerMessage{Key: []byte("a")}))
+	assert.False(t, s.keep(&sarama.ConsumerMessage{}))
+}
+
+func TestSamplerKeys(t *testing.T) {
+	s, err := newSampler(0.25)
+	if !assert.NoError(t, err) {
+		return
+	}
+	kept := 0
+	for i := 0; i < 10000; i++ {
+		msg := &sarama.ConsumerMessage{Key: []byte(fmt.Sprintf("key-%d", i))}
+		k := s.keep(msg)
+		assert.Equal(t, k, s.keep(msg), "sampling of a key is not stable")
+		if k {
+			kept++
+		}
+	}
+	assert.InDelta(t, 2500, kept, 250)
+
+	calls := 0
+	s.random = func() float64 { calls++; return 0.3 }
+	assert.False(t, s.keep(&sarama.ConsumerMessage{Value: []byte("no key")}))
+	assert.Equal(t, 1, calls, "keyless messages are sampled randomly")
+}
@@ -0,0 +1,207 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Shopify/sarama"
+	"github.com/spf13/viper"
+)
+
+// saslMechanism returns the configured producer.kafka.sasl.mechanism. Without
+// it plain is used if a username and password are set.
+func saslMechanism() string {
+	mechanism := strings.ToLower(viper.GetString("producer.kafka.sasl.mechanism"))
+	if mechanism == "" && viper.GetString("producer.kafka.username") != "" && viper.GetString("producer.kafka.password") != "" {
+		return "plain"
+	}
+	return mechanism
+}
+
+// checkSASL validates the settings of the SASL mechanism without connecting
+// anywhere
+func checkSASL() error {
+	switch mechanism := saslMechanism(); mechanism {
+	case "":
+	case "plain":
+		if viper.GetString("producer.kafka.username") == "" || viper.GetString("producer.kafka.password") == "" {
+			return fmt.Errorf("producer.kafka.sasl.mechanism plain requires producer.kafka.username and producer.kafka.password")
+		}
+	case "aws_msk_iam":
+		if awsRegion() == "" {
+			return fmt.Errorf("producer.kafka.sasl.mechanism aws_msk_iam requires producer.kafka.aws.region (or AWS_REGION)")
+		}
+	case "oauthbearer":
+		opts := producerOAuthOptions()
+		var missing []string
+		for _, o := range []struct{ key, value string }{{"token_url", opts.TokenURL}, {"client_id", opts.ClientID}, {"client_secret", opts.ClientSecret}} {
+			if o.value == "" {
+				missing = append(missing, "producer.kafka.oauth."+o.key)
+			}
+		}
+		if len(missing) > 0 {
+			return fmt.Errorf("producer.kafka.sasl.mechanism oauthbearer requires %s", strings.Join(missing, ", "))
+		}
+		if u, err := url.Parse(opts.TokenURL); err != nil || (u.Scheme != "https" && u.Scheme != "http") || u.Host == "" {
+			return fmt.Errorf("invalid producer.kafka.oauth.token_url %q, must be a http(s) url", opts.TokenURL)
+		}
+	case "gssapi":
+		return checkKerberos(producerKerberosConfig())
+	default:
+		return fmt.Errorf("invalid producer.kafka.sasl.mechanism %q, must be plain, aws_msk_iam, oauthbearer or gssapi", mechanism)
+	}
+	return nil
+}
+
+// checkKerberos validates the settings of SASL GSSAPI, the keytab and the
+// krb5.conf have to be readable
+func checkKerberos(krb sarama.GSSAPIConfig) error {
+	var missing []string
+	for _, o := range []struct{ key, value string }{{"realm", krb.Realm}, {"service_name", krb.ServiceName}, {"username", krb.Username}, {"config_file", krb.KerberosConfigPath}} {
+		if o.value == "" {
+			missing = append(missing, "producer.kafka.kerberos."+o.key)
+		}
+	}
+	if len(missing) > 0 {
+		return fmt.Errorf("producer.kafka.sasl.mechanism gssapi requires %s", strings.Join(missing, ", "))
+	}
+	if (krb.KeyTabPath == "") == (krb.Password == "") {
+		return fmt.Errorf("producer.kafka.sasl.mechanism gssapi requires either producer.kafka.kerberos.keytab_file or producer.kafka.kerberos.password")
+	}
+	if krb.KeyTabPath != "" {
+		if _, err := ioutil.ReadFile(krb.KeyTabPath); err != nil {
+			return fmt.Errorf("could not read the kerberos keytab producer.kafka.kerberos.keytab_file: %s", err)
+		}
+	}
+	if _, err := ioutil.ReadFile(krb.KerberosConfigPath); err != nil {
+		return fmt.Errorf("could not read the kerberos config producer.kafka.kerberos.config_file: %s", err)
+	}
+	return nil
+}
+
+// awsRegion returns producer.kafka.aws.region or the region of the
+// environment, like the AWS SDKs
+func awsRegion() string {
+	if region := viper.GetString("producer.kafka.aws.region"); region != "" {
+		return region
+	}
+	if region := os.Getenv("AWS_REGION"); region != "" {
+		return region
+	}
+	return os.Getenv("AWS_DEFAULT_REGION")
+}
+
+// setSASL enables the configured SASL mechanism. Token based mechanisms
+// fetch a first token, so missing credentials fail at startup.
+func setSASL(cfg *sarama.Config) error {
+	if err := checkSASL(); err != nil {
+		return err
+	}
+	switch saslMechanism() {
+	case "plain":
+		cfg.Net.SASL.Enable = true
+		cfg.Net.SASL.User = viper.GetString("producer.kafka.username")
+		cfg.Net.SASL.Password = viper.GetString("producer.kafka.password")
+		cfg.Net.SASL.Mechanism = sarama.SASLTypePlaintext
+	case "aws_msk_iam":
+		return setTokenProvider(cfg, newMSKIAMTokenProvider(awsRegion(), newAWSCredentialChain(awsRegion())))
+	case "oauthbearer":
+		return setTokenProvider(cfg, newOAuthTokenProvider(producerOAuthOptions(), &http.Client{Timeout: 10 * time.Second}))
+	case "gssapi":
+		cfg.Net.SASL.Enable = true
+		cfg.Net.SASL.Mechanism = sarama.SASLTypeGSSAPI
+		cfg.Net.SASL.GSSAPI = producerKerberosConfig()
+	}
+	return nil
+}
+
+// setTokenProvider enables SASL OAUTHBEARER with the tokens of provider
+func setTokenProvider(cfg *sarama.Config, provider sarama.AccessTokenProvider) error {
+	if _, err := provider.Token(); err != nil {
+		return err
+	}
+	cfg.Net.SASL.Enable = true
+	cfg.Net.SASL.Mechanism = sarama.SASLTypeOAuth
+	cfg.Net.SASL.Version = sarama.SASLHandshakeV1
+	cfg.Net.SASL.TokenProvider = provider
+	return nil
+}
+
+// tokenRefreshMargin is how long before its expiry a token is replaced, at
+// most half of the lifetime of the token
+const tokenRefreshMargin = time.Minute
+
+// tokenProvider implements sarama.AccessTokenProvider for SASL OAUTHBEARER.
+// sarama asks for a token on every broker connection, so a token is reused
+// until shortly before it expires. Only one fetch runs at a time, the
+// connections asking meanwhile wait for its token.
+type tokenProvider struct {
+	// fetch returns a new token and its expiry
+	fetch func() (string, time.Time, error)
+	now   func() time.Time
+
+	mu      sync.Mutex
+	token   string
+	fetched time.Time
+	expires time.Time
+	// running is the fetch in progress, nil if there is none
+	running *tokenFetch
+}
+
+// tokenFetch is the result of a fetch, done is closed once it is set
+type tokenFetch struct {
+	done  chan struct{}
+	token string
+	err   error
+}
+
+func newTokenProvider(fetch func() (string, time.Time, error)) *tokenProvider {
+	return &tokenProvider{fetch: fetch, now: time.Now}
+}
+
+func (p *tokenProvider) Token() (*sarama.AccessToken, error) {
+	p.mu.Lock()
+	if p.token != "" && p.now().Before(p.refreshAt()) {
+		token := p.token
+		p.mu.Unlock()
+		return &sarama.AccessToken{Token: token}, nil
+	}
+	f := p.running
+	if f == nil {
+		// the lock is not held during the fetch, which may take up to the
+		// timeout of the http client
+		f = &tokenFetch{done: make(chan struct{})}
+		p.running = f
+		p.mu.Unlock()
+		fetched := p.now()
+		token, expires, err := p.fetch()
+		p.mu.Lock()
+		if err == nil {
+			p.token, p.fetched, p.expires = token, fetched, expires
+		}
+		f.token, f.err = token, err
+		p.running = nil
+		close(f.done)
+	}
+	p.mu.Unlock()
+	<-f.done
+	if f.err != nil {
+		return nil, f.err
+	}
+	return &sarama.AccessToken{Token: f.token}, nil
+}
+
+// refreshAt returns when the token is replaced, the caller holds p.mu
+func (p *tokenProvider) refreshAt() time.Time {
+	margin := tokenRefreshMargin
+	if half := p.expires.Sub(p.fetched) / 2; half < margin {
+		margin = half
+	}
+	return p.expires.Add(-margin)
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/Shopify/sarama"
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTokenProvider(t *testing.T) {
+	now := time.Date(2021, 6, 1, 12, 0, 0, 0, time.UTC)
+	fetches := 0
+	var fetchErr error
+	p := newTokenProvider(func() (string, time.Time, error) {
+		fetches++
+		return "token" + string(rune('0'+fetches)), now.Add(10 * time.Minute), fetchErr
+	})
+	p.now = func() time.Time { return now }
+	token, err := p.Token()
+	assert.NoError(t, err)
+	assert.Equal(t, "token1", token.Token)
+	now = now.Add(8 * time.Minute)
+	token, _ = p.Token()
+	assert.Equal(t, "token1", token.Token, "the token was not reused")
+	now = now.Add(time.Minute)
+	token, _ = p.Token()
+	assert.Equal(t, "token2", token.Token, "the token was not refreshed before it expired")
+	fetchErr = errors.New("unauthorized")
+	now = now.Add(time.Hour)
+	_, err = p.Token()
+	assert.Error(t, err)
+}
+
+func TestTokenProviderShortLifetime(t *testing.T) {
+	now := time.Date(2021, 6, 1, 12, 0, 0, 0, time.UTC)
+	fetches := 0
+	p := newTokenProvider(func() (string, time.Time, error) {
+		fetches++
+		return "token", now.Add(time.Minute), nil
+	})
+	p.now = func() time.Time { return now }
+	_, err := p.Token()
+	assert.NoError(t, err)
+	now = now.Add(20 * time.Second)
+	_, _ = p.Token()
+	assert.Equal(t, 1, fetches, "a token of a minute was refreshed on every connection")
+	now = now.Add(10 * time.Second)
+	_, _ = p.Token()
+	assert.Equal(t, 2, fetches, "the token was not refreshed after half of its lifetime")
+}
+
+func TestTokenProviderConcurrentFetch(t *testing.T) {
+	release := make(chan struct{})
+	fetches := 0
+	p := newTokenProvider(func() (string, time.Time, error) {
+		fetches++
+		<-release
+		return "token", time.Now().Add(time.Hour), nil
+	})
+	tokens := make(chan *sarama.AccessToken)
+	for i := 0; i < 3; i++ {
+		go func() {
+			token, _ := p.Token()
+			tokens <- token
+		}()
+	}
+	// all of them wait for the one fetch
+	time.Sleep(10 * time.Millisecond)
+	close(release)
+	for i := 0; i < 3; i++ {
+		assert.Equal(t, "token", (<-tokens).Token)
+	}
+	assert.Equal(t, 1, fetches)
+}
+
+func TestCheckSASL(t *testing.T) {
+	defer viper.Reset()
+	viper.Reset()
+	setDefaults()
+	assert.NoError(t, checkSASL())
+	assert.Equal(t, "", saslMechanism())
+	viper.Set("producer.kafka.username", "kafka")
+	viper.Set("producer.kafka.password", "secret")
+	assert.Equal(t, "plain", saslMechanism())
+	cfg := sarama.NewConfig()
+	assert.NoError(t, setSASL(cfg))
+	assert.True(t, cfg.Net.SASL.Enable)
+	assert.Equal(t, sarama.SASLMechanism(sarama.SASLTypePlaintext), cfg.Net.SASL.Mechanism)
+	assert.Equal(t, "kafka", cfg.Net.SASL.User)
+
+	viper.Set("producer.kafka.sasl.mechanism", "AWS_MSK_IAM")
+	viper.Set("producer.kafka.aws.region", "eu-west-1")
+	assert.NoError(t, checkSASL())
+	viper.Set("producer.kafka.sasl.mechanism", "scram")
+	assert.Error(t, checkSASL())
+
+	viper.Set("producer.kafka.sasl.mechanism", "oauthbearer")
+	viper.Set("producer.kafka.oauth.token_url", "https://sso.example.com/token")
+	viper.Set("producer.kafka.oauth.client_id", "mirrormaker")
+	err := checkSASL()
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "producer.kafka.oauth.client_secret")
+	}
+	viper.Set("producer.kafka.oauth.client_secret", "secret")
+	assert.NoError(t, checkSASL())
+	viper.Set("producer.kafka.oauth.token_url", "sso.example.com/token")
+	assert.Error(t, checkSASL())
+}
+
+func TestCheckKerberos(t *testing.T) {
+	defer viper.Reset()
+	viper.Reset()
+	setDefaults()
+	dir, err := ioutil.TempDir("", "kerberos")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer os.RemoveAll(dir)
+	krb5 := filepath.Join(dir, "krb5.conf")
+	keytab := filepath.Join(dir, "mirrormaker.keytab")
+	assert.NoError(t, ioutil.WriteFile(krb5, []byte("[libdefaults]\n"), 0600))
+	assert.NoError(t, ioutil.WriteFile(keytab, []byte{5, 2}, 0600))
+
+	viper.Set("producer.kafka.sasl.mechanism", "gssapi")
+	err = checkSASL()
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "producer.kafka.kerberos.realm, producer.kafka.kerberos.username")
+	}
+	viper.Set("producer.kafka.kerberos.realm", "EXAMPLE.COM")
+	viper.Set("producer.kafka.kerberos.username", "mirrormaker")
+	viper.Set("producer.kafka.kerberos.config_file", krb5)
+	assert.Error(t, checkSASL(), "neither keytab nor password")
+
+	viper.Set("producer.kafka.kerberos.keytab_file", filepath.Join(dir, "missing.keytab"))
+	err = checkSASL()
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "could not read the kerberos keytab")
+	}
+	viper.Set("producer.kafka.kerberos.keytab_file", keytab)
+	cfg := sarama.NewConfig()
+	assert.NoError(t, setSASL(cfg))
+	assert.Equal(t, sarama.SASLMechanism(sarama.SASLTypeGSSAPI), cfg.Net.SASL.Mechanism)
+	assert.Equal(t, sarama.KRB5_KEYTAB_AUTH, cfg.Net.SASL.GSSAPI.AuthType)
+	assert.Equal(t, "kafka", cfg.Net.SASL.GSSAPI.ServiceName)
+	assert.Equal(t, keytab, cfg.Net.SASL.GSSAPI.KeyTabPath)
+	cfg.Net.SASL.Handshake = true
+	assert.NoError(t, cfg.Validate())
+
+	viper.Set("producer.kafka.kerberos.password", "secret")
+	assert.Error(t, checkSASL(), "keytab and password are ambiguous")
+	viper.Set("producer.kafka.kerberos.keytab_file", "")
+	assert.NoError(t, checkSASL())
+	assert.Equal(t, sarama.KRB5_USER_AUTH, producerKerberosConfig().AuthType)
+
+	viper.Set("producer.kafka.kerberos.config_file", filepath.Join(dir, "missing.conf"))
+	assert.Error(t, checkSASL())
+}
@@ -0,0 +1,303 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/Shopify/sarama"
+)
+
+// staticAssignment is a source partition consumed from offset without a
+// consumer group
+type staticAssignment struct {
+	topic     string
+	partition int32
+	// offset is sarama.OffsetOldest for oldest
+	offset int64
+}
+
+// parseStaticAssignments parses the topic:partition:offset entries of
+// consumer.static.partitions, the offset may be oldest
+func parseStaticAssignments(entries []string) ([]staticAssignment, error) {
+	if len(entries) == 0 {
+		return nil, fmt.Errorf("consumer.mode static requires consumer.static.partitions")
+	}
+	type topicPartition struct {
+		topic     string
+		partition int32
+	}
+	seen := map[topicPartition]bool{}
+	var assignments []staticAssignment
+	for _, entry := range entries {
+		parts := strings.Split(entry, ":")
+		if len(parts) != 3 || parts[0] == "" {
+			return nil, fmt.Errorf("invalid consumer.static.partitions entry %q, must be topic:partition:offset", entry)
+		}
+		partition, err := strconv.ParseInt(parts[1], 10, 32)
+		if err != nil || partition < 0 {
+			return nil, fmt.Errorf("invalid partition in consumer.static.partitions entry %q", entry)
+		}
+		offset := sarama.OffsetOldest
+		if !strings.EqualFold(parts[2], "oldest") {
+			offset, err = strconv.ParseInt(parts[2], 10, 64)
+			if err != nil || offset < 0 {
+				return nil, fmt.Errorf("invalid offset in consumer.static.partitions entry %q, must be a number or oldest", entry)
+			}
+		}
+		tp := topicPartition{topic: parts[0], partition: int32(partition)}
+		if seen[tp] {
+			return nil, fmt.Errorf("%s/%d is listed twice in consumer.static.partitions", tp.topic, tp.partition)
+		}
+		seen[tp] = true
+		assignments = append(assignments, staticAssignment{topic: tp.topic, partition: tp.partition, offset: offset})
+	}
+	return assignments, nil
+}
+
+// staticTopics returns the topics of the assignments in their order
+func staticTopics(assignments []staticAssignment) []string {
+	var topics []string
+	seen := map[string]bool{}
+	for _, a := range assignments {
+		if !seen[a.topic] {
+			seen[a.topic] = true
+			topics = append(topics, a.topic)
+		}
+	}
+	return topics
+}
+
+// staticConsumerGroup implements sarama.ConsumerGroup for a fixed list of
+// partitions, e.g. to mirror a partition again which was missed. Every
+// partition is consumed from its offset up to the high water mark at the
+// start, nothing is committed.
+type staticConsumerGroup struct {
+	consumer    sarama.Consumer
+	assignments []staticAssignment
+	// offset returns the oldest or newest offset of a partition, like
+	// sarama.Client.GetOffset
+	offset func(topic string, partition int32, time int64) (int64, error)
+	errors chan error
+	// finished is closed once all partitions reached their high water mark
+	finished     chan struct{}
+	finishedOnce sync.Once
+	closed       chan struct{}
+	closeOnce    sync.Once
+}
+
+func newStaticConsumerGroup(client sarama.Client, assignments []staticAssignment) (*staticConsumerGroup, error) {
+	consumer, err := sarama.NewConsumerFromClient(client)
+	if err != nil {
+		return nil, err
+	}
+	return &staticConsumerGroup{
+		consumer:    consumer,
+		assignments: assignments,
+		offset:      client.GetOffset,
+		errors:      make(chan error, client.Config().ChannelBufferSize),
+		finished:    make(chan struct{}),
+		closed:      make(chan struct{}),
+	}, nil
+}
+
+// Consume mirrors all partitions up to their high water mark and returns once
+// they reached it or ctx is done. Once finished later calls block until ctx
+// is done.
+func (g *staticConsumerGroup) Consume(ctx context.Context, topics []string, handler sarama.ConsumerGroupHandler) error {
+	select {
+	case <-g.finished:
+		<-ctx.Done()
+		return nil
+	default:
+	}
+	session := &staticSession{ctx: ctx, claims: map[string][]int32{}}
+	var claims []*staticClaim
+	defer func() {
+		for _, claim := range claims {
+			claim.close()
+		}
+	}()
+	for _, a := range g.assignments {
+		highWaterMark, err := g.offset(a.topic, a.partition, sarama.OffsetNewest)
+		if err != nil {
+			return fmt.Errorf("could not get the high water mark of %s/%d: %s", a.topic, a.partition, err)
+		}
+		first := a.offset
+		if first == sarama.OffsetOldest {
+			if first, err = g.offset(a.topic, a.partition, sarama.OffsetOldest); err != nil {
+				return fmt.Errorf("could not get the oldest offset of %s/%d: %s", a.topic, a.partition, err)
+			}
+		}
+		if first >= highWaterMark {
+			logger.With(Fields{"topic": a.topic, "partition": a.partition, "offset": first}).Infof("nothing to mirror, the partition is at its high water mark %d", highWaterMark)
+			continue
+		}
+		pc, err := g.consumer.ConsumePartition(a.topic, a.partition, first)
+		if err != nil {
+			return fmt.Errorf("could not consume %s/%d: %s", a.topic, a.partition, err)
+		}
+		claim := newStaticClaim(a.topic, a.partition, pc, first, highWaterMark)
+		go claim.forwardErrors(g.errors, g.closed)
+		claims = append(claims, claim)
+		session.claims[a.topic] = append(session.claims[a.topic], a.partition)
+		logger.With(Fields{"topic": a.topic, "partition": a.partition, "offset": first}).Infof("mirroring the partition up to its high water mark %d", highWaterMark)
+	}
+	if err := handler.Setup(session); err != nil {
+		return err
+	}
+	var wg sync.WaitGroup
+	for _, claim := range claims {
+		wg.Add(1)
+		go func(claim *staticClaim) {
+			defer wg.Done()
+			go claim.run(ctx)
+			if err := handler.ConsumeClaim(session, claim); err != nil {
+				select {
+				case g.errors <- err:
+				case <-g.closed:
+				}
+			}
+			claim.close()
+		}(claim)
+	}
+	wg.Wait()
+	if err := handler.Cleanup(session); err != nil {
+		return err
+	}
+	for _, claim := range claims {
+		<-claim.stopped
+		if !claim.reached {
+			return nil
+		}
+	}
+	logger.Infof("all static partitions reached their high water mark")
+	g.finishedOnce.Do(func() { close(g.finished) })
+	return nil
+}
+
+// done is closed once all partitions reached their high water mark
+func (g *staticConsumerGroup) done() <-chan struct{} {
+	return g.finished
+}
+
+func (g *staticConsumerGroup) Errors() <-chan error {
+	return g.errors
+}
+
+// Close stops forwarding errors and closes the consumer, the client is left
+// open
+func (g *staticConsumerGroup) Close() error {
+	g.closeOnce.Do(func() { close(g.closed) })
+	return g.consumer.Close()
+}
+
+// staticClaim is the sarama.ConsumerGroupClaim of a static partition, its
+// messages end at the high water mark
+type staticClaim struct {
+	topic         string
+	partition     int32
+	pc            sarama.PartitionConsumer
+	initialOffset int64
+	highWaterMark int64
+	messages      chan *sarama.ConsumerMessage
+	stop          chan struct{}
+	stopOnce      sync.Once
+	stopped       chan struct{}
+	// reached is set once the last message before the high water mark was
+	// handed over, it may be read once stopped is closed
+	reached bool
+}
+
+func newStaticClaim(topic string, partition int32, pc sarama.PartitionConsumer, initialOffset, highWaterMark int64) *staticClaim {
+	return &staticClaim{
+		topic:         topic,
+		partition:     partition,
+		pc:            pc,
+		initialOffset: initialOffset,
+		highWaterMark: highWaterMark,
+		messages:      make(chan *sarama.ConsumerMessage),
+		stop:          make(chan struct{}),
+		stopped:       make(chan struct{}),
+	}
+}
+
+// run hands the messages over until the high water mark, ctx is done or the
+// claim is closed
+func (c *staticClaim) run(ctx context.Context) {
+	defer close(c.stopped)
+	defer close(c.messages)
+	for {
+		select {
+		case msg, ok := <-c.pc.Messages():
+			if !ok {
+				return
+			}
+			select {
+			case c.messages <- msg:
+			case <-c.stop:
+				return
+			case <-ctx.Done():
+				return
+			}
+			// compacted partitions may skip offsets
+			if msg.Offset >= c.highWaterMark-1 {
+				c.reached = true
+				return
+			}
+		case <-c.stop:
+			return
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// forwardErrors hands the errors of the partition consumer to errors until
+// closed is closed
+func (c *staticClaim) forwardErrors(errors chan<- error, closed <-chan struct{}) {
+	for err := range c.pc.Errors() {
+		select {
+		case errors <- err:
+		case <-closed:
+		}
+	}
+}
+
+// close stops run and the partition consumer, it may be called more than
+// once
+func (c *staticClaim) close() {
+	c.stopOnce.Do(func() {
+		close(c.stop)
+		c.pc.AsyncClose()
+		// run may not have been started if the setup failed
+		go func() {
+			for range c.pc.Messages() {
+			}
+		}()
+	})
+}
+
+func (c *staticClaim) Topic() string                            { return c.topic }
+func (c *staticClaim) Partition() int32                         { return c.partition }
+func (c *staticClaim) InitialOffset() int64                     { return c.initialOffset }
+func (c *staticClaim) HighWaterMarkOffset() int64               { return c.pc.HighWaterMarkOffset() }
+func (c *staticClaim) Messages() <-chan *sarama.ConsumerMessage { return c.messages }
+
+// staticSession is the sarama.ConsumerGroupSession of the static partitions,
+// marked messages are not committed anywhere
+type staticSession struct {
+	ctx    context.Context
+	claims map[string][]int32
+}
+
+func (s *staticSession) Claims() map[string][]int32                                           { return s.claims }
+func (s *staticSession) MemberID() string                                                     { return "static" }
+func (s *staticSession) GenerationID() int32                                                  { return 0 }
+func (s *staticSession) MarkOffset(topic string, partition int32, offset int64, meta string)  {}
+func (s *staticSession) Commit()                                                              {}
+func (s *staticSession) ResetOffset(topic string, partition int32, offset int64, meta string) {}
+func (s *staticSession) MarkMessage(msg *sarama.ConsumerMessage, meta string)                 {}
+func (s *staticSession) Context() context.Context                                             { return s.ctx }
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Shopify/sarama"
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseStaticAssignments(t *testing.T) {
+	assignments, err := parseStaticAssignments([]string{"orders:0:42", "orders:3:oldest", "logs:1:0"})
+	assert.NoError(t, err)
+	assert.Equal(t, []staticAssignment{
+		{topic: "orders", partition: 0, offset: 42},
+		{topic: "orders", partition: 3, offset: sarama.OffsetOldest},
+		{topic: "logs", partition: 1, offset: 0},
+	}, assignments)
+	assert.Equal(t, []string{"orders", "logs"}, staticTopics(assignments))
+
+	for _, entries := range [][]string{
+		nil,
+		{"orders:0"},
+		{":0:1"},
+		{"orders:-1:1"},
+		{"orders:x:1"},
+		{"orders:0:newest"},
+		{"orders:0:-5"},
+		{"orders:0:1", "orders:0:2"},
+	} {
+		_, err := parseStaticAssignments(entries)
+		assert.Error(t, err, "No error occured for %v", entries)
+	}
+}
+
+func TestStaticAssignmentsFromConfig(t *testing.T) {
+	defer viper.Reset()
+	viper.Reset()
+	setDefaults()
+	assignments, err := staticAssignmentsFromConfig()
+	assert.NoError(t, err)
+	assert.Nil(t, assignments, "the consumer group mode has no static partitions")
+
+	viper.Set("consumer.mode", "static")
+	_, err = staticAssignmentsFromConfig()
+	assert.Error(t, err, "No error occured without partitions")
+	viper.Set("consumer.static.partitions", []string{"orders:0:42"})
+	assignments, err = staticAssignmentsFromConfig()
+	assert.NoError(t, err)
+	assert.Len(t, assignments, 1)
+	assert.NoError(t, validateConfigWith("consumer.group.id", "producer.kafka.nodes", "producer.kafka.topic"), "consumer.topic is required in static mode")
+
+	viper.Set("delivery.at_least_once", true)
+	_, err = staticAssignmentsFromConfig()
+	assert.Error(t, err, "No error occured with delivery.at_least_once")
+
+	viper.Set("consumer.mode", "manual")
+	_, err = staticAssignmentsFromConfig()
+	assert.Error(t, err, "No error occured on an invalid mode")
+}
+
+// validateConfigWith sets the keys to placeholders and validates the config
+func validateConfigWith(keys ...string) error {
+	for _, key := range keys {
+		viper.Set(key, "x")
+	}
+	return validateConfig()
+}
+
+type testPartitionConsumer struct {
+	messages  chan *sarama.ConsumerMessage
+	errors    chan *sarama.ConsumerError
+	closeOnce sync.Once
+}
+
+func (pc *testPartitionConsumer) AsyncClose() {
+	pc.closeOnce.Do(func() {
+		close(pc.messages)
+		close(pc.errors)
+	})
+}
+func (pc *testPartitionConsumer) Close() error                             { pc.AsyncClose(); return nil }
+func (pc *testPartitionConsumer) Messages() <-chan *sarama.ConsumerMessage { return pc.messages }
+func (pc *testPartitionConsumer) Errors() <-chan *sarama.ConsumerError     { return pc.errors }
+func (pc *testPartitionConsumer) HighWaterMarkOffset() int64               { return 0 }
+
+// testPartitionsConsumer serves 10 messages per partition, starting at the
+// requested offset
+type testPartitionsConsumer struct {
+	sarama.Consumer
+}
+
+func (c *testPartitionsConsumer) ConsumePartition(topic string, partition int32, offset int64) (sarama.PartitionConsumer, error) {
+	pc := &testPartitionConsumer{messages: make(chan *sarama.ConsumerMessage, 10), errors: make(chan *sarama.ConsumerError)}
+	for o := offset; o < 10; o++ {
+		pc.messages <- &sarama.ConsumerMessage{Topic: topic, Partition: partition, Offset: o, Key: []byte("a"), Value: []byte("Terrible Test")}
+	}
+	return pc, nil
+}
+
+func (c *testPartitionsConsumer) Close() error { return nil }
+
+func TestStaticConsumerGroup(t *testing.T) {
+	g := &staticConsumerGroup{
+		consumer:    &testPartitionsConsumer{},
+		assignments: []staticAssignment{{topic: "source", partition: 0, offset: 2}, {topic: "source", partition: 1, offset: sarama.OffsetOldest}, {topic: "source", partition: 2, offset: 5}},
+		offset: func(topic string, partition int32, time int64) (int64, error) {
+			if time == sarama.OffsetOldest {
+				return 1, nil
+			}
+			// the messages after the high water mark are not mirrored
+			return 5, nil
+		},
+		errors:   make(chan error, 1),
+		finished: make(chan struct{}),
+		closed:   make(chan struct{}),
+	}
+	producer := newTestProducer()
+	consumer := newTestConsumer("keeppartition", producer)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	assert.NoError(t, g.Consume(ctx, nil, consumer))
+	<-g.done()
+
+	mirrored := map[int32]int{}
+	for _, msg := range producer.produced() {
+		mirrored[msg.Partition]++
+	}
+	// offsets 2-4 and 1-4, partition 2 is at its high water mark
+	assert.Equal(t, map[int32]int{0: 3, 1: 4}, mirrored)
+
+	// a finished group blocks until the context is done
+	returned := make(chan error)
+	go func() { returned <- g.Consume(ctx, nil, consumer) }()
+	select {
+	case <-returned:
+		t.Fatal("a finished static consumer consumed again")
+	case <-time.After(10 * time.Millisecond):
+	}
+	cancel()
+	assert.NoError(t, <-returned)
+	assert.NoError(t, g.Close())
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/rcrowley/go-metrics"
+)
+
+// statsdPacketSize keeps the udp packets below the usual ethernet MTU
+const statsdPacketSize = 1432
+
+var statsdPercentiles = []float64{0.5, 0.95, 0.99}
+
+// statsdReporter sends the metrics of the registry to statsd
+type statsdReporter struct {
+	registry metrics.Registry
+	// prefix is empty or ends with a dot
+	prefix string
+	// mu serializes the flushes, the final one on shutdown runs besides the
+	// periodic ones
+	mu sync.Mutex
+	// counts are the meter counts of the last flush, meters are sent as
+	// statsd counters of the difference
+	counts map[string]int64
+}
+
+// newStatsdReporter creates a reporter which prefixes all metric names with
+// prefix followed by a dot, like the graphite reporter does
+func newStatsdReporter(r metrics.Registry, prefix string) *statsdReporter {
+	if prefix != "" {
+		prefix += "."
+	}
+	return &statsdReporter{registry: r, prefix: prefix, counts: map[string]int64{}}
+}
+
+// run flushes the registry every interval to the udp address until ctx is
+// done, then a last time if flushOnShutdown is set
+func (s *statsdReporter) run(ctx context.Context, interval time.Duration, addr string, flushOnShutdown bool) {
+	conn, err := net.Dial("udp", addr)
+	if err != nil {
+		logger.Fatalf("could not connect to statsd: %s", err)
+	}
+	defer conn.Close()
+	reportMetrics(ctx, interval, flushOnShutdown, "statsd", func() error { return s.flush(conn) })
+}
+
+// flush writes all metrics, split into packets of at most statsdPacketSize.
+// The meter counts are only kept if all packets were written, a failed flush
+// is sent again with the next one.
+func (s *statsdReporter) flush(w io.Writer) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	lines, counts := s.lines()
+	var packet bytes.Buffer
+	for _, line := range lines {
+		if packet.Len() > 0 && packet.Len()+len(line)+1 > statsdPacketSize {
+			if _, err := w.Write(packet.Bytes()); err != nil {
+				return err
+			}
+			packet.Reset()
+		}
+		if packet.Len() > 0 {
+			packet.WriteByte('\n')
+		}
+		packet.WriteString(line)
+	}
+	if packet.Len() > 0 {
+		if _, err := w.Write(packet.Bytes()); err != nil {
+			return err
+		}
+	}
+	s.counts = counts
+	return nil
+}
+
+// lines returns the statsd lines of all metrics sorted by name and the meter
+// counts they were calculated with
+func (s *statsdReporter) lines() ([]string, map[string]int64) {
+	var lines []string
+	counts := map[string]int64{}
+	s.registry.Each(func(name string, i interface{}) {
+		name = s.prefix + name
+		switch m := i.(type) {
+		case metrics.Meter:
+			count := m.Count()
+			lines = append(lines, fmt.Sprintf("%s:%d|c", name, count-s.counts[name]))
+			counts[name] = count
+		case metrics.Counter:
+			lines = append(lines, fmt.Sprintf("%s:%d|g", name, m.Count()))
+		case metrics.Gauge:
+			lines = append(lines, fmt.Sprintf("%s:%d|g", name, m.Value()))
+		case metrics.GaugeFloat64:
+			lines = append(lines, fmt.Sprintf("%s:%g|g", name, m.Value()))
+		case metrics.Timer:
+			// timers record nanoseconds, statsd timings are milliseconds
+			t := m.Snapshot()
+			lines = append(lines, fmt.Sprintf("%s.count:%d|g", name, t.Count()))
+			lines = append(lines, fmt.Sprintf("%s.mean:%g|ms", name, t.Mean()/1e6))
+			for i, p := range t.Percentiles(statsdPercentiles) {
+				lines = append(lines, fmt.Sprintf("%s.p%g:%g|ms", name, statsdPercentiles[i]*100, p/1e6))
+			}
+		case metrics.Histogram:
+			h := m.Snapshot()
+			lines = append(lines, fmt.Sprintf("%s.count:%d|g", name, h.Count()))
+			lines = append(lines, fmt.Sprintf("%s.mean:%g|g", name, h.Mean()))
+			for i, p := range h.Percentiles(statsdPercentiles) {
+				lines = append(lines, fmt.Sprintf("%s.p%g:%g|g", name, statsdPercentiles[i]*100, p))
+			}
+		}
+	})
+	sort.Strings(lines)
+	return lines, counts
+}
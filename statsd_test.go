@@ -0,0 +1,94 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/rcrowley/go-metrics"
+	"github.com/stretchr/testify/assert"
+)
+
+type packetRecorder struct {
+	packets []string
+	err     error
+}
+
+func (p *packetRecorder) Write(b []byte) (int, error) {
+	if p.err != nil {
+		return 0, p.err
+	}
+	p.packets = append(p.packets, string(b))
+	return len(b), nil
+}
+
+func TestStatsdFlush(t *testing.T) {
+	r := metrics.NewRegistry()
+	metrics.GetOrRegisterMeter("messages.processed", r).Mark(3)
+	metrics.GetOrRegisterGauge("consumer.lag.source.0", r).Update(42)
+	metrics.GetOrRegisterTimer("producer.produce_latency", r).Update(2 * time.Millisecond)
+
+	s := newStatsdReporter(r, "mirror")
+	w := &packetRecorder{}
+	assert.NoError(t, s.flush(w))
+	if assert.Len(t, w.packets, 1) {
+		lines := strings.Split(w.packets[0], "\n")
+		assert.Contains(t, lines, "mirror.messages.processed:3|c")
+		assert.Contains(t, lines, "mirror.consumer.lag.source.0:42|g")
+		assert.Contains(t, lines, "mirror.producer.produce_latency.count:1|g")
+		assert.Contains(t, lines, "mirror.producer.produce_latency.p99:2|ms")
+	}
+
+	// meters only send what happened since the last flush
+	metrics.GetOrRegisterMeter("messages.processed", r).Mark(2)
+	w = &packetRecorder{}
+	assert.NoError(t, s.flush(w))
+	assert.Contains(t, strings.Split(w.packets[0], "\n"), "mirror.messages.processed:2|c")
+
+	// a failed flush is sent again with the next one
+	metrics.GetOrRegisterMeter("messages.processed", r).Mark(4)
+	w = &packetRecorder{err: errors.New("connection refused")}
+	assert.Error(t, s.flush(w))
+	metrics.GetOrRegisterMeter("messages.processed", r).Mark(1)
+	w = &packetRecorder{}
+	assert.NoError(t, s.flush(w))
+	assert.Contains(t, strings.Split(w.packets[0], "\n"), "mirror.messages.processed:5|c")
+}
+
+func TestStatsdFlushSplitsPackets(t *testing.T) {
+	r := metrics.NewRegistry()
+	for i := 0; i < 200; i++ {
+		metrics.GetOrRegisterGauge(strings.Repeat("g", 20)+string(rune('a'+i%26))+strings.Repeat("x", i/26), r).Update(1)
+	}
+	w := &packetRecorder{}
+	assert.NoError(t, newStatsdReporter(r, "").flush(w))
+	assert.True(t, len(w.packets) > 1)
+	lines := 0
+	for _, p := range w.packets {
+		assert.True(t, len(p) <= statsdPacketSize)
+		lines += len(strings.Split(p, "\n"))
+	}
+	assert.Equal(t, 200, lines)
+}
+
+func TestStatsdRunFlushesOnCancel(t *testing.T) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer conn.Close()
+	r := metrics.NewRegistry()
+	metrics.GetOrRegisterCounter("producer.inflight", r).Inc(2)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	// the interval never passes, only the last flush sends something
+	newStatsdReporter(r, "").run(ctx, time.Hour, conn.LocalAddr().String(), true)
+	buf := make([]byte, statsdPacketSize)
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	n, _, err := conn.ReadFrom(buf)
+	assert.NoError(t, err)
+	assert.Equal(t, "producer.inflight:2|g", string(buf[:n]))
+}
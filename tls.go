@@ -0,0 +1,57 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+)
+
+// TLSOptions describes the tls setup of a kafka connection
+type TLSOptions struct {
+	// CAFile is a PEM file with the CAs used to verify the brokers, the
+	// system pool is used if empty
+	CAFile string
+	// CertFile and KeyFile hold the client certificate for mTLS
+	CertFile string
+	KeyFile  string
+	// InsecureSkipVerify disables the verification of the broker certificates
+	InsecureSkipVerify bool
+	// ServerName overrides the name used for SNI and to verify the broker
+	// certificates, e.g. when connecting through a load balancer
+	ServerName string
+}
+
+// newTLSConfig builds the tls config for the kafka connection
+func newTLSConfig(opts TLSOptions) (*tls.Config, error) {
+	cfg := &tls.Config{
+		MinVersion:         tls.VersionTLS12,
+		InsecureSkipVerify: opts.InsecureSkipVerify,
+		ServerName:         opts.ServerName,
+	}
+	if opts.CAFile != "" {
+		pem, err := ioutil.ReadFile(opts.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("could not read tls ca_file: %s", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("tls ca_file %s does not contain any PEM encoded certificate", opts.CAFile)
+		}
+		cfg.RootCAs = pool
+	}
+	if opts.CertFile != "" && opts.KeyFile == "" {
+		return nil, fmt.Errorf("tls cert_file is set but key_file is missing")
+	}
+	if opts.KeyFile != "" && opts.CertFile == "" {
+		return nil, fmt.Errorf("tls key_file is set but cert_file is missing")
+	}
+	if opts.CertFile != "" {
+		cert, err := tls.LoadX509KeyPair(opts.CertFile, opts.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("could not load tls client certificate: %s", err)
+		}
+		cfg.Certificates = []tls.Certificate{cert}
+	}
+	return cfg, nil
+}
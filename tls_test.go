@@ -0,0 +1,81 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// writeTestCert writes a self signed certificate and its key to dir
+func writeTestCert(t *testing.T, dir string) (certFile, keyFile string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "mirrormaker"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certFile = filepath.Join(dir, "cert.pem")
+	keyFile = filepath.Join(dir, "key.pem")
+	if err := ioutil.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return certFile, keyFile
+}
+
+func TestNewTLSConfig(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mirrormaker")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	certFile, keyFile := writeTestCert(t, dir)
+
+	cfg, err := newTLSConfig(TLSOptions{})
+	assert.NoError(t, err, "Unexpected error %v", err)
+	assert.Nil(t, cfg.RootCAs, "system pool is not used by default")
+	assert.Empty(t, cfg.Certificates)
+
+	cfg, err = newTLSConfig(TLSOptions{CAFile: certFile, CertFile: certFile, KeyFile: keyFile, InsecureSkipVerify: true, ServerName: "kafka.lan"})
+	assert.NoError(t, err, "Unexpected error %v", err)
+	assert.Equal(t, "kafka.lan", cfg.ServerName)
+	assert.NotNil(t, cfg.RootCAs, "ca_file was not loaded")
+	assert.Len(t, cfg.Certificates, 1, "client certificate was not loaded")
+	assert.True(t, cfg.InsecureSkipVerify)
+
+	_, err = newTLSConfig(TLSOptions{CertFile: certFile})
+	assert.Error(t, err, "No error occured on a cert without key")
+	_, err = newTLSConfig(TLSOptions{KeyFile: keyFile})
+	assert.Error(t, err, "No error occured on a key without cert")
+	_, err = newTLSConfig(TLSOptions{CAFile: filepath.Join(dir, "missing.pem")})
+	assert.Error(t, err, "No error occured on a missing ca_file")
+	_, err = newTLSConfig(TLSOptions{CAFile: keyFile})
+	assert.Error(t, err, "No error occured on a ca_file without certificates")
+}
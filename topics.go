@@ -0,0 +1,33 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/Shopify/sarama"
+)
+
+// topicCreator is the part of sarama.ClusterAdmin needed to create topics
+type topicCreator interface {
+	CreateTopic(topic string, detail *sarama.TopicDetail, validateOnly bool) error
+}
+
+// createMissingTopic creates the topic if the cluster does not know it and
+// reports whether it did. Other errors of partitions are left to the caller,
+// and a topic created concurrently, e.g. by another instance, is fine.
+func createMissingTopic(partitions func(topic string) ([]int32, error), admin func() (topicCreator, error), topic string, detail *sarama.TopicDetail) (bool, error) {
+	if _, err := partitions(topic); err != sarama.ErrUnknownTopicOrPartition {
+		return false, nil
+	}
+	creator, err := admin()
+	if err != nil {
+		return false, fmt.Errorf("could not create the admin client: %s", err)
+	}
+	err = creator.CreateTopic(topic, detail, false)
+	if topicErr, ok := err.(*sarama.TopicError); ok && topicErr.Err == sarama.ErrTopicAlreadyExists {
+		return false, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("could not create topic %s: %s", topic, err)
+	}
+	return true, nil
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/Shopify/sarama"
+	"github.com/stretchr/testify/assert"
+)
+
+type testTopicCreator struct {
+	created map[string]*sarama.TopicDetail
+	err     error
+}
+
+func (c *testTopicCreator) CreateTopic(topic string, detail *sarama.TopicDetail, validateOnly bool) error {
+	if c.err != nil {
+		return c.err
+	}
+	c.created[topic] = detail
+	return nil
+}
+
+func TestCreateMissingTopic(t *testing.T) {
+	detail := &sarama.TopicDetail{NumPartitions: 3, ReplicationFactor: 2}
+	creator := &testTopicCreator{created: map[string]*sarama.TopicDetail{}}
+	admin := func() (topicCreator, error) { return creator, nil }
+	partitions := func(topic string) ([]int32, error) {
+		switch topic {
+		case "existing":
+			return []int32{0}, nil
+		case "broken":
+			return nil, sarama.ErrOutOfBrokers
+		}
+		return nil, sarama.ErrUnknownTopicOrPartition
+	}
+
+	created, err := createMissingTopic(partitions, admin, "existing", detail)
+	assert.NoError(t, err)
+	assert.False(t, created)
+	created, err = createMissingTopic(partitions, admin, "broken", detail)
+	assert.NoError(t, err, "other errors are reported when the partitions are fetched")
+	assert.False(t, created)
+	assert.Empty(t, creator.created)
+
+	created, err = createMissingTopic(partitions, admin, "missing", detail)
+	assert.NoError(t, err)
+	assert.True(t, created)
+	assert.Equal(t, map[string]*sarama.TopicDetail{"missing": detail}, creator.created)
+
+	creator.err = &sarama.TopicError{Err: sarama.ErrTopicAlreadyExists}
+	created, err = createMissingTopic(partitions, admin, "raced", detail)
+	assert.NoError(t, err, "a topic created concurrently is fine")
+	assert.False(t, created)
+
+	creator.err = &sarama.TopicError{Err: sarama.ErrTopicAuthorizationFailed}
+	_, err = createMissingTopic(partitions, admin, "forbidden", detail)
+	assert.Error(t, err)
+
+	_, err = createMissingTopic(partitions, func() (topicCreator, error) { return nil, errors.New("no controller") }, "missing", detail)
+	assert.Error(t, err)
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"strings"
+
+	"github.com/Shopify/sarama"
+)
+
+// traceparentHeader is the W3C trace context header, see
+// https://www.w3.org/TR/trace-context/
+const traceparentHeader = "traceparent"
+
+// traceContext is the parsed content of a traceparent header
+type traceContext struct {
+	traceID [16]byte
+	spanID  [8]byte
+	flags   byte
+}
+
+// parseTraceparent parses a traceparent header. Headers of future versions
+// are read as far as version 00 defines them, as the spec requires.
+func parseTraceparent(value []byte) (traceContext, bool) {
+	var tc traceContext
+	s := strings.TrimSpace(string(value))
+	parts := strings.Split(s, "-")
+	if len(parts) < 4 || parts[0] == "ff" || (parts[0] == "00" && len(parts) != 4) || s != strings.ToLower(s) {
+		return tc, false
+	}
+	var version, flags [1]byte
+	for _, f := range []struct {
+		dst []byte
+		src string
+	}{{version[:], parts[0]}, {tc.traceID[:], parts[1]}, {tc.spanID[:], parts[2]}, {flags[:], parts[3]}} {
+		if hex.DecodedLen(len(f.src)) != len(f.dst) {
+			return tc, false
+		}
+		if _, err := hex.Decode(f.dst, []byte(f.src)); err != nil {
+			return tc, false
+		}
+	}
+	tc.flags = flags[0]
+	if tc.traceID == [16]byte{} || tc.spanID == [8]byte{} {
+		return tc, false
+	}
+	return tc, true
+}
+
+func (tc traceContext) String() string {
+	return "00-" + hex.EncodeToString(tc.traceID[:]) + "-" + hex.EncodeToString(tc.spanID[:]) + "-" + hex.EncodeToString([]byte{tc.flags})
+}
+
+// childTraceContext starts a span for a mirrored message. The span continues
+// the trace of the source message if it has a valid traceparent header,
+// otherwise it starts a new sampled trace.
+func childTraceContext(source []*sarama.RecordHeader) traceContext {
+	var tc traceContext
+	found := false
+	for _, h := range source {
+		if h != nil && strings.EqualFold(string(h.Key), traceparentHeader) {
+			tc, found = parseTraceparent(h.Value)
+			break
+		}
+	}
+	if !found {
+		tc = traceContext{flags: 0x01}
+		rand.Read(tc.traceID[:])
+	}
+	rand.Read(tc.spanID[:])
+	return tc
+}
+
+// injectTraceparent replaces the traceparent header of the mirrored message
+// with a span which is a child of the source message's trace context
+func injectTraceparent(headers []sarama.RecordHeader, source []*sarama.RecordHeader) []sarama.RecordHeader {
+	tc := childTraceContext(source)
+	res := headers[:0]
+	for _, h := range headers {
+		if !strings.EqualFold(string(h.Key), traceparentHeader) {
+			res = append(res, h)
+		}
+	}
+	return append(res, sarama.RecordHeader{Key: []byte(traceparentHeader), Value: []byte(tc.String())})
+}
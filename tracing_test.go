@@ -0,0 +1,70 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/Shopify/sarama"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseTraceparent(t *testing.T) {
+	tc, ok := parseTraceparent([]byte("00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"))
+	assert.True(t, ok)
+	assert.Equal(t, "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01", tc.String())
+	// later versions may append fields
+	tc, ok = parseTraceparent([]byte("cc-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01-what"))
+	assert.True(t, ok)
+	assert.Equal(t, "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01", tc.String())
+	for _, invalid := range []string{
+		"",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01-what",
+		"ff-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01",
+		"00-4BF92F3577B34DA6A3CE929D0E0E4736-00f067aa0ba902b7-01",
+		"00-00000000000000000000000000000000-00f067aa0ba902b7-01",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-0000000000000000-01",
+		"00-4bf92f3577b34da6a3ce929d0e0e473-00f067aa0ba902b7-01",
+		"00-4bf92f3577b34da6a3ce929d0e0e473x-00f067aa0ba902b7-01",
+	} {
+		_, ok := parseTraceparent([]byte(invalid))
+		assert.False(t, ok, "%q was accepted", invalid)
+	}
+}
+
+func TestPartitionMsgTraceHeaders(t *testing.T) {
+	var numPartitions int32 = 8
+	msg := sarama.ConsumerMessage{
+		Partition: 3,
+		Key:       []byte("Terrible Test"),
+		Value:     []byte("Terrible Test"),
+		Headers: []*sarama.RecordHeader{
+			{Key: []byte("Traceparent"), Value: []byte("00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-00")},
+			{Key: []byte("tracestate"), Value: []byte("vendor=value")},
+		},
+	}
+	c, err := PartitionMsg("hash", "empty", &msg, numPartitions, MsgOptions{})
+	assert.NoError(t, err, "Unexpected error %v", err)
+	assert.Equal(t, "Traceparent", string(c.Headers[0].Key), "headers were changed with tracing disabled")
+
+	c, err = PartitionMsg("hash", "empty", &msg, numPartitions, MsgOptions{InjectTraceHeaders: true})
+	assert.NoError(t, err, "Unexpected error %v", err)
+	if assert.Len(t, c.Headers, 2) {
+		assert.Equal(t, "tracestate", string(c.Headers[0].Key))
+		assert.Equal(t, traceparentHeader, string(c.Headers[1].Key))
+		parts := strings.Split(string(c.Headers[1].Value), "-")
+		assert.Equal(t, "4bf92f3577b34da6a3ce929d0e0e4736", parts[1], "trace id was not propagated")
+		assert.NotEqual(t, "00f067aa0ba902b7", parts[2], "no new span was started")
+		assert.Equal(t, "00", parts[3], "trace flags were not propagated")
+	}
+	assert.Equal(t, "Traceparent", string(msg.Headers[0].Key), "source message was modified")
+
+	// without trace context a new trace is started, also without headers
+	c, err = PartitionMsg("hash", "empty", &goodmsgs[0], numPartitions, MsgOptions{InjectTraceHeaders: true, DropHeaders: true})
+	assert.NoError(t, err, "Unexpected error %v", err)
+	if assert.Len(t, c.Headers, 1) {
+		tc, ok := parseTraceparent(c.Headers[0].Value)
+		assert.True(t, ok, "invalid traceparent %s", c.Headers[0].Value)
+		assert.Equal(t, byte(0x01), tc.flags)
+	}
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/Shopify/sarama"
+)
+
+// keyTransform rewrites the keys of mirrored messages. Since the hash based
+// partitioners use the key, a transformed key usually ends up in a different
+// partition than the source message.
+type keyTransform struct {
+	// regex and replacement rewrite every match in the key, the replacement
+	// may refer to capture groups as $1 or ${1}
+	regex       *regexp.Regexp
+	replacement []byte
+	// prefix is prepended after the replacement
+	prefix []byte
+}
+
+// newKeyTransform returns nil if neither a prefix nor a regex is configured
+func newKeyTransform(prefix, pattern, replacement string) (*keyTransform, error) {
+	if prefix == "" && pattern == "" {
+		return nil, nil
+	}
+	t := &keyTransform{prefix: []byte(prefix), replacement: []byte(replacement)}
+	if pattern != "" {
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			return nil, fmt.Errorf("invalid transform.key.regex: %s", err)
+		}
+		t.regex = re
+	}
+	return t, nil
+}
+
+// apply returns the transformed key. Messages without key are not changed, a
+// nil keyTransform returns the key as is.
+func (t *keyTransform) apply(key []byte) []byte {
+	if t == nil || key == nil {
+		return key
+	}
+	if t.regex != nil {
+		key = t.regex.ReplaceAll(key, t.replacement)
+	}
+	if len(t.prefix) > 0 {
+		key = append(append(make([]byte, 0, len(t.prefix)+len(key)), t.prefix...), key...)
+	}
+	return key
+}
+
+// jsonRedactor removes fields from JSON values before they are mirrored. The
+// value is re-serialized, so the field order and whitespace of objects are not
+// preserved.
+type jsonRedactor struct {
+	// paths are the dot separated field paths split into their parts
+	paths [][]string
+}
+
+// newJSONRedactor returns nil if no paths are configured. Paths are dot
+// separated, e.g. user.email, fields inside arrays are removed from every
+// element.
+func newJSONRedactor(paths []string) *jsonRedactor {
+	if len(paths) == 0 {
+		return nil
+	}
+	r := &jsonRedactor{}
+	for _, p := range paths {
+		r.paths = append(r.paths, strings.Split(p, "."))
+	}
+	return r
+}
+
+// apply returns the value without the redacted fields or an error if the
+// value is not JSON
+func (r *jsonRedactor) apply(value []byte) ([]byte, error) {
+	dec := json.NewDecoder(bytes.NewReader(value))
+	// keep large numbers intact
+	dec.UseNumber()
+	var doc interface{}
+	if err := dec.Decode(&doc); err != nil {
+		return nil, err
+	}
+	if dec.More() {
+		return nil, fmt.Errorf("trailing data after the JSON value")
+	}
+	for _, path := range r.paths {
+		redact(doc, path)
+	}
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	// leave <, > and & in strings as they are
+	enc.SetEscapeHTML(false)
+	if err := enc.Encode(doc); err != nil {
+		return nil, err
+	}
+	return bytes.TrimSuffix(buf.Bytes(), []byte("\n")), nil
+}
+
+func redact(doc interface{}, path []string) {
+	switch v := doc.(type) {
+	case map[string]interface{}:
+		if len(path) == 1 {
+			delete(v, path[0])
+			return
+		}
+		if child, ok := v[path[0]]; ok {
+			redact(child, path[1:])
+		}
+	case []interface{}:
+		for _, elem := range v {
+			redact(elem, path)
+		}
+	}
+}
+
+// envelope is the value of a message mirrored with transform.envelope, it
+// keeps the provenance of the message for destinations which can't use
+// headers. Key and value are base64 encoded, null if the source message had
+// none.
+type envelope struct {
+	SourceTopic     string `json:"source_topic"`
+	SourcePartition int32  `json:"source_partition"`
+	SourceOffset    int64  `json:"source_offset"`
+	// Timestamp is in unix milliseconds, 0 if the message had none
+	Timestamp int64  `json:"timestamp"`
+	Key       []byte `json:"key"`
+	Value     []byte `json:"value"`
+}
+
+// wrapEnvelope returns the message with its value replaced by the envelope.
+// The key stays, so the partitioners place it like the source message.
+func wrapEnvelope(message *sarama.ConsumerMessage) *sarama.ConsumerMessage {
+	e := envelope{
+		SourceTopic:     message.Topic,
+		SourcePartition: message.Partition,
+		SourceOffset:    message.Offset,
+		Key:             message.Key,
+		Value:           message.Value,
+	}
+	if !message.Timestamp.IsZero() {
+		e.Timestamp = message.Timestamp.UnixNano() / int64(time.Millisecond)
+	}
+	// marshalling the struct can't fail
+	value, _ := json.Marshal(e)
+	wrapped := *message
+	wrapped.Value = value
+	return &wrapped
+}
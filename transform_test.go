@@ -0,0 +1,79 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/Shopify/sarama"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestKeyTransform(t *testing.T) {
+	tr, err := newKeyTransform("", "", "")
+	assert.NoError(t, err)
+	assert.Nil(t, tr, "transform without settings was created")
+	assert.Equal(t, []byte("key"), tr.apply([]byte("key")))
+
+	tr, err = newKeyTransform("tenant-1:", "", "")
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("tenant-1:key"), tr.apply([]byte("key")))
+	assert.Nil(t, tr.apply(nil), "keyless message got a key")
+
+	tr, err = newKeyTransform("new-", `^old-(\d+)$`, "id-$1")
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("new-id-42"), tr.apply([]byte("old-42")))
+	assert.Equal(t, []byte("new-other"), tr.apply([]byte("other")))
+
+	_, err = newKeyTransform("", "(", "")
+	assert.Error(t, err, "No error occured on an invalid regex")
+}
+
+func TestJSONRedactor(t *testing.T) {
+	assert.Nil(t, newJSONRedactor(nil))
+
+	r := newJSONRedactor([]string{"password", "user.email", "items.secret", "missing.field"})
+	value, err := r.apply([]byte(`{"id": 12345678901234567890, "password": "hunter2", "user": {"name": "a<b>", "email": "a@example.com"}, "items": [{"secret": 1, "n": 1}, {"n": 2}, 3]}`))
+	assert.NoError(t, err)
+	assert.JSONEq(t, `{"id": 12345678901234567890, "user": {"name": "a<b>"}, "items": [{"n": 1}, {"n": 2}, 3]}`, string(value))
+	assert.Contains(t, string(value), "12345678901234567890", "large numbers lost precision")
+	assert.Contains(t, string(value), "a<b>", "strings were escaped")
+
+	value, err = r.apply([]byte(`["not", "an", "object"]`))
+	assert.NoError(t, err)
+	assert.Equal(t, `["not","an","object"]`, string(value))
+
+	_, err = r.apply([]byte("plain text"))
+	assert.Error(t, err)
+	_, err = r.apply([]byte(`{"a": 1} trailing`))
+	assert.Error(t, err)
+}
+
+func TestWrapEnvelope(t *testing.T) {
+	message := &sarama.ConsumerMessage{
+		Topic:     "orders",
+		Partition: 3,
+		Offset:    42,
+		Timestamp: time.Date(2021, 6, 1, 12, 0, 0, 0, time.UTC),
+		Key:       []byte("order-1"),
+		Value:     []byte{0xff, 0x00, 'x'},
+	}
+	wrapped := wrapEnvelope(message)
+	assert.Equal(t, []byte{0xff, 0x00, 'x'}, message.Value, "the source message was changed")
+	assert.Equal(t, message.Key, wrapped.Key)
+	assert.JSONEq(t, `{
+		"source_topic": "orders",
+		"source_partition": 3,
+		"source_offset": 42,
+		"timestamp": 1622548800000,
+		"key": "b3JkZXItMQ==",
+		"value": "/wB4"
+	}`, string(wrapped.Value))
+
+	var e envelope
+	assert.NoError(t, json.Unmarshal(wrapped.Value, &e))
+	assert.Equal(t, message.Value, e.Value, "the value does not survive the round trip")
+
+	tombstone := wrapEnvelope(&sarama.ConsumerMessage{Topic: "orders", Offset: 43})
+	assert.JSONEq(t, `{"source_topic": "orders", "source_partition": 0, "source_offset": 43, "timestamp": 0, "key": null, "value": null}`, string(tombstone.Value))
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"runtime"
+)
+
+// buildInfo describes the running binary, the values are set at build time
+// via -ldflags and are empty in development builds
+type buildInfo struct {
+	Version   string `json:"version"`
+	Commit    string `json:"commit"`
+	BuildDate string `json:"build_date"`
+	BuildTime string `json:"build_time"`
+	GoVersion string `json:"go_version"`
+}
+
+func currentBuildInfo() buildInfo {
+	return buildInfo{
+		Version:   builddate + "-" + shorthash,
+		Commit:    githash,
+		BuildDate: builddate,
+		BuildTime: buildtime,
+		GoVersion: runtime.Version(),
+	}
+}
+
+// register adds the GET /version endpoint to the mux
+func (b buildInfo) register(mux *http.ServeMux) {
+	mux.HandleFunc("/version", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(b)
+	})
+}
+
+// writePrometheus writes the constant build_info gauge carrying the build
+// as labels
+func (b buildInfo) writePrometheus(w io.Writer, group string) {
+	fmt.Fprintf(w, "# TYPE mirrormaker_build_info gauge\n")
+	fmt.Fprintf(w, "mirrormaker_build_info{group=\"%s\",version=\"%s\",commit=\"%s\",goversion=\"%s\"} 1\n",
+		escapeLabel(group), escapeLabel(b.Version), escapeLabel(b.Commit), escapeLabel(b.GoVersion))
+}
@@ -0,0 +1,33 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/rcrowley/go-metrics"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestVersionEndpoint(t *testing.T) {
+	b := buildInfo{Version: "20210601-abc1234", Commit: "abc1234def", BuildDate: "20210601", BuildTime: "12:00", GoVersion: "go1.14"}
+	mux := http.NewServeMux()
+	b.register(mux)
+	rec := httptest.NewRecorder()
+	mux.ServeHTTP(rec, httptest.NewRequest("GET", "/version", nil))
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, "application/json", rec.Header().Get("Content-Type"))
+	var got buildInfo
+	assert.NoError(t, json.Unmarshal(rec.Body.Bytes(), &got))
+	assert.Equal(t, b, got)
+}
+
+func TestBuildInfoPrometheus(t *testing.T) {
+	b := buildInfo{Version: "20210601-abc1234", Commit: "abc1234def", GoVersion: "go1.14"}
+	rec := httptest.NewRecorder()
+	prometheusHandler(metrics.NewRegistry(), "my-group", b).ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	assert.True(t, bytes.HasPrefix(rec.Body.Bytes(), []byte("# TYPE mirrormaker_build_info gauge\n"+
+		"mirrormaker_build_info{group=\"my-group\",version=\"20210601-abc1234\",commit=\"abc1234def\",goversion=\"go1.14\"} 1\n")), rec.Body.String())
+}